@@ -14,6 +14,7 @@ import (
 	"vmmanager/internal/api/errors"
 	"vmmanager/internal/api/routes"
 	"vmmanager/internal/database"
+	"vmmanager/internal/diskcrypt"
 	"vmmanager/internal/i18n"
 	"vmmanager/internal/libvirt"
 	"vmmanager/internal/middleware"
@@ -65,8 +66,17 @@ func main() {
 		defer libvirtClient.Close()
 	}
 
+	keyring, err := diskcrypt.LoadKeyring(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load disk encryption master key: %v", err)
+	}
+	if keyring == nil {
+		log.Println("No disk encryption master key configured, encrypted disks are unavailable")
+	}
+
 	installMonitor := services.NewInstallMonitor(repos.VM, libvirtClient)
-	installMonitor.Start()
+	installMonitor.SetCompletionMarker(cfg.Install.CompletionMarker)
+	installMonitor.SetFirstBootTimeout(cfg.Install.FirstBootTimeout)
 
 	wsHandler := websocket.NewHandler(libvirtClient, installMonitor)
 
@@ -84,8 +94,19 @@ func main() {
 		libvirtClient,
 		"./backups",
 	)
+	backupService.SetKeyring(keyring)
+
+	orphanService := services.NewOrphanService(repos, libvirtClient, services.OrphanScanConfig{
+		StoragePath: cfg.Storage.Path,
+		BackupDir:   backupService.BackupDir(),
+		UploadPath:  cfg.App.UploadPath,
+		Interval:    cfg.OrphanGC.Interval,
+		GracePeriod: cfg.OrphanGC.GracePeriod,
+		AutoDelete:  cfg.OrphanGC.AutoDelete,
+	})
 
 	scheduler := tasks.NewScheduler(db, libvirtClient, alertService, backupService)
+	scheduler.SetOrphanService(orphanService)
 	go scheduler.Start()
 
 	wsHandler.SetVMSyncService(scheduler.GetVMSyncService())
@@ -148,7 +169,10 @@ func main() {
 		wsHandler.HandleVMStatus(c.Writer, c.Request)
 	})
 
-	routes.Register(router, cfg, repos, libvirtClient, wsHandler, backupService)
+	routes.Register(router, cfg, repos, libvirtClient, wsHandler, backupService, orphanService, scheduler.GetDriftService(), scheduler.GetGuestAgentService(), keyring)
+	// Started after the routes so the VM handler is registered as the
+	// completion handler before the first poll.
+	installMonitor.Start()
 
 	httpServer := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.App.Host, cfg.App.HTTPPort),
@@ -21,6 +21,12 @@ type Config struct {
 	Quota        QuotaConfig        `mapstructure:"quota"`
 	Email        EmailConfig        `mapstructure:"email"`
 	Notification NotificationConfig  `mapstructure:"notification"`
+	Install      InstallConfig      `mapstructure:"install"`
+	Tuning       TuningConfig       `mapstructure:"tuning"`
+	Flavors      FlavorsConfig      `mapstructure:"flavors"`
+	Encryption   EncryptionConfig   `mapstructure:"encryption"`
+	KernelBoot   KernelBootConfig   `mapstructure:"kernel_boot"`
+	OrphanGC     OrphanGCConfig     `mapstructure:"orphan_gc"`
 }
 
 type AppConfig struct {
@@ -124,6 +130,35 @@ type NotificationConfig struct {
 	WebhookSecret       string `mapstructure:"webhook_secret"`
 }
 
+type InstallConfig struct {
+	CompletionMarker string        `mapstructure:"completion_marker"`
+	FirstBootTimeout time.Duration `mapstructure:"first_boot_timeout"`
+	VirtioWinISO     string        `mapstructure:"virtio_win_iso"`
+}
+
+type TuningConfig struct {
+	AllowedRoles []string `mapstructure:"allowed_roles"`
+}
+
+type FlavorsConfig struct {
+	RequireFlavor bool `mapstructure:"require_flavor"`
+}
+
+type EncryptionConfig struct {
+	MasterKey     string `mapstructure:"master_key"`
+	MasterKeyFile string `mapstructure:"master_key_file"`
+}
+
+type KernelBootConfig struct {
+	LibraryPath string `mapstructure:"library_path"`
+}
+
+type OrphanGCConfig struct {
+	Interval    time.Duration `mapstructure:"interval"`
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+	AutoDelete  bool          `mapstructure:"auto_delete"`
+}
+
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
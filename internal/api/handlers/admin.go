@@ -143,6 +143,7 @@ func (h *AdminHandler) GetUser(c *gin.Context) {
 			"disk":     user.QuotaDisk,
 			"vm_count": user.QuotaVMCount,
 		},
+		"qos_max":    user.QoSMax,
 		"created_at": user.CreatedAt,
 	}))
 }
@@ -240,6 +241,50 @@ func (h *AdminHandler) UpdateUserQuota(c *gin.Context) {
 	}))
 }
 
+func (h *AdminHandler) UpdateUserQoSMax(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	var req QoSRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	if _, err := h.userRepo.FindByID(ctx, id); err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeUserNotFound, t(c, "user_not_found"), id))
+		return
+	}
+
+	// Existing VMs keep their limits, so a lower maximum is refused until
+	// the VMs above it have been brought down to it.
+	limits := req.limits()
+	vms, _, err := h.vmRepo.FindByOwner(ctx, id, 0, -1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_get_vms"), err.Error()))
+		return
+	}
+	var exceeding []string
+	for _, vm := range vms {
+		if err := checkQoSWithin(vm.QoS, limits); err != nil {
+			exceeding = append(exceeding, fmt.Sprintf("%s: %v", vm.Name, err))
+		}
+	}
+	if len(exceeding) > 0 {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "qos_max_below_vm_limits"), strings.Join(exceeding, "; ")))
+		return
+	}
+
+	if err := h.userRepo.UpdateQoSMax(ctx, id, limits); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_quota"), err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"qos_max": limits,
+	}))
+}
+
 func (h *AdminHandler) UpdateUserRole(c *gin.Context) {
 	id := c.Param("id")
 	ctx := c.Request.Context()
@@ -1,10 +1,10 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"os/exec"
 	"strings"
 
@@ -23,6 +23,7 @@ type BatchHandler struct {
 	libvirt      *libvirt.Client
 	storagePath  string
 	auditService *services.AuditService
+	vmHandler    *VMHandler
 }
 
 func NewBatchHandler(vmRepo *repository.VMRepository, libvirt *libvirt.Client, storagePath string, auditService *services.AuditService) *BatchHandler {
@@ -34,6 +35,12 @@ func NewBatchHandler(vmRepo *repository.VMRepository, libvirt *libvirt.Client, s
 	}
 }
 
+// SetVMHandler gives the batch operations the single-VM handler whose start
+// preparation and cleanup they share.
+func (h *BatchHandler) SetVMHandler(vmHandler *VMHandler) {
+	h.vmHandler = vmHandler
+}
+
 type BatchStartRequest struct {
 	VMIDs []string `json:"vm_ids" binding:"required,min=1"`
 }
@@ -98,10 +105,21 @@ func (h *BatchHandler) BatchStart(c *gin.Context) {
 			continue
 		}
 
+		if err := checkDirectBoot(*vm); err != nil {
+			result.Failed = append(result.Failed, FailedItem{VMID: vmID, Name: vm.Name, Reason: err.Error()})
+			continue
+		}
+
 		started := false
 		if vm.LibvirtDomainUUID != "" && vm.LibvirtDomainUUID != "new-uuid" && vm.LibvirtDomainUUID != "defined-uuid" {
 			domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID)
 			if err == nil {
+				if err := h.vmHandler.prepareStart(ctx, vm); err != nil {
+					log.Printf("[BATCH] Failed to prepare start of VM %s: %v", vmID, err)
+					domain.Free()
+					result.Failed = append(result.Failed, FailedItem{VMID: vmID, Name: vm.Name, Reason: err.Error()})
+					continue
+				}
 				if err := domain.Create(); err != nil {
 					log.Printf("[BATCH] Failed to start VM %s: %v", vmID, err)
 					domain.Free()
@@ -117,6 +135,7 @@ func (h *BatchHandler) BatchStart(c *gin.Context) {
 			result.Failed = append(result.Failed, FailedItem{VMID: vmID, Name: vm.Name, Reason: t(c, "failed_to_start_vm")})
 			continue
 		}
+		h.vmHandler.finishStart(ctx, vm)
 
 		if err := h.vmRepo.UpdateStatus(ctx, vmID, "running"); err != nil {
 			log.Printf("[BATCH] Failed to update VM status %s: %v", vmID, err)
@@ -180,10 +199,15 @@ func (h *BatchHandler) BatchStop(c *gin.Context) {
 		if vm.LibvirtDomainUUID != "" && vm.LibvirtDomainUUID != "new-uuid" && vm.LibvirtDomainUUID != "defined-uuid" {
 			domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID)
 			if err == nil {
+				// Marked first so the sync does not restart the guest.
+				if err := h.vmRepo.UpdateStatus(ctx, vmID, "stopping"); err != nil {
+					log.Printf("[BATCH] Failed to update VM status %s: %v", vmID, err)
+				}
 				if req.Force {
 					if err := domain.Destroy(); err != nil {
 						log.Printf("[BATCH] Failed to force stop VM %s: %v", vmID, err)
 						domain.Free()
+						h.vmRepo.UpdateStatus(ctx, vmID, vm.Status)
 						result.Failed = append(result.Failed, FailedItem{VMID: vmID, Name: vm.Name, Reason: err.Error()})
 						continue
 					}
@@ -191,6 +215,7 @@ func (h *BatchHandler) BatchStop(c *gin.Context) {
 					if err := domain.Shutdown(); err != nil {
 						log.Printf("[BATCH] Failed to stop VM %s: %v", vmID, err)
 						domain.Free()
+						h.vmRepo.UpdateStatus(ctx, vmID, vm.Status)
 						result.Failed = append(result.Failed, FailedItem{VMID: vmID, Name: vm.Name, Reason: err.Error()})
 						continue
 					}
@@ -258,7 +283,7 @@ func (h *BatchHandler) BatchDelete(c *gin.Context) {
 			continue
 		}
 
-		if vm.Status == "running" || vm.Status == "paused" {
+		if vm.Status == "running" || vm.Status == "paused" || vm.Status == "suspended" {
 			result.Failed = append(result.Failed, FailedItem{VMID: vmID, Name: vm.Name, Reason: t(c, "vm_running_delete")})
 			continue
 		}
@@ -283,13 +308,7 @@ func (h *BatchHandler) BatchDelete(c *gin.Context) {
 			}
 		}
 
-		if vm.DiskPath != "" {
-			if _, err := os.Stat(vm.DiskPath); err == nil {
-				if err := os.Remove(vm.DiskPath); err != nil {
-					log.Printf("[BATCH] Failed to delete disk file %s: %v", vm.DiskPath, err)
-				}
-			}
-		}
+		h.vmHandler.releaseVM(ctx, vm)
 
 		vmUUID, _ := uuid.Parse(vmID)
 		if err := h.vmRepo.Delete(ctx, vmID); err != nil {
@@ -354,11 +373,11 @@ func (h *BatchHandler) BatchOperation(c *gin.Context) {
 		var opErr error
 		switch operation {
 		case "start":
-			opErr = h.performStart(vm)
+			opErr = h.performStart(ctx, vm)
 		case "stop":
-			opErr = h.performStop(vm, false)
+			opErr = h.performStop(ctx, vm, false)
 		case "force-stop":
-			opErr = h.performStop(vm, true)
+			opErr = h.performStop(ctx, vm, true)
 		case "suspend":
 			opErr = h.performSuspend(vm)
 		case "resume":
@@ -392,7 +411,7 @@ func (h *BatchHandler) BatchOperation(c *gin.Context) {
 	c.JSON(http.StatusOK, errors.Success(result))
 }
 
-func (h *BatchHandler) performStart(vm *models.VirtualMachine) error {
+func (h *BatchHandler) performStart(ctx context.Context, vm *models.VirtualMachine) error {
 	if h.libvirt == nil {
 		return fmt.Errorf("libvirt service unavailable")
 	}
@@ -400,6 +419,9 @@ func (h *BatchHandler) performStart(vm *models.VirtualMachine) error {
 	if vm.LibvirtDomainUUID == "" || vm.LibvirtDomainUUID == "new-uuid" {
 		return fmt.Errorf("domain not defined")
 	}
+	if err := checkDirectBoot(*vm); err != nil {
+		return err
+	}
 
 	domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID)
 	if err != nil {
@@ -407,10 +429,17 @@ func (h *BatchHandler) performStart(vm *models.VirtualMachine) error {
 	}
 	defer domain.Free()
 
-	return domain.Create()
+	if err := h.vmHandler.prepareStart(ctx, vm); err != nil {
+		return err
+	}
+	if err := domain.Create(); err != nil {
+		return err
+	}
+	h.vmHandler.finishStart(ctx, vm)
+	return nil
 }
 
-func (h *BatchHandler) performStop(vm *models.VirtualMachine, force bool) error {
+func (h *BatchHandler) performStop(ctx context.Context, vm *models.VirtualMachine, force bool) error {
 	if h.libvirt == nil {
 		return fmt.Errorf("libvirt service unavailable")
 	}
@@ -425,10 +454,20 @@ func (h *BatchHandler) performStop(vm *models.VirtualMachine, force bool) error
 	}
 	defer domain.Free()
 
+	// Marked first so the sync does not restart the guest.
+	id := vm.ID.String()
+	if err := h.vmRepo.UpdateStatus(ctx, id, "stopping"); err != nil {
+		log.Printf("[BATCH] Failed to update VM status %s: %v", id, err)
+	}
 	if force {
-		return domain.Destroy()
+		err = domain.Destroy()
+	} else {
+		err = domain.Shutdown()
+	}
+	if err != nil {
+		h.vmRepo.UpdateStatus(ctx, id, vm.Status)
 	}
-	return domain.Shutdown()
+	return err
 }
 
 func (h *BatchHandler) performSuspend(vm *models.VirtualMachine) error {
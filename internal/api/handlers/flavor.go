@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+	"vmmanager/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	cpuPolicyShared    = "shared"
+	cpuPolicyDedicated = "dedicated"
+)
+
+type FlavorHandler struct {
+	repo         *repository.FlavorRepository
+	auditService *services.AuditService
+}
+
+func NewFlavorHandler(repo *repository.FlavorRepository) *FlavorHandler {
+	return &FlavorHandler{repo: repo}
+}
+
+func (h *FlavorHandler) SetAuditService(auditService *services.AuditService) {
+	h.auditService = auditService
+}
+
+type FlavorRequest struct {
+	Name         string      `json:"name" binding:"required,max=100"`
+	Description  string      `json:"description"`
+	CPU          int         `json:"cpu" binding:"required,min=1"`
+	Memory       int         `json:"memory" binding:"required,min=512"`
+	Disk         int         `json:"disk" binding:"required,min=10"`
+	QoS          *QoSRequest `json:"qos"`
+	CPUPolicy    string      `json:"cpu_policy" binding:"omitempty,oneof=shared dedicated"`
+	AllowedRoles []string    `json:"allowed_roles"`
+	AllowedUsers []string    `json:"allowed_users"`
+	IsActive     *bool       `json:"is_active"`
+}
+
+// flavorAllowed reports whether the user with userID and role may pick
+// flavor. Admins may use every flavor, including inactive ones.
+func flavorAllowed(flavor *models.Flavor, userID uuid.UUID, role interface{}) bool {
+	if role == "admin" {
+		return true
+	}
+	if !flavor.IsActive {
+		return false
+	}
+	if len(flavor.AllowedRoles) == 0 && len(flavor.AllowedUsers) == 0 {
+		return true
+	}
+	r, _ := role.(string)
+	return slices.Contains(flavor.AllowedRoles, r) || slices.Contains(flavor.AllowedUsers, userID.String())
+}
+
+func (h *FlavorHandler) ListFlavors(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	flavors, err := h.repo.List(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_list_flavors"), err.Error()))
+		return
+	}
+
+	available := make([]models.Flavor, 0, len(flavors))
+	for i := range flavors {
+		if flavorAllowed(&flavors[i], userUUID, role) {
+			available = append(available, flavors[i])
+		}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(available))
+}
+
+func (h *FlavorHandler) GetFlavor(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	flavor, err := h.repo.FindByID(ctx, id)
+	if err != nil || !flavorAllowed(flavor, userUUID, role) {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "flavor_not_found"), id))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(flavor))
+}
+
+func (h *FlavorHandler) CreateFlavor(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req FlavorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+	if err := validateFlavorRequest(req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	if existing, _ := h.repo.FindByName(ctx, req.Name); existing != nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "flavor_name_exists"), req.Name))
+		return
+	}
+
+	flavor := &models.Flavor{IsActive: true}
+	applyFlavorRequest(flavor, req)
+
+	if err := h.repo.Create(ctx, flavor); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_flavor"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "flavor.create", "flavor", &flavor.ID, map[string]interface{}{
+			"name":   flavor.Name,
+			"cpu":    flavor.CPU,
+			"memory": flavor.Memory,
+			"disk":   flavor.Disk,
+		})
+	}
+
+	c.JSON(http.StatusCreated, errors.Success(flavor))
+}
+
+// UpdateFlavor replaces the definition of a flavor. VMs already using it
+// keep their size until they are resized to it again.
+func (h *FlavorHandler) UpdateFlavor(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	var req FlavorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+	if err := validateFlavorRequest(req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	flavor, err := h.repo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "flavor_not_found"), id))
+		return
+	}
+
+	if existing, _ := h.repo.FindByName(ctx, req.Name); existing != nil && existing.ID != flavor.ID {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "flavor_name_exists"), req.Name))
+		return
+	}
+
+	applyFlavorRequest(flavor, req)
+	if err := h.repo.Update(ctx, flavor); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_flavor"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "flavor.update", "flavor", &flavor.ID, map[string]interface{}{
+			"name":   flavor.Name,
+			"cpu":    flavor.CPU,
+			"memory": flavor.Memory,
+			"disk":   flavor.Disk,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(flavor))
+}
+
+func (h *FlavorHandler) DeleteFlavor(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	flavor, err := h.repo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "flavor_not_found"), id))
+		return
+	}
+
+	count, err := h.repo.CountVMs(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_delete_flavor"), err.Error()))
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "flavor_in_use"), fmt.Sprintf("%d VMs use this flavor", count)))
+		return
+	}
+
+	if err := h.repo.Delete(ctx, id); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_delete_flavor"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "flavor.delete", "flavor", &flavor.ID, map[string]interface{}{
+			"name": flavor.Name,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(nil))
+}
+
+func validateFlavorRequest(req FlavorRequest) error {
+	for _, id := range req.AllowedUsers {
+		if _, err := uuid.Parse(id); err != nil {
+			return fmt.Errorf("allowed_users must contain user IDs, got %q", id)
+		}
+	}
+	return nil
+}
+
+func applyFlavorRequest(flavor *models.Flavor, req FlavorRequest) {
+	flavor.Name = req.Name
+	flavor.Description = req.Description
+	flavor.CPU = req.CPU
+	flavor.Memory = req.Memory
+	flavor.Disk = req.Disk
+	flavor.QoS = models.QoSLimits{}
+	if req.QoS != nil {
+		flavor.QoS = req.QoS.limits()
+	}
+	flavor.CPUPolicy = req.CPUPolicy
+	if flavor.CPUPolicy == "" {
+		flavor.CPUPolicy = cpuPolicyShared
+	}
+	flavor.AllowedRoles = req.AllowedRoles
+	flavor.AllowedUsers = req.AllowedUsers
+	if req.IsActive != nil {
+		flavor.IsActive = *req.IsActive
+	}
+}
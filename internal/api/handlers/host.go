@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+
+	"github.com/gin-gonic/gin"
+)
+
+type HostHandler struct {
+	libvirt *libvirt.Client
+}
+
+func NewHostHandler(libvirtClient *libvirt.Client) *HostHandler {
+	return &HostHandler{libvirt: libvirtClient}
+}
+
+// GetCapabilities lists the architectures, machine types, CPU models,
+// firmware and device models VMs can be created with. Admins can pass
+// refresh=true to re-read them after a QEMU or firmware update.
+func (h *HostHandler) GetCapabilities(c *gin.Context) {
+	if h.libvirt == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+		return
+	}
+
+	role, _ := c.Get("role")
+	refresh := c.Query("refresh") == "true" && role == "admin"
+
+	caps, err := h.libvirt.GetHostCapabilities(refresh)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_get_host_capabilities"), err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(caps))
+}
@@ -335,6 +335,7 @@ type CompleteISOUploadRequest struct {
 	Description string `json:"description"`
 	OSType      string `json:"os_type"`
 	OSVersion   string `json:"os_version"`
+	OSProfile   string `json:"os_profile" binding:"omitempty,oneof=linux windows"`
 }
 
 func (h *ISOHandler) CompleteISOUpload(c *gin.Context) {
@@ -422,6 +423,7 @@ func (h *ISOHandler) CompleteISOUpload(c *gin.Context) {
 		SHA256:       sha256Sum,
 		OSType:       osType,
 		OSVersion:    osVersion,
+		OSProfile:    osProfileFor(req.OSProfile, osType),
 		Architecture: upload.Architecture,
 		Status:       "active",
 		UploadedBy:   upload.UploadedBy,
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OrphanHandler struct {
+	service      *services.OrphanService
+	auditService *services.AuditService
+}
+
+func NewOrphanHandler(service *services.OrphanService, auditService *services.AuditService) *OrphanHandler {
+	return &OrphanHandler{
+		service:      service,
+		auditService: auditService,
+	}
+}
+
+// OrphanRef names an orphan by the kind and ID a scan reported.
+type OrphanRef struct {
+	Kind string `json:"kind" binding:"required"`
+	ID   string `json:"id" binding:"required"`
+}
+
+// DeleteOrphansRequest deletes orphans right away, whatever their grace
+// period. Confirm has to be set, as nothing deleted can be brought back.
+type DeleteOrphansRequest struct {
+	Resources []OrphanRef `json:"resources" binding:"required,min=1,dive"`
+	Confirm   bool        `json:"confirm"`
+}
+
+// ListOrphans scans the host for resources no record owns and reports them
+// with their size and age.
+func (h *OrphanHandler) ListOrphans(c *gin.Context) {
+	orphans, err := h.service.Scan(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_scan_orphans"), err.Error()))
+		return
+	}
+
+	var size int64
+	for _, orphan := range orphans {
+		size += orphan.Size
+	}
+	if orphans == nil {
+		orphans = []services.Orphan{}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"orphans":    orphans,
+		"total":      len(orphans),
+		"total_size": size,
+	}))
+}
+
+// DeleteOrphans deletes the requested resources that a fresh scan still
+// finds orphaned. The others are reported back and left alone.
+func (h *OrphanHandler) DeleteOrphans(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req DeleteOrphansRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+	if !req.Confirm {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "orphan_delete_not_confirmed"), "confirm must be true"))
+		return
+	}
+
+	orphans, err := h.service.Scan(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_scan_orphans"), err.Error()))
+		return
+	}
+	byRef := make(map[OrphanRef]services.Orphan, len(orphans))
+	for _, orphan := range orphans {
+		byRef[OrphanRef{Kind: orphan.Kind, ID: orphan.ID}] = orphan
+	}
+
+	deleted := make([]services.Orphan, 0, len(req.Resources))
+	failed := make([]gin.H, 0)
+	var freed int64
+	for _, ref := range req.Resources {
+		orphan, ok := byRef[ref]
+		if !ok {
+			failed = append(failed, gin.H{"kind": ref.Kind, "id": ref.ID, "error": "not orphaned"})
+			continue
+		}
+		if err := h.service.Remove(ctx, orphan); err != nil {
+			failed = append(failed, gin.H{"kind": ref.Kind, "id": ref.ID, "error": err.Error()})
+			continue
+		}
+		log.Printf("[ORPHAN] Deleted %s %s", orphan.Kind, orphan.ID)
+		deleted = append(deleted, orphan)
+		freed += orphan.Size
+	}
+
+	if h.auditService != nil && len(deleted) > 0 {
+		h.auditService.LogSuccess(c, "orphan.delete", "orphan", nil, map[string]interface{}{
+			"deleted": deleted,
+			"freed":   freed,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"deleted": deleted,
+		"failed":  failed,
+		"freed":   freed,
+	}))
+}
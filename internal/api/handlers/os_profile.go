@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+)
+
+const (
+	osProfileLinux   = "linux"
+	osProfileWindows = "windows"
+)
+
+const (
+	diskBusVirtio = "virtio"
+	diskBusSATA   = "sata"
+)
+
+// driverISOTarget is the CD-ROM holding the virtio-win drivers, after the
+// install, cloud-init and answer file CD-ROMs.
+const driverISOTarget = "sdd"
+
+func (h *VMHandler) SetVirtioWinISO(path string) {
+	h.virtioWinISO = path
+}
+
+// osProfileFor returns profile when one is set and otherwise guesses it
+// from an ISO or template OS type. It returns an empty profile when there is
+// no obvious match.
+func osProfileFor(profile, osType string) string {
+	if profile != "" {
+		return profile
+	}
+	if strings.Contains(strings.ToLower(osType), "windows") {
+		return osProfileWindows
+	}
+	return ""
+}
+
+func isWindows(vm models.VirtualMachine) bool {
+	return vm.OSProfile == osProfileWindows
+}
+
+// rootDiskBus is the bus of the system disk. It defaults to virtio, which
+// the Windows installer cannot see without drivers.
+func rootDiskBus(vm models.VirtualMachine) string {
+	if vm.DiskBus == "" {
+		return diskBusVirtio
+	}
+	return vm.DiskBus
+}
+
+func rootDiskTarget(vm models.VirtualMachine) string {
+	return libvirt.RootDiskTarget(rootDiskBus(vm))
+}
+
+// isRootDiskRef reports whether ref names the system disk of vm. vda keeps
+// naming it when the disk sits on another bus.
+func isRootDiskRef(vm models.VirtualMachine, ref string) bool {
+	return ref == "vda" || ref == rootDiskTarget(vm)
+}
+
+// applyOSProfile sets profile on vm, defaulting to Linux. Windows VMs
+// install to a SATA disk and get the virtio-win drivers as an extra CD-ROM,
+// so the disk can be moved to virtio once the drivers are installed.
+func (h *VMHandler) applyOSProfile(vm *models.VirtualMachine, profile string) {
+	if profile == "" {
+		profile = osProfileLinux
+	}
+	vm.OSProfile = profile
+	vm.DriverISOPath = ""
+	if profile != osProfileWindows {
+		return
+	}
+	if vm.DiskBus == "" {
+		vm.DiskBus = diskBusSATA
+	}
+	if h.virtioWinISO != "" && exists(h.virtioWinISO) {
+		vm.DriverISOPath = h.virtioWinISO
+	}
+}
+
+// checkReservedTargets fails when a data disk of vm sits on a target that
+// the system disk or the driver CD-ROM need. vm must have its data disks
+// loaded.
+func checkReservedTargets(vm models.VirtualMachine) error {
+	reserved := map[string]bool{rootDiskTarget(vm): true}
+	if vm.DriverISOPath != "" {
+		reserved[driverISOTarget] = true
+	}
+	for _, disk := range vm.DataDisks {
+		if reserved[disk.TargetDev] {
+			return fmt.Errorf("data disk %s already uses target %s", disk.Name, disk.TargetDev)
+		}
+	}
+	return nil
+}
+
+// generateHyperVConfig enables the Hyper-V enlightenments Windows guests
+// use for timers, interrupts and spinlocks instead of emulated hardware.
+func generateHyperVConfig() *libvirt.FeatureHyperV {
+	on := func() *libvirt.FeatureState { return &libvirt.FeatureState{State: "on"} }
+	return &libvirt.FeatureHyperV{
+		Mode:        "custom",
+		Relaxed:     on(),
+		VAPIC:       on(),
+		Spinlocks:   &libvirt.HyperVSpinlocks{State: "on", Retries: 8191},
+		VPIndex:     on(),
+		Runtime:     on(),
+		SynIC:       on(),
+		STimer:      on(),
+		Reset:       on(),
+		Frequencies: on(),
+		TLBFlush:    on(),
+		IPI:         on(),
+	}
+}
+
+// generateClockConfig keeps Linux guests on UTC. Windows expects the RTC in
+// local time and gets the Hyper-V reference clock.
+func generateClockConfig(vm models.VirtualMachine) *libvirt.DomainClock {
+	if !isWindows(vm) || isARM(vm) {
+		return &libvirt.DomainClock{
+			Offset: "utc",
+			Timers: []libvirt.ClockTimer{{Name: "rtc", TickPolicy: "catchup"}},
+		}
+	}
+	return &libvirt.DomainClock{
+		Offset: "localtime",
+		Timers: []libvirt.ClockTimer{
+			{Name: "rtc", TickPolicy: "catchup"},
+			{Name: "pit", TickPolicy: "delay"},
+			{Name: "hypervclock", Present: "yes"},
+		},
+	}
+}
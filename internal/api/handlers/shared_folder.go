@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+	"vmmanager/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type SharedFolderHandler struct {
+	repo         *repository.SharedFolderRepository
+	auditService *services.AuditService
+}
+
+func NewSharedFolderHandler(repo *repository.SharedFolderRepository) *SharedFolderHandler {
+	return &SharedFolderHandler{repo: repo}
+}
+
+func (h *SharedFolderHandler) SetAuditService(auditService *services.AuditService) {
+	h.auditService = auditService
+}
+
+type SharedFolderRequest struct {
+	Name         string   `json:"name" binding:"required,max=100"`
+	Description  string   `json:"description"`
+	HostPath     string   `json:"host_path" binding:"required"`
+	AllowWrite   bool     `json:"allow_write"`
+	AllowedRoles []string `json:"allowed_roles"`
+	AllowedUsers []string `json:"allowed_users"`
+}
+
+// sharedFolderAllowed reports whether the user with userID and role may map
+// folder into their VMs. Admins may use every folder.
+func sharedFolderAllowed(folder *models.SharedFolder, userID uuid.UUID, role interface{}) bool {
+	if role == "admin" {
+		return true
+	}
+	if len(folder.AllowedRoles) == 0 && len(folder.AllowedUsers) == 0 {
+		return true
+	}
+	r, _ := role.(string)
+	return slices.Contains(folder.AllowedRoles, r) || slices.Contains(folder.AllowedUsers, userID.String())
+}
+
+// resolveHostDir returns path with symlinks resolved when it is an existing
+// directory other than the root directory.
+func resolveHostDir(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%s is not an absolute path", path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+	if resolved == "/" {
+		return "", fmt.Errorf("the root directory cannot be shared")
+	}
+	return resolved, nil
+}
+
+func (h *SharedFolderHandler) ListSharedFolders(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	folders, err := h.repo.List(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_list_shared_folders"), err.Error()))
+		return
+	}
+
+	available := make([]models.SharedFolder, 0, len(folders))
+	for i := range folders {
+		if sharedFolderAllowed(&folders[i], userUUID, role) {
+			available = append(available, folders[i])
+		}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(available))
+}
+
+func (h *SharedFolderHandler) GetSharedFolder(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	folder, err := h.repo.FindByID(ctx, id)
+	if err != nil || !sharedFolderAllowed(folder, userUUID, role) {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "shared_folder_not_found"), id))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(folder))
+}
+
+func (h *SharedFolderHandler) CreateSharedFolder(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req SharedFolderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+	hostPath, err := validateSharedFolderRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_shared_folder"), err.Error()))
+		return
+	}
+
+	if existing, _ := h.repo.FindByName(ctx, req.Name); existing != nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "shared_folder_name_exists"), req.Name))
+		return
+	}
+
+	folder := &models.SharedFolder{}
+	applySharedFolderRequest(folder, req, hostPath)
+
+	if err := h.repo.Create(ctx, folder); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_shared_folder"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "shared_folder.create", "shared_folder", &folder.ID, map[string]interface{}{
+			"name":        folder.Name,
+			"host_path":   folder.HostPath,
+			"allow_write": folder.AllowWrite,
+		})
+	}
+
+	c.JSON(http.StatusCreated, errors.Success(folder))
+}
+
+// UpdateSharedFolder replaces the definition of a shared folder. VMs that
+// already map it keep their source directory and access mode until the
+// mapping is recreated.
+func (h *SharedFolderHandler) UpdateSharedFolder(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	var req SharedFolderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+	hostPath, err := validateSharedFolderRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_shared_folder"), err.Error()))
+		return
+	}
+
+	folder, err := h.repo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "shared_folder_not_found"), id))
+		return
+	}
+
+	if existing, _ := h.repo.FindByName(ctx, req.Name); existing != nil && existing.ID != folder.ID {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "shared_folder_name_exists"), req.Name))
+		return
+	}
+
+	applySharedFolderRequest(folder, req, hostPath)
+	if err := h.repo.Update(ctx, folder); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_shared_folder"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "shared_folder.update", "shared_folder", &folder.ID, map[string]interface{}{
+			"name":        folder.Name,
+			"host_path":   folder.HostPath,
+			"allow_write": folder.AllowWrite,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(folder))
+}
+
+func (h *SharedFolderHandler) DeleteSharedFolder(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	folder, err := h.repo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "shared_folder_not_found"), id))
+		return
+	}
+
+	count, err := h.repo.CountMappings(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_delete_shared_folder"), err.Error()))
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "shared_folder_in_use"), fmt.Sprintf("%d VM filesystems use this folder", count)))
+		return
+	}
+
+	if err := h.repo.Delete(ctx, id); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_delete_shared_folder"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "shared_folder.delete", "shared_folder", &folder.ID, map[string]interface{}{
+			"name": folder.Name,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(nil))
+}
+
+// validateSharedFolderRequest checks req and returns its host path with
+// symlinks resolved, which is what guests will see.
+func validateSharedFolderRequest(req SharedFolderRequest) (string, error) {
+	for _, id := range req.AllowedUsers {
+		if _, err := uuid.Parse(id); err != nil {
+			return "", fmt.Errorf("allowed_users must contain user IDs, got %q", id)
+		}
+	}
+	return resolveHostDir(req.HostPath)
+}
+
+func applySharedFolderRequest(folder *models.SharedFolder, req SharedFolderRequest, hostPath string) {
+	folder.Name = req.Name
+	folder.Description = req.Description
+	folder.HostPath = hostPath
+	folder.AllowWrite = req.AllowWrite
+	folder.AllowedRoles = req.AllowedRoles
+	folder.AllowedUsers = req.AllowedUsers
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"vmmanager/internal/api/errors"
+	"vmmanager/internal/diskcrypt"
 	"vmmanager/internal/libvirt"
 	"vmmanager/internal/models"
 	"vmmanager/internal/repository"
@@ -17,6 +18,7 @@ type SnapshotHandler struct {
 	vmRepo       *repository.VMRepository
 	snapshotRepo *repository.VMSnapshotRepository
 	libvirt      *libvirt.Client
+	keyring      *diskcrypt.Keyring
 }
 
 func NewSnapshotHandler(vmRepo *repository.VMRepository, snapshotRepo *repository.VMSnapshotRepository, libvirtClient *libvirt.Client) *SnapshotHandler {
@@ -27,6 +29,10 @@ func NewSnapshotHandler(vmRepo *repository.VMRepository, snapshotRepo *repositor
 	}
 }
 
+func (h *SnapshotHandler) SetKeyring(keyring *diskcrypt.Keyring) {
+	h.keyring = keyring
+}
+
 type CreateSnapshotRequest struct {
 	Name        string `json:"name" binding:"required"`
 	Description string `json:"description"`
@@ -64,6 +70,12 @@ func (h *SnapshotHandler) CreateSnapshot(c *gin.Context) {
 	}
 
 	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		// qemu needs the disk secret to write the snapshot of an
+		// encrypted disk.
+		if err := ensureDiskSecret(h.libvirt, h.keyring, *vm, vm.DiskPath); err != nil {
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "snapshot.failedToCreate"), err.Error()))
+			return
+		}
 		if err := h.libvirt.CreateSnapshot(vm.LibvirtDomainUUID, req.Name, req.Description); err != nil {
 			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "snapshot.failedToCreate"), err.Error()))
 			return
@@ -178,6 +190,10 @@ func (h *SnapshotHandler) RestoreSnapshot(c *gin.Context) {
 	}
 
 	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		if err := ensureDiskSecret(h.libvirt, h.keyring, *vm, vm.DiskPath); err != nil {
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "snapshot.failedToRestore"), err.Error()))
+			return
+		}
 		if err := h.libvirt.RevertToSnapshot(vm.LibvirtDomainUUID, snapshot.Name); err != nil {
 			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "snapshot.failedToRestore"), err.Error()))
 			return
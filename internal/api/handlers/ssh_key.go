@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+	"vmmanager/internal/services"
+	"vmmanager/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type SSHKeyHandler struct {
+	repo         *repository.SSHKeyRepository
+	auditService *services.AuditService
+}
+
+func NewSSHKeyHandler(repo *repository.SSHKeyRepository) *SSHKeyHandler {
+	return &SSHKeyHandler{repo: repo}
+}
+
+func (h *SSHKeyHandler) SetAuditService(auditService *services.AuditService) {
+	h.auditService = auditService
+}
+
+type CreateSSHKeyRequest struct {
+	Name      string `json:"name" binding:"required,max=100"`
+	PublicKey string `json:"publicKey" binding:"required"`
+}
+
+type UpdateSSHKeyRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+func (h *SSHKeyHandler) ListKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, _ := c.Get("user_id")
+
+	keys, err := h.repo.ListByUser(ctx, userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_list_ssh_keys"), err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(keys))
+}
+
+func (h *SSHKeyHandler) GetKey(c *gin.Context) {
+	key, ok := h.findOwnKey(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, errors.Success(key))
+}
+
+func (h *SSHKeyHandler) CreateKey(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	userUUID, _ := uuid.Parse(userID.(string))
+	h.create(c, &userUUID)
+}
+
+func (h *SSHKeyHandler) UpdateKey(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req UpdateSSHKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	key, ok := h.findOwnKey(c)
+	if !ok {
+		return
+	}
+
+	key.Name = req.Name
+	if err := h.repo.Update(ctx, key); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_ssh_key"), err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(key))
+}
+
+func (h *SSHKeyHandler) DeleteKey(c *gin.Context) {
+	key, ok := h.findOwnKey(c)
+	if !ok {
+		return
+	}
+	h.delete(c, key)
+}
+
+func (h *SSHKeyHandler) ListGlobalKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	keys, err := h.repo.ListGlobal(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_list_ssh_keys"), err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(keys))
+}
+
+func (h *SSHKeyHandler) CreateGlobalKey(c *gin.Context) {
+	h.create(c, nil)
+}
+
+func (h *SSHKeyHandler) DeleteGlobalKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	key, err := h.repo.FindByID(ctx, id)
+	if err != nil || !key.IsGlobal {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "ssh_key_not_found"), id))
+		return
+	}
+	h.delete(c, key)
+}
+
+// create stores a key for owner, or an organisation-wide key when owner is nil.
+func (h *SSHKeyHandler) create(c *gin.Context, owner *uuid.UUID) {
+	ctx := c.Request.Context()
+
+	var req CreateSSHKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	parsed, err := utils.ParseSSHPublicKey(req.PublicKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_ssh_key"), err.Error()))
+		return
+	}
+
+	var ownerID *string
+	if owner != nil {
+		s := owner.String()
+		ownerID = &s
+	}
+	exists, err := h.repo.ExistsFingerprint(ctx, ownerID, parsed.Fingerprint)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_ssh_key"), err.Error()))
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "ssh_key_exists"), parsed.Fingerprint))
+		return
+	}
+
+	key := &models.SSHKey{
+		UserID:      owner,
+		Name:        req.Name,
+		PublicKey:   parsed.Normalized,
+		KeyType:     parsed.Type,
+		Fingerprint: parsed.Fingerprint,
+		IsGlobal:    owner == nil,
+	}
+
+	if err := h.repo.Create(ctx, key); err != nil {
+		if stderrors.Is(err, repository.ErrSSHKeyExists) {
+			c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "ssh_key_exists"), parsed.Fingerprint))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_ssh_key"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "ssh_key.create", "ssh_key", &key.ID, map[string]interface{}{
+			"name":        key.Name,
+			"fingerprint": key.Fingerprint,
+			"global":      key.IsGlobal,
+		})
+	}
+
+	c.JSON(http.StatusCreated, errors.Success(key))
+}
+
+func (h *SSHKeyHandler) delete(c *gin.Context, key *models.SSHKey) {
+	ctx := c.Request.Context()
+
+	if err := h.repo.Delete(ctx, key.ID.String()); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_delete_ssh_key"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "ssh_key.delete", "ssh_key", &key.ID, map[string]interface{}{
+			"name":        key.Name,
+			"fingerprint": key.Fingerprint,
+			"global":      key.IsGlobal,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(nil))
+}
+
+func (h *SSHKeyHandler) findOwnKey(c *gin.Context) (*models.SSHKey, bool) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	userID, _ := c.Get("user_id")
+
+	key, err := h.repo.FindByID(ctx, id)
+	if err != nil || key.IsGlobal || key.UserID == nil || key.UserID.String() != userID.(string) {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "ssh_key_not_found"), id))
+		return nil, false
+	}
+	return key, true
+}
@@ -519,11 +519,17 @@ func (h *StorageHandler) DeleteVolume(c *gin.Context) {
 		return
 	}
 
+	if volume.VMID != nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_volume_in_use"), volume.VMID.String()))
+		return
+	}
+
 	if h.libvirt != nil && pool.Active {
 		if err := h.libvirt.StorageVolumeDelete(pool.Name, volume.Name); err != nil {
 			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "storage.failedToDeleteVolume"), err.Error()))
 			return
 		}
+		undefineVolumeSecret(h.libvirt, *volume)
 	}
 
 	if err := h.repo.StorageVolume.Delete(ctx, volumeID); err != nil {
@@ -18,6 +18,7 @@ import (
 	"vmmanager/internal/models"
 	"vmmanager/internal/repository"
 	"vmmanager/internal/services"
+	"vmmanager/internal/unattend"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -133,22 +134,27 @@ func (h *TemplateHandler) CreateTemplate(c *gin.Context) {
 	userUUID, _ := uuid.Parse(userID.(string))
 
 	var req struct {
-		Name         string `json:"name" binding:"required"`
-		Description  string `json:"description"`
-		OSType       string `json:"os_type" binding:"required"`
-		OSVersion    string `json:"os_version"`
-		Architecture string `json:"architecture"`
-		Format       string `json:"format"`
-		CPUMin       int    `json:"cpu_min"`
-		CPUMax       int    `json:"cpu_max"`
-		MemoryMin    int    `json:"memory_min"`
-		MemoryMax    int    `json:"memory_max"`
-		DiskMin      int    `json:"disk_min"`
-		DiskMax      int    `json:"disk_max"`
-		TemplatePath string `json:"template_path"`
-		IconURL      string `json:"icon_url"`
-		DiskSize     int64  `json:"disk_size"`
-		IsPublic     bool   `json:"is_public"`
+		Name              string      `json:"name" binding:"required"`
+		Description       string      `json:"description"`
+		OSType            string      `json:"os_type" binding:"required"`
+		OSVersion         string      `json:"os_version"`
+		OSProfile         string      `json:"os_profile" binding:"omitempty,oneof=linux windows"`
+		Architecture      string      `json:"architecture"`
+		Format            string      `json:"format"`
+		CPUMin            int         `json:"cpu_min"`
+		CPUMax            int         `json:"cpu_max"`
+		MemoryMin         int         `json:"memory_min"`
+		MemoryMax         int         `json:"memory_max"`
+		DiskMin           int         `json:"disk_min"`
+		DiskMax           int         `json:"disk_max"`
+		TemplatePath      string      `json:"template_path"`
+		IconURL           string      `json:"icon_url"`
+		DiskSize          int64       `json:"disk_size"`
+		IsPublic          bool        `json:"is_public"`
+		CloudInitUserData string      `json:"cloud_init_user_data"`
+		InstallScript     string      `json:"install_script"`
+		PostInstallScript string      `json:"post_install_script"`
+		QoS               *QoSRequest `json:"qos"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -156,6 +162,11 @@ func (h *TemplateHandler) CreateTemplate(c *gin.Context) {
 		return
 	}
 
+	if err := unattend.ValidateTemplate(req.InstallScript); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_install_script"), err.Error()))
+		return
+	}
+
 	ctx := c.Request.Context()
 
 	diskSize := req.DiskSize
@@ -164,23 +175,30 @@ func (h *TemplateHandler) CreateTemplate(c *gin.Context) {
 	}
 
 	template := &models.VMTemplate{
-		Name:         req.Name,
-		Description:  req.Description,
-		OSType:       req.OSType,
-		OSVersion:    req.OSVersion,
-		Architecture: req.Architecture,
-		Format:       req.Format,
-		CPUMin:       req.CPUMin,
-		CPUMax:       req.CPUMax,
-		MemoryMin:    req.MemoryMin,
-		MemoryMax:    req.MemoryMax,
-		DiskMin:      req.DiskMin,
-		DiskMax:      req.DiskMax,
-		TemplatePath: req.TemplatePath,
-		IconURL:      req.IconURL,
-		DiskSize:     diskSize,
-		IsPublic:     req.IsPublic,
-		CreatedBy:    &userUUID,
+		Name:              req.Name,
+		Description:       req.Description,
+		OSType:            req.OSType,
+		OSVersion:         req.OSVersion,
+		OSProfile:         osProfileFor(req.OSProfile, req.OSType),
+		Architecture:      req.Architecture,
+		Format:            req.Format,
+		CPUMin:            req.CPUMin,
+		CPUMax:            req.CPUMax,
+		MemoryMin:         req.MemoryMin,
+		MemoryMax:         req.MemoryMax,
+		DiskMin:           req.DiskMin,
+		DiskMax:           req.DiskMax,
+		TemplatePath:      req.TemplatePath,
+		IconURL:           req.IconURL,
+		DiskSize:          diskSize,
+		IsPublic:          req.IsPublic,
+		CreatedBy:         &userUUID,
+		CloudInitUserData: req.CloudInitUserData,
+		InstallScript:     req.InstallScript,
+		PostInstallScript: req.PostInstallScript,
+	}
+	if req.QoS != nil {
+		template.QoS = req.QoS.limits()
 	}
 
 	if err := h.templateRepo.Create(ctx, template); err != nil {
@@ -202,11 +220,16 @@ func (h *TemplateHandler) UpdateTemplate(c *gin.Context) {
 	}
 
 	var req struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		IconURL     string `json:"icon_url"`
-		IsPublic    bool   `json:"is_public"`
-		IsActive    bool   `json:"is_active"`
+		Name              string      `json:"name"`
+		Description       string      `json:"description"`
+		IconURL           string      `json:"icon_url"`
+		IsPublic          bool        `json:"is_public"`
+		IsActive          bool        `json:"is_active"`
+		OSProfile         *string     `json:"os_profile" binding:"omitempty,oneof=linux windows"`
+		CloudInitUserData *string     `json:"cloud_init_user_data"`
+		InstallScript     *string     `json:"install_script"`
+		PostInstallScript *string     `json:"post_install_script"`
+		QoS               *QoSRequest `json:"qos"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -214,6 +237,13 @@ func (h *TemplateHandler) UpdateTemplate(c *gin.Context) {
 		return
 	}
 
+	if req.InstallScript != nil {
+		if err := unattend.ValidateTemplate(*req.InstallScript); err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_install_script"), err.Error()))
+			return
+		}
+	}
+
 	if req.Name != "" {
 		template.Name = req.Name
 	}
@@ -221,6 +251,21 @@ func (h *TemplateHandler) UpdateTemplate(c *gin.Context) {
 	template.IconURL = req.IconURL
 	template.IsPublic = req.IsPublic
 	template.IsActive = req.IsActive
+	if req.OSProfile != nil {
+		template.OSProfile = *req.OSProfile
+	}
+	if req.CloudInitUserData != nil {
+		template.CloudInitUserData = *req.CloudInitUserData
+	}
+	if req.InstallScript != nil {
+		template.InstallScript = *req.InstallScript
+	}
+	if req.PostInstallScript != nil {
+		template.PostInstallScript = *req.PostInstallScript
+	}
+	if req.QoS != nil {
+		template.QoS = req.QoS.limits()
+	}
 
 	if err := h.templateRepo.Update(ctx, template); err != nil {
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_template"), err.Error()))
@@ -313,6 +358,7 @@ type CompleteUploadRequest struct {
 	Description  string `json:"description"`
 	OSType       string `json:"os_type"`
 	OSVersion    string `json:"os_version"`
+	OSProfile    string `json:"os_profile" binding:"omitempty,oneof=linux windows"`
 	Architecture string `json:"architecture"`
 	Format       string `json:"format"`
 	CPUMin       int    `json:"cpu_min"`
@@ -594,6 +640,7 @@ func (h *TemplateHandler) CompleteTemplateUpload(c *gin.Context) {
 		Description:  req.Description,
 		OSType:       req.OSType,
 		OSVersion:    req.OSVersion,
+		OSProfile:    osProfileFor(req.OSProfile, req.OSType),
 		Architecture: architecture,
 		Format:       req.Format,
 		CPUMin:       req.CPUMin,
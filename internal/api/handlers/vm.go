@@ -2,19 +2,25 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"vmmanager/internal/api/errors"
+	"vmmanager/internal/cloudinit"
+	"vmmanager/internal/diskcrypt"
 	"vmmanager/internal/libvirt"
 	"vmmanager/internal/models"
 	"vmmanager/internal/repository"
 	"vmmanager/internal/services"
+	"vmmanager/internal/unattend"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -31,6 +37,25 @@ type VMHandler struct {
 	auditService           *services.AuditService
 	syncService            *services.VMSyncService
 	vmOperationHistoryRepo *repository.VMOperationHistoryRepository
+	guestAgentService      *services.GuestAgentService
+	sshKeyRepo             *repository.SSHKeyRepository
+	installMonitor         *services.InstallMonitor
+	storagePoolRepo        *repository.StoragePoolRepository
+	storageVolumeRepo      *repository.StorageVolumeRepository
+	vmInterfaceRepo        *repository.VMInterfaceRepository
+	virtualNetworkRepo     *repository.VirtualNetworkRepository
+	tuningRoles            []string
+	flavorRepo             *repository.FlavorRepository
+	requireFlavor          bool
+	dedicatedMu            sync.Mutex
+	dedicatedHeld          map[uuid.UUID][]int
+	virtioWinISO           string
+	sharedFolderRepo       *repository.SharedFolderRepository
+	vmFilesystemRepo       *repository.VMFilesystemRepository
+	keyring                *diskcrypt.Keyring
+	kernelLibraryPath      string
+	vmDriftRepo            *repository.VMDriftRepository
+	driftService           *services.DriftService
 }
 
 func NewVMHandler(
@@ -55,14 +80,23 @@ func NewVMHandler(
 	}
 }
 
+// SetSyncService registers the handler's start preparation with the sync
+// service, so VMs its restart policy brings back up start like any other.
 func (h *VMHandler) SetSyncService(syncService *services.VMSyncService) {
 	h.syncService = syncService
+	if syncService != nil {
+		syncService.SetStartPreparer(h.prepareStart)
+	}
 }
 
 func (h *VMHandler) SetVMOperationHistoryRepo(repo *repository.VMOperationHistoryRepository) {
 	h.vmOperationHistoryRepo = repo
 }
 
+func (h *VMHandler) SetGuestAgentService(guestAgentService *services.GuestAgentService) {
+	h.guestAgentService = guestAgentService
+}
+
 func (h *VMHandler) recordVMOperation(vmID uuid.UUID, operation, status string, triggeredBy *uuid.UUID, ipAddress, userAgent, requestParams, responseData, errorMessage string) {
 	if h.vmOperationHistoryRepo == nil {
 		return
@@ -175,20 +209,44 @@ func (h *VMHandler) GetVM(c *gin.Context) {
 
 func (h *VMHandler) CreateVM(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
 	userUUID, _ := uuid.Parse(userID.(string))
 
 	var req struct {
-		Name             string   `json:"name" binding:"required"`
-		Description      string   `json:"description"`
-		TemplateID       *string  `json:"template_id"`
-		ISOID            *string  `json:"iso_id"`
-		InstallationMode string   `json:"installation_mode"`
-		CPUAllocated     int      `json:"cpu_allocated" binding:"required,min=1"`
-		MemoryAllocated  int      `json:"memory_allocated" binding:"required,min=512"`
-		DiskAllocated    int      `json:"disk_allocated" binding:"required,min=10"`
-		BootOrder        string   `json:"boot_order"`
-		Autostart        bool     `json:"autostart"`
-		Tags             []string `json:"tags"`
+		Name             string                    `json:"name" binding:"required"`
+		Description      string                    `json:"description"`
+		TemplateID       *string                   `json:"template_id"`
+		ISOID            *string                   `json:"iso_id"`
+		InstallationMode string                    `json:"installation_mode"`
+		FlavorID         *string                   `json:"flavor_id"`
+		CPUAllocated     int                       `json:"cpu_allocated" binding:"omitempty,min=1"`
+		MemoryAllocated  int                       `json:"memory_allocated" binding:"omitempty,min=512"`
+		DiskAllocated    int                       `json:"disk_allocated" binding:"omitempty,min=10"`
+		BootOrder        string                    `json:"boot_order"`
+		Autostart        bool                      `json:"autostart"`
+		Tags             []string                  `json:"tags"`
+		Hostname         string                    `json:"hostname"`
+		SSHKeys          []string                  `json:"ssh_keys"`
+		SSHKeyIDs        []string                  `json:"ssh_key_ids"`
+		Username         string                    `json:"username"`
+		Password         string                    `json:"password"`
+		Packages         []string                  `json:"packages"`
+		UserData         string                    `json:"user_data"`
+		NetworkConfig    string                    `json:"network_config"`
+		Unattended       *UnattendedInstallRequest `json:"unattended"`
+		Architecture     string                    `json:"architecture"`
+		MachineType      string                    `json:"machine_type"`
+		CPUMode          string                    `json:"cpu_mode"`
+		CPUModel         string                    `json:"cpu_model"`
+		Firmware         string                    `json:"firmware"`
+		VideoModel       string                    `json:"video_model"`
+		TPM              bool                      `json:"tpm"`
+		OSProfile        string                    `json:"os_profile" binding:"omitempty,oneof=linux windows"`
+		DiskBus          string                    `json:"disk_bus" binding:"omitempty,oneof=virtio sata"`
+		Tuning           *VMTuning                 `json:"tuning"`
+		QoS              *QoSRequest               `json:"qos"`
+		Lifecycle        *LifecycleRequest         `json:"lifecycle"`
+		EncryptDisk      bool                      `json:"encrypt_disk"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -196,6 +254,43 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 		return
 	}
 
+	if req.EncryptDisk && h.keyring == nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "disk_encryption_unavailable"), "no master key is configured"))
+		return
+	}
+
+	if req.Tuning != nil && !h.canTune(role) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_vm_tuning"), fmt.Sprint(role)))
+		return
+	}
+
+	// A flavor sets the size up front so the quota checks below see it.
+	var flavor *models.Flavor
+	if req.FlavorID != nil {
+		var ok bool
+		if flavor, ok = h.lookupFlavor(c, *req.FlavorID, userUUID, role); !ok {
+			return
+		}
+		req.CPUAllocated, req.MemoryAllocated, req.DiskAllocated = flavor.CPU, flavor.Memory, flavor.Disk
+	} else if !h.customSizesAllowed(role) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "custom_vm_size_not_allowed"), "flavor_id is required"))
+		return
+	} else if req.CPUAllocated == 0 || req.MemoryAllocated == 0 || req.DiskAllocated == 0 {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), "cpu_allocated, memory_allocated and disk_allocated are required without flavor_id"))
+		return
+	}
+
+	if req.Hostname != "" && !cloudinit.ValidHostname(req.Hostname) {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_hostname"), req.Hostname))
+		return
+	}
+
+	sshKeys, err := h.resolveSSHKeys(c.Request.Context(), userUUID.String(), req.SSHKeyIDs, req.SSHKeys)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_ssh_key"), err.Error()))
+		return
+	}
+
 	installationMode := req.InstallationMode
 	if installationMode == "" {
 		if req.ISOID != nil {
@@ -258,7 +353,11 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 		}
 	}
 
-	macAddress, _ := models.GenerateMACAddress()
+	macAddress, err := h.uniqueMACAddress(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_vm"), err.Error()))
+		return
+	}
 	vncPassword, _ := models.GenerateVNCPassword(8)
 
 	vm := models.VirtualMachine{
@@ -280,6 +379,8 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 	}
 
 	var isoPath string
+	var isoOSType string
+	var isoProfile string
 	if installationMode == "iso" && req.ISOID != nil {
 		isoUUID, _ := uuid.Parse(*req.ISOID)
 		vm.ISOID = &isoUUID
@@ -289,6 +390,8 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 			if iso.Architecture != "" {
 				vm.Architecture = iso.Architecture
 			}
+			isoOSType = iso.OSType
+			isoProfile = iso.OSProfile
 			vm.BootOrder = "cdrom,hd,network"
 			vm.InstallStatus = "pending"
 			isoPath = iso.ISOPath
@@ -296,6 +399,8 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 	}
 
 	var templatePath string
+	var templateUserData string
+	var installTemplate *models.VMTemplate
 	if req.TemplateID != nil {
 		templateUUID, _ := uuid.Parse(*req.TemplateID)
 		vm.TemplateID = &templateUUID
@@ -306,13 +411,216 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 				vm.Architecture = template.Architecture
 			}
 			templatePath = template.TemplatePath
+			templateUserData = template.CloudInitUserData
+			installTemplate = template
 		}
 	}
 
+	if req.Architecture != "" {
+		if vm.Architecture != "" && vm.Architecture != req.Architecture {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), fmt.Sprintf("architecture %s does not match the %s installation source", req.Architecture, vm.Architecture)))
+			return
+		}
+		vm.Architecture = req.Architecture
+	}
+	hardware := ReconfigureVMRequest{}
+	if req.Firmware != "" {
+		hardware.Firmware = &req.Firmware
+		vm.Firmware = req.Firmware
+	}
+	if req.MachineType != "" {
+		hardware.MachineType = &req.MachineType
+		vm.MachineType = req.MachineType
+	}
+	if req.VideoModel != "" {
+		hardware.VideoModel = &req.VideoModel
+		vm.VideoModel = req.VideoModel
+	}
+	vm.CPUMode, vm.CPUModel = req.CPUMode, req.CPUModel
+	vm.TPM = req.TPM
+	if req.Lifecycle != nil {
+		vm.Lifecycle = req.Lifecycle.policy()
+	}
+	vm.DiskBus = req.DiskBus
+	profile := req.OSProfile
+	if profile == "" {
+		profile = osProfileFor(isoProfile, isoOSType)
+	}
+	if profile == "" && installTemplate != nil {
+		profile = osProfileFor(installTemplate.OSProfile, installTemplate.OSType)
+	}
+	h.applyOSProfile(&vm, profile)
+	if req.EncryptDisk {
+		encryption, _, err := newDiskEncryption(h.keyring)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_create_vm"), err.Error()))
+			return
+		}
+		vm.Encryption = encryption
+	}
+
+	setVMTuning(&vm, req.Tuning)
+	if flavor != nil {
+		if err := h.applyFlavor(ctx, &vm, flavor); err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+			return
+		}
+		defer h.releaseHostCPUs(vm.ID)
+	}
+	if req.QoS != nil {
+		vm.QoS = req.QoS.limits()
+	} else if flavor == nil && installTemplate != nil {
+		vm.QoS = installTemplate.QoS
+	}
+	if vm.QoS, err = capQoS(vm.QoS, user.QoSMax); err != nil {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "qos_limit_exceeded"), err.Error()))
+		return
+	}
+
+	if err := validateTuning(vm, vmTuning(vm)); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_tuning"), err.Error()))
+		return
+	}
+	err = validateReconfigureRequest(vm, hardware)
+	if err == nil {
+		err = h.applyHostCapabilities(&vm)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+		return
+	}
+
+	if req.Unattended != nil {
+		if isoPath == "" {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "unattended_requires_iso"), "unattended install needs an ISO installation source"))
+			return
+		}
+
+		profileName := req.Unattended.Profile
+		if profileName == "" {
+			profileName = string(unattend.ProfileForOS(isoOSType))
+		}
+		if profileName == "" && installTemplate != nil {
+			profileName = string(unattend.ProfileForOS(installTemplate.OSType))
+		}
+		profile, err := unattend.ParseProfile(profileName)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_unattended_config"), err.Error()))
+			return
+		}
+
+		delivery := unattend.Delivery(req.Unattended.Delivery)
+		if delivery == "" {
+			delivery = profile.DefaultDelivery()
+		}
+		if !profile.SupportsDelivery(delivery) {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_unattended_config"), fmt.Sprintf("profile %s cannot be delivered via %s", profile, delivery)))
+			return
+		}
+
+		hostname := req.Hostname
+		if hostname == "" {
+			hostname = defaultHostname(vm.Name)
+		}
+		password := req.Unattended.Password
+		if password == "" {
+			password = req.Password
+		}
+		opts := unattend.Options{
+			Profile:  profile,
+			Delivery: delivery,
+			Vars: unattend.Vars{
+				Hostname:          hostname,
+				Username:          req.Unattended.Username,
+				Password:          password,
+				PasswordHash:      req.Unattended.PasswordHash,
+				Timezone:          req.Unattended.Timezone,
+				Locale:            req.Unattended.Locale,
+				Keyboard:          req.Unattended.Keyboard,
+				DiskLayout:        req.Unattended.DiskLayout,
+				RootDisk:          unattend.RootDiskDevice(rootDiskBus(vm)),
+				SSHAuthorizedKeys: sshKeys,
+				Packages:          req.Packages,
+				ProductKey:        req.Unattended.ProductKey,
+				ImageIndex:        req.Unattended.ImageIndex,
+				Architecture:      vm.Architecture,
+				VirtioDrivers:     vm.DriverISOPath != "",
+			},
+			InstallISO: isoPath,
+			OutputDir:  h.storagePath,
+			Name:       vm.ID.String(),
+		}
+		if installTemplate != nil {
+			opts.Template = installTemplate.InstallScript
+			opts.Vars.PostInstallScript = installTemplate.PostInstallScript
+		}
+		if err := opts.Vars.Normalize(profile); err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_unattended_config"), err.Error()))
+			return
+		}
+
+		media, err := unattend.Prepare(opts)
+		if err != nil {
+			log.Printf("[VM] Failed to prepare unattended install: %v", err)
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_prepare_unattended_install"), err.Error()))
+			return
+		}
+		vm.UnattendProfile = string(profile)
+		vm.InstallMediaPath = media.ISOPath
+		vm.InstallKernelPath = media.KernelPath
+		vm.InstallInitrdPath = media.InitrdPath
+		vm.InstallCmdline = media.Cmdline
+		log.Printf("[VM] Unattended %s install prepared via %s for VM %s", profile, delivery, vm.Name)
+	}
+
+	ciConfig := &cloudinit.Config{
+		InstanceID:        vm.ID.String(),
+		Hostname:          req.Hostname,
+		SSHAuthorizedKeys: sshKeys,
+		Username:          req.Username,
+		Packages:          req.Packages,
+		UserData:          req.UserData,
+		NetworkConfig:     req.NetworkConfig,
+	}
+	if req.Password != "" {
+		ciConfig.PasswordHash = req.Password
+		if !unattend.IsPasswordHash(req.Password) {
+			hash, err := unattend.HashPassword(req.Password)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_create_cloudinit_seed"), err.Error()))
+				return
+			}
+			ciConfig.PasswordHash = hash
+		}
+	}
+	if ciConfig.UserData == "" {
+		ciConfig.UserData = templateUserData
+	}
+	// The answer file already covers hostname, keys and packages, and a
+	// second cidata volume would confuse the Ubuntu installer.
+	if vm.UnattendProfile == "" && !ciConfig.IsEmpty() {
+		seedPath := fmt.Sprintf("%s/%s-cidata.iso", h.storagePath, vm.ID.String())
+		if err := ciConfig.WriteSeedISO(seedPath); err != nil {
+			log.Printf("[VM] Failed to create cloud-init seed: %v", err)
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_create_cloudinit_seed"), err.Error()))
+			return
+		}
+		vm.CloudInitISOPath = seedPath
+		log.Printf("[VM] Cloud-init seed created: %s", seedPath)
+	}
+
 	if h.libvirt != nil {
 		diskPath := vm.DiskPath
 
-		if templatePath != "" && exists(templatePath) {
+		if vm.Encryption.Enabled {
+			if err := h.createEncryptedDisk(ctx, vm, diskPath, templatePath); err != nil {
+				log.Printf("[VM] Failed to create encrypted disk: %v", err)
+				os.Remove(diskPath)
+				removeSeedISO(&vm)
+				c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_create_vm"), err.Error()))
+				return
+			}
+		} else if templatePath != "" && exists(templatePath) {
 			log.Printf("[VM] Copying template disk to: %s", diskPath)
 			cmd := exec.Command("cp", templatePath, diskPath)
 			if err := cmd.Run(); err != nil {
@@ -330,29 +638,6 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 			}
 		}
 
-		arch := vm.Architecture
-		if arch == "" {
-			arch = "x86_64"
-		}
-
-		nvramPath := fmt.Sprintf("/var/lib/libvirt/qemu/nvram/%s_VARS.fd", vm.Name)
-		var nvramTemplate string
-		switch arch {
-		case "arm64", "aarch64":
-			nvramTemplate = "/usr/share/AAVMF/AAVMF_VARS.fd"
-		default:
-			nvramTemplate = "/usr/share/OVMF/OVMF_VARS.fd"
-		}
-
-		if exists(nvramTemplate) {
-			cmd := exec.Command("cp", nvramTemplate, nvramPath)
-			if err := cmd.Run(); err != nil {
-				log.Printf("[VM] Failed to create nvram file: %v", err)
-			} else {
-				log.Printf("[VM] NVRAM file created: %s", nvramPath)
-			}
-		}
-
 		domainXML := generateDomainXML(vm, diskPath, isoPath)
 		log.Printf("[VM] Generated domain XML for VM %s", vm.Name)
 
@@ -367,9 +652,15 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 	}
 
 	if err := h.vmRepo.Create(ctx, &vm); err != nil {
+		h.discardUnsavedVM(&vm)
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_vm"), err.Error()))
 		return
 	}
+	if h.vmInterfaceRepo != nil {
+		if err := h.ensurePrimaryInterface(ctx, &vm); err != nil {
+			log.Printf("[VM] Failed to record primary interface of VM %s: %v", vm.Name, err)
+		}
+	}
 
 	if h.auditService != nil {
 		auditDetails := map[string]interface{}{
@@ -378,6 +669,11 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 			"memory":            vm.MemoryAllocated,
 			"disk":              vm.DiskAllocated,
 			"installation_mode": installationMode,
+			"cloud_init":        vm.CloudInitISOPath != "",
+			"encrypted_disk":    vm.Encryption.Enabled,
+		}
+		if vm.UnattendProfile != "" {
+			auditDetails["unattended"] = vm.UnattendProfile
 		}
 		if req.TemplateID != nil {
 			auditDetails["template_id"] = *req.TemplateID
@@ -385,6 +681,10 @@ func (h *VMHandler) CreateVM(c *gin.Context) {
 		if req.ISOID != nil {
 			auditDetails["iso_id"] = *req.ISOID
 		}
+		if flavor != nil {
+			auditDetails["flavor"] = flavor.Name
+		}
+		auditDetails["os_profile"] = vm.OSProfile
 		h.auditService.LogSuccess(c, "vm.create", "virtual_machine", &vm.ID, auditDetails)
 	}
 
@@ -564,14 +864,7 @@ func (h *VMHandler) DeleteVM(c *gin.Context) {
 		return
 	}
 
-	if vm.DiskPath != "" && exists(vm.DiskPath) {
-		log.Printf("[VM] Deleting disk file: %s", vm.DiskPath)
-		if err := os.Remove(vm.DiskPath); err != nil {
-			log.Printf("[VM] Failed to delete disk file: %v", err)
-		} else {
-			log.Printf("[VM] Disk file deleted: %s", vm.DiskPath)
-		}
-	}
+	h.releaseVM(ctx, vm)
 
 	if err := h.vmRepo.Delete(ctx, id); err != nil {
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "vm_deleted"), err.Error()))
@@ -588,11 +881,129 @@ func (h *VMHandler) DeleteVM(c *gin.Context) {
 	c.JSON(http.StatusOK, errors.Success(nil))
 }
 
+// releaseVM removes what a deleted VM holds on the host and in the database
+// apart from its own row: the system disk and its secret, the seed and
+// install media, the boot files, and the volume, interface and filesystem
+// rows that reference the VM and would keep the row from being deleted.
+func (h *VMHandler) releaseVM(ctx context.Context, vm *models.VirtualMachine) {
+	if vm.DiskPath != "" && exists(vm.DiskPath) {
+		log.Printf("[VM] Deleting disk file: %s", vm.DiskPath)
+		if err := os.Remove(vm.DiskPath); err != nil {
+			log.Printf("[VM] Failed to delete disk file: %v", err)
+		} else {
+			log.Printf("[VM] Disk file deleted: %s", vm.DiskPath)
+		}
+	}
+
+	removeSeedISO(vm)
+	removeInstallMedia(vm)
+	removeBootArtifacts(h.storagePath, vm.ID.String())
+
+	if h.storageVolumeRepo != nil {
+		if err := h.storageVolumeRepo.DetachAllFromVM(ctx, vm.ID.String()); err != nil {
+			log.Printf("[VM] Failed to release data disks of VM %s: %v", vm.Name, err)
+		}
+	}
+	if h.vmInterfaceRepo != nil {
+		if err := h.vmInterfaceRepo.DeleteByVM(ctx, vm.ID.String()); err != nil {
+			log.Printf("[VM] Failed to delete interfaces of VM %s: %v", vm.Name, err)
+		}
+	}
+	if h.vmFilesystemRepo != nil {
+		if err := h.vmFilesystemRepo.DeleteByVM(ctx, vm.ID.String()); err != nil {
+			log.Printf("[VM] Failed to delete filesystems of VM %s: %v", vm.Name, err)
+		}
+	}
+	if vm.Encryption.Enabled && h.libvirt != nil {
+		if err := h.libvirt.UndefineSecret(vm.Encryption.SecretUUID); err != nil {
+			log.Printf("[VM] Failed to undefine disk secret of VM %s: %v", vm.Name, err)
+		}
+	}
+}
+
+// removeSeedISO deletes the cloud-init seed of vm, which holds its password
+// hash and keys.
+func removeSeedISO(vm *models.VirtualMachine) {
+	if vm.CloudInitISOPath != "" && exists(vm.CloudInitISOPath) {
+		if err := os.Remove(vm.CloudInitISOPath); err != nil {
+			log.Printf("[VM] Failed to delete cloud-init seed: %v", err)
+		}
+	}
+	vm.CloudInitISOPath = ""
+}
+
+// discardUnsavedVM removes what CreateVM set up on the host for a VM that
+// could not be saved: the domain, the system disk with its secret and the
+// cloud-init seed.
+func (h *VMHandler) discardUnsavedVM(vm *models.VirtualMachine) {
+	if h.libvirt != nil {
+		if vm.LibvirtDomainUUID != "" {
+			if err := h.libvirt.UndefineDomain(vm.LibvirtDomainUUID); err != nil {
+				log.Printf("[VM] Failed to undefine domain of unsaved VM %s: %v", vm.Name, err)
+			}
+		}
+		if vm.Encryption.Enabled {
+			if err := h.libvirt.UndefineSecret(vm.Encryption.SecretUUID); err != nil {
+				log.Printf("[VM] Failed to remove disk secret of unsaved VM %s: %v", vm.Name, err)
+			}
+		}
+		if vm.DiskPath != "" && exists(vm.DiskPath) {
+			if err := os.Remove(vm.DiskPath); err != nil {
+				log.Printf("[VM] Failed to delete disk of unsaved VM %s: %v", vm.Name, err)
+			}
+		}
+	}
+	removeSeedISO(vm)
+}
+
 func exists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
 
+// prepareStart does what a start of vm needs before its domain boots:
+// libvirt gets the secrets of the encrypted disks and a pending firmware
+// change gets a fresh NVRAM store. Every path that starts a stopped VM goes
+// through it, including the restart policy of the sync service.
+func (h *VMHandler) prepareStart(ctx context.Context, vm *models.VirtualMachine) error {
+	if h.libvirt == nil {
+		return fmt.Errorf("libvirt client is not initialized")
+	}
+
+	// An encrypted disk only opens when libvirt holds its secret.
+	if vm.Encryption.Enabled {
+		diskPath := vm.DiskPath
+		if diskPath == "" {
+			diskPath = fmt.Sprintf("%s/%s.qcow2", h.storagePath, vm.ID.String())
+		}
+		if err := ensureDiskSecret(h.libvirt, h.keyring, *vm, diskPath); err != nil {
+			return fmt.Errorf("failed to define disk secret: %w", err)
+		}
+	}
+	h.loadDataDisks(ctx, vm)
+	if err := ensureDataDiskSecrets(h.libvirt, h.keyring, *vm); err != nil {
+		return fmt.Errorf("failed to define data disk secrets: %w", err)
+	}
+
+	if nvramResetPending(*vm) {
+		if err := resetNVRAM(*vm); err != nil {
+			return fmt.Errorf("failed to reset NVRAM: %w", err)
+		}
+		log.Printf("[VM] NVRAM of VM %s reset for its new firmware", vm.Name)
+	}
+	return nil
+}
+
+// finishStart clears the changes that waited for vm to be started.
+func (h *VMHandler) finishStart(ctx context.Context, vm *models.VirtualMachine) {
+	if vm.PendingChanges == "" {
+		return
+	}
+	if err := h.vmRepo.ClearPendingChanges(ctx, vm.ID.String()); err != nil {
+		log.Printf("[VM] Failed to clear pending changes of VM %s: %v", vm.Name, err)
+	}
+}
+
 func (h *VMHandler) StartVM(c *gin.Context) {
 	id := c.Param("id")
 	ctx := c.Request.Context()
@@ -627,6 +1038,13 @@ func (h *VMHandler) StartVM(c *gin.Context) {
 		return
 	}
 
+	if err := checkDirectBoot(*vm); err != nil {
+		log.Printf("[VM] Cannot start VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "start", "failed", &userUUID, ipAddress, userAgent, "", "", err.Error())
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "direct_boot_files_missing"), err.Error()))
+		return
+	}
+
 	domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID)
 	if err != nil {
 		log.Printf("[VM] Domain not found in libvirt: %v", err)
@@ -656,7 +1074,18 @@ func (h *VMHandler) StartVM(c *gin.Context) {
 			}
 		}
 
-		if templatePath != "" && exists(templatePath) {
+		// An encrypted disk that survived the domain is kept, as a new one
+		// would get a new key.
+		if vm.Encryption.Enabled {
+			if !exists(diskPath) {
+				if err := h.createEncryptedDisk(ctx, *vm, diskPath, templatePath); err != nil {
+					log.Printf("[VM] Failed to create encrypted disk: %v", err)
+					os.Remove(diskPath)
+					c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_create_vm_domain"), err.Error()))
+					return
+				}
+			}
+		} else if templatePath != "" && exists(templatePath) {
 			log.Printf("[VM] Copying template disk to: %s", diskPath)
 			cmd := exec.Command("cp", templatePath, diskPath)
 			if err := cmd.Run(); err != nil {
@@ -700,6 +1129,9 @@ func (h *VMHandler) StartVM(c *gin.Context) {
 			log.Printf("[VM] NVRAM template not found: %s", nvramTemplate)
 		}
 
+		h.loadDataDisks(ctx, vm)
+		h.loadInterfaces(ctx, vm)
+		h.loadFilesystems(ctx, vm)
 		domainXML := generateDomainXML(*vm, diskPath, isoPath)
 		log.Printf("[VM] Generated domain XML:\n%s", domainXML)
 
@@ -736,6 +1168,13 @@ func (h *VMHandler) StartVM(c *gin.Context) {
 		return
 	}
 
+	if err := h.prepareStart(ctx, vm); err != nil {
+		log.Printf("[VM] Failed to prepare start of VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "start", "failed", &userUUID, ipAddress, userAgent, "", "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_start_vm"), err.Error()))
+		return
+	}
+
 	// 立即更新状态为 starting，避免前端状态回跳
 	if err := h.vmRepo.UpdateStatus(ctx, id, "starting"); err != nil {
 		log.Printf("[VM] Failed to update status to starting: %v", err)
@@ -750,6 +1189,20 @@ func (h *VMHandler) StartVM(c *gin.Context) {
 
 	log.Printf("[VM] Domain started successfully")
 
+	h.finishStart(ctx, vm)
+
+	if !vm.IsInstalled && vm.InstallStatus == "pending" {
+		if err := h.vmRepo.UpdateInstallStatus(ctx, id, "installing"); err != nil {
+			log.Printf("[VM] Failed to update install status: %v", err)
+		}
+		if h.installMonitor != nil {
+			h.installMonitor.MarkInstallStarted(vm.ID.String(), vm.Name)
+		}
+		if vm.UnattendProfile == string(unattend.ProfileWindows) {
+			go h.pressKeyForCDBoot(domain.UUID, libvirt.RootDiskTarget(vm.DiskBus))
+		}
+	}
+
 	if err := h.vmRepo.UpdateStatus(ctx, id, "running"); err != nil {
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_vm_status"), err.Error()))
 		return
@@ -769,242 +1222,244 @@ func (h *VMHandler) StartVM(c *gin.Context) {
 	}))
 }
 
-// extractVNCPasswordFromXML extracts the VNC password from domain XML
-func extractVNCPasswordFromXML(xmlDesc string) string {
-	for _, line := range strings.Split(xmlDesc, "\n") {
-		if strings.Contains(line, "<graphics") && strings.Contains(line, "type='vnc'") {
-			for _, part := range strings.Fields(line) {
-				if strings.HasPrefix(part, "passwd='") {
-					passwd := strings.TrimPrefix(part, "passwd='")
-					passwd = strings.TrimSuffix(passwd, "'")
-					return passwd
-				}
-			}
-		}
+// extractSPICEConfig returns the port and password of the SPICE display in
+// domain XML
+func extractSPICEConfig(xmlDesc string) (int, string) {
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		return 0, ""
+	}
+	graphics := def.FindGraphics("spice")
+	if graphics == nil {
+		return 0, ""
 	}
-	return ""
+	return graphics.Port, graphics.Passwd
 }
 
-// extractSPICEPort extracts the SPICE port from domain XML
-func extractSPICEPort(xmlDesc string) int {
-	for _, line := range strings.Split(xmlDesc, "\n") {
-		if strings.Contains(line, "<graphics") && strings.Contains(line, "type='spice'") {
-			for _, part := range strings.Fields(line) {
-				if strings.HasPrefix(part, "port='") {
-					portStr := strings.TrimPrefix(part, "port='")
-					portStr = strings.TrimSuffix(portStr, "'")
-					var port int
-					fmt.Sscanf(portStr, "%d", &port)
-					return port
-				}
-			}
+// generateBootOrder generates boot elements based on boot order string
+// Format: "hd,cdrom,network" or "cdrom,hd,network" etc.
+func generateBootOrder(bootOrder string) []libvirt.OSBoot {
+	if bootOrder == "" {
+		bootOrder = "hd,cdrom,network"
+	}
+
+	var boots []libvirt.OSBoot
+	for _, part := range strings.Split(bootOrder, ",") {
+		part = strings.TrimSpace(part)
+		if bootDevices[part] {
+			boots = append(boots, libvirt.OSBoot{Dev: part})
 		}
 	}
-	return 0
+	return boots
 }
 
-// extractSPICEPasswordFromXML extracts the SPICE password from domain XML
-func extractSPICEPasswordFromXML(xmlDesc string) string {
-	for _, line := range strings.Split(xmlDesc, "\n") {
-		if strings.Contains(line, "<graphics") && strings.Contains(line, "type='spice'") {
-			for _, part := range strings.Fields(line) {
-				if strings.HasPrefix(part, "passwd='") {
-					passwd := strings.TrimPrefix(part, "passwd='")
-					passwd = strings.TrimSuffix(passwd, "'")
-					return passwd
-				}
-			}
-		}
+// generateCDROM describes a read-only SATA CD-ROM holding path, or returns
+// nil when the image does not exist
+func generateCDROM(path, target string) *libvirt.DomainDisk {
+	if path == "" || !exists(path) {
+		return nil
+	}
+	return &libvirt.DomainDisk{
+		Type:     "file",
+		Device:   "cdrom",
+		Driver:   &libvirt.DiskDriver{Name: "qemu", Type: "raw"},
+		Source:   &libvirt.DiskSource{File: path},
+		Target:   &libvirt.DiskTarget{Dev: target, Bus: "sata"},
+		ReadOnly: &struct{}{},
 	}
-	return ""
 }
 
-// generateBootOrder generates boot elements based on boot order string
-// Format: "hd,cdrom,network" or "cdrom,hd,network" etc.
-func generateBootOrder(bootOrder string) string {
-	if bootOrder == "" {
-		bootOrder = "hd,cdrom,network"
+// generateMediaConfig attaches the ISO as the first CD-ROM, the NoCloud seed
+// image as the second, generated unattended-install media as the third
+// until the install has finished and the driver ISO as the fourth
+func generateMediaConfig(vm models.VirtualMachine, isoPath string) []libvirt.DomainDisk {
+	installMedia := vm.InstallMediaPath
+	if vm.IsInstalled {
+		installMedia = ""
+	}
+	var disks []libvirt.DomainDisk
+	for _, cdrom := range []*libvirt.DomainDisk{
+		generateCDROM(isoPath, "sda"),
+		generateCDROM(vm.CloudInitISOPath, "sdb"),
+		generateCDROM(installMedia, "sdc"),
+		generateCDROM(vm.DriverISOPath, driverISOTarget),
+	} {
+		if cdrom != nil {
+			disks = append(disks, *cdrom)
+		}
 	}
+	return disks
+}
 
-	parts := strings.Split(bootOrder, ",")
-	var bootXML string
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		switch part {
-		case "hd":
-			bootXML += "    <boot dev='hd'/>\n"
-		case "cdrom":
-			bootXML += "    <boot dev='cdrom'/>\n"
-		case "network":
-			bootXML += "    <boot dev='network'/>\n"
+// generateOSBootConfig boots the extracted installer kernel directly while an
+// unattended install with kernel delivery is pending, then the kernel of a
+// VM in direct boot mode, and falls back to the configured boot order
+// otherwise. Missing direct boot files are left to checkDirectBoot, which
+// fails the start
+func generateOSBootConfig(vm models.VirtualMachine, arch string) *libvirt.DomainOS {
+	osConfig := &libvirt.DomainOS{
+		Type: libvirt.OSType{Arch: arch, Machine: machineType(vm), Value: "hvm"},
+	}
+	osConfig.Loader, osConfig.NVRAM = generateFirmwareConfig(vm)
+	switch {
+	case !vm.IsInstalled && vm.InstallKernelPath != "" && exists(vm.InstallKernelPath):
+		osConfig.Kernel = vm.InstallKernelPath
+		osConfig.Initrd = vm.InstallInitrdPath
+		osConfig.Cmdline = vm.InstallCmdline
+	case vm.DirectBoot.Enabled && vm.DirectBoot.Kernel != "":
+		osConfig.Kernel = vm.DirectBoot.Kernel
+		osConfig.Initrd = vm.DirectBoot.Initrd
+		osConfig.Cmdline = vm.DirectBoot.Cmdline
+		if arch == "aarch64" {
+			osConfig.DTB = vm.DirectBoot.DTB
 		}
+	default:
+		osConfig.Boots = generateBootOrder(vm.BootOrder)
 	}
-	return bootXML
+	return osConfig
 }
 
-// generateISOConfig generates CD-ROM device configuration for ISO file
-func generateISOConfig(isoPath string) string {
-	if isoPath == "" || !exists(isoPath) {
-		return ""
-	}
-	return fmt.Sprintf(`    <disk type='file' device='cdrom'>
-      <driver name='qemu' type='raw'/>
-      <source file='%s'/>
-      <target dev='sda' bus='sata'/>
-      <readonly/>
-    </disk>`, isoPath)
+// generateRebootAction turns a guest reboot into a shutdown while an
+// installer runs, so the install monitor can detach the install media before
+// the installed system boots. Windows setup reboots several times and needs
+// its answer file media until the end, so it keeps restarting. A reboot
+// action set in the lifecycle policy always applies; the install monitor
+// then finishes the install from its completion signals while the guest
+// runs.
+func generateRebootAction(vm models.VirtualMachine, isoPath string) string {
+	if vm.IsInstalled || vm.Lifecycle.OnReboot != "" {
+		return lifecycleAction(vm.Lifecycle.OnReboot, "restart")
+	}
+	if vm.UnattendProfile == string(unattend.ProfileWindows) {
+		return "restart"
+	}
+	if isoPath == "" && vm.InstallKernelPath == "" {
+		return "restart"
+	}
+	return "destroy"
 }
 
-func generateDomainXML(vm models.VirtualMachine, diskPath, isoPath string) string {
-	arch := vm.Architecture
-	if arch == "" {
-		arch = "x86_64"
+// marshalDevice encodes a device for the attach, detach and update device
+// calls. The typed device structs always encode, so a failure is only logged.
+func marshalDevice(device interface{}) string {
+	deviceXML, err := libvirt.MarshalDevice(device)
+	if err != nil {
+		log.Printf("[VM] %v", err)
+	}
+	return deviceXML
+}
+
+// buildDomainDef describes vm as a libvirt domain with diskPath as its
+// system disk and isoPath in the first CD-ROM.
+func buildDomainDef(vm models.VirtualMachine, diskPath, isoPath string) *libvirt.DomainDef {
+	arch := "x86_64"
+	if isARM(vm) {
+		arch = "aarch64"
 	}
 
-	vcpuPlacement := "static"
-	vcpuCurrent := ""
-	maxVCPUs := vm.CPUAllocated
+	vcpu := &libvirt.DomainVCPU{Placement: "static", Value: vm.CPUAllocated}
 	if vm.VCPUHotplug {
-		vcpuPlacement = "auto"
-		vcpuCurrent = fmt.Sprintf(" current='%d'", vm.CPUAllocated)
-	}
-
-	currentMemory := vm.MemoryAllocated
-	maxMemory := vm.MemoryAllocated
-	if vm.MemoryHotplug {
-		if vm.MemoryAllocated > 0 {
-			maxMemory = vm.MemoryAllocated
-		}
-	}
-
-	var archConfig string
-	switch arch {
-	case "arm64", "aarch64":
-		archConfig = fmt.Sprintf(`<domain type='qemu'>
-  <name>%s</name>
-  <uuid>%s</uuid>
-  <memory unit='MiB'>%d</memory>
-  <currentMemory unit='MiB'>%d</currentMemory>
-  <vcpu placement='%s'%s>%d</vcpu>
-  <os>
-    <type arch='aarch64' machine='virt'>hvm</type>
-    <loader readonly='yes' type='pflash'>/usr/share/AAVMF/AAVMF_CODE.fd</loader>
-    <nvram template='/usr/share/AAVMF/AAVMF_VARS.fd'>/var/lib/libvirt/qemu/nvram/%s_VARS.fd</nvram>
-%s  </os>
-  <serial type='pty'>
-    <target port='0'/>
-  </serial>
-  <console type='pty'>
-    <target type='serial' port='0'/>
-  </console>
-  <features>
-    <acpi/>
-    <apic/>
-    <gic version='3'/>
-  </features>
-  <cpu mode='custom' match='exact'>
-    <model>cortex-a72</model>
-  </cpu>
-  <clock offset='utc'>
-    <timer name='rtc' tickpolicy='catchup'/>
-  </clock>
-  <on_poweroff>destroy</on_poweroff>
-  <on_reboot>restart</on_reboot>
-  <on_crash>restart</on_crash>
-  <devices>
-    <emulator>/usr/bin/qemu-system-aarch64</emulator>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>
-%s    <interface type='network'>
-      <source network='default'/>
-      <model type='virtio'/>
-    </interface>
-    <graphics type='spice' port='-1' autoport='yes' listen='0.0.0.0'>
-      <listen type='address' address='0.0.0.0'/>
-    </graphics>
-    <video>
-      <model type='qxl' ram='65536' vram='65536'/>
-    </video>
-    <controller type='usb' model='ehci'>
-    </controller>
-    <controller type='virtio-serial'>
-    </controller>
-    <channel type='spicevmc'>
-      <target type='virtio' name='com.redhat.spice.0'/>
-    </channel>
-    <input type='tablet' bus='usb'>
-    </input>
-    <input type='mouse' bus='usb'>
-    </input>
-  </devices>
-</domain>`, vm.Name, vm.ID.String(), maxMemory, currentMemory, vcpuPlacement, vcpuCurrent, maxVCPUs, vm.ID.String(), generateBootOrder(vm.BootOrder), diskPath, generateISOConfig(isoPath))
-	case "x86_64":
-		archConfig = fmt.Sprintf(`<domain type='qemu'>
-  <name>%s</name>
-  <uuid>%s</uuid>
-  <memory unit='MiB'>%d</memory>
-  <currentMemory unit='MiB'>%d</currentMemory>
-  <vcpu placement='%s'%s>%d</vcpu>
-  <os>
-    <type arch='x86_64' machine='q35'>hvm</type>
-    <loader readonly='yes' type='pflash'>/usr/share/OVMF/OVMF_CODE.fd</loader>
-    <nvram template='/usr/share/OVMF/OVMF_VARS.fd'>/var/lib/libvirt/qemu/nvram/%s_VARS.fd</nvram>
-%s  </os>
-  <serial type='pty'>
-    <target port='0'/>
-  </serial>
-  <console type='pty'>
-    <target type='serial' port='0'/>
-  </console>
-  <features>
-    <acpi/>
-    <apic/>
-  </features>
-  <cpu mode='host-model'>
-    <model fallback='allow'/>
-  </cpu>
-  <clock offset='utc'>
-    <timer name='rtc' tickpolicy='catchup'/>
-    <timer name='hpet' present='no'/>
-  </clock>
-  <on_poweroff>destroy</on_poweroff>
-  <on_reboot>restart</on_reboot>
-  <on_crash>restart</on_crash>
-  <devices>
-    <emulator>/usr/bin/qemu-system-x86_64</emulator>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>
-%s    <interface type='network'>
-      <source network='default'/>
-      <model type='virtio'/>
-    </interface>
-    <graphics type='spice' port='-1' autoport='yes' listen='0.0.0.0'>
-      <listen type='address' address='0.0.0.0'/>
-      <mouse mode='server'/>
-    </graphics>
-    <video>
-      <model type='qxl' ram='65536' vram='65536'/>
-    </video>
-    <controller type='usb' model='qemu-xhci'/>
-    <controller type='virtio-serial'/>
-    <channel type='spicevmc'>
-      <target type='virtio' name='com.redhat.spice.0'/>
-    </channel>
-    <input type='tablet' bus='virtio'>
-    </input>
-    <input type='mouse' bus='virtio'>
-    </input>
-  </devices>
-</domain>`, vm.Name, vm.ID.String(), maxMemory, currentMemory, vcpuPlacement, vcpuCurrent, maxVCPUs, vm.ID.String(), generateBootOrder(vm.BootOrder), diskPath, generateISOConfig(isoPath))
-	}
-
-	return archConfig
+		vcpu.Placement = "auto"
+		vcpu.Current = vm.CPUAllocated
+	}
+
+	def := &libvirt.DomainDef{
+		Type:          domainType(vm),
+		Name:          vm.Name,
+		UUID:          vm.ID.String(),
+		Memory:        &libvirt.DomainMemory{Unit: "MiB", Value: uint64(vm.MemoryAllocated)},
+		CurrentMemory: &libvirt.DomainMemory{Unit: "MiB", Value: uint64(vm.MemoryAllocated)},
+		VCPU:          vcpu,
+		OS:            generateOSBootConfig(vm, arch),
+		CPU:           generateCPUConfig(vm),
+		Features:      &libvirt.DomainFeatures{ACPI: &struct{}{}, APIC: &libvirt.FeatureAPIC{}},
+		Clock:         generateClockConfig(vm),
+		OnPoweroff:    lifecycleAction(vm.Lifecycle.OnPoweroff, "destroy"),
+		OnReboot:      generateRebootAction(vm, isoPath),
+		OnCrash:       lifecycleAction(vm.Lifecycle.OnCrash, "restart"),
+	}
+
+	devices := &libvirt.DomainDevices{
+		Emulator: "/usr/bin/qemu-system-" + arch,
+		Disks: []libvirt.DomainDisk{{
+			Type:       "file",
+			Device:     "disk",
+			Driver:     &libvirt.DiskDriver{Name: "qemu", Type: "qcow2"},
+			Source:     &libvirt.DiskSource{File: diskPath},
+			Target:     &libvirt.DiskTarget{Dev: rootDiskTarget(vm), Bus: rootDiskBus(vm)},
+			IOTune:     diskIOTune(vm.QoS),
+			Encryption: libvirt.DiskEncryptionFor(vm.Encryption.SecretUUID),
+		}},
+		Interfaces: generateInterfacesConfig(vm),
+		Serials: []libvirt.DomainChardev{{
+			Type:   "pty",
+			Log:    &libvirt.ChardevLog{File: libvirt.SerialLogPath(vm.ID.String()), Append: "on"},
+			Target: &libvirt.ChardevTarget{Port: "0"},
+		}},
+		Consoles: []libvirt.DomainChardev{{
+			Type:   "pty",
+			Target: &libvirt.ChardevTarget{Type: "serial", Port: "0"},
+		}},
+		Channels: []libvirt.DomainChardev{
+			{Type: "spicevmc", Target: &libvirt.ChardevTarget{Type: "virtio", Name: "com.redhat.spice.0"}},
+			{Type: "unix", Target: &libvirt.ChardevTarget{Type: "virtio", Name: "org.qemu.guest_agent.0"}},
+		},
+		Graphics: []libvirt.DomainGraphics{{
+			Type:     "spice",
+			Port:     -1,
+			AutoPort: "yes",
+			Listen:   "0.0.0.0",
+			Listens:  []libvirt.GraphicsListen{{Type: "address", Address: "0.0.0.0"}},
+		}},
+		Videos:      []libvirt.DomainVideo{generateVideoModel(vm.VideoModel)},
+		TPMs:        generateTPMConfig(vm),
+		Watchdogs:   generateWatchdogConfig(vm),
+		MemBalloon:  generateMemBalloonConfig(),
+		Filesystems: generateFilesystemsConfig(vm),
+	}
+	devices.Disks = append(devices.Disks, generateMediaConfig(vm, isoPath)...)
+	devices.Disks = append(devices.Disks, generateDataDisksConfig(vm.DataDisks, vm.QoS)...)
+
+	usbModel, inputBus := "qemu-xhci", "virtio"
+	if arch == "aarch64" {
+		def.Features.GIC = &libvirt.FeatureGIC{Version: "3"}
+		usbModel, inputBus = "ehci", "usb"
+	} else {
+		if vmFirmware(vm) == firmwareUEFISecure {
+			def.Features.SMM = &libvirt.FeatureSMM{State: "on"}
+		}
+		// Windows ships no virtio input driver, so it gets USB devices.
+		if isWindows(vm) {
+			def.Features.HyperV = generateHyperVConfig()
+			inputBus = "usb"
+		}
+		def.Clock.Timers = append(def.Clock.Timers, libvirt.ClockTimer{Name: "hpet", Present: "no"})
+		devices.Graphics[0].Extra = []libvirt.RawElement{{
+			XMLName: xml.Name{Local: "mouse"},
+			Attrs:   []xml.Attr{{Name: xml.Name{Local: "mode"}, Value: "server"}},
+		}}
+	}
+	devices.Controllers = []libvirt.DomainController{
+		{Type: "usb", Model: usbModel},
+		{Type: "virtio-serial"},
+		{Type: "scsi", Model: "virtio-scsi"},
+	}
+	devices.Inputs = []libvirt.DomainInput{
+		{Type: "tablet", Bus: inputBus},
+		{Type: "mouse", Bus: inputBus},
+	}
+	def.Devices = devices
+	applyTuning(def, vm)
+	applySharedMemory(def, vm)
+	return def
+}
+
+func generateDomainXML(vm models.VirtualMachine, diskPath, isoPath string) string {
+	domainXML, err := buildDomainDef(vm, diskPath, isoPath).Marshal()
+	if err != nil {
+		log.Printf("[VM] %v", err)
+	}
+	return domainXML
 }
 
 func (h *VMHandler) StopVM(c *gin.Context) {
@@ -1176,8 +1631,15 @@ func (h *VMHandler) ForceStopVM(c *gin.Context) {
 		return
 	}
 
+	// Marked first so the sync does not take the destroyed guest for one
+	// that went down on its own and restart it.
+	if err := h.vmRepo.UpdateStatus(ctx, id, "stopping"); err != nil {
+		log.Printf("[VM] Failed to update status to stopping: %v", err)
+	}
+
 	if err := domain.Destroy(); err != nil {
 		log.Printf("[VM] Failed to destroy domain: %v", err)
+		h.vmRepo.UpdateStatus(ctx, id, vm.Status)
 		h.recordVMOperation(vm.ID, "force_stop", "failed", &userUUID, ipAddress, userAgent, "", "", err.Error())
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_force_stop_vm"), err.Error()))
 		return
@@ -1489,8 +1951,7 @@ func (h *VMHandler) GetConsole(c *gin.Context) {
 	spicePassword := ""
 	if domain, err := h.libvirt.LookupByUUID(vm.ID.String()); err == nil {
 		if xmlDesc, err := domain.GetXMLDesc(); err == nil {
-			spicePort = extractSPICEPort(xmlDesc)
-			spicePassword = extractSPICEPasswordFromXML(xmlDesc)
+			spicePort, spicePassword = extractSPICEConfig(xmlDesc)
 		}
 	}
 
@@ -1583,6 +2044,9 @@ func (h *VMHandler) StartInstallation(c *gin.Context) {
 
 	log.Printf("[Installation] Starting VM %s in installation mode with ISO: %s", vm.Name, template.ISOPath)
 
+	h.loadDataDisks(ctx, vm)
+	h.loadInterfaces(ctx, vm)
+	h.loadFilesystems(ctx, vm)
 	domainXML := generateDomainXML(*vm, diskPath, template.ISOPath)
 	log.Printf("[Installation] Domain XML:\n%s", domainXML)
 
@@ -1602,6 +2066,9 @@ func (h *VMHandler) StartInstallation(c *gin.Context) {
 	vm.LibvirtDomainUUID = vmUUIDStr
 	vm.Status = "running"
 	vm.InstallStatus = "installing"
+	if h.installMonitor != nil {
+		h.installMonitor.MarkInstallStarted(vm.ID.String(), vm.Name)
+	}
 
 	if err := h.vmRepo.Update(ctx, vm); err != nil {
 		log.Printf("[Installation] Failed to update VM: %v", err)
@@ -1660,6 +2127,9 @@ func (h *VMHandler) FinishInstallation(c *gin.Context) {
 	vm.InstallStatus = "completed"
 	vm.InstallProgress = 100
 
+	h.loadDataDisks(ctx, vm)
+	h.loadInterfaces(ctx, vm)
+	h.loadFilesystems(ctx, vm)
 	domainXML := generateDomainXML(*vm, vm.DiskPath, "")
 	log.Printf("[Installation] Domain XML after install:\n%s", domainXML)
 
@@ -1669,6 +2139,7 @@ func (h *VMHandler) FinishInstallation(c *gin.Context) {
 		return
 	}
 	defer domain.Free()
+	removeInstallMedia(vm)
 
 	if err := domain.Create(); err != nil {
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_start_vm"), err.Error()))
@@ -1682,6 +2153,9 @@ func (h *VMHandler) FinishInstallation(c *gin.Context) {
 	if err := h.vmRepo.Update(ctx, vm); err != nil {
 		log.Printf("[Installation] Failed to update VM: %v", err)
 	}
+	if h.installMonitor != nil {
+		h.installMonitor.MarkInstallCompleted(vm.ID.String())
+	}
 
 	c.JSON(http.StatusOK, errors.Success(gin.H{
 		"message":      "Installation completed, VM started from hard disk",
@@ -1691,6 +2165,24 @@ func (h *VMHandler) FinishInstallation(c *gin.Context) {
 	}))
 }
 
+// agentInstallScripts are the built-in install scripts InstallAgent runs in
+// the guest for each agent type.
+var agentInstallScripts = map[string]string{
+	"spice-vdagent": `apt-get update && apt-get install -y spice-vdagent 2>/dev/null || \
+yum install -y spice-vdagent 2>/dev/null || \
+zypper install -y spice-vdagent 2>/dev/null
+systemctl enable spice-vdagent 2>/dev/null || true
+systemctl start spice-vdagent 2>/dev/null || true
+echo "SPICE vdagent installation completed"
+`,
+}
+
+// agentInstallTimeout bounds how long InstallAgent waits for the install
+// script; package installs fetch from the network.
+const agentInstallTimeout = 5 * time.Minute
+
+// InstallAgent installs a guest agent by running its install script inside
+// the guest through qemu-guest-agent.
 func (h *VMHandler) InstallAgent(c *gin.Context) {
 	id := c.Param("id")
 	ctx := c.Request.Context()
@@ -1698,13 +2190,15 @@ func (h *VMHandler) InstallAgent(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 	role, _ := c.Get("role")
 	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
 
 	var req struct {
 		AgentType string `json:"agent_type"`
 		Script    string `json:"script"`
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil || req.AgentType == "" {
 		req.AgentType = "spice-vdagent"
 	}
 
@@ -1714,7 +2208,9 @@ func (h *VMHandler) InstallAgent(c *gin.Context) {
 		return
 	}
 
-	if role != "admin" && vm.OwnerID != userUUID {
+	// A custom script runs arbitrary commands in the guest, so like
+	// GuestExec it is reserved to the owner.
+	if (role != "admin" || req.Script != "") && vm.OwnerID != userUUID {
 		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
 		return
 	}
@@ -1724,50 +2220,56 @@ func (h *VMHandler) InstallAgent(c *gin.Context) {
 		return
 	}
 
-	if h.libvirt == nil {
-		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
 		return
 	}
 
-	var script string
-	if req.Script != "" {
-		script = req.Script
-	} else {
-		switch req.AgentType {
-		case "spice-vdagent":
-			script = `#!/bin/bash
-apt-get update && apt-get install -y spice-vdagent 2>/dev/null || \
-yum install -y spice-vdagent 2>/dev/null || \
-zypper install -y spice-vdagent 2>/dev/null
-systemctl enable spice-vdagent 2>/dev/null || true
-systemctl start spice-vdagent 2>/dev/null || true
-echo "SPICE vdagent installation completed"
-`
-		default:
-			script = req.Script
+	script := req.Script
+	if script == "" {
+		var ok bool
+		if script, ok = agentInstallScripts[req.AgentType]; !ok {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_request"), "unknown agent type: "+req.AgentType))
+			return
 		}
 	}
 
-	scriptPath := fmt.Sprintf("/tmp/install_agent_%s.sh", vm.ID.String())
-	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_write_script"), err.Error()))
+	params, _ := json.Marshal(gin.H{"agent_type": req.AgentType, "custom_script": req.Script != ""})
+
+	result, err := h.libvirt.GuestExec(vm.LibvirtDomainUUID, "/bin/sh", []string{"-s"}, []byte(script), agentInstallTimeout)
+	if err == nil && result.ExitCode != 0 {
+		err = fmt.Errorf("install script exited with status %d: %s", result.ExitCode, strings.TrimSpace(result.Stderr))
+	}
+	if err != nil {
+		log.Printf("[VM] Agent installation failed for VM %s: %v", id, err)
+		h.recordVMOperation(vm.ID, "install_agent", "failed", &userUUID, ipAddress, userAgent, string(params), "", err.Error())
+		if h.auditService != nil {
+			h.auditService.LogError(c, "vm.install_agent", "virtual_machine", &vm.ID, err.Error())
+		}
+		c.JSON(http.StatusBadGateway, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "agent_install_failed"), err.Error()))
 		return
 	}
-	defer os.Remove(scriptPath)
-
-	cmd := exec.Command("bash", scriptPath)
-	cmd.Run()
 
 	vm.AgentInstalled = true
 	if err := h.vmRepo.Update(ctx, vm); err != nil {
-		log.Printf("[Agent] Failed to update VM: %v", err)
+		log.Printf("[VM] Failed to mark agent installed for VM %s: %v", id, err)
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.install_agent", "virtual_machine", &vm.ID, map[string]interface{}{
+			"agent_type":    req.AgentType,
+			"custom_script": req.Script != "",
+		})
 	}
+	h.recordVMOperation(vm.ID, "install_agent", "success", &userUUID, ipAddress, userAgent, string(params), "", "")
 
 	c.JSON(http.StatusOK, errors.Success(gin.H{
-		"message":    "Agent installation script prepared",
-		"agent_type": req.AgentType,
-		"script":     script,
-		"note":       "Please run the script inside the VM manually via console",
+		"message":       "Agent installed",
+		"agent_type":    req.AgentType,
+		"stdout":        result.Stdout,
+		"stderr":        result.Stderr,
+		"out_truncated": result.OutTruncated,
+		"err_truncated": result.ErrTruncated,
 	}))
 }
 
@@ -1988,8 +2490,9 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 	userUUID, _ := uuid.Parse(userID.(string))
 
 	var req struct {
-		Name        string `json:"name" binding:"required"`
-		Description string `json:"description"`
+		Name        string  `json:"name" binding:"required"`
+		Description string  `json:"description"`
+		FlavorID    *string `json:"flavor_id"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -2008,6 +2511,26 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 		return
 	}
 
+	// Clones keep the size of their source unless they pick a flavor,
+	// which cannot shrink the copied disk.
+	var flavor *models.Flavor
+	if req.FlavorID != nil {
+		var ok bool
+		if flavor, ok = h.lookupFlavor(c, *req.FlavorID, userUUID, role); !ok {
+			return
+		}
+		if flavor.Disk < sourceVM.DiskAllocated {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_disk_size"), fmt.Sprintf("flavor %s has a %d GB disk, the source VM has %d GB", flavor.Name, flavor.Disk, sourceVM.DiskAllocated)))
+			return
+		}
+	} else if sourceVM.FlavorID != nil && h.flavorRepo != nil {
+		// Dedicated CPUs cannot be shared with the source, so the clone
+		// gets its own through the source flavor.
+		if source, err := h.flavorRepo.FindByID(ctx, sourceVM.FlavorID.String()); err == nil && source.CPUPolicy == cpuPolicyDedicated {
+			flavor = source
+		}
+	}
+
 	existingVM, _ := h.vmRepo.FindByName(ctx, req.Name)
 	if existingVM != nil {
 		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeVMConflict, t(c, "vm_name_exists"), req.Name))
@@ -2024,9 +2547,42 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 		return
 	}
 
+	// Only the system disk is copied; data disks cannot be shared with the
+	// clone and are not dropped silently either.
+	h.loadDataDisks(ctx, sourceVM)
+	if len(sourceVM.DataDisks) > 0 {
+		targets := make([]string, 0, len(sourceVM.DataDisks))
+		for _, disk := range sourceVM.DataDisks {
+			targets = append(targets, disk.TargetDev)
+		}
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "clone_has_data_disks"), strings.Join(targets, ", ")))
+		return
+	}
+
 	newDiskPath := fmt.Sprintf("%s/%s.qcow2", h.storagePath, uuid.New().String())
 
-	if sourceVM.DiskPath != "" {
+	// An encrypted source is copied in full under a key of its own, since
+	// an overlay would need the key of the source disk as well.
+	var encryption models.DiskEncryption
+	if sourceVM.Encryption.Enabled {
+		sourcePass, err := diskPassphrase(h.keyring, *sourceVM)
+		if err == nil {
+			var clonePass []byte
+			if encryption, clonePass, err = newDiskEncryption(h.keyring); err == nil {
+				err = diskcrypt.ConvertImage(ctx, sourceVM.DiskPath, sourcePass, newDiskPath, clonePass)
+			}
+			if err == nil {
+				err = h.libvirt.DefineVolumeSecret(encryption.SecretUUID, newDiskPath, clonePass)
+			}
+		}
+		if err != nil {
+			os.Remove(newDiskPath)
+			log.Printf("[VM] Failed to copy encrypted disk: %v", err)
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_clone_vm"), err.Error()))
+			return
+		}
+		log.Printf("[VM] Copied encrypted disk: %s -> %s", sourceVM.DiskPath, newDiskPath)
+	} else if sourceVM.DiskPath != "" {
 		if _, err := os.Stat(sourceVM.DiskPath); err == nil {
 			cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", sourceVM.DiskPath, newDiskPath)
 			if output, err := cmd.CombinedOutput(); err != nil {
@@ -2038,9 +2594,24 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 		}
 	}
 
-	newDomainUUID, err := h.libvirt.CloneVM(sourceVM.LibvirtDomainUUID, req.Name, newDiskPath)
-	if err != nil {
+	discardDisk := func() {
 		os.Remove(newDiskPath)
+		if encryption.Enabled {
+			h.libvirt.UndefineSecret(encryption.SecretUUID)
+		}
+	}
+
+	h.loadInterfaces(ctx, sourceVM)
+	interfaces, macs, err := h.cloneInterfaces(ctx, sourceVM)
+	if err != nil {
+		discardDisk()
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_clone_vm"), err.Error()))
+		return
+	}
+
+	newDomainUUID, err := h.libvirt.CloneVM(sourceVM.LibvirtDomainUUID, req.Name, newDiskPath, macs, encryption.SecretUUID)
+	if err != nil {
+		discardDisk()
 		log.Printf("[VM] Failed to clone VM in libvirt: %v", err)
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_clone_vm"), err.Error()))
 		return
@@ -2053,6 +2624,7 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 		OwnerID:           userUUID,
 		Status:            "stopped",
 		TemplateID:        sourceVM.TemplateID,
+		FlavorID:          sourceVM.FlavorID,
 		Architecture:      sourceVM.Architecture,
 		CPUAllocated:      sourceVM.CPUAllocated,
 		MemoryAllocated:   sourceVM.MemoryAllocated,
@@ -2060,21 +2632,53 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 		DiskPath:          newDiskPath,
 		LibvirtDomainUUID: newDomainUUID,
 		BootOrder:         sourceVM.BootOrder,
+		MachineType:       sourceVM.MachineType,
+		Firmware:          sourceVM.Firmware,
+		LoaderPath:        sourceVM.LoaderPath,
+		NVRAMTemplate:     sourceVM.NVRAMTemplate,
+		TPM:               sourceVM.TPM,
+		OSProfile:         sourceVM.OSProfile,
+		DiskBus:           sourceVM.DiskBus,
+		DriverISOPath:     sourceVM.DriverISOPath,
+		Lifecycle:         sourceVM.Lifecycle,
+		Balloon:           sourceVM.Balloon,
+		Encryption:        encryption,
+		VideoModel:        sourceVM.VideoModel,
+		Tuning:            sourceVM.Tuning,
+		QoS:               sourceVM.QoS,
 		Autostart:         false,
 	}
 
-	macAddress, _ := models.GenerateMACAddress()
-	newVM.MACAddress = macAddress
+	newVM.MACAddress = primaryMACAddress(interfaces)
 
 	vncPassword, _ := models.GenerateVNCPassword(8)
 	newVM.VNCPassword = vncPassword
 
+	if flavor != nil {
+		defer h.releaseHostCPUs(newVM.ID)
+		if err := h.resizeClone(c, &newVM, flavor); err != nil {
+			h.libvirt.UndefineDomain(newDomainUUID)
+			discardDisk()
+			log.Printf("[VM] Failed to apply flavor %s to clone %s: %v", flavor.Name, req.Name, err)
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+			return
+		}
+	}
+
 	if err := h.vmRepo.Create(ctx, &newVM); err != nil {
 		h.libvirt.UndefineDomain(newDomainUUID)
-		os.Remove(newDiskPath)
+		discardDisk()
 		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_vm"), err.Error()))
 		return
 	}
+	if h.vmInterfaceRepo != nil {
+		for _, iface := range interfaces {
+			iface.VMID = newVM.ID
+			if err := h.vmInterfaceRepo.Create(ctx, &iface); err != nil {
+				log.Printf("[VM] Failed to record interface %s of VM %s: %v", iface.MACAddress, newVM.Name, err)
+			}
+		}
+	}
 
 	log.Printf("[VM] VM cloned successfully: %s -> %s (UUID: %s)", sourceVM.Name, req.Name, newVM.ID)
 
@@ -2083,6 +2687,7 @@ func (h *VMHandler) CloneVM(c *gin.Context) {
 			"name":           newVM.Name,
 			"source_vm_id":   sourceVM.ID.String(),
 			"source_vm_name": sourceVM.Name,
+			"flavor_id":      newVM.FlavorID,
 		})
 	}
 
@@ -0,0 +1,616 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AdoptDomainRequest assigns an unmanaged domain to an owner. Admins may
+// adopt it past the quota of the owner.
+type AdoptDomainRequest struct {
+	OwnerID     string `json:"owner_id" binding:"required,uuid"`
+	Description string `json:"description"`
+	IgnoreQuota bool   `json:"ignore_quota"`
+}
+
+// UnmanagedDomain is a libvirt domain on the host that no VM record
+// describes, as adoption would see it.
+type UnmanagedDomain struct {
+	UUID         string   `json:"uuid"`
+	Name         string   `json:"name"`
+	Status       string   `json:"status"`
+	Architecture string   `json:"architecture,omitempty"`
+	CPU          int      `json:"cpu"`
+	Memory       int      `json:"memory"`
+	Disks        []string `json:"disks"`
+	MACAddresses []string `json:"mac_addresses"`
+	// Error tells why the domain cannot be adopted.
+	Error string `json:"error,omitempty"`
+}
+
+// adoptedDomain is the VM record a domain definition maps to, with its
+// NICs and the disks after the system disk.
+type adoptedDomain struct {
+	VM         models.VirtualMachine
+	Interfaces []models.VMInterface
+	DataDisks  []models.StorageVolume
+	// RootTarget is the target of the system disk in the domain.
+	RootTarget string
+	// NVRAM is the UEFI variable store the domain uses now.
+	NVRAM string
+}
+
+// memoryUnits are the factors of the libvirt memory units to bytes.
+var memoryUnits = map[string]uint64{
+	"b": 1, "bytes": 1,
+	"KB": 1000, "k": 1 << 10, "KiB": 1 << 10,
+	"MB": 1000 * 1000, "M": 1 << 20, "MiB": 1 << 20,
+	"GB": 1000 * 1000 * 1000, "G": 1 << 30, "GiB": 1 << 30,
+	"TB": 1000 * 1000 * 1000 * 1000, "T": 1 << 40, "TiB": 1 << 40,
+}
+
+// domainMemoryMB converts a libvirt memory element to MiB. Without a unit
+// libvirt counts in KiB.
+func domainMemoryMB(memory *libvirt.DomainMemory) (int, error) {
+	if memory == nil {
+		return 0, fmt.Errorf("domain has no memory size")
+	}
+	unit := memory.Unit
+	if unit == "" {
+		unit = "KiB"
+	}
+	factor, ok := memoryUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown memory unit %s", unit)
+	}
+	return int(memory.Value * factor / (1 << 20)), nil
+}
+
+// describeDomain maps the definition of an unmanaged domain to a VM record.
+// The record keeps the UUID of the domain as its ID, so redefining the
+// domain later replaces it instead of adding another. Sizes of disks are
+// left to the caller, who can ask libvirt for them.
+func describeDomain(def *libvirt.DomainDef) (adoptedDomain, error) {
+	var adopted adoptedDomain
+	id, err := uuid.Parse(def.UUID)
+	if err != nil {
+		return adopted, fmt.Errorf("domain has no valid UUID: %w", err)
+	}
+	if def.VCPU == nil || def.VCPU.Value <= 0 {
+		return adopted, fmt.Errorf("domain has no vCPU count")
+	}
+	memory, err := domainMemoryMB(def.Memory)
+	if err != nil {
+		return adopted, err
+	}
+
+	vm := models.VirtualMachine{
+		ID:                id,
+		Name:              def.Name,
+		Description:       def.Description,
+		InstallationMode:  "adopted",
+		Status:            "stopped",
+		Architecture:      "x86_64",
+		CPUAllocated:      def.VCPU.Value,
+		MemoryAllocated:   memory,
+		LibvirtDomainUUID: def.UUID,
+		IsInstalled:       true,
+		Firmware:          firmwareBIOS,
+	}
+
+	if def.OS != nil {
+		if def.OS.Type.Arch != "" {
+			vm.Architecture = def.OS.Type.Arch
+		}
+		vm.MachineType = def.OS.Type.Machine
+		if loader := def.OS.Loader; loader != nil && loader.Type == "pflash" {
+			vm.Firmware = firmwareUEFI
+			if loader.Secure == "yes" {
+				vm.Firmware = firmwareUEFISecure
+			}
+			vm.LoaderPath = loader.Path
+			if def.OS.NVRAM != nil {
+				vm.NVRAMTemplate = def.OS.NVRAM.Template
+				adopted.NVRAM = def.OS.NVRAM.Path
+			}
+		}
+		for _, attr := range def.OS.Attrs {
+			if attr.Name.Local == "firmware" && attr.Value == "efi" {
+				vm.Firmware = firmwareUEFI
+			}
+		}
+		var boots []string
+		for _, boot := range def.OS.Boots {
+			if bootDevices[boot.Dev] {
+				boots = append(boots, boot.Dev)
+			}
+		}
+		vm.BootOrder = strings.Join(boots, ",")
+	}
+
+	if devices := def.Devices; devices != nil {
+		for _, disk := range devices.Disks {
+			if disk.Device != "" && disk.Device != "disk" {
+				continue
+			}
+			if disk.Source == nil || disk.Target == nil {
+				continue
+			}
+			// Managed disks are always defined as files, so a block
+			// device would come back as a file of the same name.
+			if disk.Source.Dev != "" {
+				return adopted, fmt.Errorf("disk %s is the block device %s", disk.Target.Dev, disk.Source.Dev)
+			}
+			path := disk.Source.File
+			if path == "" {
+				continue
+			}
+			if disk.Encryption != nil {
+				return adopted, fmt.Errorf("disk %s is encrypted", disk.Target.Dev)
+			}
+			if vm.DiskPath == "" {
+				// The system disk is redefined as qcow2; reading another
+				// format as qcow2 fails to boot.
+				if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+					format := "unknown"
+					if disk.Driver != nil && disk.Driver.Type != "" {
+						format = disk.Driver.Type
+					}
+					return adopted, fmt.Errorf("system disk %s is a %s image, not qcow2", disk.Target.Dev, format)
+				}
+				vm.DiskPath = path
+				adopted.RootTarget = disk.Target.Dev
+				if disk.Target.Bus == diskBusSATA {
+					vm.DiskBus = diskBusSATA
+				} else if disk.Target.Bus != diskBusVirtio {
+					return adopted, fmt.Errorf("system disk is on the %s bus", disk.Target.Bus)
+				}
+				continue
+			}
+			volume := models.StorageVolume{
+				Name:       filepath.Base(path),
+				Path:       path,
+				VolumeType: "file",
+				TargetDev:  disk.Target.Dev,
+				Bus:        disk.Target.Bus,
+				ReadOnly:   disk.ReadOnly != nil,
+			}
+			if disk.Driver != nil {
+				volume.Format = disk.Driver.Type
+				volume.CacheMode = disk.Driver.Cache
+			}
+			adopted.DataDisks = append(adopted.DataDisks, volume)
+		}
+		for _, iface := range devices.Interfaces {
+			if iface.MAC == nil || iface.Source == nil {
+				continue
+			}
+			nic := models.VMInterface{
+				VMID:       id,
+				MACAddress: strings.ToLower(iface.MAC.Address),
+				Model:      "virtio",
+				LinkState:  "up",
+				IsPrimary:  len(adopted.Interfaces) == 0,
+			}
+			switch iface.Type {
+			case "network":
+				nic.SourceType, nic.Source = "network", iface.Source.Network
+			case "bridge":
+				nic.SourceType, nic.Source = "bridge", iface.Source.Bridge
+			default:
+				return adopted, fmt.Errorf("interface %s is of type %s", iface.MAC.Address, iface.Type)
+			}
+			if iface.Model != nil && nicModels[iface.Model.Type] {
+				nic.Model = iface.Model.Type
+			}
+			if iface.Link != nil && iface.Link.State == "down" {
+				nic.LinkState = "down"
+			}
+			adopted.Interfaces = append(adopted.Interfaces, nic)
+		}
+		if len(adopted.Interfaces) > 0 {
+			vm.MACAddress = adopted.Interfaces[0].MACAddress
+		}
+
+		for _, graphics := range devices.Graphics {
+			switch graphics.Type {
+			case "vnc":
+				vm.VNCPort = max(graphics.Port, 0)
+				if len(graphics.Passwd) <= 20 {
+					vm.VNCPassword = graphics.Passwd
+				}
+			case "spice":
+				vm.SPICEPort = max(graphics.Port, 0)
+			}
+		}
+		if len(devices.Videos) > 0 && devices.Videos[0].Model != nil {
+			if _, ok := videoModels[devices.Videos[0].Model.Type]; ok {
+				vm.VideoModel = devices.Videos[0].Model.Type
+			}
+		}
+		vm.TPM = len(devices.TPMs) > 0
+	}
+	if vm.DiskPath == "" {
+		return adopted, fmt.Errorf("domain has no system disk")
+	}
+
+	adopted.VM = vm
+	return adopted, nil
+}
+
+// unmanagedDomains returns the domains of the host that no VM record
+// describes. The caller frees them.
+func (h *VMHandler) unmanagedDomains(ctx context.Context) ([]*libvirt.Domain, error) {
+	domains, err := h.libvirt.ListAllDomains()
+	if err != nil {
+		return nil, err
+	}
+	var unmanaged []*libvirt.Domain
+	for _, domain := range domains {
+		if _, err := h.vmRepo.FindByLibvirtUUID(ctx, domain.UUID); err == nil {
+			domain.Free()
+			continue
+		}
+		if _, err := h.vmRepo.FindByID(ctx, domain.UUID); err == nil {
+			domain.Free()
+			continue
+		}
+		unmanaged = append(unmanaged, domain)
+	}
+	return unmanaged, nil
+}
+
+// diskSizeGB returns the virtual size of the disk of a domain at target in
+// whole GB, rounded up, falling back to the size of the file at path.
+func (h *VMHandler) diskSizeGB(domainUUID, target, path string) int64 {
+	size, err := h.libvirt.GetDiskCapacity(domainUUID, target)
+	if err != nil {
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			log.Printf("[VM] Failed to get size of disk %s: %v", path, err)
+			return 0
+		}
+		size = uint64(info.Size())
+	}
+	return int64((size + (1<<30 - 1)) >> 30)
+}
+
+// storagePoolsByPath maps the target directory of each storage pool to the
+// pool. Without the storage repositories no pool is known.
+func (h *VMHandler) storagePoolsByPath(ctx context.Context) map[string]models.StoragePool {
+	pools := map[string]models.StoragePool{}
+	if h.storagePoolRepo == nil || h.storageVolumeRepo == nil {
+		return pools
+	}
+	if list, _, err := h.storagePoolRepo.List(ctx, 0, 0); err == nil {
+		for _, pool := range list {
+			pools[filepath.Clean(pool.TargetPath)] = pool
+		}
+	}
+	return pools
+}
+
+// unpooledDisks returns the paths of the disks that lie outside of pools.
+// Such disks cannot be recorded as volumes, so a redefine of the domain
+// from its record would drop them.
+func unpooledDisks(disks []models.StorageVolume, pools map[string]models.StoragePool) []string {
+	var paths []string
+	for _, disk := range disks {
+		if _, ok := pools[filepath.Dir(disk.Path)]; !ok {
+			paths = append(paths, disk.Path)
+		}
+	}
+	return paths
+}
+
+// copyNVRAM copies the UEFI variable store of an adopted domain to the path
+// VMManager keeps it at, so boot entries survive the next redefine.
+func copyNVRAM(src, dst string) error {
+	if src == "" || src == dst || !exists(src) || exists(dst) {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// ListUnmanagedDomains lists the domains on the host that were defined
+// outside of VMManager.
+func (h *VMHandler) ListUnmanagedDomains(c *gin.Context) {
+	if h.libvirt == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	domains, err := h.unmanagedDomains(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_list_domains"), err.Error()))
+		return
+	}
+
+	pools := h.storagePoolsByPath(ctx)
+	result := make([]UnmanagedDomain, 0, len(domains))
+	for _, domain := range domains {
+		info := UnmanagedDomain{
+			UUID:         domain.UUID,
+			Name:         domain.Name,
+			Status:       services.LibvirtStateToStatus(domain.State),
+			Disks:        []string{},
+			MACAddresses: []string{},
+		}
+		domain.Free()
+
+		xmlDesc, err := h.libvirt.GetDomainXML(domain.UUID)
+		if err != nil {
+			info.Error = err.Error()
+			result = append(result, info)
+			continue
+		}
+		def, err := libvirt.ParseDomainXML(xmlDesc)
+		if err != nil {
+			info.Error = err.Error()
+			result = append(result, info)
+			continue
+		}
+		adopted, err := describeDomain(def)
+		if err != nil {
+			info.Error = err.Error()
+		} else if outside := unpooledDisks(adopted.DataDisks, pools); len(outside) > 0 {
+			info.Error = fmt.Sprintf("disks outside of storage pools: %s", strings.Join(outside, ", "))
+		}
+		info.Architecture = adopted.VM.Architecture
+		info.CPU = adopted.VM.CPUAllocated
+		info.Memory = adopted.VM.MemoryAllocated
+		if adopted.VM.DiskPath != "" {
+			info.Disks = append(info.Disks, adopted.VM.DiskPath)
+		}
+		for _, disk := range adopted.DataDisks {
+			info.Disks = append(info.Disks, disk.Path)
+		}
+		for _, nic := range adopted.Interfaces {
+			info.MACAddresses = append(info.MACAddresses, nic.MACAddress)
+		}
+		result = append(result, info)
+	}
+
+	c.JSON(http.StatusOK, errors.Success(result))
+}
+
+// AdoptDomain creates the VM record of an unmanaged domain for an owner.
+// The domain keeps running and stays defined as it is until its settings
+// are changed through VMManager, which redefines it from the record. Data
+// disks are recorded as volumes of their storage pool; a domain with disks
+// outside of every known pool is refused, as that redefine would drop them.
+func (h *VMHandler) AdoptDomain(c *gin.Context) {
+	domainUUID := c.Param("uuid")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req AdoptDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	if h.libvirt == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+		return
+	}
+
+	if _, err := h.vmRepo.FindByLibvirtUUID(ctx, domainUUID); err == nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "domain_already_managed"), domainUUID))
+		return
+	}
+	if _, err := h.vmRepo.FindByID(ctx, domainUUID); err == nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "domain_already_managed"), domainUUID))
+		return
+	}
+
+	domain, err := h.libvirt.LookupByUUID(domainUUID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "domain_not_found"), domainUUID))
+		return
+	}
+	state := domain.State
+	domain.Free()
+
+	xmlDesc, err := h.libvirt.GetDomainXML(domainUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_adopt_domain"), err.Error()))
+		return
+	}
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_adopt_domain"), err.Error()))
+		return
+	}
+	adopted, err := describeDomain(def)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "domain_cannot_be_adopted"), err.Error()))
+		return
+	}
+	pools := h.storagePoolsByPath(ctx)
+	if outside := unpooledDisks(adopted.DataDisks, pools); len(outside) > 0 {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "domain_cannot_be_adopted"),
+			fmt.Sprintf("disks outside of storage pools: %s", strings.Join(outside, ", "))))
+		return
+	}
+
+	vm := adopted.VM
+	vm.Status = services.LibvirtStateToStatus(state)
+	if req.Description != "" {
+		vm.Description = req.Description
+	}
+	vm.OwnerID, _ = uuid.Parse(req.OwnerID)
+
+	// Autoport displays only have a port while the domain runs.
+	if vm.Status == "running" {
+		if liveXML, err := h.libvirt.GetLiveDomainXML(domainUUID); err == nil {
+			if live, err := libvirt.ParseDomainXML(liveXML); err == nil && live.Devices != nil {
+				for _, graphics := range live.Devices.Graphics {
+					switch graphics.Type {
+					case "vnc":
+						vm.VNCPort = max(graphics.Port, 0)
+					case "spice":
+						vm.SPICEPort = max(graphics.Port, 0)
+					}
+				}
+			}
+		}
+	}
+
+	vm.DiskAllocated = int(h.diskSizeGB(domainUUID, adopted.RootTarget, vm.DiskPath))
+
+	diskGB := int64(vm.DiskAllocated)
+	var dataDisks []models.StorageVolume
+	for _, disk := range adopted.DataDisks {
+		disk.Capacity = h.diskSizeGB(domainUUID, disk.TargetDev, disk.Path) << 30
+		disk.PoolID = pools[filepath.Dir(disk.Path)].ID
+		disk.VMID = &vm.ID
+		disk.OwnerID = &vm.OwnerID
+		dataDisks = append(dataDisks, disk)
+		diskGB += disk.Capacity >> 30
+	}
+
+	owner, err := h.userRepo.FindByID(ctx, req.OwnerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeUserNotFound, t(c, "user_not_found"), req.OwnerID))
+		return
+	}
+	if !req.IgnoreQuota && !h.checkAdoptQuota(c, owner, vm, diskGB) {
+		return
+	}
+
+	for _, nic := range adopted.Interfaces {
+		if existing, err := h.vmRepo.FindByMAC(ctx, nic.MACAddress); err == nil && existing.ID != vm.ID {
+			c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "mac_address_in_use"), nic.MACAddress))
+			return
+		}
+		if h.vmInterfaceRepo != nil {
+			if used, err := h.vmInterfaceRepo.MACInUse(ctx, nic.MACAddress); err == nil && used {
+				c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "mac_address_in_use"), nic.MACAddress))
+				return
+			}
+		}
+	}
+	if vm.MACAddress == "" {
+		// Without a NIC the record still needs a unique MAC for the one
+		// generateDomainXML falls back to.
+		vm.MACAddress, _ = models.GenerateMACAddress()
+	}
+
+	if vmFirmware(vm) != firmwareBIOS {
+		if err := copyNVRAM(adopted.NVRAM, nvramPath(vm)); err != nil {
+			log.Printf("[VM] Failed to copy NVRAM of adopted domain %s: %v", vm.Name, err)
+		}
+	}
+
+	paramsJSON, _ := json.Marshal(map[string]interface{}{
+		"domain_uuid":  domainUUID,
+		"owner_id":     req.OwnerID,
+		"ignore_quota": req.IgnoreQuota,
+	})
+	params := string(paramsJSON)
+
+	if err := h.vmRepo.Create(ctx, &vm); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_adopt_domain"), err.Error()))
+		return
+	}
+	if h.vmInterfaceRepo != nil {
+		for i := range adopted.Interfaces {
+			nic := &adopted.Interfaces[i]
+			if h.virtualNetworkRepo != nil && nic.SourceType == "network" {
+				if network, err := h.virtualNetworkRepo.FindByName(ctx, nic.Source); err == nil {
+					nic.NetworkID = &network.ID
+				}
+			}
+			if err := h.vmInterfaceRepo.Create(ctx, nic); err != nil {
+				log.Printf("[VM] Failed to record NIC %s of adopted VM %s: %v", nic.MACAddress, vm.Name, err)
+			}
+		}
+	}
+	for i := range dataDisks {
+		if err := h.storageVolumeRepo.Create(ctx, &dataDisks[i]); err != nil {
+			// A record without the disk would drop it on the next
+			// redefine, so the adoption is undone.
+			log.Printf("[VM] Failed to record disk %s of adopted VM %s: %v", dataDisks[i].Path, vm.Name, err)
+			for _, recorded := range dataDisks[:i] {
+				h.storageVolumeRepo.Delete(ctx, recorded.ID.String())
+			}
+			if h.vmInterfaceRepo != nil {
+				h.vmInterfaceRepo.DeleteByVM(ctx, vm.ID.String())
+			}
+			h.vmRepo.Delete(ctx, vm.ID.String())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_adopt_domain"), err.Error()))
+			return
+		}
+	}
+
+	log.Printf("[VM] Domain %s adopted as VM %s for owner %s", domainUUID, vm.Name, req.OwnerID)
+	h.recordVMOperation(vm.ID, "adopt", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.adopt", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":      vm.Name,
+			"owner_id":     req.OwnerID,
+			"ignore_quota": req.IgnoreQuota,
+		})
+	}
+
+	c.JSON(http.StatusCreated, errors.Success(vm))
+}
+
+// checkAdoptQuota fails when vm with diskGB of disks would take owner over
+// their quota.
+func (h *VMHandler) checkAdoptQuota(c *gin.Context, owner *models.User, vm models.VirtualMachine, diskGB int64) bool {
+	usage, err := h.userRepo.GetResourceUsage(c.Request.Context(), owner.ID.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_get_resource_usage"), err.Error()))
+		return false
+	}
+
+	switch {
+	case owner.QuotaVMCount > 0 && usage.VMCount >= owner.QuotaVMCount:
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_vm_count_exceeded"), fmt.Sprintf("used: %d, quota: %d", usage.VMCount, owner.QuotaVMCount)))
+	case owner.QuotaCPU > 0 && usage.CPUUsed+vm.CPUAllocated > owner.QuotaCPU:
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_cpu_exceeded"), fmt.Sprintf("used: %d, requested: %d, quota: %d", usage.CPUUsed, vm.CPUAllocated, owner.QuotaCPU)))
+	case owner.QuotaMemory > 0 && usage.MemoryUsed+vm.MemoryAllocated > owner.QuotaMemory:
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_memory_exceeded"), fmt.Sprintf("used: %d, requested: %d, quota: %d", usage.MemoryUsed, vm.MemoryAllocated, owner.QuotaMemory)))
+	case owner.QuotaDisk > 0 && usage.DiskUsed+diskGB > int64(owner.QuotaDisk):
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_disk_exceeded"), fmt.Sprintf("used: %d, requested: %d, quota: %d", usage.DiskUsed, diskGB, owner.QuotaDisk)))
+	default:
+		return true
+	}
+	return false
+}
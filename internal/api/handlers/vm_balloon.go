@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// minBalloonMemory is the lowest floor the balloon may shrink a guest to, in
+// MB.
+const minBalloonMemory = 256
+
+// BalloonRequest sets the automatic balloon policy of a VM. A zero minimum
+// memory lets the balloon reclaim up to half of the allocated memory.
+type BalloonRequest struct {
+	Auto      bool `json:"auto"`
+	MinMemory int  `json:"min_memory" binding:"min=0"`
+}
+
+// generateMemBalloonConfig adds a virtio balloon that reports guest memory
+// stats. autodeflate lets the guest take ballooned memory back before its
+// OOM killer runs.
+func generateMemBalloonConfig() *libvirt.DomainMemBalloon {
+	return &libvirt.DomainMemBalloon{
+		Model:       "virtio",
+		AutoDeflate: "on",
+		Stats:       &libvirt.MemBalloonStats{Period: libvirt.MemBalloonStatsPeriod},
+	}
+}
+
+func (h *VMHandler) GetVMBalloon(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	result := gin.H{
+		"balloon": vm.Balloon,
+		"max":     vm.MemoryAllocated,
+	}
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" && vm.Status == "running" {
+		if stats, err := h.libvirt.GetMemoryStats(vm.LibvirtDomainUUID); err == nil {
+			result["stats"] = gin.H{
+				"actual":       stats.Actual / 1024,
+				"unused":       stats.Unused / 1024,
+				"available":    stats.Available / 1024,
+				"usable":       stats.Usable / 1024,
+				"rss":          stats.RSS / 1024,
+				"major_faults": stats.MajorFaults,
+				"guest_stats":  stats.HasGuestStats(),
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(result))
+}
+
+// UpdateVMBalloon replaces the automatic balloon policy of a VM. The stats
+// collector applies it on its next run; turning it off gives a running
+// guest all of its memory back at once.
+func (h *VMHandler) UpdateVMBalloon(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req BalloonRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if req.MinMemory != 0 && (req.MinMemory < minBalloonMemory || req.MinMemory > vm.MemoryAllocated) {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "balloon_min_memory_invalid"), "min_memory must be between 256 MB and the allocated memory"))
+		return
+	}
+
+	wasAuto := vm.Balloon.Auto
+	vm.Balloon = models.BalloonPolicy{Auto: req.Auto, MinMemory: req.MinMemory}
+	paramsJSON, _ := json.Marshal(vm.Balloon)
+	params := string(paramsJSON)
+
+	if err := h.vmRepo.Update(ctx, vm); err != nil {
+		h.recordVMOperation(vm.ID, "update_balloon", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_vm_balloon"), err.Error()))
+		return
+	}
+
+	if wasAuto && !req.Auto && h.libvirt != nil && vm.LibvirtDomainUUID != "" && vm.Status == "running" {
+		if err := h.libvirt.SetBalloon(vm.LibvirtDomainUUID, uint64(vm.MemoryAllocated)*1024); err != nil {
+			log.Printf("[VM] Failed to deflate balloon of VM %s: %v", vm.Name, err)
+		}
+	}
+
+	log.Printf("[VM] Balloon policy of VM %s updated", vm.Name)
+	h.recordVMOperation(vm.ID, "update_balloon", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.update_balloon", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"balloon": vm.Balloon,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(vm.Balloon))
+}
@@ -0,0 +1,721 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	firmwareUEFI       = "uefi"
+	firmwareUEFISecure = "uefi-secure"
+	firmwareBIOS       = "bios"
+)
+
+var videoModels = map[string]libvirt.VideoModel{
+	"qxl":    {Type: "qxl", RAM: 65536, VRAM: 65536},
+	"virtio": {Type: "virtio"},
+	"vga":    {Type: "vga"},
+	"bochs":  {Type: "bochs"},
+}
+
+var bootDevices = map[string]bool{
+	"hd":      true,
+	"cdrom":   true,
+	"network": true,
+}
+
+// VMPendingChange is a configuration value that has been written to the
+// persistent definition of a running VM and applies on its next power cycle.
+type VMPendingChange struct {
+	Current interface{} `json:"current"`
+	Pending interface{} `json:"pending"`
+}
+
+type ReconfigureVMRequest struct {
+	FlavorID        *string   `json:"flavor_id"`
+	CPUAllocated    *int      `json:"cpu_allocated" binding:"omitempty,min=1"`
+	MemoryAllocated *int      `json:"memory_allocated" binding:"omitempty,min=512"`
+	BootOrder       *string   `json:"boot_order"`
+	Firmware        *string   `json:"firmware"`
+	MachineType     *string   `json:"machine_type"`
+	VideoModel      *string   `json:"video_model"`
+	TPM             *bool     `json:"tpm"`
+	OSProfile       *string   `json:"os_profile" binding:"omitempty,oneof=linux windows"`
+	DiskBus         *string   `json:"disk_bus" binding:"omitempty,oneof=virtio sata"`
+	Tuning          *VMTuning `json:"tuning"`
+}
+
+func isARM(vm models.VirtualMachine) bool {
+	return vm.Architecture == "arm64" || vm.Architecture == "aarch64"
+}
+
+func machineType(vm models.VirtualMachine) string {
+	if vm.MachineType != "" {
+		return vm.MachineType
+	}
+	if isARM(vm) {
+		return "virt"
+	}
+	return "q35"
+}
+
+// vmFirmware returns the firmware of vm. ARM guests only boot UEFI.
+func vmFirmware(vm models.VirtualMachine) string {
+	if vm.Firmware == "" || (isARM(vm) && vm.Firmware == firmwareBIOS) {
+		return firmwareUEFI
+	}
+	return vm.Firmware
+}
+
+// nvramPath is where libvirt keeps the UEFI variable store of vm.
+func nvramPath(vm models.VirtualMachine) string {
+	return fmt.Sprintf("/var/lib/libvirt/qemu/nvram/%s_VARS.fd", vm.ID.String())
+}
+
+// generateFirmwareConfig returns the UEFI loader and NVRAM store of vm, or
+// nothing for SeaBIOS. libvirt creates the store from the template on the
+// first start. VMs created before the loader was picked from the host
+// capabilities fall back to the paths of the edk2 packages.
+func generateFirmwareConfig(vm models.VirtualMachine) (*libvirt.OSLoader, *libvirt.OSNVRAM) {
+	firmware := vmFirmware(vm)
+	if firmware == firmwareBIOS {
+		return nil, nil
+	}
+	loaderPath, nvramTemplate := vm.LoaderPath, vm.NVRAMTemplate
+	if loaderPath == "" {
+		fw := "OVMF"
+		if isARM(vm) {
+			fw = "AAVMF"
+		}
+		loaderPath = fmt.Sprintf("/usr/share/%[1]s/%[1]s_CODE.fd", fw)
+		nvramTemplate = fmt.Sprintf("/usr/share/%[1]s/%[1]s_VARS.fd", fw)
+		if firmware == firmwareUEFISecure && !isARM(vm) {
+			loaderPath = "/usr/share/OVMF/OVMF_CODE.secboot.fd"
+			nvramTemplate = "/usr/share/OVMF/OVMF_VARS.ms.fd"
+		}
+	}
+	loader := &libvirt.OSLoader{
+		Readonly: "yes",
+		Type:     "pflash",
+		Path:     loaderPath,
+	}
+	if firmware == firmwareUEFISecure {
+		loader.Secure = "yes"
+	}
+	nvram := &libvirt.OSNVRAM{
+		Template: nvramTemplate,
+		Path:     nvramPath(vm),
+	}
+	return loader, nvram
+}
+
+// tpmModel returns the TPM device model for the architecture of vm; the
+// ARM virt machine has no LPC bus for a CRB or TIS interface.
+func tpmModel(vm models.VirtualMachine) string {
+	if isARM(vm) {
+		return "tpm-tis"
+	}
+	return "tpm-crb"
+}
+
+// generateTPMConfig returns the emulated TPM 2.0 of vm, if it has one.
+func generateTPMConfig(vm models.VirtualMachine) []libvirt.DomainTPM {
+	if !vm.TPM {
+		return nil
+	}
+	return []libvirt.DomainTPM{{
+		Model:   tpmModel(vm),
+		Backend: &libvirt.TPMBackend{Type: "emulator", Version: "2.0"},
+	}}
+}
+
+// domainType returns the libvirt domain type of vm. VMs created before it
+// was picked from the host capabilities run under plain emulation.
+func domainType(vm models.VirtualMachine) string {
+	if vm.DomainType != "" {
+		return vm.DomainType
+	}
+	return "qemu"
+}
+
+// generateCPUConfig returns the CPU of vm. Without a stored mode x86 guests
+// get the host model and ARM guests an emulated Cortex-A72.
+func generateCPUConfig(vm models.VirtualMachine) *libvirt.DomainCPU {
+	switch {
+	case vm.CPUMode == "custom":
+		return &libvirt.DomainCPU{Mode: "custom", Match: "exact", Model: &libvirt.CPUModel{Value: vm.CPUModel}}
+	case vm.CPUMode != "":
+		return &libvirt.DomainCPU{Mode: vm.CPUMode}
+	case isARM(vm):
+		return &libvirt.DomainCPU{Mode: "custom", Match: "exact", Model: &libvirt.CPUModel{Value: "cortex-a72"}}
+	default:
+		return &libvirt.DomainCPU{Mode: "host-model", Model: &libvirt.CPUModel{Fallback: "allow"}}
+	}
+}
+
+// validateCPUConfig checks that a CPU model is only given with the custom
+// CPU mode, which needs one.
+func validateCPUConfig(vm models.VirtualMachine) error {
+	switch vm.CPUMode {
+	case "":
+		if vm.CPUModel != "" {
+			return fmt.Errorf("CPU model %s needs the custom CPU mode", vm.CPUModel)
+		}
+	case "custom":
+		if vm.CPUModel == "" {
+			return fmt.Errorf("the custom CPU mode needs a CPU model")
+		}
+	case "host-model", "host-passthrough", "maximum":
+		if vm.CPUModel != "" {
+			return fmt.Errorf("CPU model %s can only be used with the custom CPU mode", vm.CPUModel)
+		}
+	default:
+		return fmt.Errorf("unknown CPU mode %s", vm.CPUMode)
+	}
+	return nil
+}
+
+// pickCPUMode fills in the CPU mode of vm when none was requested. Guests
+// under KVM take over the host CPU, ARM guests under emulation get a
+// Cortex-A72 and x86 guests the host model.
+func pickCPUMode(vm *models.VirtualMachine, guest *libvirt.GuestCapabilities) {
+	if vm.CPUMode != "" {
+		return
+	}
+	switch {
+	case vm.DomainType == "kvm" && slices.Contains(guest.CPUModes, "host-passthrough"):
+		vm.CPUMode = "host-passthrough"
+	case isARM(*vm):
+		vm.CPUMode, vm.CPUModel = "custom", "cortex-a72"
+	default:
+		vm.CPUMode = "host-model"
+	}
+}
+
+func generateVideoModel(model string) libvirt.DomainVideo {
+	video, ok := videoModels[model]
+	if !ok {
+		video = videoModels["qxl"]
+	}
+	return libvirt.DomainVideo{Model: &video}
+}
+
+// hardwareConfig lists the effective values of the settings that need a
+// power cycle to change.
+func hardwareConfig(vm models.VirtualMachine) map[string]interface{} {
+	video := vm.VideoModel
+	if video == "" {
+		video = "qxl"
+	}
+	bootOrder := vm.BootOrder
+	if bootOrder == "" {
+		bootOrder = "hd,cdrom,network"
+	}
+	return map[string]interface{}{
+		"cpu_allocated":    vm.CPUAllocated,
+		"memory_allocated": vm.MemoryAllocated,
+		"boot_order":       bootOrder,
+		"firmware":         vmFirmware(vm),
+		"machine_type":     machineType(vm),
+		"video_model":      video,
+		"tpm":              vm.TPM,
+		"on_poweroff":      lifecycleAction(vm.Lifecycle.OnPoweroff, "destroy"),
+		"on_reboot":        lifecycleAction(vm.Lifecycle.OnReboot, "restart"),
+		"on_crash":         lifecycleAction(vm.Lifecycle.OnCrash, "restart"),
+		"watchdog_action":  vm.Lifecycle.WatchdogAction,
+		"os_profile":       vm.OSProfile,
+		"disk_bus":         rootDiskBus(vm),
+		"tuning":           vmTuning(vm),
+		"direct_boot":      directBootConfig(vm),
+	}
+}
+
+func pendingChanges(vm models.VirtualMachine) map[string]VMPendingChange {
+	pending := map[string]VMPendingChange{}
+	if vm.PendingChanges != "" {
+		if err := json.Unmarshal([]byte(vm.PendingChanges), &pending); err != nil {
+			log.Printf("[VM] Ignoring unreadable pending changes of VM %s: %v", vm.Name, err)
+		}
+	}
+	return pending
+}
+
+// mergePendingChanges adds the difference between before and after to the
+// changes already waiting for a power cycle. A value changed back to what the
+// guest runs with is no longer pending.
+func mergePendingChanges(pending map[string]VMPendingChange, before, after map[string]interface{}) {
+	for key, value := range after {
+		if sameConfigValue(before[key], value) {
+			continue
+		}
+		current := before[key]
+		if change, ok := pending[key]; ok {
+			current = change.Current
+		}
+		if sameConfigValue(current, value) {
+			delete(pending, key)
+			continue
+		}
+		pending[key] = VMPendingChange{Current: current, Pending: value}
+	}
+}
+
+// sameConfigValue compares configuration values by their JSON form, since
+// pending values read back from the database are decoded into plain maps.
+func sameConfigValue(a, b interface{}) bool {
+	normalize := func(v interface{}) string {
+		encoded, _ := json.Marshal(v)
+		var decoded interface{}
+		json.Unmarshal(encoded, &decoded)
+		encoded, _ = json.Marshal(decoded)
+		return string(encoded)
+	}
+	return normalize(a) == normalize(b)
+}
+
+func validateReconfigureRequest(vm models.VirtualMachine, req ReconfigureVMRequest) error {
+	if req.FlavorID != nil && (req.CPUAllocated != nil || req.MemoryAllocated != nil) {
+		return fmt.Errorf("flavor_id cannot be combined with cpu_allocated or memory_allocated")
+	}
+	if req.BootOrder != nil {
+		parts := strings.Split(*req.BootOrder, ",")
+		seen := map[string]bool{}
+		for _, part := range parts {
+			part = strings.TrimSpace(part)
+			if !bootDevices[part] || seen[part] {
+				return fmt.Errorf("boot_order must list hd, cdrom and network at most once each")
+			}
+			seen[part] = true
+		}
+	}
+	if req.Firmware != nil {
+		switch *req.Firmware {
+		case firmwareUEFI, firmwareUEFISecure:
+		case firmwareBIOS:
+			if isARM(vm) {
+				return fmt.Errorf("%s VMs require UEFI firmware", vm.Architecture)
+			}
+		default:
+			return fmt.Errorf("firmware must be uefi, uefi-secure or bios")
+		}
+	}
+	if req.MachineType != nil {
+		mt := *req.MachineType
+		valid := mt == "virt" || strings.HasPrefix(mt, "virt-")
+		if !isARM(vm) {
+			valid = mt == "q35" || mt == "pc" || strings.HasPrefix(mt, "pc-q35-") || strings.HasPrefix(mt, "pc-i440fx-")
+		}
+		if !valid {
+			return fmt.Errorf("machine type %q is not supported on %s", mt, vm.Architecture)
+		}
+	}
+	firmware, mt := vmFirmware(vm), machineType(vm)
+	if req.Firmware != nil {
+		firmware = *req.Firmware
+	}
+	if req.MachineType != nil {
+		mt = *req.MachineType
+	}
+	// Secure boot on x86 needs SMM, which only q35 provides.
+	if firmware == firmwareUEFISecure && !isARM(vm) && mt != "q35" && !strings.HasPrefix(mt, "pc-q35-") {
+		return fmt.Errorf("secure boot requires the q35 machine type")
+	}
+	if req.VideoModel != nil {
+		if _, ok := videoModels[*req.VideoModel]; !ok {
+			return fmt.Errorf("video_model must be one of qxl, virtio, vga or bochs")
+		}
+	}
+	return nil
+}
+
+// applyHostCapabilities checks the architecture, machine type, CPU, video
+// model and TPM of vm against what the host supports and picks its UEFI
+// loader.
+// It also records the domain type and CPU mode the guest runs with. Without a
+// libvirt connection only the static validation applies.
+func (h *VMHandler) applyHostCapabilities(vm *models.VirtualMachine) error {
+	if err := validateCPUConfig(*vm); err != nil {
+		return err
+	}
+	if h.libvirt == nil {
+		return nil
+	}
+	caps, err := h.libvirt.GetHostCapabilities(false)
+	if err != nil {
+		return fmt.Errorf("failed to read host capabilities: %w", err)
+	}
+
+	arch := vm.Architecture
+	if arch == "" {
+		arch = "x86_64"
+	}
+	guest := caps.Guest(arch)
+	if guest == nil {
+		return fmt.Errorf("architecture %s is not supported by this host", arch)
+	}
+	if mt := machineType(*vm); !guest.SupportsMachine(mt) {
+		return fmt.Errorf("machine type %q is not supported by the %s emulator", mt, arch)
+	}
+	video := vm.VideoModel
+	if video == "" {
+		video = "qxl"
+	}
+	if len(guest.VideoModels) > 0 && !slices.Contains(guest.VideoModels, video) {
+		return fmt.Errorf("video model %s is not supported on this host", video)
+	}
+	// A running guest already holds its hugepages, so only a VM that still
+	// has to claim them is checked against the free pool.
+	tuning := vmTuning(*vm)
+	var pool *libvirt.HugePagePool
+	if tuning != nil && tuning.HugePages && vm.Status != "running" && vm.Status != "paused" {
+		if pool, err = h.libvirt.GetHugePagePool(hugePageSize(tuning)); err != nil {
+			return fmt.Errorf("failed to read the hugepage pool: %w", err)
+		}
+	}
+	if err := validateHostTuning(tuning, caps, pool, vm.MemoryAllocated); err != nil {
+		return err
+	}
+
+	vm.DomainType = guest.DomainType
+	pickCPUMode(vm, guest)
+	if len(guest.CPUModes) > 0 && !slices.Contains(guest.CPUModes, vm.CPUMode) {
+		return fmt.Errorf("CPU mode %s is not supported by the %s emulator", vm.CPUMode, arch)
+	}
+	if vm.CPUMode == "custom" && len(guest.CPUModels) > 0 && !slices.Contains(guest.CPUModels, vm.CPUModel) {
+		return fmt.Errorf("CPU model %s is not usable on this host", vm.CPUModel)
+	}
+
+	if vm.TPM {
+		if len(guest.TPMModels) > 0 && !slices.Contains(guest.TPMModels, tpmModel(*vm)) {
+			return fmt.Errorf("TPM model %s is not supported on this host", tpmModel(*vm))
+		}
+		if len(guest.TPMBackends) > 0 && !slices.Contains(guest.TPMBackends, "emulator") {
+			return fmt.Errorf("the emulated TPM backend (swtpm) is not available on this host")
+		}
+	}
+
+	vm.LoaderPath, vm.NVRAMTemplate = "", ""
+	if firmware := vmFirmware(*vm); firmware != firmwareBIOS {
+		secureBoot := firmware == firmwareUEFISecure
+		fw := guest.PickFirmware(secureBoot)
+		if fw == nil && secureBoot {
+			return fmt.Errorf("no secure boot UEFI firmware is installed for %s", arch)
+		}
+		if fw == nil {
+			return fmt.Errorf("no UEFI firmware is installed for %s", arch)
+		}
+		vm.LoaderPath, vm.NVRAMTemplate = fw.Path, fw.NVRAMTemplate
+	}
+	return nil
+}
+
+// checkComputeQuota fails when growing a VM of ownerID by the given CPU and
+// memory would exceed the owner's quota.
+func (h *VMHandler) checkComputeQuota(c *gin.Context, ownerID uuid.UUID, cpuDelta, memoryDelta int) bool {
+	if cpuDelta <= 0 && memoryDelta <= 0 {
+		return true
+	}
+	ctx := c.Request.Context()
+
+	owner, err := h.userRepo.FindByID(ctx, ownerID.String())
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeUserNotFound, t(c, "user_not_found"), ownerID.String()))
+		return false
+	}
+	usage, err := h.userRepo.GetResourceUsage(ctx, ownerID.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_get_resource_usage"), err.Error()))
+		return false
+	}
+	if cpuDelta > 0 && owner.QuotaCPU > 0 && usage.CPUUsed+cpuDelta > owner.QuotaCPU {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_cpu_exceeded"), fmt.Sprintf("used: %d, requested: %d, quota: %d", usage.CPUUsed, cpuDelta, owner.QuotaCPU)))
+		return false
+	}
+	if memoryDelta > 0 && owner.QuotaMemory > 0 && usage.MemoryUsed+memoryDelta > owner.QuotaMemory {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_memory_exceeded"), fmt.Sprintf("used: %d, requested: %d, quota: %d", usage.MemoryUsed, memoryDelta, owner.QuotaMemory)))
+		return false
+	}
+	return true
+}
+
+// redefineDomain rewrites the persistent definition of vm from its current
+// settings, keeping a mounted ISO. It reports whether the domain is active,
+// in which case the new definition applies on the next power cycle.
+func (h *VMHandler) redefineDomain(c *gin.Context, vm *models.VirtualMachine) (bool, error) {
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		return false, nil
+	}
+	domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID)
+	if err != nil {
+		// Not defined yet; StartVM defines it from the stored settings.
+		return false, nil
+	}
+	state, _, _ := domain.GetState()
+	domain.Free()
+
+	isoPath, err := h.libvirt.GetMountedISO(vm.LibvirtDomainUUID)
+	if err != nil {
+		log.Printf("[VM] Failed to read mounted ISO of VM %s: %v", vm.Name, err)
+	}
+
+	diskPath := vm.DiskPath
+	if diskPath == "" {
+		diskPath = fmt.Sprintf("%s/%s.qcow2", h.storagePath, vm.ID.String())
+	}
+
+	ctx := c.Request.Context()
+	h.loadDataDisks(ctx, vm)
+	h.loadInterfaces(ctx, vm)
+	h.loadFilesystems(ctx, vm)
+	defined, err := h.libvirt.DefineXML(generateDomainXML(*vm, diskPath, isoPath))
+	if err != nil {
+		return false, err
+	}
+	defined.Free()
+
+	return state != 5 && state != 6, nil
+}
+
+func (h *VMHandler) GetVMConfig(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	pending := pendingChanges(*vm)
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"config":           hardwareConfig(*vm),
+		"pending":          pending,
+		"restart_required": len(pending) > 0,
+	}))
+}
+
+func (h *VMHandler) ReconfigureVM(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req ReconfigureVMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if req.Tuning != nil && !h.canTune(role) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_vm_tuning"), fmt.Sprint(role)))
+		return
+	}
+
+	if !vm.IsInstalled && vm.InstallStatus == "installing" {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeVMConflict, t(c, "vm_install_in_progress"), vm.InstallStatus))
+		return
+	}
+
+	if err := validateReconfigureRequest(*vm, req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+		return
+	}
+
+	customSize := req.CPUAllocated != nil || req.MemoryAllocated != nil
+	if customSize && !h.customSizesAllowed(role) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "custom_vm_size_not_allowed"), "flavor_id is required"))
+		return
+	}
+	var flavor *models.Flavor
+	if req.FlavorID != nil {
+		var ok bool
+		if flavor, ok = h.lookupFlavor(c, *req.FlavorID, userUUID, role); !ok {
+			return
+		}
+		if flavor.Disk < vm.DiskAllocated {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_disk_size"), fmt.Sprintf("flavor %s has a %d GB disk, the VM has %d GB", flavor.Name, flavor.Disk, vm.DiskAllocated)))
+			return
+		}
+	}
+
+	before := hardwareConfig(*vm)
+	updated := *vm
+	if req.CPUAllocated != nil {
+		updated.CPUAllocated = *req.CPUAllocated
+	}
+	if req.MemoryAllocated != nil {
+		updated.MemoryAllocated = *req.MemoryAllocated
+	}
+	if req.BootOrder != nil {
+		updated.BootOrder = strings.ReplaceAll(*req.BootOrder, " ", "")
+	}
+	if req.Firmware != nil {
+		updated.Firmware = *req.Firmware
+	}
+	if req.MachineType != nil {
+		updated.MachineType = *req.MachineType
+	}
+	if req.VideoModel != nil {
+		updated.VideoModel = *req.VideoModel
+	}
+	if req.TPM != nil {
+		updated.TPM = *req.TPM
+	}
+	if req.DiskBus != nil {
+		updated.DiskBus = *req.DiskBus
+	}
+	if req.OSProfile != nil {
+		h.applyOSProfile(&updated, *req.OSProfile)
+	}
+	if req.Tuning != nil {
+		setVMTuning(&updated, req.Tuning)
+	}
+	if customSize {
+		h.leaveFlavor(ctx, &updated)
+	}
+	if flavor != nil {
+		if err := h.applyFlavor(ctx, &updated, flavor); err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+			return
+		}
+		defer h.releaseHostCPUs(updated.ID)
+		owner, err := h.userRepo.FindByID(ctx, vm.OwnerID.String())
+		if err != nil {
+			c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeUserNotFound, t(c, "user_not_found"), vm.OwnerID.String()))
+			return
+		}
+		if updated.QoS, err = capQoS(updated.QoS, owner.QoSMax); err != nil {
+			c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "qos_limit_exceeded"), err.Error()))
+			return
+		}
+	}
+	after := hardwareConfig(updated)
+
+	// Live disk operations address the system disk by its target, which
+	// must not change under a running guest.
+	live := vm.Status == "running" || vm.Status == "paused"
+	if live && rootDiskTarget(updated) != rootDiskTarget(*vm) {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeVMConflict, t(c, "vm_not_stopped"), "the disk bus can only change while the VM is stopped"))
+		return
+	}
+	if req.DiskBus != nil || req.OSProfile != nil {
+		h.loadDataDisks(ctx, &updated)
+		if err := checkReservedTargets(updated); err != nil {
+			c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "invalid_vm_config"), err.Error()))
+			return
+		}
+	}
+
+	if err := validateTuning(updated, vmTuning(updated)); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_tuning"), err.Error()))
+		return
+	}
+	if err := h.applyHostCapabilities(&updated); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+		return
+	}
+
+	// Quota usage already counts the stored allocation of this VM.
+	if !h.checkComputeQuota(c, vm.OwnerID, updated.CPUAllocated-vm.CPUAllocated, updated.MemoryAllocated-vm.MemoryAllocated) {
+		return
+	}
+	growGB := 0
+	if flavor != nil {
+		growGB = flavor.Disk - vm.DiskAllocated
+	}
+	if growGB > 0 && (!h.checkDiskQuota(c, vm.OwnerID, int64(growGB)) || !checkHostCapacity(c, h.storagePath, int64(growGB)*bytesPerGB)) {
+		return
+	}
+
+	paramsJSON, _ := json.Marshal(req)
+	params := string(paramsJSON)
+
+	active, err := h.redefineDomain(c, &updated)
+	if err == nil && growGB > 0 {
+		if err = h.resizeRootDisk(c, &updated, int64(flavor.Disk), active); err == nil {
+			updated.DiskAllocated = flavor.Disk
+		}
+	}
+	if err == nil && active && updated.QoS != vm.QoS {
+		err = h.applyLiveQoS(updated)
+	}
+	// A store made from the other template would boot with the wrong
+	// secure boot keys. Running VMs get theirs reset by StartVM, which
+	// sees the pending firmware change.
+	if err == nil && !active && vmFirmware(updated) != vmFirmware(*vm) {
+		err = resetNVRAM(updated)
+	}
+	if err != nil {
+		log.Printf("[VM] Failed to redefine VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "reconfigure", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_update_vm"), err.Error()))
+		return
+	}
+
+	pending := map[string]VMPendingChange{}
+	if active {
+		pending = pendingChanges(*vm)
+		mergePendingChanges(pending, before, after)
+	}
+	updated.PendingChanges = ""
+	if len(pending) > 0 {
+		encoded, _ := json.Marshal(pending)
+		updated.PendingChanges = string(encoded)
+	}
+
+	if err := h.vmRepo.Update(ctx, &updated); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_vm"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] VM %s reconfigured (pending changes: %d)", vm.Name, len(pending))
+	h.recordVMOperation(vm.ID, "reconfigure", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.reconfigure", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"config":  after,
+			"pending": len(pending) > 0,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"config":           after,
+		"pending":          pending,
+		"restart_required": len(pending) > 0,
+	}))
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"vmmanager/internal/libvirt"
+)
+
+func TestValidateReconfigureRequest(t *testing.T) {
+	str := func(s string) *string { return &s }
+	cpus := 4
+
+	tests := []struct {
+		name    string
+		arch    string
+		req     ReconfigureVMRequest
+		wantErr bool
+	}{
+		{name: "empty request", arch: "x86_64"},
+		{name: "cpu and boot order", arch: "x86_64", req: ReconfigureVMRequest{CPUAllocated: &cpus, BootOrder: str("hd,network")}},
+		{name: "flavor with cpu", arch: "x86_64", req: ReconfigureVMRequest{FlavorID: str("f"), CPUAllocated: &cpus}, wantErr: true},
+		{name: "unknown boot device", arch: "x86_64", req: ReconfigureVMRequest{BootOrder: str("hd,usb")}, wantErr: true},
+		{name: "repeated boot device", arch: "x86_64", req: ReconfigureVMRequest{BootOrder: str("hd,hd")}, wantErr: true},
+		{name: "bios on x86", arch: "x86_64", req: ReconfigureVMRequest{Firmware: str(firmwareBIOS)}},
+		{name: "bios on arm", arch: "aarch64", req: ReconfigureVMRequest{Firmware: str(firmwareBIOS)}, wantErr: true},
+		{name: "unknown firmware", arch: "x86_64", req: ReconfigureVMRequest{Firmware: str("coreboot")}, wantErr: true},
+		{name: "versioned q35", arch: "x86_64", req: ReconfigureVMRequest{MachineType: str("pc-q35-8.2")}},
+		{name: "virt on x86", arch: "x86_64", req: ReconfigureVMRequest{MachineType: str("virt")}, wantErr: true},
+		{name: "q35 on arm", arch: "aarch64", req: ReconfigureVMRequest{MachineType: str("q35")}, wantErr: true},
+		{name: "versioned virt on arm", arch: "aarch64", req: ReconfigureVMRequest{MachineType: str("virt-9.0")}},
+		{name: "virtio video", arch: "x86_64", req: ReconfigureVMRequest{VideoModel: str("virtio")}},
+		{name: "unknown video", arch: "x86_64", req: ReconfigureVMRequest{VideoModel: str("cirrus")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReconfigureRequest(goldenVM(tt.arch), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateReconfigureRequest error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMergePendingChanges(t *testing.T) {
+	vm := goldenVM("x86_64")
+	before := hardwareConfig(vm)
+
+	// A first change is pending against what the guest runs with.
+	vm.CPUAllocated = 4
+	pending := map[string]VMPendingChange{}
+	mergePendingChanges(pending, before, hardwareConfig(vm))
+	if len(pending) != 1 || pending["cpu_allocated"].Current != 2 || pending["cpu_allocated"].Pending != 4 {
+		t.Fatalf("unexpected pending changes after the first change: %+v", pending)
+	}
+
+	// A second change keeps the value the guest runs with as current.
+	before = hardwareConfig(vm)
+	vm.CPUAllocated = 8
+	vm.VideoModel = "virtio"
+	mergePendingChanges(pending, before, hardwareConfig(vm))
+	if len(pending) != 2 || pending["cpu_allocated"].Current != 2 || pending["cpu_allocated"].Pending != 8 {
+		t.Fatalf("unexpected pending changes after the second change: %+v", pending)
+	}
+	if pending["video_model"].Current != "qxl" || pending["video_model"].Pending != "virtio" {
+		t.Errorf("unexpected pending video model: %+v", pending["video_model"])
+	}
+
+	// Changing a value back is no longer pending, even when the current
+	// value was read back from JSON as a float.
+	pending["cpu_allocated"] = VMPendingChange{Current: float64(2), Pending: float64(8)}
+	before = hardwareConfig(vm)
+	vm.CPUAllocated = 2
+	mergePendingChanges(pending, before, hardwareConfig(vm))
+	if _, ok := pending["cpu_allocated"]; ok {
+		t.Errorf("cpu change reverted to the running value is still pending: %+v", pending)
+	}
+	if _, ok := pending["video_model"]; !ok {
+		t.Errorf("unrelated pending change was dropped: %+v", pending)
+	}
+
+	// Settings that did not change leave the pending changes alone.
+	before = hardwareConfig(vm)
+	mergePendingChanges(pending, before, hardwareConfig(vm))
+	if len(pending) != 1 {
+		t.Errorf("unchanged config altered pending changes: %+v", pending)
+	}
+}
+
+func TestValidateCPUConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		model   string
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "host model", mode: "host-model"},
+		{name: "host passthrough", mode: "host-passthrough"},
+		{name: "custom model", mode: "custom", model: "Skylake-Server"},
+		{name: "custom without model", mode: "custom", wantErr: true},
+		{name: "model without mode", model: "Skylake-Server", wantErr: true},
+		{name: "model with host mode", mode: "host-passthrough", model: "Skylake-Server", wantErr: true},
+		{name: "unknown mode", mode: "host", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := goldenVM("x86_64")
+			vm.CPUMode, vm.CPUModel = tt.mode, tt.model
+			err := validateCPUConfig(vm)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateCPUConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPickCPUMode(t *testing.T) {
+	guest := &libvirt.GuestCapabilities{CPUModes: []string{"host-passthrough", "host-model", "custom"}}
+
+	tests := []struct {
+		name       string
+		arch       string
+		domainType string
+		mode       string
+		wantMode   string
+		wantModel  string
+	}{
+		{name: "x86 under kvm", arch: "x86_64", domainType: "kvm", wantMode: "host-passthrough"},
+		{name: "x86 under emulation", arch: "x86_64", domainType: "qemu", wantMode: "host-model"},
+		{name: "arm under kvm", arch: "aarch64", domainType: "kvm", wantMode: "host-passthrough"},
+		{name: "arm under emulation", arch: "aarch64", domainType: "qemu", wantMode: "custom", wantModel: "cortex-a72"},
+		{name: "requested mode", arch: "x86_64", domainType: "kvm", mode: "host-model", wantMode: "host-model"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := goldenVM(tt.arch)
+			vm.DomainType, vm.CPUMode = tt.domainType, tt.mode
+			pickCPUMode(&vm, guest)
+			if vm.CPUMode != tt.wantMode || vm.CPUModel != tt.wantModel {
+				t.Errorf("pickCPUMode = %s/%s, want %s/%s", vm.CPUMode, vm.CPUModel, tt.wantMode, tt.wantModel)
+			}
+		})
+	}
+}
+
+func TestNVRAMResetPending(t *testing.T) {
+	vm := goldenVM("x86_64")
+	if nvramResetPending(vm) {
+		t.Errorf("NVRAM reset pending without pending changes")
+	}
+
+	before := hardwareConfig(vm)
+	vm.Firmware = firmwareUEFISecure
+	pending := map[string]VMPendingChange{}
+	mergePendingChanges(pending, before, hardwareConfig(vm))
+	encoded, _ := json.Marshal(pending)
+	vm.PendingChanges = string(encoded)
+	if !nvramResetPending(vm) {
+		t.Errorf("NVRAM reset not pending after a firmware change: %+v", pending)
+	}
+
+	vm.PendingChanges = `{"cpu_allocated":{"current":2,"pending":4}}`
+	if nvramResetPending(vm) {
+		t.Errorf("NVRAM reset pending after an unrelated change")
+	}
+}
@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	bootSourceLibrary = "library"
+	bootSourceUpload  = "upload"
+
+	// maxBootArtifactSize bounds an uploaded kernel, initrd or device tree,
+	// and maxBootFormOverhead the rest of the upload form.
+	maxBootArtifactSize = 1 << 30
+	maxBootFormOverhead = 1 << 20
+	// maxLibraryListing bounds the files listed from the kernel library.
+	maxLibraryListing = 1000
+)
+
+// BootArtifactRef names a kernel, initrd or device tree in the kernel
+// library of the host or among the files uploaded for the VM, by its path
+// relative to either.
+type BootArtifactRef struct {
+	Source string `json:"source" binding:"required,oneof=library upload"`
+	Path   string `json:"path" binding:"required"`
+}
+
+// BootModeRequest switches a VM between booting from its disk and booting
+// a kernel directly. Without a kernel, direct mode boots the files set
+// before; a nil command line keeps the current one.
+type BootModeRequest struct {
+	Mode    string           `json:"mode" binding:"required,oneof=direct disk"`
+	Kernel  *BootArtifactRef `json:"kernel"`
+	Initrd  *BootArtifactRef `json:"initrd"`
+	DTB     *BootArtifactRef `json:"dtb"`
+	Cmdline *string          `json:"cmdline" binding:"omitempty,max=4096"`
+}
+
+func (h *VMHandler) SetKernelLibrary(path string) {
+	h.kernelLibraryPath = path
+}
+
+// bootArtifactDir holds the files uploaded for direct boot of a VM.
+func bootArtifactDir(storagePath, vmID string) string {
+	return filepath.Join(storagePath, "boot", vmID)
+}
+
+// removeBootArtifacts deletes the files uploaded for direct boot of a VM.
+func removeBootArtifacts(storagePath, vmID string) {
+	if err := os.RemoveAll(bootArtifactDir(storagePath, vmID)); err != nil {
+		log.Printf("[VM] Failed to delete boot files of VM %s: %v", vmID, err)
+	}
+}
+
+// directBootConfig is the direct boot setup of vm as the hardware
+// configuration shows it, nil while the VM boots from disk.
+func directBootConfig(vm models.VirtualMachine) *models.DirectBoot {
+	if !vm.DirectBoot.Enabled {
+		return nil
+	}
+	boot := vm.DirectBoot
+	return &boot
+}
+
+// checkDirectBoot reports the boot files of a VM in direct boot mode that
+// are gone, so the start fails instead of the guest quietly booting from
+// its disk or stopping in the firmware.
+func checkDirectBoot(vm models.VirtualMachine) error {
+	if !vm.DirectBoot.Enabled {
+		return nil
+	}
+	if vm.DirectBoot.Kernel == "" {
+		return fmt.Errorf("direct boot needs a kernel")
+	}
+	files := []struct{ kind, path string }{
+		{"kernel", vm.DirectBoot.Kernel},
+		{"initrd", vm.DirectBoot.Initrd},
+	}
+	if isARM(vm) {
+		files = append(files, struct{ kind, path string }{"dtb", vm.DirectBoot.DTB})
+	}
+	for _, file := range files {
+		if file.path != "" && !exists(file.path) {
+			return fmt.Errorf("%s %s does not exist", file.kind, file.path)
+		}
+	}
+	return nil
+}
+
+// resolveBootArtifact resolves the relative path rel below root. Like
+// sharedSourcePath it follows symlinks and insists the result stays inside
+// root; it also has to be a regular file.
+func resolveBootArtifact(root, rel string) (string, error) {
+	if rel == "" || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("path must be relative")
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, rel))
+	if err != nil {
+		return "", err
+	}
+	inside, err := filepath.Rel(root, path)
+	if err != nil || inside == ".." || strings.HasPrefix(inside, "../") {
+		return "", fmt.Errorf("%s leads outside of its directory", rel)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", rel)
+	}
+	return path, nil
+}
+
+// bootArtifactPath returns the host path of ref for the VM with vmID, or
+// an empty path for a nil ref.
+func (h *VMHandler) bootArtifactPath(vmID string, ref *BootArtifactRef) (string, error) {
+	if ref == nil {
+		return "", nil
+	}
+	root := bootArtifactDir(h.storagePath, vmID)
+	if ref.Source == bootSourceLibrary {
+		if h.kernelLibraryPath == "" {
+			return "", fmt.Errorf("no kernel library is configured")
+		}
+		root = h.kernelLibraryPath
+	}
+	return resolveBootArtifact(root, ref.Path)
+}
+
+// directBootFromRequest returns the direct boot setup req asks for on vm.
+func (h *VMHandler) directBootFromRequest(vm models.VirtualMachine, req BootModeRequest) (models.DirectBoot, error) {
+	boot := vm.DirectBoot
+	boot.Enabled = req.Mode == "direct"
+	if req.Cmdline != nil {
+		boot.Cmdline = *req.Cmdline
+	}
+	if req.Kernel == nil {
+		if req.Initrd != nil || req.DTB != nil {
+			return boot, fmt.Errorf("initrd and dtb need a kernel")
+		}
+		if boot.Enabled && boot.Kernel == "" {
+			return boot, fmt.Errorf("direct boot needs a kernel")
+		}
+		return boot, nil
+	}
+	if req.DTB != nil && !isARM(vm) {
+		return boot, fmt.Errorf("a device tree only applies to aarch64 VMs")
+	}
+
+	id := vm.ID.String()
+	var err error
+	if boot.Kernel, err = h.bootArtifactPath(id, req.Kernel); err != nil {
+		return boot, fmt.Errorf("kernel: %w", err)
+	}
+	if boot.Initrd, err = h.bootArtifactPath(id, req.Initrd); err != nil {
+		return boot, fmt.Errorf("initrd: %w", err)
+	}
+	if boot.DTB, err = h.bootArtifactPath(id, req.DTB); err != nil {
+		return boot, fmt.Errorf("dtb: %w", err)
+	}
+	return boot, nil
+}
+
+// findVMForBoot loads the VM of the request and checks that the caller owns
+// it. It writes the error response and returns nil otherwise.
+func (h *VMHandler) findVMForBoot(c *gin.Context) *models.VirtualMachine {
+	id := c.Param("id")
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return nil
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return nil
+	}
+	return vm
+}
+
+// ListBootArtifacts lists the kernel library and the files uploaded for a
+// VM, by the paths a boot mode request refers to them with.
+func (h *VMHandler) ListBootArtifacts(c *gin.Context) {
+	vm := h.findVMForBoot(c)
+	if vm == nil {
+		return
+	}
+
+	uploads := []string{}
+	if entries, err := os.ReadDir(bootArtifactDir(h.storagePath, vm.ID.String())); err == nil {
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				uploads = append(uploads, entry.Name())
+			}
+		}
+	}
+
+	library := []string{}
+	if h.kernelLibraryPath != "" {
+		filepath.WalkDir(h.kernelLibraryPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if len(library) >= maxLibraryListing {
+				return filepath.SkipAll
+			}
+			if d.Type().IsRegular() {
+				rel, _ := filepath.Rel(h.kernelLibraryPath, path)
+				library = append(library, rel)
+			}
+			return nil
+		})
+		sort.Strings(library)
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"library":     library,
+		"uploads":     uploads,
+		"direct_boot": vm.DirectBoot,
+	}))
+}
+
+// UploadBootArtifact stores a kernel, initrd or device tree for direct boot
+// of a VM under the name of the uploaded file, replacing one of that name.
+func (h *VMHandler) UploadBootArtifact(c *gin.Context) {
+	vm := h.findVMForBoot(c)
+	if vm == nil {
+		return
+	}
+
+	// The form is spooled to disk before the size below is known, so the
+	// body is cut off as well.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBootArtifactSize+maxBootFormOverhead)
+	file, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if stderrors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "boot_artifact_too_large"), "max 1 GB"))
+			return
+		}
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "boot_artifact_file_required"), err.Error()))
+		return
+	}
+	if file.Size > maxBootArtifactSize {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "boot_artifact_too_large"), "max 1 GB"))
+		return
+	}
+	name := filepath.Base(file.Filename)
+	if name == "/" || strings.HasPrefix(name, ".") {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_boot_artifact_name"), file.Filename))
+		return
+	}
+
+	dir := bootArtifactDir(h.storagePath, vm.ID.String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_upload_boot_artifact"), err.Error()))
+		return
+	}
+	if err := c.SaveUploadedFile(file, filepath.Join(dir, name)); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_upload_boot_artifact"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Boot file %s uploaded for VM %s", name, vm.Name)
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.upload_boot_artifact", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"file":    name,
+			"size":    file.Size,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"source": bootSourceUpload,
+		"path":   name,
+		"size":   file.Size,
+	}))
+}
+
+// DeleteBootArtifact deletes a file uploaded for direct boot of a VM unless
+// the VM is set up to boot it.
+func (h *VMHandler) DeleteBootArtifact(c *gin.Context) {
+	vm := h.findVMForBoot(c)
+	if vm == nil {
+		return
+	}
+
+	path, err := resolveBootArtifact(bootArtifactDir(h.storagePath, vm.ID.String()), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "boot_artifact_not_found"), err.Error()))
+		return
+	}
+	boot := vm.DirectBoot
+	if path == boot.Kernel || path == boot.Initrd || path == boot.DTB {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "boot_artifact_in_use"), c.Param("name")))
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_delete_boot_artifact"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.delete_boot_artifact", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"file":    c.Param("name"),
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(nil))
+}
+
+// SetBootMode switches a VM between direct kernel boot and disk boot. A
+// running guest keeps booting the way it did until its next power cycle.
+func (h *VMHandler) SetBootMode(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req BootModeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm := h.findVMForBoot(c)
+	if vm == nil {
+		return
+	}
+
+	boot, err := h.directBootFromRequest(*vm, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_boot_mode"), err.Error()))
+		return
+	}
+
+	before := hardwareConfig(*vm)
+	updated := *vm
+	updated.DirectBoot = boot
+	after := hardwareConfig(updated)
+	paramsJSON, _ := json.Marshal(updated.DirectBoot)
+	params := string(paramsJSON)
+
+	active, err := h.redefineDomain(c, &updated)
+	if err != nil {
+		log.Printf("[VM] Failed to set boot mode of VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "set_boot_mode", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_set_boot_mode"), err.Error()))
+		return
+	}
+
+	pending := map[string]VMPendingChange{}
+	if active {
+		pending = pendingChanges(*vm)
+		mergePendingChanges(pending, before, after)
+	}
+	updated.PendingChanges = ""
+	if len(pending) > 0 {
+		encoded, _ := json.Marshal(pending)
+		updated.PendingChanges = string(encoded)
+	}
+
+	if err := h.vmRepo.Update(ctx, &updated); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_set_boot_mode"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] VM %s now boots from %s", vm.Name, req.Mode)
+	h.recordVMOperation(vm.ID, "set_boot_mode", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.set_boot_mode", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":     vm.Name,
+			"mode":        req.Mode,
+			"direct_boot": updated.DirectBoot,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"direct_boot":      updated.DirectBoot,
+		"pending":          pending,
+		"restart_required": len(pending) > 0,
+	}))
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/diskcrypt"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	bytesPerGB             = int64(1024 * 1024 * 1024)
+	guestResizeTimeout     = 2 * time.Minute
+	guestResizeStatusOK    = "ok"
+	guestResizeStatusSkip  = "skipped"
+	guestResizeStatusError = "failed"
+)
+
+// linuxGrowScript grows the last partition of a disk and the filesystem on
+// it. $1 is "root" for the disk holding / or the serial of a data disk.
+// growpart exits 1 when there is nothing to grow, which is not an error.
+const linuxGrowScript = `set -e
+if [ "$1" = root ]; then
+  disk=$(lsblk -nps -o NAME,TYPE "$(findmnt -no SOURCE /)" | awk '$2=="disk"{print $1; exit}')
+else
+  disk=$(lsblk -dnp -o NAME,SERIAL | awk -v s="$1" '$2==s{print $1; exit}')
+fi
+[ -n "$disk" ] || { echo "disk not found in guest" >&2; exit 2; }
+target=$disk
+part=$(lsblk -lnp -o NAME,TYPE "$disk" | awk '$2=="part"{p=$1} END{print p}')
+if [ -n "$part" ]; then
+  num=$(cat "/sys/class/block/$(basename "$part")/partition")
+  growpart "$disk" "$num" || [ $? -eq 1 ]
+  target=$part
+fi
+fstype=$(lsblk -dno FSTYPE "$target")
+mnt=$(lsblk -dno MOUNTPOINT "$target")
+case "$fstype" in
+  ext2|ext3|ext4) resize2fs "$target" ;;
+  xfs) xfs_growfs "${mnt:?filesystem is not mounted}" ;;
+  btrfs) btrfs filesystem resize max "${mnt:?filesystem is not mounted}" ;;
+  LVM2_member) pvresize "$target" ;;
+  *) echo "unsupported filesystem: $fstype" >&2; exit 2 ;;
+esac
+`
+
+type ResizeVMDiskRequest struct {
+	SizeGB         int64 `json:"size_gb" binding:"required,min=1"`
+	GrowFilesystem bool  `json:"grow_filesystem"`
+}
+
+// checkHostCapacity fails when the filesystem holding path does not have
+// sizeBytes free.
+func checkHostCapacity(c *gin.Context, path string, sizeBytes int64) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return true
+	}
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	if sizeBytes > available {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_pool_insufficient_capacity"), fmt.Sprintf("requested: %d, available: %d", sizeBytes, available)))
+		return false
+	}
+	return true
+}
+
+// growGuestFilesystem asks the guest agent to grow the partition and the
+// filesystem of a resized disk. serial is empty for the root disk. It never
+// fails the resize itself; the outcome is reported to the caller.
+func (h *VMHandler) growGuestFilesystem(vm *models.VirtualMachine, serial string) gin.H {
+	if err := h.libvirt.GuestPing(vm.LibvirtDomainUUID); err != nil {
+		return gin.H{"status": guestResizeStatusSkip, "output": "guest agent is not available"}
+	}
+
+	var path string
+	var args []string
+	if info, err := h.libvirt.GuestGetOSInfo(vm.LibvirtDomainUUID); err == nil && info.ID == "mswindows" {
+		selector := "Get-Partition -DriveLetter C"
+		if serial != "" {
+			selector = fmt.Sprintf("Get-Disk | Where-Object SerialNumber -eq '%s' | Get-Partition | Sort-Object PartitionNumber | Select-Object -Last 1", serial)
+		}
+		path = "powershell.exe"
+		args = []string{"-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Update-HostStorageCache; $p = %s; $p | Resize-Partition -Size ($p | Get-PartitionSupportedSize).SizeMax", selector)}
+	} else {
+		disk := "root"
+		if serial != "" {
+			disk = serial
+		}
+		path = "/bin/sh"
+		args = []string{"-c", linuxGrowScript, "grow", disk}
+	}
+
+	result, err := h.libvirt.GuestExec(vm.LibvirtDomainUUID, path, args, nil, guestResizeTimeout)
+	if err != nil {
+		return gin.H{"status": guestResizeStatusError, "output": err.Error()}
+	}
+	output := strings.TrimSpace(result.Stdout + result.Stderr)
+	if result.ExitCode != 0 {
+		return gin.H{"status": guestResizeStatusError, "exit_code": result.ExitCode, "output": output}
+	}
+	return gin.H{"status": guestResizeStatusOK, "output": output}
+}
+
+// resizeRootDisk grows the system disk of vm to sizeGB.
+func (h *VMHandler) resizeRootDisk(c *gin.Context, vm *models.VirtualMachine, sizeGB int64, live bool) error {
+	diskPath := vm.DiskPath
+	if diskPath == "" {
+		diskPath = fmt.Sprintf("%s/%s.qcow2", h.storagePath, vm.ID.String())
+	}
+
+	if live {
+		return h.libvirt.BlockResize(vm.LibvirtDomainUUID, rootDiskTarget(*vm), uint64(sizeGB*bytesPerGB))
+	}
+
+	if _, err := os.Stat(diskPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("system disk %s does not exist", diskPath)
+		}
+		return err
+	}
+	if vm.Encryption.Enabled {
+		passphrase, err := diskPassphrase(h.keyring, *vm)
+		if err != nil {
+			return err
+		}
+		return diskcrypt.ResizeImage(c.Request.Context(), diskPath, passphrase, sizeGB)
+	}
+	output, err := exec.CommandContext(c.Request.Context(), "qemu-img", "resize", diskPath, fmt.Sprintf("%dG", sizeGB)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (h *VMHandler) ResizeDisk(c *gin.Context) {
+	id := c.Param("id")
+	ref := c.Param("disk")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req ResizeVMDiskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	// With flavors enforced the system disk only grows with the flavor.
+	if isRootDiskRef(*vm, ref) && !h.customSizesAllowed(role) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "custom_vm_size_not_allowed"), "the system disk is sized by the VM flavor"))
+		return
+	}
+
+	live := vm.Status == "running" || vm.Status == "paused"
+	if live && (h.libvirt == nil || vm.LibvirtDomainUUID == "") {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
+		return
+	}
+
+	var disk *models.StorageVolume
+	target := rootDiskTarget(*vm)
+	var currentBytes int64
+	if isRootDiskRef(*vm, ref) {
+		currentBytes = int64(vm.DiskAllocated) * bytesPerGB
+	} else {
+		if h.storageVolumeRepo == nil {
+			c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "storage is not initialized"))
+			return
+		}
+		h.loadDataDisks(ctx, vm)
+		if disk = findVMDataDisk(vm, ref); disk == nil {
+			c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "storage_volume_not_found"), ref))
+			return
+		}
+		if disk.ReadOnly {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_disk_size"), "read-only disks cannot be resized"))
+			return
+		}
+		target = disk.TargetDev
+		currentBytes = disk.Capacity
+	}
+
+	newBytes := req.SizeGB * bytesPerGB
+	if newBytes <= currentBytes {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_disk_size"), fmt.Sprintf("disks can only grow: current %d bytes, requested %d bytes", currentBytes, newBytes)))
+		return
+	}
+
+	// Quota usage counts data disks rounded up to whole GB.
+	quotaOwner := vm.OwnerID
+	if disk != nil && disk.OwnerID != nil {
+		quotaOwner = *disk.OwnerID
+	}
+	currentGB := (currentBytes + bytesPerGB - 1) / bytesPerGB
+	if !h.checkDiskQuota(c, quotaOwner, req.SizeGB-currentGB) {
+		return
+	}
+
+	var pool *models.StoragePool
+	if disk != nil {
+		pool, err = h.storagePoolRepo.FindByID(ctx, disk.PoolID.String())
+		if err != nil {
+			c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "storage_pool_not_found"), disk.PoolID.String()))
+			return
+		}
+		if !h.checkPoolCapacity(c, pool, newBytes-currentBytes) {
+			return
+		}
+	} else if !checkHostCapacity(c, h.storagePath, newBytes-currentBytes) {
+		return
+	}
+
+	params := fmt.Sprintf(`{"target":%q,"size_gb":%d,"live":%v}`, target, req.SizeGB, live)
+
+	switch {
+	case disk == nil:
+		err = h.resizeRootDisk(c, vm, req.SizeGB, live)
+	case live:
+		err = h.libvirt.BlockResize(vm.LibvirtDomainUUID, target, uint64(newBytes))
+	case h.libvirt != nil && pool.Active:
+		err = h.libvirt.StorageVolumeResize(pool.Name, disk.Name, uint64(newBytes))
+	default:
+		err = fmt.Errorf("storage pool %s is not active", pool.Name)
+	}
+	if err != nil {
+		log.Printf("[VM] Failed to resize %s of VM %s: %v", target, vm.Name, err)
+		h.recordVMOperation(vm.ID, "resize_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_resize_disk"), err.Error()))
+		return
+	}
+
+	if disk == nil {
+		vm.DiskAllocated = int(req.SizeGB)
+		err = h.vmRepo.Update(ctx, vm)
+	} else {
+		disk.Capacity = newBytes
+		err = h.storageVolumeRepo.Update(ctx, disk)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_resize_disk"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Disk %s of VM %s resized to %d GB (live: %v)", target, vm.Name, req.SizeGB, live)
+	h.recordVMOperation(vm.ID, "resize_disk", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.disk.resize", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"target":  target,
+			"size_gb": req.SizeGB,
+			"live":    live,
+		})
+	}
+
+	response := gin.H{
+		"target":  target,
+		"size_gb": req.SizeGB,
+		"live":    live,
+	}
+	if req.GrowFilesystem {
+		if vm.Status == "running" {
+			serial := ""
+			if disk != nil {
+				serial = diskSerial(*disk)
+			}
+			guest := h.growGuestFilesystem(vm, serial)
+			log.Printf("[VM] Guest filesystem growth on %s of VM %s: %v", target, vm.Name, guest["status"])
+			response["guest_resize"] = guest
+		} else {
+			response["guest_resize"] = gin.H{"status": guestResizeStatusSkip, "output": "VM is not running"}
+		}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(response))
+}
@@ -0,0 +1,729 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// diskBusPrefixes maps the supported data disk buses to their target name
+// prefix. sda to sdd are kept for the install, cloud-init, answer file and
+// driver CD-ROMs.
+var diskBusPrefixes = map[string]string{
+	"virtio": "vd",
+	"scsi":   "sd",
+	"sata":   "sd",
+}
+
+var diskCacheModes = map[string]bool{
+	"default":      true,
+	"none":         true,
+	"writethrough": true,
+	"writeback":    true,
+	"directsync":   true,
+	"unsafe":       true,
+}
+
+var volumeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+type VMDisk struct {
+	Target   string     `json:"target"`
+	Bus      string     `json:"bus"`
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Format   string     `json:"format"`
+	Capacity int64      `json:"capacity"`
+	Cache    string     `json:"cache"`
+	ReadOnly bool       `json:"read_only"`
+	Primary  bool       `json:"primary"`
+	VolumeID *uuid.UUID `json:"volume_id,omitempty"`
+	PoolID   *uuid.UUID `json:"pool_id,omitempty"`
+}
+
+type CreateVMDiskRequest struct {
+	PoolID   string `json:"pool_id" binding:"required"`
+	Name     string `json:"name"`
+	SizeGB   int    `json:"size_gb" binding:"required,min=1"`
+	Format   string `json:"format"`
+	Bus      string `json:"bus"`
+	Cache    string `json:"cache"`
+	ReadOnly bool   `json:"read_only"`
+	Encrypt  bool   `json:"encrypt"`
+}
+
+// AttachVMDiskRequest attaches an existing volume. A plain volume is
+// encrypted first when Encrypt is set or the system disk of the VM is
+// encrypted, which turns it into a qcow2 image.
+type AttachVMDiskRequest struct {
+	VolumeID string `json:"volume_id" binding:"required"`
+	Bus      string `json:"bus"`
+	Cache    string `json:"cache"`
+	ReadOnly bool   `json:"read_only"`
+	Encrypt  bool   `json:"encrypt"`
+}
+
+func (h *VMHandler) SetStorageRepos(pools *repository.StoragePoolRepository, volumes *repository.StorageVolumeRepository) {
+	h.storagePoolRepo = pools
+	h.storageVolumeRepo = volumes
+}
+
+// loadDataDisks fills vm.DataDisks so generateDomainXML keeps attached data
+// disks when the domain is redefined.
+func (h *VMHandler) loadDataDisks(ctx context.Context, vm *models.VirtualMachine) {
+	if h.storageVolumeRepo == nil {
+		return
+	}
+	disks, err := h.storageVolumeRepo.ListByVM(ctx, vm.ID.String())
+	if err != nil {
+		log.Printf("[VM] Failed to load data disks of VM %s: %v", vm.Name, err)
+		return
+	}
+	vm.DataDisks = disks
+}
+
+func normalizeDiskOptions(bus, cache string) (string, string, error) {
+	if bus == "" {
+		bus = "virtio"
+	}
+	if _, ok := diskBusPrefixes[bus]; !ok {
+		return "", "", fmt.Errorf("unsupported bus %q, expected virtio, scsi or sata", bus)
+	}
+	if cache == "" {
+		cache = "none"
+	}
+	if !diskCacheModes[cache] {
+		return "", "", fmt.Errorf("unsupported cache mode %q", cache)
+	}
+	return bus, cache, nil
+}
+
+// nextDiskTarget picks the first free target name for bus, looking at the
+// targets in the domain definition and those recorded for data disks.
+func (h *VMHandler) nextDiskTarget(vm *models.VirtualMachine, bus string) (string, error) {
+	used := map[string]bool{"vda": true, "sda": true, "sdb": true, "sdc": true, driverISOTarget: true, rootDiskTarget(*vm): true}
+	for _, disk := range vm.DataDisks {
+		used[disk.TargetDev] = true
+	}
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		if targets, err := h.libvirt.ListTargetDevs(vm.LibvirtDomainUUID); err == nil {
+			for _, target := range targets {
+				used[target] = true
+			}
+		}
+	}
+
+	prefix := diskBusPrefixes[bus]
+	for c := 'a'; c <= 'z'; c++ {
+		target := prefix + string(c)
+		if !used[target] {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("no free %s disk target left", bus)
+}
+
+// diskSerial is the serial number a data disk is presented with, so the
+// guest can find it under /dev/disk/by-id.
+func diskSerial(disk models.StorageVolume) string {
+	return strings.ReplaceAll(disk.ID.String(), "-", "")[:20]
+}
+
+// generateDataDisk describes an attached storage volume as a domain disk
+// device throttled by qos. Volumes of block based pools are attached as
+// block devices.
+func generateDataDisk(disk models.StorageVolume, qos models.QoSLimits) libvirt.DomainDisk {
+	format := disk.Format
+	if format == "" {
+		format = "raw"
+	}
+	device := libvirt.DomainDisk{
+		Type:       "file",
+		Device:     "disk",
+		Driver:     &libvirt.DiskDriver{Name: "qemu", Type: format},
+		Source:     &libvirt.DiskSource{File: disk.Path},
+		Target:     &libvirt.DiskTarget{Dev: disk.TargetDev, Bus: disk.Bus},
+		IOTune:     diskIOTune(qos),
+		Serial:     diskSerial(disk),
+		Encryption: libvirt.DiskEncryptionFor(disk.Encryption.SecretUUID),
+	}
+	if strings.HasPrefix(disk.Path, "/dev/") {
+		device.Type = "block"
+		device.Source = &libvirt.DiskSource{Dev: disk.Path}
+	}
+	if disk.CacheMode != "" && disk.CacheMode != "default" {
+		device.Driver.Cache = disk.CacheMode
+	}
+	if disk.ReadOnly {
+		device.ReadOnly = &struct{}{}
+	}
+	return device
+}
+
+func generateDataDiskXML(disk models.StorageVolume, qos models.QoSLimits) string {
+	return marshalDevice(generateDataDisk(disk, qos))
+}
+
+func generateDataDisksConfig(disks []models.StorageVolume, qos models.QoSLimits) []libvirt.DomainDisk {
+	var devices []libvirt.DomainDisk
+	for _, disk := range disks {
+		if disk.TargetDev != "" && disk.Path != "" {
+			devices = append(devices, generateDataDisk(disk, qos))
+		}
+	}
+	return devices
+}
+
+// checkDiskQuota fails when adding sizeGB would take the VM owner over their
+// disk quota.
+func (h *VMHandler) checkDiskQuota(c *gin.Context, ownerID uuid.UUID, sizeGB int64) bool {
+	ctx := c.Request.Context()
+
+	owner, err := h.userRepo.FindByID(ctx, ownerID.String())
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeUserNotFound, t(c, "user_not_found"), ownerID.String()))
+		return false
+	}
+	usage, err := h.userRepo.GetResourceUsage(ctx, ownerID.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_get_resource_usage"), err.Error()))
+		return false
+	}
+	if owner.QuotaDisk > 0 && usage.DiskUsed+sizeGB > int64(owner.QuotaDisk) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "quota_disk_exceeded"), fmt.Sprintf("used: %d, requested: %d, quota: %d", usage.DiskUsed, sizeGB, owner.QuotaDisk)))
+		return false
+	}
+	return true
+}
+
+// checkPoolCapacity fails when pool does not have sizeBytes free. The
+// capacity is refreshed from libvirt when the pool is active.
+func (h *VMHandler) checkPoolCapacity(c *gin.Context, pool *models.StoragePool, sizeBytes int64) bool {
+	available := pool.Available
+	if h.libvirt != nil && pool.Active {
+		if info, err := h.libvirt.StoragePoolGetInfo(pool.Name); err == nil {
+			available = int64(info.Available)
+		}
+	}
+	if sizeBytes > available {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_pool_insufficient_capacity"), fmt.Sprintf("requested: %d, available: %d", sizeBytes, available)))
+		return false
+	}
+	return true
+}
+
+// attachDataDisk records the attachment and plugs the disk into the domain,
+// live when the VM is running and the bus supports hotplug, otherwise into
+// the persistent definition only. It reports whether the disk went live.
+func (h *VMHandler) attachDataDisk(ctx context.Context, vm *models.VirtualMachine, disk *models.StorageVolume) (bool, error) {
+	if err := h.storageVolumeRepo.Attach(ctx, disk, vm.ID); err != nil {
+		return false, err
+	}
+
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		return false, nil
+	}
+
+	deviceXML := generateDataDiskXML(*disk, vm.QoS)
+	if disk.Bus == "scsi" {
+		if err := h.libvirt.EnsureSCSIController(vm.LibvirtDomainUUID, vm.Status == "running"); err != nil {
+			if detachErr := h.storageVolumeRepo.Detach(ctx, disk.ID.String()); detachErr != nil {
+				log.Printf("[VM] Failed to roll back attachment of volume %s: %v", disk.ID, detachErr)
+			}
+			return false, err
+		}
+	}
+	if vm.Status == "running" {
+		err := h.libvirt.AttachDevice(vm.LibvirtDomainUUID, deviceXML, true)
+		if err == nil {
+			return true, nil
+		}
+		log.Printf("[VM] Live attach of %s to VM %s failed, attaching to the persistent config: %v", disk.TargetDev, vm.Name, err)
+	}
+	if err := h.libvirt.AttachDevice(vm.LibvirtDomainUUID, deviceXML, false); err != nil {
+		if detachErr := h.storageVolumeRepo.Detach(ctx, disk.ID.String()); detachErr != nil {
+			log.Printf("[VM] Failed to roll back attachment of volume %s: %v", disk.ID, detachErr)
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// discardVolume deletes a volume that was created for a data disk which
+// could not be set up, together with its secret.
+func (h *VMHandler) discardVolume(poolName string, disk *models.StorageVolume) {
+	if err := h.libvirt.StorageVolumeDelete(poolName, disk.Name); err != nil {
+		log.Printf("[VM] Failed to remove volume %s: %v", disk.Name, err)
+	}
+	undefineVolumeSecret(h.libvirt, *disk)
+}
+
+// undefineVolumeSecret removes the libvirt secret of an encrypted volume
+// that is being deleted.
+func undefineVolumeSecret(client *libvirt.Client, disk models.StorageVolume) {
+	if !disk.Encryption.Enabled {
+		return
+	}
+	if err := client.UndefineSecret(disk.Encryption.SecretUUID); err != nil {
+		log.Printf("[VM] Failed to remove the secret of volume %s: %v", disk.Name, err)
+	}
+}
+
+// findVMDataDisk looks up an attached data disk by volume ID or target name.
+func findVMDataDisk(vm *models.VirtualMachine, ref string) *models.StorageVolume {
+	for i := range vm.DataDisks {
+		if vm.DataDisks[i].ID.String() == ref || vm.DataDisks[i].TargetDev == ref {
+			return &vm.DataDisks[i]
+		}
+	}
+	return nil
+}
+
+func (h *VMHandler) ListDisks(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	h.loadDataDisks(ctx, vm)
+
+	disks := []VMDisk{{
+		Target:   rootDiskTarget(*vm),
+		Bus:      rootDiskBus(*vm),
+		Name:     "root",
+		Path:     vm.DiskPath,
+		Format:   "qcow2",
+		Capacity: int64(vm.DiskAllocated) << 30,
+		Cache:    "default",
+		Primary:  true,
+	}}
+	for _, disk := range vm.DataDisks {
+		volumeID, poolID := disk.ID, disk.PoolID
+		disks = append(disks, VMDisk{
+			Target:   disk.TargetDev,
+			Bus:      disk.Bus,
+			Name:     disk.Name,
+			Path:     disk.Path,
+			Format:   disk.Format,
+			Capacity: disk.Capacity,
+			Cache:    disk.CacheMode,
+			ReadOnly: disk.ReadOnly,
+			VolumeID: &volumeID,
+			PoolID:   &poolID,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"disks": disks,
+	}))
+}
+
+func (h *VMHandler) CreateDisk(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req CreateVMDiskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	bus, cache, err := normalizeDiskOptions(req.Bus, req.Cache)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_disk_options"), err.Error()))
+		return
+	}
+	format := req.Format
+	if format == "" {
+		format = "qcow2"
+	}
+	if format != "qcow2" && format != "raw" {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_disk_options"), "format must be qcow2 or raw"))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.libvirt == nil || h.storageVolumeRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client or storage is not initialized"))
+		return
+	}
+
+	// Data disks of a VM with an encrypted system disk are encrypted too.
+	encrypt := req.Encrypt || vm.Encryption.Enabled
+	if encrypt && h.keyring == nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "disk_encryption_unavailable"), "no master key is configured"))
+		return
+	}
+	if encrypt && format != "qcow2" {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_disk_options"), "encrypted volumes must be qcow2"))
+		return
+	}
+
+	pool, err := h.storagePoolRepo.FindByID(ctx, req.PoolID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "storage_pool_not_found"), req.PoolID))
+		return
+	}
+	if !pool.Active {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_pool_not_active"), pool.Name))
+		return
+	}
+
+	sizeBytes := int64(req.SizeGB) << 30
+	if !h.checkDiskQuota(c, vm.OwnerID, int64(req.SizeGB)) || !h.checkPoolCapacity(c, pool, sizeBytes) {
+		return
+	}
+
+	h.loadDataDisks(ctx, vm)
+	target, err := h.nextDiskTarget(vm, bus)
+	if err != nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "invalid_disk_options"), err.Error()))
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("%s-%s.%s", vm.ID.String(), target, format)
+	}
+	if !volumeNameRegex.MatchString(name) {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_disk_options"), "invalid volume name"))
+		return
+	}
+	if _, err := h.storageVolumeRepo.FindByNameAndPool(ctx, pool.ID.String(), name); err == nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_volume_exists"), name))
+		return
+	}
+
+	params := fmt.Sprintf(`{"pool":%q,"name":%q,"size_gb":%d,"bus":%q,"cache":%q,"read_only":%v,"encrypt":%v}`, pool.Name, name, req.SizeGB, bus, cache, req.ReadOnly, encrypt)
+
+	if err := h.libvirt.StorageVolumeCreate(pool.Name, name, sizeBytes, format); err != nil {
+		log.Printf("[VM] Failed to create data disk %s for VM %s: %v", name, vm.Name, err)
+		h.recordVMOperation(vm.ID, "create_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_create_disk"), err.Error()))
+		return
+	}
+
+	ownerID := vm.OwnerID
+	disk := &models.StorageVolume{
+		PoolID:     pool.ID,
+		Name:       name,
+		VolumeType: "file",
+		Capacity:   sizeBytes,
+		Format:     format,
+		OwnerID:    &ownerID,
+		TargetDev:  target,
+		Bus:        bus,
+		CacheMode:  cache,
+		ReadOnly:   req.ReadOnly,
+	}
+	if info, err := h.libvirt.StorageVolumeGet(pool.Name, name); err == nil {
+		disk.Path = info.Path
+		disk.Allocation = int64(info.Allocation)
+	}
+	if encrypt {
+		if err := h.encryptVolume(ctx, disk, req.SizeGB); err != nil {
+			log.Printf("[VM] Failed to encrypt data disk %s for VM %s: %v", name, vm.Name, err)
+			h.discardVolume(pool.Name, disk)
+			h.recordVMOperation(vm.ID, "create_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_create_disk"), err.Error()))
+			return
+		}
+	}
+	if err := h.storageVolumeRepo.Create(ctx, disk); err != nil {
+		h.discardVolume(pool.Name, disk)
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_create_disk"), err.Error()))
+		return
+	}
+
+	live, err := h.attachDataDisk(ctx, vm, disk)
+	if err != nil {
+		log.Printf("[VM] Failed to attach data disk %s to VM %s: %v", name, vm.Name, err)
+		h.discardVolume(pool.Name, disk)
+		if delErr := h.storageVolumeRepo.Delete(ctx, disk.ID.String()); delErr != nil {
+			log.Printf("[VM] Failed to remove volume record %s after failed attach: %v", disk.ID, delErr)
+		}
+		h.recordVMOperation(vm.ID, "create_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_attach_disk"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Data disk %s created and attached to VM %s as %s", name, vm.Name, target)
+	h.recordVMOperation(vm.ID, "create_disk", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.disk.create", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"volume":  disk.ID,
+			"target":  target,
+			"size_gb": req.SizeGB,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"disk": disk,
+		"live": live,
+	}))
+}
+
+func (h *VMHandler) AttachDisk(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req AttachVMDiskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	bus, cache, err := normalizeDiskOptions(req.Bus, req.Cache)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_disk_options"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.storageVolumeRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "storage is not initialized"))
+		return
+	}
+
+	disk, err := h.storageVolumeRepo.FindByID(ctx, req.VolumeID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "storage_volume_not_found"), req.VolumeID))
+		return
+	}
+
+	// Users may only attach their own volumes; unowned volumes created by
+	// an administrator need an administrator to hand them out.
+	if role != "admin" && (disk.OwnerID == nil || *disk.OwnerID != userUUID) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied"), "not volume owner"))
+		return
+	}
+
+	if disk.VMID != nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_volume_in_use"), disk.VMID.String()))
+		return
+	}
+
+	if disk.Path == "" {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "invalid_disk_options"), "volume has no path"))
+		return
+	}
+
+	if disk.OwnerID == nil || *disk.OwnerID != vm.OwnerID {
+		sizeGB := (disk.Capacity + (1 << 30) - 1) >> 30
+		if !h.checkDiskQuota(c, vm.OwnerID, sizeGB) {
+			return
+		}
+	}
+
+	encrypt := (req.Encrypt || vm.Encryption.Enabled) && !disk.Encryption.Enabled
+	if encrypt && h.keyring == nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "disk_encryption_unavailable"), "no master key is configured"))
+		return
+	}
+	if encrypt && h.libvirt == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+		return
+	}
+
+	h.loadDataDisks(ctx, vm)
+	target, err := h.nextDiskTarget(vm, bus)
+	if err != nil {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "invalid_disk_options"), err.Error()))
+		return
+	}
+	disk.TargetDev = target
+	disk.Bus = bus
+	disk.CacheMode = cache
+	disk.ReadOnly = req.ReadOnly
+
+	params := fmt.Sprintf(`{"volume_id":%q,"bus":%q,"cache":%q,"read_only":%v,"encrypt":%v}`, disk.ID, bus, cache, req.ReadOnly, encrypt)
+
+	if encrypt {
+		err := h.encryptVolume(ctx, disk, 0)
+		if err == nil {
+			err = h.storageVolumeRepo.Update(ctx, disk)
+		}
+		if err != nil {
+			log.Printf("[VM] Failed to encrypt volume %s for VM %s: %v", disk.Name, vm.Name, err)
+			h.recordVMOperation(vm.ID, "attach_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_attach_disk"), err.Error()))
+			return
+		}
+	}
+
+	live, err := h.attachDataDisk(ctx, vm, disk)
+	if err != nil {
+		log.Printf("[VM] Failed to attach volume %s to VM %s: %v", disk.Name, vm.Name, err)
+		h.recordVMOperation(vm.ID, "attach_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		if err == repository.ErrStorageVolumeInUse {
+			c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "storage_volume_in_use"), err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_attach_disk"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Volume %s attached to VM %s as %s (live: %v)", disk.Name, vm.Name, target, live)
+	h.recordVMOperation(vm.ID, "attach_disk", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.disk.attach", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"volume":  disk.ID,
+			"target":  target,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"disk": disk,
+		"live": live,
+	}))
+}
+
+func (h *VMHandler) DetachDisk(c *gin.Context) {
+	id := c.Param("id")
+	ref := c.Param("disk")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+	deleteVolume := c.Query("delete") == "true"
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.storageVolumeRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "storage is not initialized"))
+		return
+	}
+
+	if isRootDiskRef(*vm, ref) {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "cannot_detach_root_disk"), ref))
+		return
+	}
+
+	h.loadDataDisks(ctx, vm)
+	disk := findVMDataDisk(vm, ref)
+	if disk == nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "storage_volume_not_found"), ref))
+		return
+	}
+
+	params := fmt.Sprintf(`{"volume_id":%q,"target":%q,"delete":%v}`, disk.ID, disk.TargetDev, deleteVolume)
+
+	live := false
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		deviceXML := generateDataDiskXML(*disk, vm.QoS)
+		live = vm.Status == "running"
+		if err := h.libvirt.DetachDevice(vm.LibvirtDomainUUID, deviceXML, live); err != nil {
+			log.Printf("[VM] Failed to detach %s from VM %s: %v", disk.TargetDev, vm.Name, err)
+			h.recordVMOperation(vm.ID, "detach_disk", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_detach_disk"), err.Error()))
+			return
+		}
+	}
+
+	if err := h.storageVolumeRepo.Detach(ctx, disk.ID.String()); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_detach_disk"), err.Error()))
+		return
+	}
+
+	if deleteVolume {
+		if pool, err := h.storagePoolRepo.FindByID(ctx, disk.PoolID.String()); err == nil && h.libvirt != nil && pool.Active {
+			if err := h.libvirt.StorageVolumeDelete(pool.Name, disk.Name); err != nil {
+				log.Printf("[VM] Failed to delete volume %s: %v", disk.Name, err)
+				c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_delete_disk"), err.Error()))
+				return
+			}
+			undefineVolumeSecret(h.libvirt, *disk)
+		}
+		if err := h.storageVolumeRepo.Delete(ctx, disk.ID.String()); err != nil {
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_delete_disk"), err.Error()))
+			return
+		}
+	}
+
+	log.Printf("[VM] Data disk %s detached from VM %s (deleted: %v)", disk.TargetDev, vm.Name, deleteVolume)
+	h.recordVMOperation(vm.ID, "detach_disk", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.disk.detach", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"volume":  disk.ID,
+			"target":  disk.TargetDev,
+			"deleted": deleteVolume,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"volume_id": disk.ID,
+		"target":    disk.TargetDev,
+		"live":      live,
+		"deleted":   deleteVolume,
+	}))
+}
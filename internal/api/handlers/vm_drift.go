@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+	"vmmanager/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func (h *VMHandler) SetDriftService(driftRepo *repository.VMDriftRepository, driftService *services.DriftService) {
+	h.vmDriftRepo = driftRepo
+	h.driftService = driftService
+}
+
+// ListDrifts lists the open drifts between VM records and their domains,
+// of one VM when vm_id is given.
+func (h *VMHandler) ListDrifts(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	drifts, err := h.vmDriftRepo.ListOpen(ctx, c.Query("vm_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_list_drifts"), err.Error()))
+		return
+	}
+
+	names := make(map[uuid.UUID]string)
+	result := make([]gin.H, 0, len(drifts))
+	for _, drift := range drifts {
+		name, ok := names[drift.VMID]
+		if !ok {
+			if vm, err := h.vmRepo.FindByID(ctx, drift.VMID.String()); err == nil {
+				name = vm.Name
+			}
+			names[drift.VMID] = name
+		}
+		result = append(result, gin.H{
+			"id":            drift.ID,
+			"vm_id":         drift.VMID,
+			"vm_name":       name,
+			"field":         drift.Field,
+			"db_value":      drift.DBValue,
+			"libvirt_value": drift.LibvirtValue,
+			"detected_at":   drift.DetectedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(result))
+}
+
+// ScanDrifts reconciles every VM with its domain at once instead of waiting
+// for the next scheduled pass.
+func (h *VMHandler) ScanDrifts(c *gin.Context) {
+	if h.libvirt == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+		return
+	}
+
+	open, err := h.driftService.ReconcileAll(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_scan_drifts"), err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{"open": open}))
+}
+
+// findOpenDrift loads the open drift of the request with its VM and the
+// persistent definition of the domain, writing the error response when one
+// of them is missing.
+func (h *VMHandler) findOpenDrift(c *gin.Context) (*models.VMDrift, *models.VirtualMachine, *libvirt.DomainDef, bool) {
+	ctx := c.Request.Context()
+
+	if h.libvirt == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized"))
+		return nil, nil, nil, false
+	}
+
+	drift, err := h.vmDriftRepo.FindByID(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "drift_not_found"), c.Param("id")))
+		return nil, nil, nil, false
+	}
+	if drift.Status != "open" {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "drift_already_resolved"), drift.Resolution))
+		return nil, nil, nil, false
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, drift.VMID.String())
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), drift.VMID.String()))
+		return nil, nil, nil, false
+	}
+
+	xmlDesc, err := h.libvirt.GetDomainXML(vm.LibvirtDomainUUID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "domain_not_found"), err.Error()))
+		return nil, nil, nil, false
+	}
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_resolve_drift"), err.Error()))
+		return nil, nil, nil, false
+	}
+
+	return drift, vm, def, true
+}
+
+// currentDrift compares vm and def again, as either may have changed since
+// drift was found. It returns nil when they agree on the field by now.
+func currentDrift(drift *models.VMDrift, vm *models.VirtualMachine, def *libvirt.DomainDef) *services.FieldDrift {
+	for _, found := range services.DetectDrift(vm, def) {
+		if found.Field == drift.Field {
+			return &found
+		}
+	}
+	return nil
+}
+
+// AcceptLibvirtDrift takes the value of the domain definition into the VM
+// record.
+func (h *VMHandler) AcceptLibvirtDrift(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	drift, vm, def, ok := h.findOpenDrift(c)
+	if !ok {
+		return
+	}
+
+	found := currentDrift(drift, vm, def)
+	if found == nil {
+		if err := h.vmDriftRepo.Resolve(ctx, drift.ID, services.DriftResolutionCleared, nil); err != nil {
+			log.Printf("[VM] Failed to clear drift %s: %v", drift.ID, err)
+		}
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "drift_already_resolved"), services.DriftResolutionCleared))
+		return
+	}
+
+	paramsJSON, _ := json.Marshal(found)
+	params := string(paramsJSON)
+
+	oldMAC := vm.MACAddress
+	if err := services.AcceptLibvirtValue(vm, found.Field, found.LibvirtValue); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "failed_to_resolve_drift"), err.Error()))
+		return
+	}
+
+	if found.Field == services.DriftFieldMACAddress && h.vmInterfaceRepo != nil {
+		if inUse, err := h.vmInterfaceRepo.MACInUse(ctx, vm.MACAddress); err == nil && inUse {
+			c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "mac_address_in_use"), vm.MACAddress))
+			return
+		}
+	}
+
+	if err := h.vmRepo.Update(ctx, vm); err != nil {
+		h.recordVMOperation(vm.ID, "accept_drift", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_resolve_drift"), err.Error()))
+		return
+	}
+
+	// The primary interface mirrors the MAC address of the VM.
+	if found.Field == services.DriftFieldMACAddress && h.vmInterfaceRepo != nil {
+		if iface, err := h.vmInterfaceRepo.FindByVMAndMAC(ctx, vm.ID.String(), oldMAC); err == nil {
+			iface.MACAddress = vm.MACAddress
+			if err := h.vmInterfaceRepo.Update(ctx, iface); err != nil {
+				log.Printf("[VM] Failed to update primary interface of VM %s: %v", vm.Name, err)
+			}
+		}
+	}
+
+	if err := h.vmDriftRepo.Resolve(ctx, drift.ID, services.DriftResolutionAcceptLibvirt, &userUUID); err != nil {
+		log.Printf("[VM] Failed to resolve drift %s: %v", drift.ID, err)
+	}
+
+	log.Printf("[VM] Accepted libvirt %s of VM %s: %s -> %s", found.Field, vm.Name, found.DBValue, found.LibvirtValue)
+	h.recordVMOperation(vm.ID, "accept_drift", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.drift_accept_libvirt", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":       vm.Name,
+			"field":         found.Field,
+			"db_value":      found.DBValue,
+			"libvirt_value": found.LibvirtValue,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"id":         drift.ID,
+		"field":      found.Field,
+		"value":      found.LibvirtValue,
+		"resolution": services.DriftResolutionAcceptLibvirt,
+	}))
+}
+
+// EnforceDBDrift writes the value of the VM record into the domain
+// definition. Only the drifted field is changed, so other drifts stay open
+// for their own decision. A running guest sees the change after its next
+// restart.
+func (h *VMHandler) EnforceDBDrift(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	drift, vm, def, ok := h.findOpenDrift(c)
+	if !ok {
+		return
+	}
+
+	found := currentDrift(drift, vm, def)
+	if found == nil {
+		if err := h.vmDriftRepo.Resolve(ctx, drift.ID, services.DriftResolutionCleared, nil); err != nil {
+			log.Printf("[VM] Failed to clear drift %s: %v", drift.ID, err)
+		}
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "drift_already_resolved"), services.DriftResolutionCleared))
+		return
+	}
+
+	paramsJSON, _ := json.Marshal(found)
+	params := string(paramsJSON)
+
+	if err := services.EnforceDBValue(def, vm, found.Field); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "failed_to_resolve_drift"), err.Error()))
+		return
+	}
+	xmlDesc, err := def.Marshal()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_resolve_drift"), err.Error()))
+		return
+	}
+
+	domain, err := h.libvirt.DefineXML(xmlDesc)
+	if err != nil {
+		h.recordVMOperation(vm.ID, "enforce_drift", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_resolve_drift"), err.Error()))
+		return
+	}
+	state, _, _ := domain.GetState()
+	domain.Free()
+
+	if err := h.vmDriftRepo.Resolve(ctx, drift.ID, services.DriftResolutionEnforceDB, &userUUID); err != nil {
+		log.Printf("[VM] Failed to resolve drift %s: %v", drift.ID, err)
+	}
+
+	log.Printf("[VM] Enforced %s of VM %s on its domain: %s -> %s", found.Field, vm.Name, found.LibvirtValue, found.DBValue)
+	h.recordVMOperation(vm.ID, "enforce_drift", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.drift_enforce_db", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":       vm.Name,
+			"field":         found.Field,
+			"db_value":      found.DBValue,
+			"libvirt_value": found.LibvirtValue,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"id":               drift.ID,
+		"field":            found.Field,
+		"value":            found.DBValue,
+		"resolution":       services.DriftResolutionEnforceDB,
+		"restart_required": state != 5 && state != 6,
+	}))
+}
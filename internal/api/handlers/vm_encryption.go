@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/diskcrypt"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func (h *VMHandler) SetKeyring(keyring *diskcrypt.Keyring) {
+	h.keyring = keyring
+}
+
+// newDiskEncryption returns the encryption settings for a new disk with a
+// fresh passphrase and secret UUID, and the passphrase itself.
+func newDiskEncryption(keyring *diskcrypt.Keyring) (models.DiskEncryption, []byte, error) {
+	if keyring == nil {
+		return models.DiskEncryption{}, nil, fmt.Errorf("no master key is configured")
+	}
+	passphrase, err := diskcrypt.NewPassphrase()
+	if err != nil {
+		return models.DiskEncryption{}, nil, err
+	}
+	wrapped, err := keyring.Wrap(passphrase)
+	if err != nil {
+		return models.DiskEncryption{}, nil, err
+	}
+	return models.DiskEncryption{Enabled: true, SecretUUID: uuid.New().String(), WrappedKey: wrapped}, passphrase, nil
+}
+
+// diskPassphrase unwraps the passphrase of an encrypted system disk.
+func diskPassphrase(keyring *diskcrypt.Keyring, vm models.VirtualMachine) ([]byte, error) {
+	if keyring == nil {
+		return nil, fmt.Errorf("no master key is configured")
+	}
+	return keyring.Unwrap(vm.Encryption.WrappedKey)
+}
+
+// ensureDiskSecret defines the libvirt secret of an encrypted system disk
+// from the wrapped key, so the domain opens even when libvirt lost the
+// secret or the disk was restored on another host.
+func ensureDiskSecret(client *libvirt.Client, keyring *diskcrypt.Keyring, vm models.VirtualMachine, diskPath string) error {
+	if !vm.Encryption.Enabled || client == nil {
+		return nil
+	}
+	passphrase, err := diskPassphrase(keyring, vm)
+	if err != nil {
+		return err
+	}
+	return client.DefineVolumeSecret(vm.Encryption.SecretUUID, diskPath, passphrase)
+}
+
+// createEncryptedDisk creates the encrypted system disk of vm at diskPath,
+// as a copy of templatePath when there is one, and defines its secret.
+func (h *VMHandler) createEncryptedDisk(ctx context.Context, vm models.VirtualMachine, diskPath, templatePath string) error {
+	passphrase, err := diskPassphrase(h.keyring, vm)
+	if err != nil {
+		return err
+	}
+	if templatePath != "" && exists(templatePath) {
+		log.Printf("[VM] Encrypting template disk to: %s", diskPath)
+		err = diskcrypt.ConvertImage(ctx, templatePath, nil, diskPath, passphrase)
+	} else {
+		log.Printf("[VM] Creating encrypted disk image: %s", diskPath)
+		err = diskcrypt.CreateImage(ctx, diskPath, vm.DiskAllocated, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	return h.libvirt.DefineVolumeSecret(vm.Encryption.SecretUUID, diskPath, passphrase)
+}
+
+// encryptVolume makes disk an encrypted qcow2 volume under a new passphrase
+// and defines its secret. With sizeGB the file libvirt just created is
+// replaced by an empty encrypted image of that size; without, the content
+// of the plain volume is copied into an encrypted image that takes its
+// place.
+func (h *VMHandler) encryptVolume(ctx context.Context, disk *models.StorageVolume, sizeGB int) error {
+	if disk.Path == "" || strings.HasPrefix(disk.Path, "/dev/") {
+		return fmt.Errorf("volume %s is not a file and cannot be encrypted", disk.Name)
+	}
+	encryption, passphrase, err := newDiskEncryption(h.keyring)
+	if err != nil {
+		return err
+	}
+	if sizeGB > 0 {
+		err = diskcrypt.CreateImage(ctx, disk.Path, sizeGB, passphrase)
+	} else {
+		tmpPath := disk.Path + ".encrypting"
+		err = diskcrypt.ConvertImage(ctx, disk.Path, nil, tmpPath, passphrase)
+		if err == nil {
+			err = os.Rename(tmpPath, disk.Path)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.libvirt.DefineVolumeSecret(encryption.SecretUUID, disk.Path, passphrase); err != nil {
+		return err
+	}
+	disk.Encryption = encryption
+	disk.Format = "qcow2"
+	log.Printf("[VM] Volume %s encrypted", disk.Name)
+	return nil
+}
+
+// ensureDataDiskSecrets defines the libvirt secrets of the encrypted data
+// disks of vm, like ensureDiskSecret does for the system disk.
+func ensureDataDiskSecrets(client *libvirt.Client, keyring *diskcrypt.Keyring, vm models.VirtualMachine) error {
+	for _, disk := range vm.DataDisks {
+		if !disk.Encryption.Enabled {
+			continue
+		}
+		if keyring == nil {
+			return fmt.Errorf("no master key is configured")
+		}
+		passphrase, err := keyring.Unwrap(disk.Encryption.WrappedKey)
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", disk.Name, err)
+		}
+		if err := client.DefineVolumeSecret(disk.Encryption.SecretUUID, disk.Path, passphrase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatePassphrase replaces the passphrase of the encrypted image at path.
+// The new passphrase goes into a free LUKS key slot before the old one is
+// erased, so the image opens at every step. save stores enc once it holds
+// the new wrapped key; if it fails, the secret and enc get the old
+// passphrase back and the returned saveErr is set.
+func (h *VMHandler) rotatePassphrase(ctx context.Context, path string, enc *models.DiskEncryption, oldPass []byte, save func() error) (saveErr, err error) {
+	newPass, err := diskcrypt.NewPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := h.keyring.Wrap(newPass)
+	if err != nil {
+		return nil, err
+	}
+
+	// An image that was never created gets the new key when it is.
+	_, statErr := os.Stat(path)
+	exists := statErr == nil
+	if exists {
+		if err := diskcrypt.AddPassphrase(ctx, path, oldPass, newPass); err != nil {
+			return nil, err
+		}
+	}
+	if h.libvirt != nil {
+		if err := h.libvirt.DefineVolumeSecret(enc.SecretUUID, path, newPass); err != nil {
+			return nil, err
+		}
+	}
+
+	previous := *enc
+	now := time.Now()
+	enc.WrappedKey = wrapped
+	enc.RotatedAt = &now
+	if err := save(); err != nil {
+		// The image still opens with the old passphrase, so put it back
+		// into the secret.
+		*enc = previous
+		if h.libvirt != nil {
+			h.libvirt.DefineVolumeSecret(enc.SecretUUID, path, oldPass)
+		}
+		return err, err
+	}
+
+	if exists {
+		if err := diskcrypt.RemovePassphrase(ctx, path, newPass, oldPass); err != nil {
+			log.Printf("[VM] Old key of %s is still in a key slot: %v", path, err)
+		}
+	}
+	return nil, nil
+}
+
+// domainStopped reports whether QEMU has let go of the VM's images;
+// qemu-img cannot change key slots while QEMU holds them.
+func (h *VMHandler) domainStopped(vm *models.VirtualMachine) bool {
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		return true
+	}
+	domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID)
+	if err != nil {
+		return true
+	}
+	defer domain.Free()
+	state, _, _ := domain.GetState()
+	return state == 5 || state == 6
+}
+
+// RotateDiskKey replaces the passphrase of an encrypted system disk.
+// Snapshots keep working as the volume key stays the same; backups keep
+// the passphrase they were taken with.
+func (h *VMHandler) RotateDiskKey(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if !vm.Encryption.Enabled {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "vm_disk_not_encrypted"), vm.Name))
+		return
+	}
+
+	if h.keyring == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "disk_encryption_unavailable"), "no master key is configured"))
+		return
+	}
+
+	if !h.domainStopped(vm) {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeVMConflict, t(c, "vm_not_stopped"), vm.Name))
+		return
+	}
+
+	diskPath := vm.DiskPath
+	if diskPath == "" {
+		diskPath = fmt.Sprintf("%s/%s.qcow2", h.storagePath, vm.ID.String())
+	}
+
+	fail := func(err error) {
+		log.Printf("[VM] Failed to rotate disk key of VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "rotate_disk_key", "failed", &userUUID, ipAddress, userAgent, "", "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_rotate_disk_key"), err.Error()))
+	}
+
+	oldPass, err := diskPassphrase(h.keyring, *vm)
+	if err != nil {
+		fail(err)
+		return
+	}
+	saveErr, err := h.rotatePassphrase(ctx, diskPath, &vm.Encryption, oldPass, func() error {
+		return h.vmRepo.Update(ctx, vm)
+	})
+	if saveErr != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_rotate_disk_key"), saveErr.Error()))
+		return
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	log.Printf("[VM] Disk key of VM %s rotated", vm.Name)
+	h.recordVMOperation(vm.ID, "rotate_disk_key", "success", &userUUID, ipAddress, userAgent, "", "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.rotate_disk_key", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":     vm.Name,
+			"secret_uuid": vm.Encryption.SecretUUID,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(vm.Encryption))
+}
+
+// RotateDataDiskKey replaces the passphrase of an encrypted data disk of a
+// stopped VM, the same way RotateDiskKey does for the system disk.
+func (h *VMHandler) RotateDataDiskKey(c *gin.Context) {
+	id := c.Param("id")
+	ref := c.Param("disk")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.storageVolumeRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "storage is not initialized"))
+		return
+	}
+
+	h.loadDataDisks(ctx, vm)
+	disk := findVMDataDisk(vm, ref)
+	if disk == nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "storage_volume_not_found"), ref))
+		return
+	}
+
+	if !disk.Encryption.Enabled {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "vm_disk_not_encrypted"), disk.Name))
+		return
+	}
+
+	if h.keyring == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "disk_encryption_unavailable"), "no master key is configured"))
+		return
+	}
+
+	if !h.domainStopped(vm) {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeVMConflict, t(c, "vm_not_stopped"), vm.Name))
+		return
+	}
+
+	params := fmt.Sprintf(`{"volume_id":%q,"target":%q}`, disk.ID, disk.TargetDev)
+
+	fail := func(err error) {
+		log.Printf("[VM] Failed to rotate key of disk %s of VM %s: %v", disk.TargetDev, vm.Name, err)
+		h.recordVMOperation(vm.ID, "rotate_disk_key", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_rotate_disk_key"), err.Error()))
+	}
+
+	oldPass, err := h.keyring.Unwrap(disk.Encryption.WrappedKey)
+	if err != nil {
+		fail(err)
+		return
+	}
+	saveErr, err := h.rotatePassphrase(ctx, disk.Path, &disk.Encryption, oldPass, func() error {
+		return h.storageVolumeRepo.Update(ctx, disk)
+	})
+	if saveErr != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_rotate_disk_key"), saveErr.Error()))
+		return
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	log.Printf("[VM] Key of disk %s of VM %s rotated", disk.TargetDev, vm.Name)
+	h.recordVMOperation(vm.ID, "rotate_disk_key", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.disk.rotate_key", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":     vm.Name,
+			"volume":      disk.ID,
+			"target":      disk.TargetDev,
+			"secret_uuid": disk.Encryption.SecretUUID,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(disk.Encryption))
+}
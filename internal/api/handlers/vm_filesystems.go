@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// mountTagRegex limits mount tags to what fits the 36 byte virtio-fs tag.
+var mountTagRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,36}$`)
+
+type AddVMFilesystemRequest struct {
+	SharedFolderID string `json:"shared_folder_id" binding:"required"`
+	SubPath        string `json:"sub_path"`
+	MountTag       string `json:"mount_tag"`
+	Mode           string `json:"mode" binding:"omitempty,oneof=ro rw"`
+}
+
+func (h *VMHandler) SetSharedFolderRepos(folders *repository.SharedFolderRepository, filesystems *repository.VMFilesystemRepository) {
+	h.sharedFolderRepo = folders
+	h.vmFilesystemRepo = filesystems
+}
+
+// loadFilesystems fills vm.Filesystems so generateDomainXML keeps every
+// shared folder when the domain is redefined. Mappings are checked against
+// the shared folders as they are now: ones the owner may no longer use are
+// left out and writable ones become read-only once the folder stops
+// allowing writes.
+func (h *VMHandler) loadFilesystems(ctx context.Context, vm *models.VirtualMachine) {
+	if h.vmFilesystemRepo == nil || h.sharedFolderRepo == nil {
+		return
+	}
+	filesystems, err := h.vmFilesystemRepo.ListByVM(ctx, vm.ID.String())
+	if err != nil {
+		log.Printf("[VM] Failed to load filesystems of VM %s: %v", vm.Name, err)
+		return
+	}
+	vm.Filesystems = nil
+	if len(filesystems) == 0 {
+		return
+	}
+	owner, err := h.userRepo.FindByID(ctx, vm.OwnerID.String())
+	if err != nil {
+		log.Printf("[VM] Leaving out the filesystems of VM %s, its owner is gone: %v", vm.Name, err)
+		return
+	}
+	for _, fs := range filesystems {
+		folder, err := h.sharedFolderRepo.FindByID(ctx, fs.SharedFolderID.String())
+		if err != nil {
+			log.Printf("[VM] Leaving out filesystem %s of VM %s, its shared folder is gone", fs.MountTag, vm.Name)
+			continue
+		}
+		checked, err := checkFilesystem(fs, folder, owner)
+		if err != nil {
+			log.Printf("[VM] Leaving out filesystem %s of VM %s: %v", fs.MountTag, vm.Name, err)
+			continue
+		}
+		if checked.ReadOnly != fs.ReadOnly {
+			log.Printf("[VM] Filesystem %s of VM %s is read-only now, shared folder %s no longer allows writes", fs.MountTag, vm.Name, folder.Name)
+		}
+		vm.Filesystems = append(vm.Filesystems, checked)
+	}
+}
+
+// checkFilesystem checks a mapping against the current settings of its
+// shared folder. It returns the mapping, read-only if the folder no longer
+// allows writes, or an error when owner may no longer use the folder or the
+// source is no longer inside its host path.
+func checkFilesystem(fs models.VMFilesystem, folder *models.SharedFolder, owner *models.User) (models.VMFilesystem, error) {
+	if !sharedFolderAllowed(folder, owner.ID, owner.Role) {
+		return fs, fmt.Errorf("user %s may no longer use shared folder %s", owner.Username, folder.Name)
+	}
+	root, err := resolveHostDir(folder.HostPath)
+	if err != nil {
+		return fs, err
+	}
+	source, err := resolveHostDir(fs.SourcePath)
+	if err != nil {
+		return fs, err
+	}
+	rel, err := filepath.Rel(root, source)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fs, fmt.Errorf("%s is no longer inside shared folder %s", fs.SourcePath, folder.Name)
+	}
+	if !folder.AllowWrite {
+		fs.ReadOnly = true
+	}
+	return fs, nil
+}
+
+// sharedSourcePath resolves subPath below the host path of folder. The
+// result has to stay inside the folder once symlinks are followed, so a
+// link in the shared tree cannot expose other host directories.
+func sharedSourcePath(folder *models.SharedFolder, subPath string) (string, error) {
+	root, err := resolveHostDir(folder.HostPath)
+	if err != nil {
+		return "", err
+	}
+	if subPath == "" {
+		return root, nil
+	}
+	if filepath.IsAbs(subPath) {
+		return "", fmt.Errorf("sub_path must be relative to the shared folder")
+	}
+	path, err := resolveHostDir(filepath.Join(root, subPath))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("sub_path %s leads outside of the shared folder", subPath)
+	}
+	return path, nil
+}
+
+// defaultMountTag derives a mount tag from the name of a shared folder.
+func defaultMountTag(name string) string {
+	tag := strings.Map(func(r rune) rune {
+		if r < 128 && mountTagRegex.MatchString(string(r)) {
+			return r
+		}
+		return '_'
+	}, name)
+	if len(tag) > 36 {
+		tag = tag[:36]
+	}
+	return tag
+}
+
+// generateFilesystemsConfig describes the virtio-fs shares of vm.
+func generateFilesystemsConfig(vm models.VirtualMachine) []libvirt.DomainFilesystem {
+	var devices []libvirt.DomainFilesystem
+	for _, fs := range vm.Filesystems {
+		device := libvirt.DomainFilesystem{
+			Type:       "mount",
+			AccessMode: "passthrough",
+			Driver:     &libvirt.FilesystemDriver{Type: "virtiofs"},
+			Source:     &libvirt.FilesystemSource{Dir: fs.SourcePath},
+			Target:     &libvirt.FilesystemTarget{Dir: fs.MountTag},
+		}
+		if fs.ReadOnly {
+			device.ReadOnly = &struct{}{}
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// applySharedMemory shares the guest memory with virtiofsd, which virtio-fs
+// needs. Hugepage backed memory only needs the access mode, anything else
+// is backed by memfd.
+func applySharedMemory(def *libvirt.DomainDef, vm models.VirtualMachine) {
+	if len(vm.Filesystems) == 0 {
+		return
+	}
+	if def.MemoryBacking == nil {
+		def.MemoryBacking = &libvirt.MemoryBacking{}
+	}
+	if def.MemoryBacking.HugePages == nil {
+		def.MemoryBacking.Source = &libvirt.MemorySource{Type: "memfd"}
+	}
+	def.MemoryBacking.Access = &libvirt.MemoryAccess{Mode: "shared"}
+}
+
+// checkVirtiofs fails when the host lists its filesystem drivers and
+// virtio-fs is not among them.
+func (h *VMHandler) checkVirtiofs(vm models.VirtualMachine) error {
+	if h.libvirt == nil {
+		return nil
+	}
+	caps, err := h.libvirt.GetHostCapabilities(false)
+	if err != nil {
+		log.Printf("[VM] Host capabilities unavailable, skipping virtio-fs check for VM %s: %v", vm.Name, err)
+		return nil
+	}
+	arch := vm.Architecture
+	if arch == "" {
+		arch = "x86_64"
+	}
+	guest := caps.Guest(arch)
+	if guest != nil && len(guest.FilesystemDrivers) > 0 && !slices.Contains(guest.FilesystemDrivers, "virtiofs") {
+		return fmt.Errorf("virtio-fs is not supported on this host")
+	}
+	return nil
+}
+
+func mountTags(filesystems []models.VMFilesystem) []string {
+	tags := []string{}
+	for _, fs := range filesystems {
+		tags = append(tags, fs.MountTag)
+	}
+	return tags
+}
+
+// applyFilesystemChange redefines the domain of vm after its filesystems
+// changed from before. A running guest only sees the change after its next
+// power cycle, which is recorded as pending.
+func (h *VMHandler) applyFilesystemChange(c *gin.Context, vm *models.VirtualMachine, before []string) (bool, error) {
+	active, err := h.redefineDomain(c, vm)
+	if err != nil || !active {
+		return active, err
+	}
+	pending := pendingChanges(*vm)
+	mergePendingChanges(pending, map[string]interface{}{"filesystems": before}, map[string]interface{}{"filesystems": mountTags(vm.Filesystems)})
+	vm.PendingChanges = ""
+	if len(pending) > 0 {
+		encoded, _ := json.Marshal(pending)
+		vm.PendingChanges = string(encoded)
+	}
+	return true, h.vmRepo.Update(c.Request.Context(), vm)
+}
+
+func (h *VMHandler) ListFilesystems(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	h.loadFilesystems(ctx, vm)
+	filesystems := vm.Filesystems
+	if filesystems == nil {
+		filesystems = []models.VMFilesystem{}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(filesystems))
+}
+
+// AddFilesystem maps a shared folder, or a directory below it, into a VM.
+// The guest mounts it with "mount -t virtiofs <mount_tag> <dir>".
+func (h *VMHandler) AddFilesystem(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req AddVMFilesystemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.sharedFolderRepo == nil || h.vmFilesystemRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_add_filesystem"), "shared folders are not initialized"))
+		return
+	}
+
+	folder, err := h.sharedFolderRepo.FindByID(ctx, req.SharedFolderID)
+	if err != nil || !sharedFolderAllowed(folder, userUUID, role) {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "shared_folder_not_found"), req.SharedFolderID))
+		return
+	}
+
+	readOnly := req.Mode != "rw"
+	if !readOnly && !folder.AllowWrite {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "shared_folder_read_only"), folder.Name))
+		return
+	}
+
+	sourcePath, err := sharedSourcePath(folder, req.SubPath)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_shared_folder"), err.Error()))
+		return
+	}
+
+	tag := req.MountTag
+	if tag == "" {
+		tag = defaultMountTag(folder.Name)
+	}
+	if !mountTagRegex.MatchString(tag) {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), "mount_tag must be 1 to 36 letters, digits, dots, dashes or underscores"))
+		return
+	}
+
+	// Tags of mappings loadFilesystems leaves out stay taken, as they come
+	// back once the folder allows them again.
+	existing, err := h.vmFilesystemRepo.ListByVM(ctx, vm.ID.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_add_filesystem"), err.Error()))
+		return
+	}
+	h.loadFilesystems(ctx, vm)
+	before := mountTags(vm.Filesystems)
+	if slices.Contains(mountTags(existing), tag) {
+		c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "mount_tag_in_use"), tag))
+		return
+	}
+
+	if err := h.checkVirtiofs(*vm); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_vm_config"), err.Error()))
+		return
+	}
+
+	fs := models.VMFilesystem{
+		VMID:           vm.ID,
+		SharedFolderID: folder.ID,
+		SourcePath:     sourcePath,
+		MountTag:       tag,
+		ReadOnly:       readOnly,
+	}
+	if err := h.vmFilesystemRepo.Create(ctx, &fs); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_add_filesystem"), err.Error()))
+		return
+	}
+
+	params := fmt.Sprintf(`{"shared_folder_id":%q,"source":%q,"mount_tag":%q,"read_only":%v}`, folder.ID, sourcePath, tag, readOnly)
+
+	active, err := h.applyFilesystemChange(c, vm, before)
+	if err != nil {
+		h.vmFilesystemRepo.Delete(ctx, fs.ID.String())
+		log.Printf("[VM] Failed to add filesystem %s to VM %s: %v", tag, vm.Name, err)
+		h.recordVMOperation(vm.ID, "add_filesystem", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_add_filesystem"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Filesystem %s (%s) added to VM %s", tag, sourcePath, vm.Name)
+	h.recordVMOperation(vm.ID, "add_filesystem", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.filesystem.add", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":       vm.Name,
+			"shared_folder": folder.Name,
+			"source":        sourcePath,
+			"mount_tag":     tag,
+			"read_only":     readOnly,
+		})
+	}
+
+	c.JSON(http.StatusCreated, errors.Success(gin.H{
+		"filesystem":       fs,
+		"restart_required": active,
+	}))
+}
+
+func (h *VMHandler) RemoveFilesystem(c *gin.Context) {
+	id := c.Param("id")
+	fsID := c.Param("fsid")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.vmFilesystemRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_remove_filesystem"), "shared folders are not initialized"))
+		return
+	}
+
+	fs, err := h.vmFilesystemRepo.FindByVMAndID(ctx, vm.ID.String(), fsID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "filesystem_not_found"), fsID))
+		return
+	}
+
+	h.loadFilesystems(ctx, vm)
+	before := mountTags(vm.Filesystems)
+	if err := h.vmFilesystemRepo.Delete(ctx, fs.ID.String()); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_remove_filesystem"), err.Error()))
+		return
+	}
+
+	params := fmt.Sprintf(`{"filesystem_id":%q,"mount_tag":%q}`, fs.ID, fs.MountTag)
+
+	active, err := h.applyFilesystemChange(c, vm, before)
+	if err != nil {
+		log.Printf("[VM] Failed to remove filesystem %s from VM %s: %v", fs.MountTag, vm.Name, err)
+		h.recordVMOperation(vm.ID, "remove_filesystem", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_remove_filesystem"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Filesystem %s removed from VM %s", fs.MountTag, vm.Name)
+	h.recordVMOperation(vm.ID, "remove_filesystem", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.filesystem.remove", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":   vm.Name,
+			"mount_tag": fs.MountTag,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"mount_tag":        fs.MountTag,
+		"restart_required": active,
+	}))
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func (h *VMHandler) SetFlavors(repo *repository.FlavorRepository, requireFlavor bool) {
+	h.flavorRepo = repo
+	h.requireFlavor = requireFlavor
+}
+
+// customSizesAllowed reports whether users with role may pick CPU, memory
+// and disk sizes outside of a flavor. Admins always can.
+func (h *VMHandler) customSizesAllowed(role interface{}) bool {
+	return role == "admin" || !h.requireFlavor
+}
+
+// lookupFlavor returns the flavor with id if the user may use it, writing
+// the error response otherwise.
+func (h *VMHandler) lookupFlavor(c *gin.Context, id string, userID uuid.UUID, role interface{}) (*models.Flavor, bool) {
+	if h.flavorRepo == nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "flavor_not_found"), id))
+		return nil, false
+	}
+	flavor, err := h.flavorRepo.FindByID(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "flavor_not_found"), id))
+		return nil, false
+	}
+	if !flavorAllowed(flavor, userID, role) {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_flavor"), flavor.Name))
+		return nil, false
+	}
+	return flavor, true
+}
+
+// applyFlavor sizes vm after flavor and sets its QoS limits, which callers
+// still have to cap. Dedicated flavors pin every vCPU to a host CPU no
+// other VM is pinned to. Those CPUs stay held until the caller has saved vm
+// and calls releaseHostCPUs. The disk size is left to the caller since
+// growing it needs I/O.
+func (h *VMHandler) applyFlavor(ctx context.Context, vm *models.VirtualMachine, flavor *models.Flavor) error {
+	if vm.FlavorID != nil && *vm.FlavorID != flavor.ID {
+		h.leaveFlavor(ctx, vm)
+	}
+	vm.FlavorID = &flavor.ID
+	vm.CPUAllocated = flavor.CPU
+	vm.MemoryAllocated = flavor.Memory
+	vm.QoS = flavor.QoS
+
+	if flavor.CPUPolicy != cpuPolicyDedicated {
+		return nil
+	}
+	if h.libvirt == nil {
+		return fmt.Errorf("flavor %s needs dedicated CPUs, which requires a libvirt connection", flavor.Name)
+	}
+	caps, err := h.libvirt.GetHostCapabilities(false)
+	if err != nil {
+		return fmt.Errorf("flavor %s needs dedicated CPUs: %w", flavor.Name, err)
+	}
+
+	// The pins only reach the database when the caller saves vm, so CPUs
+	// picked by requests still in flight are held in memory until then.
+	h.dedicatedMu.Lock()
+	defer h.dedicatedMu.Unlock()
+	used, err := h.pinnedHostCPUs(ctx, vm.ID)
+	if err != nil {
+		return err
+	}
+	h.addHeldHostCPUs(used, vm.ID)
+	cpus, err := allocateHostCPUs(caps, used, flavor.CPU)
+	if err != nil {
+		return fmt.Errorf("flavor %s needs dedicated CPUs: %w", flavor.Name, err)
+	}
+	if h.dedicatedHeld == nil {
+		h.dedicatedHeld = map[uuid.UUID][]int{}
+	}
+	h.dedicatedHeld[vm.ID] = cpus
+
+	tuning := vmTuning(*vm)
+	if tuning == nil {
+		tuning = &VMTuning{}
+	}
+	tuning.VCPUPins = make(map[int]string, len(cpus))
+	for vcpu, cpu := range cpus {
+		tuning.VCPUPins[vcpu] = strconv.Itoa(cpu)
+	}
+	setVMTuning(vm, tuning)
+	return nil
+}
+
+// addHeldHostCPUs adds the CPUs held for VMs other than exclude to used.
+// The caller holds dedicatedMu.
+func (h *VMHandler) addHeldHostCPUs(used map[int]bool, exclude uuid.UUID) {
+	for id, held := range h.dedicatedHeld {
+		if id == exclude {
+			continue
+		}
+		for _, cpu := range held {
+			used[cpu] = true
+		}
+	}
+}
+
+// releaseHostCPUs drops the hold applyFlavor put on the dedicated CPUs of
+// the VM with id, once the VM is saved with its pins or has been given up.
+func (h *VMHandler) releaseHostCPUs(id uuid.UUID) {
+	h.dedicatedMu.Lock()
+	delete(h.dedicatedHeld, id)
+	h.dedicatedMu.Unlock()
+}
+
+// leaveFlavor detaches vm from its flavor, dropping the CPU pins a
+// dedicated flavor gave it.
+func (h *VMHandler) leaveFlavor(ctx context.Context, vm *models.VirtualMachine) {
+	if vm.FlavorID == nil {
+		return
+	}
+	if h.flavorRepo != nil {
+		old, err := h.flavorRepo.FindByID(ctx, vm.FlavorID.String())
+		if tuning := vmTuning(*vm); err == nil && old.CPUPolicy == cpuPolicyDedicated && tuning != nil {
+			tuning.VCPUPins = nil
+			setVMTuning(vm, tuning)
+		}
+	}
+	vm.FlavorID = nil
+}
+
+// pinnedHostCPUs returns the host CPUs that VMs other than exclude have
+// their vCPUs or emulator threads pinned to.
+func (h *VMHandler) pinnedHostCPUs(ctx context.Context, exclude uuid.UUID) (map[int]bool, error) {
+	vms, err := h.vmRepo.ListTuned(ctx)
+	if err != nil {
+		return nil, err
+	}
+	used := map[int]bool{}
+	for _, other := range vms {
+		tuning := vmTuning(other)
+		if other.ID == exclude || tuning == nil {
+			continue
+		}
+		sets := []string{tuning.EmulatorPin}
+		for _, set := range tuning.VCPUPins {
+			sets = append(sets, set)
+		}
+		for _, set := range sets {
+			if set == "" {
+				continue
+			}
+			cpus, err := parseCPUSet(set)
+			if err != nil {
+				continue
+			}
+			for _, cpu := range cpus {
+				used[cpu] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// allocateHostCPUs picks n host CPUs that are not in used, from a single
+// NUMA cell when one has enough free CPUs and across cells otherwise.
+func allocateHostCPUs(caps *libvirt.HostCapabilities, used map[int]bool, n int) ([]int, error) {
+	if len(caps.NUMACells) == 0 {
+		return nil, fmt.Errorf("host CPU topology is unknown")
+	}
+
+	var all []int
+	for _, cell := range caps.NUMACells {
+		var free []int
+		for _, cpu := range cell.CPUs {
+			if !used[cpu] {
+				free = append(free, cpu)
+			}
+		}
+		if len(free) >= n {
+			return free[:n], nil
+		}
+		all = append(all, free...)
+	}
+	if len(all) < n {
+		return nil, fmt.Errorf("only %d of the %d requested host CPUs are free", len(all), n)
+	}
+	return all[:n], nil
+}
+
+// resizeClone applies flavor to a freshly cloned vm, grows its disk to the
+// flavor size and rewrites its domain definition to match.
+func (h *VMHandler) resizeClone(c *gin.Context, vm *models.VirtualMachine, flavor *models.Flavor) error {
+	ctx := c.Request.Context()
+
+	if err := h.applyFlavor(ctx, vm, flavor); err != nil {
+		return err
+	}
+	owner, err := h.userRepo.FindByID(ctx, vm.OwnerID.String())
+	if err != nil {
+		return err
+	}
+	if vm.QoS, err = capQoS(vm.QoS, owner.QoSMax); err != nil {
+		return err
+	}
+	if err := validateTuning(*vm, vmTuning(*vm)); err != nil {
+		return err
+	}
+	if err := h.applyHostCapabilities(vm); err != nil {
+		return err
+	}
+
+	if flavor.Disk > vm.DiskAllocated {
+		if err := h.resizeRootDisk(c, vm, int64(flavor.Disk), false); err != nil {
+			return err
+		}
+		vm.DiskAllocated = flavor.Disk
+	}
+	_, err = h.redefineDomain(c, vm)
+	return err
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"vmmanager/internal/api/errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func (h *VMHandler) GetGuestInfo(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if c.Query("refresh") == "true" {
+		if vm.Status != "running" {
+			c.JSON(http.StatusBadRequest, errors.FailWithCode(errors.ErrCodeBadRequest, t(c, "vm_not_running")))
+			return
+		}
+		if h.guestAgentService == nil || h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+			c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
+			return
+		}
+
+		info, err := h.guestAgentService.Collect(ctx, vm)
+		if err != nil {
+			log.Printf("[VM] Failed to collect guest info for VM %s: %v", id, err)
+			c.JSON(http.StatusBadGateway, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "guest_agent_unavailable"), err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, errors.Success(gin.H{
+			"agent_connected": true,
+			"ip_address":      info.PrimaryIP,
+			"guest_info":      info,
+			"collected_at":    info.CollectedAt,
+		}))
+		return
+	}
+
+	var guestInfo interface{}
+	if vm.GuestInfo != nil {
+		json.Unmarshal([]byte(*vm.GuestInfo), &guestInfo)
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"agent_connected": vm.AgentConnected,
+		"ip_address":      vm.IPAddress,
+		"guest_info":      guestInfo,
+		"collected_at":    vm.GuestInfoAt,
+	}))
+}
+
+type GuestExecRequest struct {
+	Path    string   `json:"path" binding:"required"`
+	Args    []string `json:"args"`
+	Input   string   `json:"input"`
+	Timeout int      `json:"timeout" binding:"omitempty,min=1,max=300"`
+}
+
+// GuestExec runs a command inside the guest through qemu-guest-agent. Unlike
+// other VM actions it is restricted to the VM owner, admins included.
+func (h *VMHandler) GuestExec(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req GuestExecRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_request"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if vm.Status != "running" {
+		c.JSON(http.StatusBadRequest, errors.FailWithCode(errors.ErrCodeBadRequest, t(c, "vm_not_running")))
+		return
+	}
+
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
+		return
+	}
+
+	timeout := 30 * time.Second
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+
+	params, _ := json.Marshal(gin.H{"path": req.Path, "args": req.Args})
+
+	result, err := h.libvirt.GuestExec(vm.LibvirtDomainUUID, req.Path, req.Args, []byte(req.Input), timeout)
+	if err != nil {
+		log.Printf("[VM] Guest exec failed for VM %s: %v", id, err)
+		h.recordVMOperation(vm.ID, "guest_exec", "failed", &userUUID, ipAddress, userAgent, string(params), "", err.Error())
+		c.JSON(http.StatusBadGateway, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "guest_exec_failed"), err.Error()))
+		return
+	}
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.guest_exec", "virtual_machine", &vm.ID, map[string]interface{}{
+			"path":      req.Path,
+			"args":      req.Args,
+			"exit_code": result.ExitCode,
+		})
+	}
+	h.recordVMOperation(vm.ID, "guest_exec", "success", &userUUID, ipAddress, userAgent, string(params), "", "")
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"exit_code":     result.ExitCode,
+		"signal":        result.Signal,
+		"stdout":        result.Stdout,
+		"stderr":        result.Stderr,
+		"out_truncated": result.OutTruncated,
+		"err_truncated": result.ErrTruncated,
+	}))
+}
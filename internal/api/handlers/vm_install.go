@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"vmmanager/internal/models"
+	"vmmanager/internal/services"
+)
+
+// SetInstallMonitor registers the handler as the monitor's completion
+// handler so finished installs boot from disk without user action.
+func (h *VMHandler) SetInstallMonitor(monitor *services.InstallMonitor) {
+	h.installMonitor = monitor
+	if monitor != nil {
+		monitor.SetCompletionHandler(h.bootInstalledSystem)
+	}
+}
+
+// bootInstalledSystem redefines the domain to boot from disk without the
+// installer ISO, kernel and answer file media, removes the generated files
+// and starts the installed system. The install stays in progress until the
+// monitor sees the first boot.
+func (h *VMHandler) bootInstalledSystem(ctx context.Context, vm *models.VirtualMachine) error {
+	if h.libvirt == nil {
+		return fmt.Errorf("libvirt client is not initialized")
+	}
+
+	h.loadDataDisks(ctx, vm)
+	h.loadInterfaces(ctx, vm)
+	h.loadFilesystems(ctx, vm)
+	installed := *vm
+	installed.IsInstalled = true
+	installed.BootOrder = "hd,cdrom,network"
+
+	diskPath := installed.DiskPath
+	if diskPath == "" {
+		diskPath = fmt.Sprintf("%s/%s.qcow2", h.storagePath, vm.ID.String())
+	}
+
+	domain, err := h.libvirt.DefineXML(generateDomainXML(installed, diskPath, ""))
+	if err != nil {
+		return err
+	}
+	defer domain.Free()
+
+	*vm = installed
+	vm.PendingChanges = ""
+	removeInstallMedia(vm)
+	vm.LibvirtDomainUUID = domain.UUID
+
+	var startErr error
+	if state, _, _ := domain.GetState(); state != 1 {
+		if startErr = domain.Create(); startErr == nil {
+			vm.Status = "running"
+		} else {
+			vm.Status = "stopped"
+		}
+	}
+
+	if err := h.vmRepo.Update(ctx, vm); err != nil {
+		log.Printf("[VM] Failed to update VM after install: %v", err)
+	}
+
+	if startErr != nil {
+		return fmt.Errorf("failed to start installed system: %w", startErr)
+	}
+
+	log.Printf("[VM] Installer of VM %s finished, booting from disk", vm.Name)
+	return nil
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxKeyStepTime bounds the hold time and the delay of a single step,
+	// in milliseconds, and maxSendKeysDuration a whole sequence, which
+	// runs while the request waits.
+	maxKeyStepTime      = 10000
+	maxSendKeysDuration = 60 * time.Second
+)
+
+type SendKeysStep struct {
+	Keys     string `json:"keys"`
+	Keycodes []uint `json:"keycodes"`
+	Codeset  string `json:"codeset"`
+	HoldTime uint   `json:"hold_time"`
+	DelayMs  uint   `json:"delay_ms"`
+}
+
+type SendKeysRequest struct {
+	Sequence []SendKeysStep `json:"sequence" binding:"required,min=1,max=32"`
+}
+
+type resolvedKeyStep struct {
+	codeset  uint
+	keycodes []uint
+	holdTime uint
+	delay    time.Duration
+}
+
+func resolveSendKeysSteps(steps []SendKeysStep) ([]resolvedKeyStep, error) {
+	resolved := make([]resolvedKeyStep, 0, len(steps))
+	var total time.Duration
+	for i, step := range steps {
+		if (step.Keys == "") == (len(step.Keycodes) == 0) {
+			return nil, fmt.Errorf("step %d: exactly one of keys or keycodes is required", i)
+		}
+		if step.HoldTime > maxKeyStepTime || step.DelayMs > maxKeyStepTime {
+			return nil, fmt.Errorf("step %d: hold_time and delay_ms must not exceed %d", i, maxKeyStepTime)
+		}
+		total += time.Duration(step.HoldTime+step.DelayMs) * time.Millisecond
+		if total > maxSendKeysDuration {
+			return nil, fmt.Errorf("step %d: the sequence must not take longer than %v", i, maxSendKeysDuration)
+		}
+
+		r := resolvedKeyStep{
+			holdTime: step.HoldTime,
+			delay:    time.Duration(step.DelayMs) * time.Millisecond,
+		}
+		if step.Keys != "" {
+			if step.Codeset != "" && step.Codeset != "linux" {
+				return nil, fmt.Errorf("step %d: named keys only support the linux codeset", i)
+			}
+			keycodes, err := libvirt.ParseKeyCombo(step.Keys)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %w", i, err)
+			}
+			codeset, _ := libvirt.ParseKeycodeSet("linux")
+			r.codeset = codeset
+			r.keycodes = keycodes
+		} else {
+			if len(step.Keycodes) > libvirt.MaxSendKeys {
+				return nil, fmt.Errorf("step %d: at most %d keycodes per step", i, libvirt.MaxSendKeys)
+			}
+			codeset, err := libvirt.ParseKeycodeSet(step.Codeset)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %w", i, err)
+			}
+			r.codeset = codeset
+			r.keycodes = step.Keycodes
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved, nil
+}
+
+// waitKeyDelay waits for delay between two steps, or until the client goes
+// away.
+func waitKeyDelay(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *VMHandler) SendKeys(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req SendKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_request"), err.Error()))
+		return
+	}
+
+	steps, err := resolveSendKeysSteps(req.Sequence)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "invalid_key_sequence"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if vm.Status != "running" {
+		c.JSON(http.StatusBadRequest, errors.FailWithCode(errors.ErrCodeBadRequest, t(c, "vm_not_running")))
+		return
+	}
+
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
+		return
+	}
+
+	params, _ := json.Marshal(req)
+
+	for i, step := range steps {
+		if err := h.libvirt.SendKey(vm.LibvirtDomainUUID, step.codeset, step.holdTime, step.keycodes); err != nil {
+			log.Printf("[VM] Failed to send keys to VM %s (step %d): %v", id, i, err)
+			h.recordVMOperation(vm.ID, "send_keys", "failed", &userUUID, ipAddress, userAgent, string(params), "", err.Error())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_send_keys"), err.Error()))
+			return
+		}
+		if step.delay > 0 && i < len(steps)-1 {
+			if err := waitKeyDelay(ctx, step.delay); err != nil {
+				log.Printf("[VM] Stopped sending keys to VM %s after step %d: %v", id, i, err)
+				h.recordVMOperation(vm.ID, "send_keys", "failed", &userUUID, ipAddress, userAgent, string(params), "", err.Error())
+				return
+			}
+		}
+	}
+
+	log.Printf("[VM] Sent %d key steps to VM %s", len(steps), id)
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.send_keys", "virtual_machine", &vm.ID, map[string]interface{}{
+			"steps": len(steps),
+		})
+	}
+	h.recordVMOperation(vm.ID, "send_keys", "success", &userUUID, ipAddress, userAgent, string(params), "", "")
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"id":    vm.ID,
+		"steps": len(steps),
+	}))
+}
+
+func (h *VMHandler) PressPowerButton(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if vm.Status != "running" {
+		c.JSON(http.StatusBadRequest, errors.FailWithCode(errors.ErrCodeBadRequest, t(c, "vm_not_running")))
+		return
+	}
+
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
+		return
+	}
+
+	if err := h.libvirt.PressPowerButton(vm.LibvirtDomainUUID); err != nil {
+		log.Printf("[VM] Failed to press power button for VM %s: %v", id, err)
+		h.recordVMOperation(vm.ID, "power_button", "failed", &userUUID, ipAddress, userAgent, "", "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_press_power_button"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] ACPI power button pressed for VM %s", id)
+
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.power_button", "virtual_machine", &vm.ID, nil)
+	}
+	h.recordVMOperation(vm.ID, "power_button", "success", &userUUID, ipAddress, userAgent, "", "", "")
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"id":     vm.ID,
+		"status": vm.Status,
+	}))
+}
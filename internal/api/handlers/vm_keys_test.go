@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResolveSendKeysSteps(t *testing.T) {
+	long := make([]SendKeysStep, 7)
+	for i := range long {
+		long[i] = SendKeysStep{Keys: "enter", HoldTime: 1000, DelayMs: maxKeyStepTime}
+	}
+
+	tests := []struct {
+		name    string
+		steps   []SendKeysStep
+		wantErr bool
+	}{
+		{name: "named keys", steps: []SendKeysStep{{Keys: "ctrl+alt+del", HoldTime: 100, DelayMs: 500}, {Keys: "enter"}}},
+		{name: "raw keycodes", steps: []SendKeysStep{{Keycodes: []uint{0x1d, 0x38}, Codeset: "xt"}}},
+		{name: "keys and keycodes", steps: []SendKeysStep{{Keys: "enter", Keycodes: []uint{28}}}, wantErr: true},
+		{name: "neither", steps: []SendKeysStep{{HoldTime: 10}}, wantErr: true},
+		{name: "unknown key", steps: []SendKeysStep{{Keys: "ctrl+hyper"}}, wantErr: true},
+		{name: "named keys in another codeset", steps: []SendKeysStep{{Keys: "enter", Codeset: "usb"}}, wantErr: true},
+		{name: "unknown codeset", steps: []SendKeysStep{{Keycodes: []uint{1}, Codeset: "ebcdic"}}, wantErr: true},
+		{name: "too many keycodes", steps: []SendKeysStep{{Keycodes: make([]uint, 17)}}, wantErr: true},
+		{name: "hold time too long", steps: []SendKeysStep{{Keys: "enter", HoldTime: maxKeyStepTime + 1}}, wantErr: true},
+		{name: "delay too long", steps: []SendKeysStep{{Keys: "enter", DelayMs: maxKeyStepTime + 1}}, wantErr: true},
+		{name: "sequence too long", steps: long, wantErr: true},
+		{name: "sequence at the limit", steps: long[:5]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSendKeysSteps(tt.steps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveSendKeysSteps error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(got) != len(tt.steps) {
+				t.Errorf("got %d steps, want %d", len(got), len(tt.steps))
+			}
+		})
+	}
+
+	got, err := resolveSendKeysSteps([]SendKeysStep{{Keys: "ctrl+alt+del", HoldTime: 100, DelayMs: 500}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step := got[0]; !slices.Equal(step.keycodes, []uint{29, 56, 111}) || step.holdTime != 100 || step.delay != 500*time.Millisecond {
+		t.Errorf("resolved step = %+v", step)
+	}
+}
+
+func TestWaitKeyDelay(t *testing.T) {
+	if err := waitKeyDelay(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("waitKeyDelay = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := waitKeyDelay(ctx, time.Minute); err == nil {
+		t.Error("waitKeyDelay ignored a cancelled request")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitKeyDelay waited %v after the request was cancelled", elapsed)
+	}
+}
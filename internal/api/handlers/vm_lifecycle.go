@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// LifecycleRequest sets what happens when the guest of a VM powers off,
+// reboots, crashes or stops responding, and whether the manager starts it
+// again after it went down on its own. Empty actions keep the defaults and
+// an empty watchdog action removes the watchdog.
+type LifecycleRequest struct {
+	OnPoweroff        string `json:"on_poweroff" binding:"omitempty,oneof=destroy restart preserve rename-restart"`
+	OnReboot          string `json:"on_reboot" binding:"omitempty,oneof=destroy restart preserve rename-restart"`
+	OnCrash           string `json:"on_crash" binding:"omitempty,oneof=destroy restart preserve rename-restart coredump-destroy coredump-restart"`
+	WatchdogAction    string `json:"watchdog_action" binding:"omitempty,oneof=reset shutdown poweroff pause none dump inject-nmi"`
+	RestartPolicy     string `json:"restart_policy" binding:"omitempty,oneof=no always on-failure"`
+	RestartMaxRetries int    `json:"restart_max_retries" binding:"min=0"`
+	RestartBackoff    int    `json:"restart_backoff" binding:"min=0"`
+}
+
+func (r LifecycleRequest) policy() models.LifecyclePolicy {
+	return models.LifecyclePolicy{
+		OnPoweroff:        r.OnPoweroff,
+		OnReboot:          r.OnReboot,
+		OnCrash:           r.OnCrash,
+		WatchdogAction:    r.WatchdogAction,
+		RestartPolicy:     r.RestartPolicy,
+		RestartMaxRetries: r.RestartMaxRetries,
+		RestartBackoff:    r.RestartBackoff,
+	}
+}
+
+func lifecycleAction(action, fallback string) string {
+	if action == "" {
+		return fallback
+	}
+	return action
+}
+
+// generateWatchdogConfig adds an i6300esb watchdog when vm has a watchdog
+// action. The guest has to run a watchdog daemon for it to fire.
+func generateWatchdogConfig(vm models.VirtualMachine) []libvirt.DomainWatchdog {
+	if vm.Lifecycle.WatchdogAction == "" {
+		return nil
+	}
+	return []libvirt.DomainWatchdog{{Model: "i6300esb", Action: vm.Lifecycle.WatchdogAction}}
+}
+
+func (h *VMHandler) GetVMLifecycle(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	c.JSON(http.StatusOK, errors.Success(vm.Lifecycle))
+}
+
+// UpdateVMLifecycle replaces the lifecycle policy of a VM. The restart
+// policy applies at once; the domain actions and the watchdog of a running
+// guest change on its next power cycle.
+func (h *VMHandler) UpdateVMLifecycle(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req LifecycleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	before := hardwareConfig(*vm)
+	updated := *vm
+	updated.Lifecycle = req.policy()
+	after := hardwareConfig(updated)
+	paramsJSON, _ := json.Marshal(updated.Lifecycle)
+	params := string(paramsJSON)
+
+	active, err := h.redefineDomain(c, &updated)
+	if err != nil {
+		log.Printf("[VM] Failed to update lifecycle policy of VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "update_lifecycle", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_update_vm_lifecycle"), err.Error()))
+		return
+	}
+
+	pending := map[string]VMPendingChange{}
+	if active {
+		pending = pendingChanges(*vm)
+		mergePendingChanges(pending, before, after)
+	}
+	updated.PendingChanges = ""
+	if len(pending) > 0 {
+		encoded, _ := json.Marshal(pending)
+		updated.PendingChanges = string(encoded)
+	}
+
+	if err := h.vmRepo.Update(ctx, &updated); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_vm_lifecycle"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] Lifecycle policy of VM %s updated", vm.Name)
+	h.recordVMOperation(vm.ID, "update_lifecycle", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.update_lifecycle", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":   vm.Name,
+			"lifecycle": updated.Lifecycle,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"lifecycle":        updated.Lifecycle,
+		"pending":          pending,
+		"restart_required": len(pending) > 0,
+	}))
+}
@@ -0,0 +1,630 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const defaultNetworkName = "default"
+
+var nicModels = map[string]bool{
+	"virtio":  true,
+	"e1000":   true,
+	"e1000e":  true,
+	"rtl8139": true,
+}
+
+var (
+	macAddressRegex = regexp.MustCompile(`^[0-9a-f]{2}(:[0-9a-f]{2}){5}$`)
+	bridgeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+)
+
+type AddVMNICRequest struct {
+	NetworkID  string `json:"network_id"`
+	Bridge     string `json:"bridge"`
+	Model      string `json:"model"`
+	MACAddress string `json:"mac_address"`
+	LinkState  string `json:"link_state"`
+	Live       *bool  `json:"live"`
+}
+
+type UpdateVMNICRequest struct {
+	Model     string `json:"model"`
+	LinkState string `json:"link_state"`
+	Live      *bool  `json:"live"`
+}
+
+func (h *VMHandler) SetNetworkRepos(interfaces *repository.VMInterfaceRepository, networks *repository.VirtualNetworkRepository) {
+	h.vmInterfaceRepo = interfaces
+	h.virtualNetworkRepo = networks
+}
+
+// loadInterfaces fills vm.Interfaces so generateDomainXML keeps every NIC
+// when the domain is redefined.
+func (h *VMHandler) loadInterfaces(ctx context.Context, vm *models.VirtualMachine) {
+	if h.vmInterfaceRepo == nil {
+		return
+	}
+	ifaces, err := h.vmInterfaceRepo.ListByVM(ctx, vm.ID.String())
+	if err != nil {
+		log.Printf("[VM] Failed to load interfaces of VM %s: %v", vm.Name, err)
+		return
+	}
+	vm.Interfaces = ifaces
+}
+
+// uniqueMACAddress generates a MAC address that no VM interface uses yet.
+func (h *VMHandler) uniqueMACAddress(ctx context.Context) (string, error) {
+	for i := 0; i < 16; i++ {
+		mac, err := models.GenerateMACAddress()
+		if err != nil {
+			return "", err
+		}
+		if h.vmInterfaceRepo == nil {
+			return mac, nil
+		}
+		inUse, err := h.vmInterfaceRepo.MACInUse(ctx, mac)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return mac, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a unique MAC address")
+}
+
+// ensurePrimaryInterface records the NIC every VM is created with, so it can
+// be listed and changed like the others.
+func (h *VMHandler) ensurePrimaryInterface(ctx context.Context, vm *models.VirtualMachine) error {
+	for _, iface := range vm.Interfaces {
+		if iface.IsPrimary {
+			return nil
+		}
+	}
+
+	mac := strings.ToLower(vm.MACAddress)
+	if mac == "" {
+		generated, err := h.uniqueMACAddress(ctx)
+		if err != nil {
+			return err
+		}
+		mac = generated
+		vm.MACAddress = mac
+		if err := h.vmRepo.Update(ctx, vm); err != nil {
+			return err
+		}
+	}
+
+	primary := models.VMInterface{
+		VMID:       vm.ID,
+		MACAddress: mac,
+		SourceType: "network",
+		Source:     defaultNetworkName,
+		Model:      "virtio",
+		LinkState:  "up",
+		IsPrimary:  true,
+	}
+	if err := h.vmInterfaceRepo.Create(ctx, &primary); err != nil {
+		return err
+	}
+	vm.Interfaces = append([]models.VMInterface{primary}, vm.Interfaces...)
+	return nil
+}
+
+// cloneInterfaces copies the NICs of source, or the single default NIC of a
+// VM without recorded ones, with new unique MAC addresses. It also returns
+// the new address of each source address for CloneVM.
+func (h *VMHandler) cloneInterfaces(ctx context.Context, source *models.VirtualMachine) ([]models.VMInterface, map[string]string, error) {
+	ifaces := source.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = []models.VMInterface{{
+			MACAddress: source.MACAddress,
+			SourceType: "network",
+			Source:     defaultNetworkName,
+			Model:      "virtio",
+			LinkState:  "up",
+			IsPrimary:  true,
+		}}
+	}
+
+	macs := make(map[string]string, len(ifaces))
+	taken := make(map[string]bool, len(ifaces))
+	clones := make([]models.VMInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		var mac string
+		for mac == "" || taken[mac] {
+			generated, err := h.uniqueMACAddress(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			mac = generated
+		}
+		taken[mac] = true
+		macs[strings.ToLower(iface.MACAddress)] = mac
+
+		clones = append(clones, models.VMInterface{
+			MACAddress: mac,
+			SourceType: iface.SourceType,
+			Source:     iface.Source,
+			NetworkID:  iface.NetworkID,
+			Model:      iface.Model,
+			LinkState:  iface.LinkState,
+			IsPrimary:  iface.IsPrimary,
+		})
+	}
+	return clones, macs, nil
+}
+
+// primaryMACAddress is the address of the primary NIC among ifaces, or of
+// the first one when none is marked.
+func primaryMACAddress(ifaces []models.VMInterface) string {
+	for _, iface := range ifaces {
+		if iface.IsPrimary {
+			return iface.MACAddress
+		}
+	}
+	if len(ifaces) > 0 {
+		return ifaces[0].MACAddress
+	}
+	return ""
+}
+
+func generateInterface(iface models.VMInterface, qos models.QoSLimits) libvirt.DomainInterface {
+	device := libvirt.DomainInterface{
+		Type:      iface.SourceType,
+		Source:    &libvirt.InterfaceSource{Network: iface.Source},
+		Model:     &libvirt.InterfaceModel{Type: iface.Model},
+		Bandwidth: interfaceBandwidth(qos),
+	}
+	if iface.SourceType == "bridge" {
+		device.Source = &libvirt.InterfaceSource{Bridge: iface.Source}
+	}
+	if device.Model.Type == "" {
+		device.Model.Type = "virtio"
+	}
+	if iface.MACAddress != "" {
+		device.MAC = &libvirt.InterfaceMAC{Address: iface.MACAddress}
+	}
+	if iface.LinkState == "down" {
+		device.Link = &libvirt.InterfaceLink{State: "down"}
+	}
+	return device
+}
+
+func generateInterfaceXML(iface models.VMInterface, qos models.QoSLimits) string {
+	return marshalDevice(generateInterface(iface, qos))
+}
+
+// generateInterfacesConfig describes the NICs of vm. VMs whose interfaces
+// have never been changed get a single NIC on the default network.
+func generateInterfacesConfig(vm models.VirtualMachine) []libvirt.DomainInterface {
+	if len(vm.Interfaces) == 0 {
+		return []libvirt.DomainInterface{generateInterface(models.VMInterface{
+			MACAddress: vm.MACAddress,
+			SourceType: "network",
+			Source:     defaultNetworkName,
+			Model:      "virtio",
+		}, vm.QoS)}
+	}
+	var devices []libvirt.DomainInterface
+	for _, iface := range vm.Interfaces {
+		devices = append(devices, generateInterface(iface, vm.QoS))
+	}
+	return devices
+}
+
+func validateLinkState(state string) (string, error) {
+	switch state {
+	case "":
+		return "up", nil
+	case "up", "down":
+		return state, nil
+	}
+	return "", fmt.Errorf("link_state must be up or down")
+}
+
+func (h *VMHandler) ListNICs(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.vmInterfaceRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_list_nics"), "interface store is not initialized"))
+		return
+	}
+
+	ifaces, err := h.vmInterfaceRepo.ListByVM(ctx, vm.ID.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_list_nics"), err.Error()))
+		return
+	}
+	// A VM without recorded interfaces still has the NIC it was defined
+	// with; it is recorded by the next change to its interfaces.
+	if len(ifaces) == 0 && vm.MACAddress != "" {
+		ifaces = []models.VMInterface{{
+			VMID:       vm.ID,
+			MACAddress: strings.ToLower(vm.MACAddress),
+			SourceType: "network",
+			Source:     defaultNetworkName,
+			Model:      "virtio",
+			LinkState:  "up",
+			IsPrimary:  true,
+		}}
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"interfaces": ifaces,
+	}))
+}
+
+func (h *VMHandler) AddNIC(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req AddVMNICRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	if (req.NetworkID == "") == (req.Bridge == "") {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), "exactly one of network_id or bridge is required"))
+		return
+	}
+	model := req.Model
+	if model == "" {
+		model = "virtio"
+	}
+	if !nicModels[model] {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), fmt.Sprintf("unsupported model %q", model)))
+		return
+	}
+	linkState, err := validateLinkState(req.LinkState)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.vmInterfaceRepo == nil || h.virtualNetworkRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_add_nic"), "interface store is not initialized"))
+		return
+	}
+
+	iface := models.VMInterface{
+		VMID:      vm.ID,
+		Model:     model,
+		LinkState: linkState,
+	}
+
+	if req.NetworkID != "" {
+		network, err := h.virtualNetworkRepo.FindByID(ctx, req.NetworkID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "network_not_found"), req.NetworkID))
+			return
+		}
+		iface.SourceType = "network"
+		iface.Source = network.Name
+		iface.NetworkID = &network.ID
+	} else {
+		// Host bridges are only for administrators, as they bypass the
+		// managed networks.
+		if role != "admin" {
+			c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied"), "host bridges require admin"))
+			return
+		}
+		if !bridgeNameRegex.MatchString(req.Bridge) {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), "invalid bridge name"))
+			return
+		}
+		if _, err := os.Stat(fmt.Sprintf("/sys/class/net/%s/bridge", req.Bridge)); err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), fmt.Sprintf("%s is not a host bridge", req.Bridge)))
+			return
+		}
+		iface.SourceType = "bridge"
+		iface.Source = req.Bridge
+	}
+
+	if req.MACAddress != "" {
+		mac := strings.ToLower(req.MACAddress)
+		if !macAddressRegex.MatchString(mac) || !strings.ContainsRune("02468ace", rune(mac[1])) {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), "mac_address must be a unicast MAC address"))
+			return
+		}
+		inUse, err := h.vmInterfaceRepo.MACInUse(ctx, mac)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_add_nic"), err.Error()))
+			return
+		}
+		if inUse {
+			c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeConflict, t(c, "mac_address_in_use"), mac))
+			return
+		}
+		iface.MACAddress = mac
+	} else {
+		mac, err := h.uniqueMACAddress(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_add_nic"), err.Error()))
+			return
+		}
+		iface.MACAddress = mac
+	}
+
+	h.loadInterfaces(ctx, vm)
+	if err := h.ensurePrimaryInterface(ctx, vm); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_add_nic"), err.Error()))
+		return
+	}
+
+	params := fmt.Sprintf(`{"source_type":%q,"source":%q,"model":%q,"mac_address":%q,"link_state":%q}`, iface.SourceType, iface.Source, iface.Model, iface.MACAddress, iface.LinkState)
+
+	if err := h.vmInterfaceRepo.Create(ctx, &iface); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_add_nic"), err.Error()))
+		return
+	}
+
+	live := false
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		deviceXML := generateInterfaceXML(iface, vm.QoS)
+		wantLive := vm.Status == "running" && (req.Live == nil || *req.Live)
+		if wantLive {
+			if err := h.libvirt.AttachDevice(vm.LibvirtDomainUUID, deviceXML, true); err == nil {
+				live = true
+			} else {
+				log.Printf("[VM] Live attach of NIC %s to VM %s failed, attaching to the persistent config: %v", iface.MACAddress, vm.Name, err)
+			}
+		}
+		if !live {
+			if err := h.libvirt.AttachDevice(vm.LibvirtDomainUUID, deviceXML, false); err != nil {
+				if delErr := h.vmInterfaceRepo.Delete(ctx, iface.ID.String()); delErr != nil {
+					log.Printf("[VM] Failed to roll back NIC %s: %v", iface.MACAddress, delErr)
+				}
+				log.Printf("[VM] Failed to add NIC to VM %s: %v", vm.Name, err)
+				h.recordVMOperation(vm.ID, "add_nic", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+				c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_add_nic"), err.Error()))
+				return
+			}
+		}
+	}
+
+	log.Printf("[VM] NIC %s added to VM %s on %s %s (live: %v)", iface.MACAddress, vm.Name, iface.SourceType, iface.Source, live)
+	h.recordVMOperation(vm.ID, "add_nic", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.nic.add", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":     vm.Name,
+			"mac_address": iface.MACAddress,
+			"source":      iface.Source,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"interface": iface,
+		"live":      live,
+	}))
+}
+
+func (h *VMHandler) UpdateNIC(c *gin.Context) {
+	id := c.Param("id")
+	mac := strings.ToLower(c.Param("mac"))
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req UpdateVMNICRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+	if req.Model != "" && !nicModels[req.Model] {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), fmt.Sprintf("unsupported model %q", req.Model)))
+		return
+	}
+	if req.LinkState != "" {
+		if _, err := validateLinkState(req.LinkState); err != nil {
+			c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_nic_options"), err.Error()))
+			return
+		}
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.vmInterfaceRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_update_nic"), "interface store is not initialized"))
+		return
+	}
+
+	h.loadInterfaces(ctx, vm)
+	if err := h.ensurePrimaryInterface(ctx, vm); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_nic"), err.Error()))
+		return
+	}
+
+	iface, err := h.vmInterfaceRepo.FindByVMAndMAC(ctx, vm.ID.String(), mac)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "nic_not_found"), mac))
+		return
+	}
+
+	updated := *iface
+	if req.Model != "" {
+		updated.Model = req.Model
+	}
+	if req.LinkState != "" {
+		updated.LinkState = req.LinkState
+	}
+	modelChanged := updated.Model != iface.Model
+	linkChanged := updated.LinkState != iface.LinkState
+
+	params := fmt.Sprintf(`{"mac_address":%q,"model":%q,"link_state":%q}`, mac, updated.Model, updated.LinkState)
+
+	// Only the link state can change on a running guest; a new model is
+	// written to the persistent config and applies on the next power cycle.
+	live := false
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" && (modelChanged || linkChanged) {
+		var applyErr error
+		if linkChanged && vm.Status == "running" && (req.Live == nil || *req.Live) {
+			liveIface := updated
+			liveIface.Model = iface.Model
+			if applyErr = h.libvirt.UpdateDevice(vm.LibvirtDomainUUID, generateInterfaceXML(liveIface, vm.QoS), true); applyErr == nil {
+				live = true
+			}
+		}
+		if applyErr == nil && (modelChanged || !live) {
+			applyErr = h.libvirt.UpdateDevice(vm.LibvirtDomainUUID, generateInterfaceXML(updated, vm.QoS), false)
+		}
+		if applyErr != nil {
+			log.Printf("[VM] Failed to update NIC %s of VM %s: %v", mac, vm.Name, applyErr)
+			h.recordVMOperation(vm.ID, "update_nic", "failed", &userUUID, ipAddress, userAgent, params, "", applyErr.Error())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_update_nic"), applyErr.Error()))
+			return
+		}
+	}
+
+	if err := h.vmInterfaceRepo.Update(ctx, &updated); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_nic"), err.Error()))
+		return
+	}
+
+	h.recordVMOperation(vm.ID, "update_nic", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.nic.update", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":     vm.Name,
+			"mac_address": mac,
+			"model":       updated.Model,
+			"link_state":  updated.LinkState,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"interface": updated,
+		"live":      live,
+		"pending":   modelChanged && vm.Status == "running",
+	}))
+}
+
+func (h *VMHandler) RemoveNIC(c *gin.Context) {
+	id := c.Param("id")
+	mac := strings.ToLower(c.Param("mac"))
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if h.vmInterfaceRepo == nil {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_remove_nic"), "interface store is not initialized"))
+		return
+	}
+
+	iface, err := h.vmInterfaceRepo.FindByVMAndMAC(ctx, vm.ID.String(), mac)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeNotFound, t(c, "nic_not_found"), mac))
+		return
+	}
+	if iface.IsPrimary || strings.EqualFold(vm.MACAddress, mac) {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "cannot_remove_primary_nic"), mac))
+		return
+	}
+
+	params := fmt.Sprintf(`{"mac_address":%q}`, mac)
+
+	live := false
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		live = vm.Status == "running"
+		if err := h.libvirt.DetachDevice(vm.LibvirtDomainUUID, generateInterfaceXML(*iface, vm.QoS), live); err != nil {
+			log.Printf("[VM] Failed to remove NIC %s from VM %s: %v", mac, vm.Name, err)
+			h.recordVMOperation(vm.ID, "remove_nic", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+			c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_remove_nic"), err.Error()))
+			return
+		}
+	}
+
+	if err := h.vmInterfaceRepo.Delete(ctx, iface.ID.String()); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_remove_nic"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] NIC %s removed from VM %s (live: %v)", mac, vm.Name, live)
+	h.recordVMOperation(vm.ID, "remove_nic", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.nic.remove", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":     vm.Name,
+			"mac_address": mac,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"mac_address": mac,
+		"live":        live,
+	}))
+}
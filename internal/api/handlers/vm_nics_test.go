@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"vmmanager/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestCloneInterfaces(t *testing.T) {
+	h := &VMHandler{}
+	networkID := uuid.New()
+	source := &models.VirtualMachine{
+		ID:         uuid.New(),
+		MACAddress: "52:54:00:12:34:56",
+		Interfaces: []models.VMInterface{
+			{ID: uuid.New(), MACAddress: "52:54:00:12:34:56", SourceType: "network", Source: "default", Model: "virtio", LinkState: "up", IsPrimary: true},
+			{ID: uuid.New(), MACAddress: "52:54:00:AB:CD:EF", SourceType: "bridge", Source: "br0", NetworkID: &networkID, Model: "e1000e", LinkState: "down"},
+		},
+	}
+
+	clones, macs, err := h.cloneInterfaces(context.Background(), source)
+	if err != nil {
+		t.Fatalf("cloneInterfaces failed: %v", err)
+	}
+	if len(clones) != 2 || len(macs) != 2 {
+		t.Fatalf("cloneInterfaces = %+v, %v", clones, macs)
+	}
+	for i, clone := range clones {
+		orig := source.Interfaces[i]
+		if clone.ID != uuid.Nil || clone.VMID != uuid.Nil {
+			t.Errorf("clone %d keeps the identity of the source: %+v", i, clone)
+		}
+		if clone.MACAddress == orig.MACAddress || !macAddressRegex.MatchString(clone.MACAddress) {
+			t.Errorf("clone %d MAC = %q", i, clone.MACAddress)
+		}
+		if clone.SourceType != orig.SourceType || clone.Source != orig.Source || clone.NetworkID != orig.NetworkID ||
+			clone.Model != orig.Model || clone.LinkState != orig.LinkState || clone.IsPrimary != orig.IsPrimary {
+			t.Errorf("clone %d = %+v, want the settings of %+v", i, clone, orig)
+		}
+	}
+	if macs["52:54:00:12:34:56"] != clones[0].MACAddress || macs["52:54:00:ab:cd:ef"] != clones[1].MACAddress {
+		t.Errorf("MAC map %v does not match the clones", macs)
+	}
+	if clones[0].MACAddress == clones[1].MACAddress {
+		t.Error("clones share a MAC address")
+	}
+	if got := primaryMACAddress(clones); got != clones[0].MACAddress {
+		t.Errorf("primaryMACAddress = %q, want %q", got, clones[0].MACAddress)
+	}
+}
+
+func TestCloneInterfacesWithoutRecordedNICs(t *testing.T) {
+	h := &VMHandler{}
+	source := &models.VirtualMachine{ID: uuid.New(), MACAddress: "52:54:00:12:34:56"}
+
+	clones, macs, err := h.cloneInterfaces(context.Background(), source)
+	if err != nil {
+		t.Fatalf("cloneInterfaces failed: %v", err)
+	}
+	if len(clones) != 1 || !clones[0].IsPrimary || clones[0].Source != defaultNetworkName {
+		t.Fatalf("cloneInterfaces = %+v, want one primary NIC on the default network", clones)
+	}
+	if macs["52:54:00:12:34:56"] != clones[0].MACAddress {
+		t.Errorf("MAC map %v does not match the clone", macs)
+	}
+}
+
+func TestPrimaryMACAddress(t *testing.T) {
+	ifaces := []models.VMInterface{{MACAddress: "52:54:00:00:00:01"}, {MACAddress: "52:54:00:00:00:02", IsPrimary: true}}
+	if got := primaryMACAddress(ifaces); got != "52:54:00:00:00:02" {
+		t.Errorf("primaryMACAddress = %q", got)
+	}
+	if got := primaryMACAddress(ifaces[:1]); got != "52:54:00:00:00:01" {
+		t.Errorf("primaryMACAddress without a primary NIC = %q", got)
+	}
+	if got := primaryMACAddress(nil); got != "" {
+		t.Errorf("primaryMACAddress(nil) = %q", got)
+	}
+}
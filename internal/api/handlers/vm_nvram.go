@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// resetNVRAM deletes the UEFI variable store of vm. libvirt creates a fresh
+// one from the template of the current loader on the next start, which
+// also enrolls the secure boot keys again.
+func resetNVRAM(vm models.VirtualMachine) error {
+	if err := os.Remove(nvramPath(vm)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// nvramResetPending reports whether the firmware of vm changed while it was
+// running. Its variable store still comes from the old template and has to
+// be recreated before the next start.
+func nvramResetPending(vm models.VirtualMachine) bool {
+	_, ok := pendingChanges(vm)["firmware"]
+	return ok
+}
+
+// GetVMNVRAM shows the firmware of a VM and the state of its UEFI variable
+// store.
+func (h *VMHandler) GetVMNVRAM(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	firmware := vmFirmware(*vm)
+	result := gin.H{
+		"firmware":    firmware,
+		"secure_boot": firmware == firmwareUEFISecure,
+		"tpm":         vm.TPM,
+	}
+	if firmware == firmwareBIOS {
+		c.JSON(http.StatusOK, errors.Success(result))
+		return
+	}
+
+	loader, nvram := generateFirmwareConfig(*vm)
+	result["loader_path"] = loader.Path
+	result["nvram_template"] = nvram.Template
+	result["nvram_path"] = nvram.Path
+	result["exists"] = false
+	if info, err := os.Stat(nvram.Path); err == nil {
+		result["exists"] = true
+		result["size"] = info.Size()
+		result["modified_at"] = info.ModTime()
+	}
+
+	c.JSON(http.StatusOK, errors.Success(result))
+}
+
+// ResetVMNVRAM discards the UEFI variables of a stopped VM, such as boot
+// entries and enrolled keys, so it boots from a fresh copy of the template.
+func (h *VMHandler) ResetVMNVRAM(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if vmFirmware(*vm) == firmwareBIOS {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeBadRequest, t(c, "vm_not_uefi"), vm.Name))
+		return
+	}
+
+	if h.libvirt != nil && vm.LibvirtDomainUUID != "" {
+		if domain, err := h.libvirt.LookupByUUID(vm.LibvirtDomainUUID); err == nil {
+			state, _, _ := domain.GetState()
+			domain.Free()
+			if state != 5 && state != 6 {
+				c.JSON(http.StatusConflict, errors.FailWithDetails(errors.ErrCodeVMConflict, t(c, "vm_not_stopped"), vm.Name))
+				return
+			}
+		}
+	}
+
+	if err := resetNVRAM(*vm); err != nil {
+		log.Printf("[VM] Failed to reset NVRAM of VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "reset_nvram", "failed", &userUUID, ipAddress, userAgent, "", "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeInternalError, t(c, "failed_to_reset_nvram"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] NVRAM of VM %s reset", vm.Name)
+	h.recordVMOperation(vm.ID, "reset_nvram", "success", &userUUID, ipAddress, userAgent, "", "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.nvram.reset", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name":  vm.Name,
+			"firmware": vmFirmware(*vm),
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{}))
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// QoSRequest sets the disk I/O and network bandwidth limits of a VM, the
+// defaults of a template or the maximums of a user. Zero means unlimited.
+type QoSRequest struct {
+	DiskReadIOPS      int64 `json:"disk_read_iops" binding:"min=0"`
+	DiskWriteIOPS     int64 `json:"disk_write_iops" binding:"min=0"`
+	DiskReadBytesSec  int64 `json:"disk_read_bytes_sec" binding:"min=0"`
+	DiskWriteBytesSec int64 `json:"disk_write_bytes_sec" binding:"min=0"`
+	NetInboundKBps    int64 `json:"net_inbound_kbps" binding:"min=0"`
+	NetOutboundKBps   int64 `json:"net_outbound_kbps" binding:"min=0"`
+}
+
+func (r QoSRequest) limits() models.QoSLimits {
+	return models.QoSLimits{
+		DiskReadIOPS:      r.DiskReadIOPS,
+		DiskWriteIOPS:     r.DiskWriteIOPS,
+		DiskReadBytesSec:  r.DiskReadBytesSec,
+		DiskWriteBytesSec: r.DiskWriteBytesSec,
+		NetInboundKBps:    r.NetInboundKBps,
+		NetOutboundKBps:   r.NetOutboundKBps,
+	}
+}
+
+// qosField is one limit of a QoSLimits with the maximum that applies to it.
+type qosField struct {
+	name       string
+	value      *int64
+	maxAllowed int64
+}
+
+func qosFields(limits *models.QoSLimits, maximums models.QoSLimits) []qosField {
+	return []qosField{
+		{"disk_read_iops", &limits.DiskReadIOPS, maximums.DiskReadIOPS},
+		{"disk_write_iops", &limits.DiskWriteIOPS, maximums.DiskWriteIOPS},
+		{"disk_read_bytes_sec", &limits.DiskReadBytesSec, maximums.DiskReadBytesSec},
+		{"disk_write_bytes_sec", &limits.DiskWriteBytesSec, maximums.DiskWriteBytesSec},
+		{"net_inbound_kbps", &limits.NetInboundKBps, maximums.NetInboundKBps},
+		{"net_outbound_kbps", &limits.NetOutboundKBps, maximums.NetOutboundKBps},
+	}
+}
+
+// capQoS holds limits to the per-user maximums. An unlimited value
+// takes the maximum; a value above it is an error.
+func capQoS(limits, maximums models.QoSLimits) (models.QoSLimits, error) {
+	for _, f := range qosFields(&limits, maximums) {
+		if f.maxAllowed <= 0 {
+			continue
+		}
+		if *f.value == 0 {
+			*f.value = f.maxAllowed
+		} else if *f.value > f.maxAllowed {
+			return limits, fmt.Errorf("%s of %d exceeds the maximum of %d", f.name, *f.value, f.maxAllowed)
+		}
+	}
+	return limits, nil
+}
+
+// checkQoSWithin fails when the stored limits of an existing VM are above
+// maximums. Unlike capQoS an unlimited value is above any maximum, as the
+// guest already runs without that limit.
+func checkQoSWithin(limits, maximums models.QoSLimits) error {
+	for _, f := range qosFields(&limits, maximums) {
+		if f.maxAllowed <= 0 {
+			continue
+		}
+		if *f.value == 0 {
+			return fmt.Errorf("%s is unlimited but the maximum is %d", f.name, f.maxAllowed)
+		}
+		if *f.value > f.maxAllowed {
+			return fmt.Errorf("%s of %d exceeds the maximum of %d", f.name, *f.value, f.maxAllowed)
+		}
+	}
+	return nil
+}
+
+// diskIOTune returns the libvirt iotune for qos, or nil without disk limits.
+func diskIOTune(qos models.QoSLimits) *libvirt.DiskIOTune {
+	if qos.DiskReadIOPS == 0 && qos.DiskWriteIOPS == 0 && qos.DiskReadBytesSec == 0 && qos.DiskWriteBytesSec == 0 {
+		return nil
+	}
+	return &libvirt.DiskIOTune{
+		ReadBytesSec:  uint64(qos.DiskReadBytesSec),
+		WriteBytesSec: uint64(qos.DiskWriteBytesSec),
+		ReadIOPSSec:   uint64(qos.DiskReadIOPS),
+		WriteIOPSSec:  uint64(qos.DiskWriteIOPS),
+	}
+}
+
+// interfaceBandwidth returns the libvirt bandwidth for qos, or nil without
+// network limits.
+func interfaceBandwidth(qos models.QoSLimits) *libvirt.InterfaceBandwidth {
+	if qos.NetInboundKBps == 0 && qos.NetOutboundKBps == 0 {
+		return nil
+	}
+	bandwidth := &libvirt.InterfaceBandwidth{}
+	if qos.NetInboundKBps > 0 {
+		bandwidth.Inbound = &libvirt.BandwidthLimit{Average: uint64(qos.NetInboundKBps)}
+	}
+	if qos.NetOutboundKBps > 0 {
+		bandwidth.Outbound = &libvirt.BandwidthLimit{Average: uint64(qos.NetOutboundKBps)}
+	}
+	return bandwidth
+}
+
+// applyLiveQoS pushes the limits of vm to its running domain. vm must have
+// its data disks and interfaces loaded.
+func (h *VMHandler) applyLiveQoS(vm models.VirtualMachine) error {
+	tune := diskIOTune(vm.QoS)
+	targets := []string{rootDiskTarget(vm)}
+	for _, disk := range generateDataDisksConfig(vm.DataDisks, vm.QoS) {
+		targets = append(targets, disk.Target.Dev)
+	}
+	for _, target := range targets {
+		if err := h.libvirt.SetDiskIOTune(vm.LibvirtDomainUUID, target, tune, true); err != nil {
+			return err
+		}
+	}
+
+	bandwidth := interfaceBandwidth(vm.QoS)
+	for _, iface := range generateInterfacesConfig(vm) {
+		if err := h.libvirt.SetInterfaceBandwidth(vm.LibvirtDomainUUID, iface.MAC.Address, bandwidth, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *VMHandler) UpdateVMQoS(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req QoSRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	owner, err := h.userRepo.FindByID(ctx, vm.OwnerID.String())
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeUserNotFound, t(c, "user_not_found"), vm.OwnerID.String()))
+		return
+	}
+	limits, err := capQoS(req.limits(), owner.QoSMax)
+	if err != nil {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeQuotaExceeded, t(c, "qos_limit_exceeded"), err.Error()))
+		return
+	}
+
+	updated := *vm
+	updated.QoS = limits
+	paramsJSON, _ := json.Marshal(limits)
+	params := string(paramsJSON)
+
+	active, err := h.redefineDomain(c, &updated)
+	if err == nil && active {
+		err = h.applyLiveQoS(updated)
+	}
+	if err != nil {
+		log.Printf("[VM] Failed to apply QoS limits to VM %s: %v", vm.Name, err)
+		h.recordVMOperation(vm.ID, "update_qos", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "failed_to_update_vm_qos"), err.Error()))
+		return
+	}
+
+	if err := h.vmRepo.Update(ctx, &updated); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.FailWithDetails(errors.ErrCodeDatabase, t(c, "failed_to_update_vm_qos"), err.Error()))
+		return
+	}
+
+	log.Printf("[VM] QoS limits of VM %s updated (live: %v)", vm.Name, active)
+	h.recordVMOperation(vm.ID, "update_qos", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.update_qos", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"qos":     limits,
+			"live":    active,
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"qos":  limits,
+		"live": active,
+	}))
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"vmmanager/internal/api/errors"
+	"vmmanager/internal/repository"
+	"vmmanager/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func (h *VMHandler) SetSSHKeyRepo(repo *repository.SSHKeyRepository) {
+	h.sshKeyRepo = repo
+}
+
+// resolveSSHKeys returns the public keys to place in a VM: the caller's
+// selected stored keys, any raw keys from the request and every
+// organisation-wide key, de-duplicated by fingerprint.
+func (h *VMHandler) resolveSSHKeys(ctx context.Context, userID string, keyIDs, rawKeys []string) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(fingerprint, key string) {
+		if !seen[fingerprint] {
+			seen[fingerprint] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, raw := range rawKeys {
+		parsed, err := utils.ParseSSHPublicKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		add(parsed.Fingerprint, parsed.Normalized)
+	}
+
+	if h.sshKeyRepo == nil {
+		if len(keyIDs) > 0 {
+			return nil, fmt.Errorf("ssh key store is not available")
+		}
+		return keys, nil
+	}
+
+	if len(keyIDs) > 0 {
+		stored, err := h.sshKeyRepo.FindByUserAndIDs(ctx, userID, keyIDs)
+		if err != nil {
+			return nil, err
+		}
+		if len(stored) != len(uniqueStrings(keyIDs)) {
+			return nil, fmt.Errorf("one or more ssh keys were not found")
+		}
+		for _, k := range stored {
+			add(k.Fingerprint, k.PublicKey)
+		}
+	}
+
+	global, err := h.sshKeyRepo.ListGlobal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range global {
+		add(k.Fingerprint, k.PublicKey)
+	}
+
+	return keys, nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+type InjectSSHKeysRequest struct {
+	User      string   `json:"user" binding:"required"`
+	SSHKeyIDs []string `json:"ssh_key_ids"`
+	Keys      []string `json:"keys"`
+}
+
+// InjectSSHKeys appends keys to a user's authorized_keys inside a running
+// guest through qemu-guest-agent, for VMs that were not seeded by cloud-init.
+func (h *VMHandler) InjectSSHKeys(c *gin.Context) {
+	id := c.Param("id")
+	ctx := c.Request.Context()
+
+	userID, _ := c.Get("user_id")
+	role, _ := c.Get("role")
+	userUUID, _ := uuid.Parse(userID.(string))
+	ipAddress := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	var req InjectSSHKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "validation_error"), err.Error()))
+		return
+	}
+
+	vm, err := h.vmRepo.FindByID(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errors.FailWithDetails(errors.ErrCodeVMNotFound, t(c, "vm_not_found_id"), id))
+		return
+	}
+
+	if role != "admin" && vm.OwnerID != userUUID {
+		c.JSON(http.StatusForbidden, errors.FailWithDetails(errors.ErrCodeForbidden, t(c, "permission_denied_not_vm_owner"), "not VM owner"))
+		return
+	}
+
+	if vm.Status != "running" {
+		c.JSON(http.StatusBadRequest, errors.FailWithCode(errors.ErrCodeBadRequest, t(c, "vm_not_running")))
+		return
+	}
+
+	if h.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		c.JSON(http.StatusServiceUnavailable, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "libvirt_service_unavailable"), "libvirt client is not initialized or domain not configured"))
+		return
+	}
+
+	keys, err := h.resolveSSHKeys(ctx, userUUID.String(), req.SSHKeyIDs, req.Keys)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_ssh_key"), err.Error()))
+		return
+	}
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, errors.FailWithDetails(errors.ErrCodeValidation, t(c, "invalid_ssh_key"), "no keys to inject"))
+		return
+	}
+
+	params := fmt.Sprintf(`{"user":%q,"keys":%d}`, req.User, len(keys))
+	if err := h.libvirt.GuestAddAuthorizedKeys(vm.LibvirtDomainUUID, req.User, keys); err != nil {
+		log.Printf("[VM] Failed to inject SSH keys into VM %s: %v", id, err)
+		h.recordVMOperation(vm.ID, "inject_ssh_keys", "failed", &userUUID, ipAddress, userAgent, params, "", err.Error())
+		c.JSON(http.StatusBadGateway, errors.FailWithDetails(errors.ErrCodeLibvirt, t(c, "guest_agent_unavailable"), err.Error()))
+		return
+	}
+
+	h.recordVMOperation(vm.ID, "inject_ssh_keys", "success", &userUUID, ipAddress, userAgent, params, "", "")
+	if h.auditService != nil {
+		h.auditService.LogSuccess(c, "vm.inject_ssh_keys", "virtual_machine", &vm.ID, map[string]interface{}{
+			"vm_name": vm.Name,
+			"user":    req.User,
+			"keys":    len(keys),
+		})
+	}
+
+	c.JSON(http.StatusOK, errors.Success(gin.H{
+		"user":     req.User,
+		"injected": len(keys),
+	}))
+}
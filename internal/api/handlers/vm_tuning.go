@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+)
+
+// maxCPUSetID bounds the ids in a cpuset so a range cannot make parsing
+// allocate without limit.
+const maxCPUSetID = 4095
+
+// hugePageSizes are the hugepage sizes in KiB a VM may ask for.
+var hugePageSizes = map[uint64]bool{
+	2048:    true,
+	1048576: true,
+}
+
+// VMTuning holds the CPU pinning, guest topology and memory backing of a VM
+// for latency-sensitive workloads. Host CPU and node sets use the libvirt
+// cpuset syntax, e.g. "2-5,^3,8".
+type VMTuning struct {
+	VCPUPins        map[int]string `json:"vcpu_pins,omitempty"`
+	EmulatorPin     string         `json:"emulator_pin,omitempty"`
+	Sockets         int            `json:"sockets,omitempty"`
+	Cores           int            `json:"cores,omitempty"`
+	Threads         int            `json:"threads,omitempty"`
+	NUMACells       []VMNUMACell   `json:"numa_cells,omitempty"`
+	HugePages       bool           `json:"hugepages,omitempty"`
+	HugePageSizeKiB uint64         `json:"hugepage_size_kib,omitempty"`
+}
+
+// VMNUMACell is a guest NUMA node made of the vCPUs in CPUs, optionally
+// bound to the host nodes in HostNodes.
+type VMNUMACell struct {
+	CPUs      string `json:"cpus"`
+	MemoryMB  int    `json:"memory_mb"`
+	HostNodes string `json:"host_nodes,omitempty"`
+}
+
+func (t *VMTuning) isEmpty() bool {
+	return t == nil || (len(t.VCPUPins) == 0 && t.EmulatorPin == "" && t.Sockets == 0 && t.Cores == 0 &&
+		t.Threads == 0 && len(t.NUMACells) == 0 && !t.HugePages && t.HugePageSizeKiB == 0)
+}
+
+func (t *VMTuning) hasTopology() bool {
+	return t.Sockets > 0 || t.Cores > 0 || t.Threads > 0
+}
+
+// topology returns sockets, cores and threads with unset values counting as one.
+func (t *VMTuning) topology() (int, int, int) {
+	sockets, cores, threads := max(t.Sockets, 1), max(t.Cores, 1), max(t.Threads, 1)
+	return sockets, cores, threads
+}
+
+func (h *VMHandler) SetTuningRoles(roles []string) {
+	h.tuningRoles = roles
+}
+
+// canTune reports whether users with role may change the tuning of a VM.
+// Admins always can.
+func (h *VMHandler) canTune(role interface{}) bool {
+	r, _ := role.(string)
+	return r == "admin" || slices.Contains(h.tuningRoles, r)
+}
+
+// vmTuning returns the stored tuning of vm, or nil when it has none.
+func vmTuning(vm models.VirtualMachine) *VMTuning {
+	if vm.Tuning == "" {
+		return nil
+	}
+	var tuning VMTuning
+	if err := json.Unmarshal([]byte(vm.Tuning), &tuning); err != nil {
+		log.Printf("[VM] Ignoring unreadable tuning of VM %s: %v", vm.Name, err)
+		return nil
+	}
+	if tuning.isEmpty() {
+		return nil
+	}
+	return &tuning
+}
+
+// setVMTuning stores tuning on vm; an empty tuning clears it.
+func setVMTuning(vm *models.VirtualMachine, tuning *VMTuning) {
+	vm.Tuning = ""
+	if !tuning.isEmpty() {
+		encoded, _ := json.Marshal(tuning)
+		vm.Tuning = string(encoded)
+	}
+}
+
+// parseCPUSet expands a libvirt cpuset such as "0-3,^2,6" into sorted ids.
+func parseCPUSet(set string) ([]int, error) {
+	ids := map[int]bool{}
+	var excluded []int
+	for _, part := range strings.Split(set, ",") {
+		part = strings.TrimSpace(part)
+		exclude := strings.HasPrefix(part, "^")
+		part = strings.TrimPrefix(part, "^")
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 || start > maxCPUSetID {
+			return nil, fmt.Errorf("invalid cpuset %q", set)
+		}
+		end := start
+		if isRange {
+			if exclude {
+				return nil, fmt.Errorf("invalid cpuset %q: ranges cannot be excluded", set)
+			}
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start || end > maxCPUSetID {
+				return nil, fmt.Errorf("invalid cpuset %q", set)
+			}
+		}
+		for id := start; id <= end; id++ {
+			if exclude {
+				excluded = append(excluded, id)
+			} else {
+				ids[id] = true
+			}
+		}
+	}
+	for _, id := range excluded {
+		delete(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("cpuset %q is empty", set)
+	}
+	result := make([]int, 0, len(ids))
+	for id := range ids {
+		result = append(result, id)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+// validateTuning checks that tuning fits the vCPUs and memory of vm.
+func validateTuning(vm models.VirtualMachine, tuning *VMTuning) error {
+	if tuning.isEmpty() {
+		return nil
+	}
+	if tuning.Sockets < 0 || tuning.Cores < 0 || tuning.Threads < 0 {
+		return fmt.Errorf("sockets, cores and threads must not be negative")
+	}
+	if tuning.hasTopology() {
+		sockets, cores, threads := tuning.topology()
+		if sockets*cores*threads != vm.CPUAllocated {
+			return fmt.Errorf("topology %d sockets x %d cores x %d threads does not match %d vCPUs", sockets, cores, threads, vm.CPUAllocated)
+		}
+	}
+	for vcpu, set := range tuning.VCPUPins {
+		if vcpu < 0 || vcpu >= vm.CPUAllocated {
+			return fmt.Errorf("vCPU %d is pinned but the VM has %d vCPUs", vcpu, vm.CPUAllocated)
+		}
+		if _, err := parseCPUSet(set); err != nil {
+			return fmt.Errorf("vCPU %d: %w", vcpu, err)
+		}
+	}
+	if tuning.EmulatorPin != "" {
+		if _, err := parseCPUSet(tuning.EmulatorPin); err != nil {
+			return fmt.Errorf("emulator_pin: %w", err)
+		}
+	}
+
+	if len(tuning.NUMACells) > 0 {
+		seen := map[int]bool{}
+		memory := 0
+		for i, cell := range tuning.NUMACells {
+			vcpus, err := parseCPUSet(cell.CPUs)
+			if err != nil {
+				return fmt.Errorf("NUMA cell %d: %w", i, err)
+			}
+			for _, vcpu := range vcpus {
+				if vcpu >= vm.CPUAllocated {
+					return fmt.Errorf("NUMA cell %d uses vCPU %d but the VM has %d vCPUs", i, vcpu, vm.CPUAllocated)
+				}
+				if seen[vcpu] {
+					return fmt.Errorf("vCPU %d is in more than one NUMA cell", vcpu)
+				}
+				seen[vcpu] = true
+			}
+			if cell.MemoryMB <= 0 {
+				return fmt.Errorf("NUMA cell %d needs memory", i)
+			}
+			memory += cell.MemoryMB
+			if cell.HostNodes != "" {
+				if _, err := parseCPUSet(cell.HostNodes); err != nil {
+					return fmt.Errorf("NUMA cell %d host_nodes: %w", i, err)
+				}
+			}
+		}
+		if len(seen) != vm.CPUAllocated {
+			return fmt.Errorf("NUMA cells cover %d of %d vCPUs", len(seen), vm.CPUAllocated)
+		}
+		if memory != vm.MemoryAllocated {
+			return fmt.Errorf("NUMA cells have %d MB of memory but the VM has %d MB", memory, vm.MemoryAllocated)
+		}
+	}
+
+	if tuning.HugePageSizeKiB != 0 {
+		if !tuning.HugePages {
+			return fmt.Errorf("hugepage_size_kib requires hugepages")
+		}
+		if !hugePageSizes[tuning.HugePageSizeKiB] {
+			return fmt.Errorf("hugepage_size_kib must be 2048 or 1048576")
+		}
+		if uint64(vm.MemoryAllocated)*1024%tuning.HugePageSizeKiB != 0 {
+			return fmt.Errorf("memory of %d MB is not a multiple of the hugepage size", vm.MemoryAllocated)
+		}
+	}
+	return nil
+}
+
+// validateHostTuning checks the pinned CPUs and bound nodes of tuning
+// against the NUMA layout of the host, and its hugepages against what is
+// left in pool. A nil pool skips the hugepage check.
+func validateHostTuning(tuning *VMTuning, caps *libvirt.HostCapabilities, pool *libvirt.HugePagePool, memoryMB int) error {
+	if tuning.isEmpty() || len(caps.NUMACells) == 0 {
+		return nil
+	}
+	checkCPUs := func(name, set string) error {
+		cpus, _ := parseCPUSet(set)
+		for _, cpu := range cpus {
+			if !caps.HasCPU(cpu) {
+				return fmt.Errorf("%s uses host CPU %d, which does not exist", name, cpu)
+			}
+		}
+		return nil
+	}
+	for vcpu, set := range tuning.VCPUPins {
+		if err := checkCPUs(fmt.Sprintf("vCPU %d", vcpu), set); err != nil {
+			return err
+		}
+	}
+	if tuning.EmulatorPin != "" {
+		if err := checkCPUs("emulator_pin", tuning.EmulatorPin); err != nil {
+			return err
+		}
+	}
+
+	nodes := map[int]bool{}
+	for i, cell := range tuning.NUMACells {
+		if cell.HostNodes == "" {
+			continue
+		}
+		ids, _ := parseCPUSet(cell.HostNodes)
+		for _, id := range ids {
+			if caps.NUMACell(id) == nil {
+				return fmt.Errorf("NUMA cell %d is bound to host node %d, which does not exist", i, id)
+			}
+			nodes[id] = true
+		}
+	}
+
+	if tuning.HugePages && pool != nil {
+		size := hugePageSize(tuning)
+		available := pool.Available(nodes)
+		needed := int(uint64(memoryMB) * 1024 / size)
+		if available < needed {
+			return fmt.Errorf("%d hugepages of %d KiB are needed but only %d are free", needed, size, available)
+		}
+	}
+	return nil
+}
+
+// applyTuning adds the pinning, topology, guest NUMA cells and hugepage
+// backing of vm to def.
+func applyTuning(def *libvirt.DomainDef, vm models.VirtualMachine) {
+	tuning := vmTuning(vm)
+	if tuning == nil {
+		return
+	}
+
+	if len(tuning.VCPUPins) > 0 || tuning.EmulatorPin != "" {
+		cputune := &libvirt.DomainCPUTune{}
+		vcpus := make([]int, 0, len(tuning.VCPUPins))
+		for vcpu := range tuning.VCPUPins {
+			vcpus = append(vcpus, vcpu)
+		}
+		sort.Ints(vcpus)
+		for _, vcpu := range vcpus {
+			cputune.VCPUPins = append(cputune.VCPUPins, libvirt.VCPUPin{VCPU: vcpu, CPUSet: tuning.VCPUPins[vcpu]})
+		}
+		if tuning.EmulatorPin != "" {
+			cputune.EmulatorPin = &libvirt.EmulatorPin{CPUSet: tuning.EmulatorPin}
+		}
+		def.CPUTune = cputune
+		// numad placement would override the pinning.
+		def.VCPU.Placement = "static"
+	}
+
+	if def.CPU == nil {
+		def.CPU = &libvirt.DomainCPU{}
+	}
+	if tuning.hasTopology() {
+		sockets, cores, threads := tuning.topology()
+		def.CPU.Topology = &libvirt.CPUTopology{Sockets: sockets, Cores: cores, Threads: threads}
+	}
+	if len(tuning.NUMACells) > 0 {
+		def.CPU.NUMA = &libvirt.CPUNUMA{}
+		numatune := &libvirt.DomainNUMATune{}
+		for i, cell := range tuning.NUMACells {
+			def.CPU.NUMA.Cells = append(def.CPU.NUMA.Cells, libvirt.NUMACell{
+				ID:     i,
+				CPUs:   cell.CPUs,
+				Memory: uint64(cell.MemoryMB),
+				Unit:   "MiB",
+			})
+			if cell.HostNodes != "" {
+				numatune.MemNodes = append(numatune.MemNodes, libvirt.NUMAMemNode{CellID: i, Mode: "strict", Nodeset: cell.HostNodes})
+			}
+		}
+		if len(numatune.MemNodes) > 0 {
+			def.NUMATune = numatune
+		}
+	}
+
+	if tuning.HugePages {
+		hugepages := &libvirt.HugePages{}
+		if tuning.HugePageSizeKiB != 0 {
+			hugepages.Pages = []libvirt.HugePage{{Size: tuning.HugePageSizeKiB, Unit: "KiB"}}
+		}
+		def.MemoryBacking = &libvirt.MemoryBacking{HugePages: hugepages}
+	}
+}
+
+// hugePageSize returns the hugepage size of tuning in KiB.
+func hugePageSize(tuning *VMTuning) uint64 {
+	if tuning.HugePageSizeKiB == 0 {
+		return 2048
+	}
+	return tuning.HugePageSizeKiB
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+)
+
+// UnattendedInstallRequest selects an answer file profile for an ISO install.
+// Hostname, SSH keys, packages and password fall back to the cloud-init
+// fields of the create request.
+type UnattendedInstallRequest struct {
+	Profile      string `json:"profile"`
+	Delivery     string `json:"delivery"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordHash string `json:"password_hash"`
+	Timezone     string `json:"timezone"`
+	Locale       string `json:"locale"`
+	Keyboard     string `json:"keyboard"`
+	DiskLayout   string `json:"disk_layout"`
+	ProductKey   string `json:"product_key"`
+	ImageIndex   int    `json:"image_index"`
+}
+
+// defaultHostname derives an RFC 1123 label from a VM name.
+func defaultHostname(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			sb.WriteRune(r)
+		case r == '-' || r == '_' || r == ' ' || r == '.':
+			sb.WriteByte('-')
+		}
+	}
+	host := strings.Trim(sb.String(), "-")
+	if len(host) > 63 {
+		host = strings.Trim(host[:63], "-")
+	}
+	if host == "" {
+		host = "vm"
+	}
+	return host
+}
+
+// removeInstallMedia deletes generated unattended-install files and clears
+// their paths on vm.
+func removeInstallMedia(vm *models.VirtualMachine) {
+	for _, path := range []string{vm.InstallMediaPath, vm.InstallKernelPath, vm.InstallInitrdPath} {
+		if path != "" && exists(path) {
+			if err := os.Remove(path); err != nil {
+				log.Printf("[VM] Failed to delete install media %s: %v", path, err)
+			}
+		}
+	}
+	vm.InstallMediaPath = ""
+	vm.InstallKernelPath = ""
+	vm.InstallInitrdPath = ""
+	vm.InstallCmdline = ""
+}
+
+// pressKeyForCDBoot answers the "Press any key to boot from CD or DVD"
+// prompt of Windows install media. It stops pressing as soon as the guest is
+// no longer running or setup has started writing to the system disk, so no
+// key reaches setup itself.
+func (h *VMHandler) pressKeyForCDBoot(domainUUID, diskTarget string) {
+	keycodes, err := libvirt.ParseKeyCombo("enter")
+	if err != nil {
+		return
+	}
+	codeset, _ := libvirt.ParseKeycodeSet("linux")
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Second)
+		if !cdBootPending(h.libvirt, domainUUID, diskTarget) {
+			return
+		}
+		if err := h.libvirt.SendKey(domainUUID, codeset, 50, keycodes); err != nil {
+			log.Printf("[VM] Failed to press key for CD boot on %s: %v", domainUUID, err)
+			return
+		}
+	}
+}
+
+// cdBootPending reports whether the domain is running and has not written
+// to its system disk yet, that is whether it may still wait at the boot
+// prompt of the install media.
+func cdBootPending(client *libvirt.Client, domainUUID, diskTarget string) bool {
+	domain, err := client.LookupByUUID(domainUUID)
+	if err != nil {
+		return false
+	}
+	defer domain.Free()
+
+	state, _, err := domain.GetState()
+	if err != nil || state != 1 {
+		return false
+	}
+	if _, written, err := domain.BlockStats(diskTarget); err == nil && written > 0 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,862 @@
+package handlers
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/services"
+	"vmmanager/internal/unattend"
+
+	"github.com/google/uuid"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden domain XML files")
+
+func goldenVM(arch string) models.VirtualMachine {
+	vmID := uuid.MustParse("5b1e4c3a-8d2f-4e6b-9a71-0c3d5e7f9a12")
+	return models.VirtualMachine{
+		ID:              vmID,
+		Name:            "golden-" + arch,
+		Architecture:    arch,
+		CPUAllocated:    2,
+		MemoryAllocated: 2048,
+		MACAddress:      "52:54:00:12:34:56",
+		BootOrder:       "cdrom,hd",
+		IsInstalled:     true,
+		DataDisks: []models.StorageVolume{{
+			ID:        uuid.MustParse("0f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a"),
+			Path:      "/var/lib/libvirt/images/data.qcow2",
+			Format:    "qcow2",
+			TargetDev: "vdb",
+			Bus:       "virtio",
+			CacheMode: "none",
+		}},
+		Interfaces: []models.VMInterface{
+			{MACAddress: "52:54:00:12:34:56", SourceType: "network", Source: "default", Model: "virtio", LinkState: "up"},
+			{MACAddress: "52:54:00:ab:cd:ef", SourceType: "bridge", Source: "br0", Model: "e1000e", LinkState: "down"},
+		},
+	}
+}
+
+func TestGenerateDomainXMLGolden(t *testing.T) {
+	for _, arch := range []string{"x86_64", "aarch64"} {
+		got := generateDomainXML(goldenVM(arch), "/var/lib/vmmanager/disk.qcow2", "")
+		golden := filepath.Join("testdata", "domain_"+arch+".xml")
+		if *updateGolden {
+			if err := os.WriteFile(golden, []byte(got+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", golden, err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", golden, err)
+		}
+		if got+"\n" != string(want) {
+			t.Errorf("%s: generated domain XML differs from %s:\n%s", arch, golden, got)
+		}
+
+		// The generated definition must survive a parse and re-marshal
+		// unchanged, as ISO and clone edits go through that path.
+		def, err := libvirt.ParseDomainXML(got)
+		if err != nil {
+			t.Fatalf("%s: ParseDomainXML failed: %v", arch, err)
+		}
+		again, err := def.Marshal()
+		if err != nil {
+			t.Fatalf("%s: Marshal failed: %v", arch, err)
+		}
+		if again != got {
+			t.Errorf("%s: round trip changed the domain XML:\n%s", arch, again)
+		}
+	}
+}
+
+func TestGenerateDomainXMLKernelBoot(t *testing.T) {
+	kernel := filepath.Join(t.TempDir(), "vmlinuz")
+	if err := os.WriteFile(kernel, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	vm := goldenVM("x86_64")
+	vm.IsInstalled = false
+	vm.InstallKernelPath = kernel
+	vm.InstallInitrdPath = "/tmp/initrd"
+	vm.InstallCmdline = "inst.ks=cdrom:/ks.cfg console=ttyS0 quiet&"
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.OS.Kernel != kernel || def.OS.Cmdline != vm.InstallCmdline || len(def.OS.Boots) != 0 {
+		t.Errorf("unexpected kernel boot config: %+v", def.OS)
+	}
+	if def.OnReboot != "destroy" {
+		t.Errorf("on_reboot = %q, want destroy", def.OnReboot)
+	}
+}
+
+func TestGenerateDomainXMLSecureBoot(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.Firmware = firmwareUEFISecure
+	vm.LoaderPath = "/usr/share/OVMF/OVMF_CODE_4M.ms.fd"
+	vm.NVRAMTemplate = "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"
+	vm.TPM = true
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.OS.Loader == nil || def.OS.Loader.Secure != "yes" || def.OS.Loader.Path != vm.LoaderPath {
+		t.Errorf("unexpected loader: %+v", def.OS.Loader)
+	}
+	if def.OS.NVRAM == nil || def.OS.NVRAM.Template != vm.NVRAMTemplate || def.OS.NVRAM.Path != nvramPath(vm) {
+		t.Errorf("unexpected NVRAM: %+v", def.OS.NVRAM)
+	}
+	if def.Features.SMM == nil || def.Features.SMM.State != "on" {
+		t.Errorf("secure boot needs SMM enabled")
+	}
+	if len(def.Devices.TPMs) != 1 || def.Devices.TPMs[0].Model != "tpm-crb" || def.Devices.TPMs[0].Backend.Version != "2.0" {
+		t.Errorf("unexpected TPM: %+v", def.Devices.TPMs)
+	}
+
+	plain, err := libvirt.ParseDomainXML(generateDomainXML(goldenVM("x86_64"), "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if plain.OS.Loader.Secure != "" || plain.Features.SMM != nil || len(plain.Devices.TPMs) != 0 {
+		t.Errorf("plain UEFI VM got secure boot or TPM settings")
+	}
+}
+
+func TestGenerateDomainXMLCPU(t *testing.T) {
+	vm := goldenVM("aarch64")
+	vm.DomainType = "kvm"
+	vm.CPUMode = "host-passthrough"
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.Type != "kvm" {
+		t.Errorf("domain type = %q, want kvm", def.Type)
+	}
+	if def.CPU == nil || def.CPU.Mode != "host-passthrough" || def.CPU.Model != nil {
+		t.Errorf("unexpected CPU: %+v", def.CPU)
+	}
+
+	vm = goldenVM("x86_64")
+	vm.CPUMode, vm.CPUModel = "custom", "Skylake-Server"
+	def, err = libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.Type != "qemu" {
+		t.Errorf("domain type without capabilities = %q, want qemu", def.Type)
+	}
+	if def.CPU == nil || def.CPU.Mode != "custom" || def.CPU.Model == nil || def.CPU.Model.Value != "Skylake-Server" {
+		t.Errorf("unexpected CPU: %+v", def.CPU)
+	}
+}
+
+func TestValidateSecureBootMachineType(t *testing.T) {
+	vm := goldenVM("x86_64")
+	secure, pc := firmwareUEFISecure, "pc"
+	if err := validateReconfigureRequest(vm, ReconfigureVMRequest{Firmware: &secure}); err != nil {
+		t.Errorf("secure boot on q35 rejected: %v", err)
+	}
+	if err := validateReconfigureRequest(vm, ReconfigureVMRequest{Firmware: &secure, MachineType: &pc}); err == nil {
+		t.Errorf("secure boot on the pc machine type was accepted")
+	}
+	vm.Firmware = firmwareUEFISecure
+	if err := validateReconfigureRequest(vm, ReconfigureVMRequest{MachineType: &pc}); err == nil {
+		t.Errorf("switching a secure boot VM to the pc machine type was accepted")
+	}
+}
+
+func TestGenerateDomainXMLTuning(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.CPUAllocated = 4
+	vm.VCPUHotplug = true
+	tuning := &VMTuning{
+		VCPUPins:    map[int]string{1: "3", 0: "2"},
+		EmulatorPin: "0-1",
+		Sockets:     2,
+		Cores:       2,
+		NUMACells: []VMNUMACell{
+			{CPUs: "0-1", MemoryMB: 1024, HostNodes: "0"},
+			{CPUs: "2-3", MemoryMB: 1024},
+		},
+		HugePages:       true,
+		HugePageSizeKiB: 2048,
+	}
+	if err := validateTuning(vm, tuning); err != nil {
+		t.Fatalf("validateTuning failed: %v", err)
+	}
+	setVMTuning(&vm, tuning)
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.VCPU.Placement != "static" || def.CPUTune == nil || len(def.CPUTune.VCPUPins) != 2 ||
+		def.CPUTune.VCPUPins[0] != (libvirt.VCPUPin{VCPU: 0, CPUSet: "2"}) || def.CPUTune.EmulatorPin.CPUSet != "0-1" {
+		t.Errorf("unexpected pinning: %+v %+v", def.VCPU, def.CPUTune)
+	}
+	if topo := def.CPU.Topology; topo == nil || topo.Sockets != 2 || topo.Cores != 2 || topo.Threads != 1 {
+		t.Errorf("unexpected topology: %+v", topo)
+	}
+	if def.CPU.NUMA == nil || len(def.CPU.NUMA.Cells) != 2 || def.CPU.NUMA.Cells[1].CPUs != "2-3" {
+		t.Errorf("unexpected guest NUMA cells: %+v", def.CPU.NUMA)
+	}
+	if def.NUMATune == nil || len(def.NUMATune.MemNodes) != 1 || def.NUMATune.MemNodes[0].Nodeset != "0" {
+		t.Errorf("unexpected numatune: %+v", def.NUMATune)
+	}
+	if mb := def.MemoryBacking; mb == nil || mb.HugePages == nil || len(mb.HugePages.Pages) != 1 || mb.HugePages.Pages[0].Size != 2048 {
+		t.Errorf("unexpected memory backing: %+v", mb)
+	}
+}
+
+func TestValidateTuning(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.CPUAllocated = 4
+	for name, tuning := range map[string]*VMTuning{
+		"topology mismatch":  {Sockets: 3},
+		"pin out of range":   {VCPUPins: map[int]string{4: "0"}},
+		"bad cpuset":         {EmulatorPin: "1-a"},
+		"uncovered vCPU":     {NUMACells: []VMNUMACell{{CPUs: "0-2", MemoryMB: 2048}}},
+		"overlapping cells":  {NUMACells: []VMNUMACell{{CPUs: "0-2", MemoryMB: 1024}, {CPUs: "2-3", MemoryMB: 1024}}},
+		"memory mismatch":    {NUMACells: []VMNUMACell{{CPUs: "0-3", MemoryMB: 1024}}},
+		"size without pages": {HugePageSizeKiB: 2048},
+		"unknown page size":  {HugePages: true, HugePageSizeKiB: 4096},
+	} {
+		if err := validateTuning(vm, tuning); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// The capabilities report the configured pool, which is larger than
+	// what is still free.
+	caps := &libvirt.HostCapabilities{NUMACells: []libvirt.HostNUMACell{
+		{ID: 0, CPUs: []int{0, 1}, Pages: map[uint64]int{2048: 2048}},
+		{ID: 1, CPUs: []int{2, 3}, Pages: map[uint64]int{2048: 2048}},
+	}}
+	pool := &libvirt.HugePagePool{Free: map[int]int{0: 512, 1: 1024}}
+	if err := validateHostTuning(&VMTuning{VCPUPins: map[int]string{0: "2-3"}, HugePages: true}, caps, pool, 2048); err != nil {
+		t.Errorf("valid host tuning rejected: %v", err)
+	}
+	if err := validateHostTuning(&VMTuning{VCPUPins: map[int]string{0: "4"}}, caps, pool, 2048); err == nil {
+		t.Errorf("pinning to a missing host CPU was accepted")
+	}
+	bound := &VMTuning{NUMACells: []VMNUMACell{{CPUs: "0-3", MemoryMB: 2048, HostNodes: "0"}}, HugePages: true}
+	if err := validateHostTuning(bound, caps, pool, 2048); err == nil {
+		t.Errorf("hugepages beyond the free pages of the bound node were accepted")
+	}
+	if err := validateHostTuning(bound, caps, nil, 2048); err != nil {
+		t.Errorf("hugepage check without a pool rejected the tuning: %v", err)
+	}
+	pool.Reserved = 600
+	if err := validateHostTuning(&VMTuning{HugePages: true}, caps, pool, 2048); err == nil {
+		t.Errorf("hugepages already reserved by other mappings were counted as free")
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	got, err := parseCPUSet("0-3,^2,6")
+	if err != nil || len(got) != 4 || got[2] != 3 || got[3] != 6 {
+		t.Errorf("parseCPUSet = %v, %v", got, err)
+	}
+	for _, set := range []string{"", "3-1", "^1", "0-100000"} {
+		if _, err := parseCPUSet(set); err == nil {
+			t.Errorf("parseCPUSet(%q) should fail", set)
+		}
+	}
+}
+
+func TestGenerateDomainXMLQoS(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.QoS = models.QoSLimits{DiskReadIOPS: 500, DiskWriteBytesSec: 10485760, NetOutboundKBps: 1024}
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	for _, disk := range def.DisksByDevice("disk") {
+		if disk.IOTune == nil || disk.IOTune.ReadIOPSSec != 500 || disk.IOTune.WriteBytesSec != 10485760 || disk.IOTune.WriteIOPSSec != 0 {
+			t.Errorf("disk %s: unexpected iotune %+v", disk.Target.Dev, disk.IOTune)
+		}
+	}
+	for _, iface := range def.Devices.Interfaces {
+		if iface.Bandwidth == nil || iface.Bandwidth.Inbound != nil || iface.Bandwidth.Outbound.Average != 1024 {
+			t.Errorf("NIC %s: unexpected bandwidth %+v", iface.MAC.Address, iface.Bandwidth)
+		}
+	}
+	for _, cdrom := range def.DisksByDevice("cdrom") {
+		if cdrom.IOTune != nil {
+			t.Errorf("CD-ROM %s must not be throttled", cdrom.Target.Dev)
+		}
+	}
+}
+
+func TestCapQoS(t *testing.T) {
+	maximums := models.QoSLimits{DiskReadIOPS: 1000, NetInboundKBps: 2048}
+
+	got, err := capQoS(models.QoSLimits{DiskWriteIOPS: 300, NetInboundKBps: 1024}, maximums)
+	if err != nil {
+		t.Fatalf("capQoS failed: %v", err)
+	}
+	want := models.QoSLimits{DiskReadIOPS: 1000, DiskWriteIOPS: 300, NetInboundKBps: 1024}
+	if got != want {
+		t.Errorf("capQoS = %+v, want %+v", got, want)
+	}
+	if _, err := capQoS(models.QoSLimits{DiskReadIOPS: 1001}, maximums); err == nil {
+		t.Errorf("a limit above the maximum was accepted")
+	}
+}
+
+func TestCheckQoSWithin(t *testing.T) {
+	maximums := models.QoSLimits{DiskReadIOPS: 1000, NetInboundKBps: 2048}
+
+	if err := checkQoSWithin(models.QoSLimits{DiskReadIOPS: 1000, DiskWriteIOPS: 5000, NetInboundKBps: 1024}, maximums); err != nil {
+		t.Errorf("limits within the maximums rejected: %v", err)
+	}
+	if err := checkQoSWithin(models.QoSLimits{DiskReadIOPS: 1001, NetInboundKBps: 1024}, maximums); err == nil {
+		t.Errorf("a limit above the maximum was accepted")
+	}
+	if err := checkQoSWithin(models.QoSLimits{DiskReadIOPS: 500}, maximums); err == nil {
+		t.Errorf("an unlimited value under a maximum was accepted")
+	}
+	if err := checkQoSWithin(models.QoSLimits{}, models.QoSLimits{}); err != nil {
+		t.Errorf("unlimited values without maximums rejected: %v", err)
+	}
+}
+
+func TestAllocateHostCPUs(t *testing.T) {
+	caps := &libvirt.HostCapabilities{NUMACells: []libvirt.HostNUMACell{
+		{ID: 0, CPUs: []int{0, 1, 2, 3}},
+		{ID: 1, CPUs: []int{4, 5, 6, 7}},
+	}}
+
+	got, err := allocateHostCPUs(caps, map[int]bool{0: true, 1: true}, 3)
+	if err != nil || len(got) != 3 || got[0] != 4 || got[2] != 6 {
+		t.Errorf("expected CPUs from the one cell with room, got %v, %v", got, err)
+	}
+	got, err = allocateHostCPUs(caps, map[int]bool{0: true, 4: true}, 5)
+	if err != nil || len(got) != 5 || got[0] != 1 || got[4] != 6 {
+		t.Errorf("expected CPUs spread across cells, got %v, %v", got, err)
+	}
+	if _, err := allocateHostCPUs(caps, map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true}, 4); err == nil {
+		t.Errorf("allocation beyond the free CPUs succeeded")
+	}
+	if _, err := allocateHostCPUs(&libvirt.HostCapabilities{}, nil, 1); err == nil {
+		t.Errorf("allocation without a known topology succeeded")
+	}
+}
+
+func TestHeldHostCPUs(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	h := &VMHandler{dedicatedHeld: map[uuid.UUID][]int{first: {0, 1}}}
+
+	used := map[int]bool{}
+	h.addHeldHostCPUs(used, second)
+	if !used[0] || !used[1] || len(used) != 2 {
+		t.Errorf("CPUs held for another VM not counted as used: %v", used)
+	}
+	used = map[int]bool{}
+	h.addHeldHostCPUs(used, first)
+	if len(used) != 0 {
+		t.Errorf("CPUs held for the VM itself counted as used: %v", used)
+	}
+
+	h.releaseHostCPUs(first)
+	h.addHeldHostCPUs(used, second)
+	if len(used) != 0 {
+		t.Errorf("released CPUs still held: %v", used)
+	}
+}
+
+func TestFlavorAllowed(t *testing.T) {
+	userID := uuid.New()
+	open := &models.Flavor{IsActive: true}
+	restricted := &models.Flavor{IsActive: true, AllowedRoles: []string{"operator"}, AllowedUsers: []string{userID.String()}}
+	inactive := &models.Flavor{IsActive: false}
+
+	cases := []struct {
+		flavor *models.Flavor
+		userID uuid.UUID
+		role   string
+		want   bool
+	}{
+		{open, uuid.New(), "user", true},
+		{restricted, uuid.New(), "user", false},
+		{restricted, uuid.New(), "operator", true},
+		{restricted, userID, "user", true},
+		{inactive, userID, "user", false},
+		{inactive, userID, "admin", true},
+	}
+	for i, tc := range cases {
+		if got := flavorAllowed(tc.flavor, tc.userID, tc.role); got != tc.want {
+			t.Errorf("case %d: flavorAllowed = %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateDomainXMLWindows(t *testing.T) {
+	driverISO := filepath.Join(t.TempDir(), "virtio-win.iso")
+	if err := os.WriteFile(driverISO, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &VMHandler{virtioWinISO: driverISO}
+	vm := goldenVM("x86_64")
+	h.applyOSProfile(&vm, osProfileFor("", "Windows Server 2022"))
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	hyperv := def.Features.HyperV
+	if hyperv == nil || hyperv.Relaxed == nil || hyperv.Spinlocks == nil || hyperv.Spinlocks.Retries != 8191 {
+		t.Errorf("unexpected Hyper-V features: %+v", hyperv)
+	}
+	if def.Clock.Offset != "localtime" {
+		t.Errorf("clock offset = %q, want localtime", def.Clock.Offset)
+	}
+	if root := def.Devices.Disks[0].Target; root.Dev != "sde" || root.Bus != "sata" {
+		t.Errorf("unexpected system disk target: %+v", root)
+	}
+	var driverDisk *libvirt.DomainDisk
+	for i, disk := range def.Devices.Disks {
+		if disk.Target.Dev == driverISOTarget {
+			driverDisk = &def.Devices.Disks[i]
+		}
+	}
+	if driverDisk == nil || driverDisk.Device != "cdrom" || driverDisk.Source.File != driverISO {
+		t.Errorf("driver ISO not attached as %s: %+v", driverISOTarget, driverDisk)
+	}
+
+	linux, err := libvirt.ParseDomainXML(generateDomainXML(goldenVM("x86_64"), "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if linux.Features.HyperV != nil || linux.Clock.Offset != "utc" || linux.Devices.Disks[0].Target.Dev != "vda" {
+		t.Errorf("Linux VM got Windows settings")
+	}
+}
+
+func TestGenerateDomainXMLLifecycle(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.Lifecycle = models.LifecyclePolicy{OnPoweroff: "preserve", OnCrash: "coredump-destroy", WatchdogAction: "reset"}
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.OnPoweroff != "preserve" || def.OnReboot != "restart" || def.OnCrash != "coredump-destroy" {
+		t.Errorf("unexpected lifecycle actions: %s/%s/%s", def.OnPoweroff, def.OnReboot, def.OnCrash)
+	}
+	if len(def.Devices.Watchdogs) != 1 || def.Devices.Watchdogs[0].Model != "i6300esb" || def.Devices.Watchdogs[0].Action != "reset" {
+		t.Errorf("unexpected watchdog: %+v", def.Devices.Watchdogs)
+	}
+
+	// A Linux installer powers off on reboot to drop its media, unless the
+	// lifecycle policy sets its own reboot action.
+	vm.IsInstalled = false
+	if got := generateRebootAction(vm, "/isos/install.iso"); got != "destroy" {
+		t.Errorf("on_reboot during install = %q, want destroy", got)
+	}
+	vm.Lifecycle.OnReboot = "preserve"
+	if got := generateRebootAction(vm, "/isos/install.iso"); got != "preserve" {
+		t.Errorf("on_reboot during install with a policy = %q, want preserve", got)
+	}
+	vm.Lifecycle.OnReboot = ""
+	vm.UnattendProfile = string(unattend.ProfileWindows)
+	if got := generateRebootAction(vm, "/isos/install.iso"); got != "restart" {
+		t.Errorf("on_reboot during Windows install = %q, want restart", got)
+	}
+}
+
+func TestGenerateDomainXMLFilesystems(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.Filesystems = []models.VMFilesystem{{SourcePath: "/srv/share", MountTag: "share", ReadOnly: true}}
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if len(def.Devices.Filesystems) != 1 {
+		t.Fatalf("expected one filesystem, got %+v", def.Devices.Filesystems)
+	}
+	fs := def.Devices.Filesystems[0]
+	if fs.Driver == nil || fs.Driver.Type != "virtiofs" || fs.Source.Dir != "/srv/share" || fs.Target.Dir != "share" || fs.ReadOnly == nil {
+		t.Errorf("unexpected filesystem: %+v", fs)
+	}
+	mb := def.MemoryBacking
+	if mb == nil || mb.Access == nil || mb.Access.Mode != "shared" || mb.Source == nil || mb.Source.Type != "memfd" {
+		t.Errorf("unexpected memory backing: %+v", mb)
+	}
+}
+
+func TestSharedSourcePath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	folder := &models.SharedFolder{HostPath: root}
+
+	if _, err := sharedSourcePath(folder, "data"); err != nil {
+		t.Errorf("sub directory rejected: %v", err)
+	}
+	for _, sub := range []string{"escape", "../", "/etc"} {
+		if path, err := sharedSourcePath(folder, sub); err == nil {
+			t.Errorf("sub_path %q accepted as %s", sub, path)
+		}
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	root := t.TempDir()
+	data := filepath.Join(root, "data")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	owner := &models.User{ID: uuid.New(), Username: "alice", Role: "user"}
+	fs := models.VMFilesystem{SourcePath: data, MountTag: "data"}
+
+	folder := &models.SharedFolder{Name: "share", HostPath: root, AllowWrite: true}
+	if got, err := checkFilesystem(fs, folder, owner); err != nil || got.ReadOnly {
+		t.Errorf("writable mapping changed: %+v, %v", got, err)
+	}
+
+	folder.AllowWrite = false
+	if got, err := checkFilesystem(fs, folder, owner); err != nil || !got.ReadOnly {
+		t.Errorf("mapping not downgraded to read-only: %+v, %v", got, err)
+	}
+
+	folder.HostPath = t.TempDir()
+	if _, err := checkFilesystem(fs, folder, owner); err == nil {
+		t.Errorf("mapping outside of the narrowed host path accepted")
+	}
+
+	folder.HostPath = root
+	folder.AllowedUsers = []string{uuid.NewString()}
+	if _, err := checkFilesystem(fs, folder, owner); err == nil {
+		t.Errorf("mapping of a user removed from the folder accepted")
+	}
+	owner.Role = "admin"
+	if _, err := checkFilesystem(fs, folder, owner); err != nil {
+		t.Errorf("mapping of an admin rejected: %v", err)
+	}
+}
+
+func TestGenerateDomainXMLEncryptedDisk(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.Encryption = models.DiskEncryption{Enabled: true, SecretUUID: "0f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0"}
+
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	disk := def.FindDisk("vda")
+	if disk == nil || disk.Encryption == nil || disk.Encryption.Format != "luks" {
+		t.Fatalf("system disk is not encrypted: %+v", disk)
+	}
+	if secret := disk.Encryption.Secret; secret == nil || secret.Type != "passphrase" || secret.UUID != vm.Encryption.SecretUUID {
+		t.Errorf("unexpected disk secret: %+v", secret)
+	}
+	if data := def.FindDisk("vdb"); data == nil || data.Encryption != nil {
+		t.Errorf("plain data disk has encryption: %+v", data)
+	}
+
+	vm.DataDisks[0].Encryption = models.DiskEncryption{Enabled: true, SecretUUID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"}
+	def, err = libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	data := def.FindDisk("vdb")
+	if data == nil || data.Encryption == nil || data.Encryption.Secret == nil || data.Encryption.Secret.UUID != vm.DataDisks[0].Encryption.SecretUUID {
+		t.Errorf("data disk is not encrypted with its own secret: %+v", data)
+	}
+}
+
+func TestGenerateDomainXMLMemBalloon(t *testing.T) {
+	def, err := libvirt.ParseDomainXML(generateDomainXML(goldenVM("x86_64"), "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	balloon := def.Devices.MemBalloon
+	if balloon == nil || balloon.Model != "virtio" || balloon.AutoDeflate != "on" {
+		t.Fatalf("unexpected memory balloon: %+v", balloon)
+	}
+	if balloon.Stats == nil || balloon.Stats.Period != libvirt.MemBalloonStatsPeriod {
+		t.Errorf("balloon stats period = %+v, want %d", balloon.Stats, libvirt.MemBalloonStatsPeriod)
+	}
+}
+
+func TestGenerateDomainXMLDirectBoot(t *testing.T) {
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "Image")
+	if err := os.WriteFile(kernel, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	boot := models.DirectBoot{
+		Enabled: true,
+		Kernel:  kernel,
+		Initrd:  filepath.Join(dir, "initrd.img"),
+		DTB:     filepath.Join(dir, "board.dtb"),
+		Cmdline: "console=ttyAMA0 root=/dev/vda1 rw",
+	}
+
+	for _, arch := range []string{"x86_64", "aarch64"} {
+		vm := goldenVM(arch)
+		vm.DirectBoot = boot
+		def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+		if err != nil {
+			t.Fatalf("%s: ParseDomainXML failed: %v", arch, err)
+		}
+		if def.OS.Kernel != kernel || def.OS.Initrd != boot.Initrd || def.OS.Cmdline != boot.Cmdline || len(def.OS.Boots) != 0 {
+			t.Errorf("%s: unexpected direct boot config: %+v", arch, def.OS)
+		}
+		wantDTB := ""
+		if arch == "aarch64" {
+			wantDTB = boot.DTB
+		}
+		if def.OS.DTB != wantDTB {
+			t.Errorf("%s: dtb = %q, want %q", arch, def.OS.DTB, wantDTB)
+		}
+	}
+
+	vm := goldenVM("x86_64")
+	vm.DirectBoot = boot
+	vm.DirectBoot.Enabled = false
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.OS.Kernel != "" || len(def.OS.Boots) == 0 {
+		t.Errorf("disk boot still boots the kernel: %+v", def.OS)
+	}
+}
+
+func TestCheckDirectBoot(t *testing.T) {
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "Image")
+	initrd := filepath.Join(dir, "initrd.img")
+	for _, path := range []string{kernel, initrd} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name    string
+		arch    string
+		boot    models.DirectBoot
+		wantErr bool
+	}{
+		{name: "disk boot", arch: "x86_64", boot: models.DirectBoot{Kernel: missing}},
+		{name: "files present", arch: "x86_64", boot: models.DirectBoot{Enabled: true, Kernel: kernel, Initrd: initrd}},
+		{name: "no initrd", arch: "x86_64", boot: models.DirectBoot{Enabled: true, Kernel: kernel}},
+		{name: "no kernel", arch: "x86_64", boot: models.DirectBoot{Enabled: true}, wantErr: true},
+		{name: "kernel missing", arch: "x86_64", boot: models.DirectBoot{Enabled: true, Kernel: missing}, wantErr: true},
+		{name: "initrd missing", arch: "x86_64", boot: models.DirectBoot{Enabled: true, Kernel: kernel, Initrd: missing}, wantErr: true},
+		{name: "dtb ignored on x86", arch: "x86_64", boot: models.DirectBoot{Enabled: true, Kernel: kernel, DTB: missing}},
+		{name: "dtb missing on arm", arch: "aarch64", boot: models.DirectBoot{Enabled: true, Kernel: kernel, DTB: missing}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := goldenVM(tt.arch)
+			vm.DirectBoot = tt.boot
+			if err := checkDirectBoot(vm); (err != nil) != tt.wantErr {
+				t.Errorf("checkDirectBoot error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	vm := goldenVM("x86_64")
+	vm.DirectBoot = models.DirectBoot{Enabled: true, Kernel: missing}
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	if def.OS.Kernel != missing || len(def.OS.Boots) != 0 {
+		t.Errorf("missing kernel fell back to disk boot: %+v", def.OS)
+	}
+}
+
+func TestResolveBootArtifact(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "vmlinuz")
+	for _, path := range []string{filepath.Join(root, "vmlinuz"), outside} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := resolveBootArtifact(root, "vmlinuz"); err != nil || filepath.Base(got) != "vmlinuz" {
+		t.Errorf("resolveBootArtifact(vmlinuz) = %q, %v", got, err)
+	}
+	for _, rel := range []string{"", "/etc/passwd", "../vmlinuz", "escape", "dir", "missing"} {
+		if got, err := resolveBootArtifact(root, rel); err == nil {
+			t.Errorf("resolveBootArtifact(%q) = %q, want an error", rel, got)
+		}
+	}
+}
+
+func TestDescribeDomain(t *testing.T) {
+	vm := goldenVM("x86_64")
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, "/var/lib/vmmanager/disk.qcow2", ""))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	def.Memory = &libvirt.DomainMemory{Value: 2097152}
+
+	adopted, err := describeDomain(def)
+	if err != nil {
+		t.Fatalf("describeDomain failed: %v", err)
+	}
+	got := adopted.VM
+	if got.ID != vm.ID || got.LibvirtDomainUUID != vm.ID.String() || got.Name != vm.Name {
+		t.Errorf("identity = %s %s %s", got.ID, got.LibvirtDomainUUID, got.Name)
+	}
+	if got.CPUAllocated != 2 || got.MemoryAllocated != 2048 {
+		t.Errorf("size = %d vCPUs, %d MB", got.CPUAllocated, got.MemoryAllocated)
+	}
+	if got.DiskPath != "/var/lib/vmmanager/disk.qcow2" || adopted.RootTarget != "vda" || got.BootOrder != "cdrom,hd" {
+		t.Errorf("disk = %s on %s, boot order %s", got.DiskPath, adopted.RootTarget, got.BootOrder)
+	}
+	if got.Firmware != firmwareUEFI || got.MACAddress != "52:54:00:12:34:56" || got.VideoModel != "qxl" {
+		t.Errorf("firmware %s, MAC %s, video %s", got.Firmware, got.MACAddress, got.VideoModel)
+	}
+	if len(adopted.DataDisks) != 1 || adopted.DataDisks[0].TargetDev != "vdb" || adopted.DataDisks[0].Path != vm.DataDisks[0].Path {
+		t.Errorf("unexpected data disks: %+v", adopted.DataDisks)
+	}
+	if len(adopted.Interfaces) != 2 || !adopted.Interfaces[0].IsPrimary ||
+		adopted.Interfaces[1].Source != "br0" || adopted.Interfaces[1].Model != "e1000e" || adopted.Interfaces[1].LinkState != "down" {
+		t.Errorf("unexpected interfaces: %+v", adopted.Interfaces)
+	}
+
+	def.Devices.Disks[0].Target.Bus = "ide"
+	if _, err := describeDomain(def); err == nil {
+		t.Error("describeDomain accepted a system disk on the IDE bus")
+	}
+	def.Devices.Disks[0].Target.Bus = diskBusVirtio
+
+	def.Devices.Disks[0].Driver.Type = "raw"
+	if _, err := describeDomain(def); err == nil {
+		t.Error("describeDomain accepted a raw system disk")
+	}
+	def.Devices.Disks[0].Driver = nil
+	if _, err := describeDomain(def); err == nil {
+		t.Error("describeDomain accepted a system disk without a format")
+	}
+	def.Devices.Disks[0].Driver = &libvirt.DiskDriver{Name: "qemu", Type: "qcow2"}
+
+	def.Devices.Disks[0].Source = &libvirt.DiskSource{Dev: "/dev/vg0/root"}
+	if _, err := describeDomain(def); err == nil {
+		t.Error("describeDomain accepted a block device system disk")
+	}
+}
+
+func TestUnpooledDisks(t *testing.T) {
+	pools := map[string]models.StoragePool{"/var/lib/vmmanager/pools/fast": {Name: "fast"}}
+	disks := []models.StorageVolume{
+		{Path: "/var/lib/vmmanager/pools/fast/data.qcow2"},
+		{Path: "/srv/images/scratch.qcow2"},
+		{Path: "/var/lib/vmmanager/pools/fast/nested/logs.qcow2"},
+	}
+	got := unpooledDisks(disks, pools)
+	want := []string{"/srv/images/scratch.qcow2", "/var/lib/vmmanager/pools/fast/nested/logs.qcow2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unpooledDisks = %v, want %v", got, want)
+	}
+	if got := unpooledDisks(disks[:1], pools); len(got) != 0 {
+		t.Errorf("unpooledDisks of a pooled disk = %v", got)
+	}
+	if got := unpooledDisks(disks[:1], map[string]models.StoragePool{}); len(got) != 1 {
+		t.Errorf("unpooledDisks without pools = %v", got)
+	}
+}
+
+func TestDomainMemoryMB(t *testing.T) {
+	for _, tc := range []struct {
+		memory libvirt.DomainMemory
+		want   int
+	}{
+		{libvirt.DomainMemory{Value: 1048576}, 1024},
+		{libvirt.DomainMemory{Unit: "MiB", Value: 512}, 512},
+		{libvirt.DomainMemory{Unit: "G", Value: 4}, 4096},
+		{libvirt.DomainMemory{Unit: "bytes", Value: 268435456}, 256},
+	} {
+		if got, err := domainMemoryMB(&tc.memory); err != nil || got != tc.want {
+			t.Errorf("domainMemoryMB(%+v) = %d, %v, want %d", tc.memory, got, err, tc.want)
+		}
+	}
+	if _, err := domainMemoryMB(&libvirt.DomainMemory{Unit: "pages", Value: 1}); err == nil {
+		t.Error("domainMemoryMB accepted an unknown unit")
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	vm := goldenVM("x86_64")
+	vm.DiskPath = "/var/lib/vmmanager/disk.qcow2"
+	def, err := libvirt.ParseDomainXML(generateDomainXML(vm, vm.DiskPath, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifts := services.DetectDrift(&vm, def); len(drifts) != 0 {
+		t.Fatalf("generated domain drifted from its VM: %+v", drifts)
+	}
+
+	def.VCPU.Value = 4
+	def.Memory = &libvirt.DomainMemory{Unit: "GiB", Value: 4}
+	def.Devices.Disks[0].Source.File = "/srv/other.qcow2"
+	def.Devices.Interfaces[0].MAC.Address = "52:54:00:FF:00:01"
+	def.Devices.Graphics[0].Port, def.Devices.Graphics[0].AutoPort = 5905, "no"
+
+	want := map[string]string{
+		services.DriftFieldCPU:        "4",
+		services.DriftFieldMemory:     "4096",
+		services.DriftFieldDiskPath:   "/srv/other.qcow2",
+		services.DriftFieldMACAddress: "52:54:00:ff:00:01",
+		services.DriftFieldVNCPort:    "5905",
+	}
+	drifts := services.DetectDrift(&vm, def)
+	if len(drifts) != len(want) {
+		t.Fatalf("got %d drifts, want %d: %+v", len(drifts), len(want), drifts)
+	}
+	for _, drift := range drifts {
+		if want[drift.Field] != drift.LibvirtValue {
+			t.Errorf("%s drifted to %q, want %q", drift.Field, drift.LibvirtValue, want[drift.Field])
+		}
+	}
+
+	for _, drift := range drifts[:2] {
+		if err := services.EnforceDBValue(def, &vm, drift.Field); err != nil {
+			t.Fatalf("EnforceDBValue(%s): %v", drift.Field, err)
+		}
+	}
+	accepted := vm
+	for _, drift := range drifts[2:] {
+		if err := services.AcceptLibvirtValue(&accepted, drift.Field, drift.LibvirtValue); err != nil {
+			t.Fatalf("AcceptLibvirtValue(%s): %v", drift.Field, err)
+		}
+	}
+	if drifts := services.DetectDrift(&accepted, def); len(drifts) != 0 {
+		t.Errorf("drift left after resolving every field: %+v", drifts)
+	}
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	"vmmanager/config"
 	"vmmanager/internal/api/handlers"
+	"vmmanager/internal/diskcrypt"
 	"vmmanager/internal/libvirt"
 	"vmmanager/internal/middleware"
 	"vmmanager/internal/repository"
@@ -12,7 +13,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func Register(router *gin.Engine, cfg *config.Config, repos *repository.Repositories, libvirtClient *libvirt.Client, wsHandler *websocket.Handler, backupService *services.BackupService) {
+func Register(router *gin.Engine, cfg *config.Config, repos *repository.Repositories, libvirtClient *libvirt.Client, wsHandler *websocket.Handler, backupService *services.BackupService, orphanService *services.OrphanService, driftService *services.DriftService, guestAgentService *services.GuestAgentService, keyring *diskcrypt.Keyring) {
 	jwtMiddleware := middleware.JWTRequired(cfg.JWT.Secret)
 
 	auditService := services.NewAuditService(repos.AuditLog)
@@ -22,12 +23,29 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 	authHandler.SetLoginHistoryRepo(repos.LoginHistory)
 	vmHandler := handlers.NewVMHandler(repos.VM, repos.User, repos.Template, repos.VMStats, repos.ISO, libvirtClient, cfg.Storage.Path, auditService)
 	vmHandler.SetVMOperationHistoryRepo(repos.VMOperationHistory)
+	vmHandler.SetGuestAgentService(guestAgentService)
+	vmHandler.SetSSHKeyRepo(repos.SSHKey)
+	vmHandler.SetStorageRepos(repos.StoragePool, repos.StorageVolume)
+	vmHandler.SetNetworkRepos(repos.VMInterface, repos.VirtualNetwork)
+	vmHandler.SetTuningRoles(cfg.Tuning.AllowedRoles)
+	vmHandler.SetFlavors(repos.Flavor, cfg.Flavors.RequireFlavor)
+	vmHandler.SetVirtioWinISO(cfg.Install.VirtioWinISO)
+	vmHandler.SetSharedFolderRepos(repos.SharedFolder, repos.VMFilesystem)
+	vmHandler.SetKeyring(keyring)
+	vmHandler.SetKernelLibrary(cfg.KernelBoot.LibraryPath)
+	vmHandler.SetDriftService(repos.VMDrift, driftService)
+	if wsHandler != nil {
+		vmHandler.SetInstallMonitor(wsHandler.InstallMonitor())
+		vmHandler.SetSyncService(wsHandler.VMSyncService())
+	}
 	templateHandler := handlers.NewTemplateHandler(repos.Template, repos.TemplateUpload, repos.VM)
 	templateHandler.SetAuditService(auditService)
 	adminHandler := handlers.NewAdminHandler(repos.User, repos.VM, repos.Template, repos.AuditLog)
 	auditHandler := handlers.NewAuditHandler(repos.AuditLog)
 	snapshotHandler := handlers.NewSnapshotHandler(repos.VM, repos.VMSnapshot, libvirtClient)
+	snapshotHandler.SetKeyring(keyring)
 	batchHandler := handlers.NewBatchHandler(repos.VM, libvirtClient, cfg.Storage.Path, auditService)
+	batchHandler.SetVMHandler(vmHandler)
 	statsHandler := handlers.NewVMStatsHandler(repos.VMStats, repos.DB)
 	alertRuleHandler := handlers.NewAlertRuleHandler(repos.AlertRule)
 	alertHistoryHandler := handlers.NewAlertHistoryHandler(repos.AlertHistory)
@@ -36,6 +54,14 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 	storageHandler := handlers.NewStorageHandler(repos, libvirtClient)
 	backupHandler := handlers.NewBackupHandler(repos, backupService)
 	operationHistoryHandler := handlers.NewOperationHistoryHandler(repos)
+	sshKeyHandler := handlers.NewSSHKeyHandler(repos.SSHKey)
+	sshKeyHandler.SetAuditService(auditService)
+	flavorHandler := handlers.NewFlavorHandler(repos.Flavor)
+	flavorHandler.SetAuditService(auditService)
+	sharedFolderHandler := handlers.NewSharedFolderHandler(repos.SharedFolder)
+	sharedFolderHandler.SetAuditService(auditService)
+	hostHandler := handlers.NewHostHandler(libvirtClient)
+	orphanHandler := handlers.NewOrphanHandler(orphanService, auditService)
 
 	api := router.Group("/api/v1")
 	{
@@ -47,6 +73,11 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 			auth.GET("/profile", jwtMiddleware, authHandler.GetProfile)
 			auth.PUT("/profile", jwtMiddleware, authHandler.UpdateProfile)
 			auth.POST("/profile/avatar", jwtMiddleware, authHandler.UpdateAvatar)
+			auth.GET("/profile/ssh-keys", jwtMiddleware, sshKeyHandler.ListKeys)
+			auth.POST("/profile/ssh-keys", jwtMiddleware, sshKeyHandler.CreateKey)
+			auth.GET("/profile/ssh-keys/:id", jwtMiddleware, sshKeyHandler.GetKey)
+			auth.PUT("/profile/ssh-keys/:id", jwtMiddleware, sshKeyHandler.UpdateKey)
+			auth.DELETE("/profile/ssh-keys/:id", jwtMiddleware, sshKeyHandler.DeleteKey)
 			auth.POST("/refresh", authHandler.RefreshToken)
 		}
 
@@ -64,6 +95,35 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 			vms.POST("/:id/restart", vmHandler.RebootVM)
 			vms.POST("/:id/suspend", vmHandler.SuspendVM)
 			vms.POST("/:id/resume", vmHandler.ResumeVM)
+			vms.POST("/:id/power-button", vmHandler.PressPowerButton)
+			vms.POST("/:id/send-keys", vmHandler.SendKeys)
+			vms.GET("/:id/disks", vmHandler.ListDisks)
+			vms.POST("/:id/disks", vmHandler.CreateDisk)
+			vms.POST("/:id/disks/attach", vmHandler.AttachDisk)
+			vms.DELETE("/:id/disks/:disk", vmHandler.DetachDisk)
+			vms.POST("/:id/disks/:disk/resize", vmHandler.ResizeDisk)
+			vms.POST("/:id/disks/:disk/encryption/rotate", vmHandler.RotateDataDiskKey)
+			vms.GET("/:id/config", vmHandler.GetVMConfig)
+			vms.PUT("/:id/config", vmHandler.ReconfigureVM)
+			vms.PUT("/:id/qos", vmHandler.UpdateVMQoS)
+			vms.GET("/:id/lifecycle", vmHandler.GetVMLifecycle)
+			vms.PUT("/:id/lifecycle", vmHandler.UpdateVMLifecycle)
+			vms.GET("/:id/balloon", vmHandler.GetVMBalloon)
+			vms.PUT("/:id/balloon", vmHandler.UpdateVMBalloon)
+			vms.PUT("/:id/boot-mode", vmHandler.SetBootMode)
+			vms.GET("/:id/boot-artifacts", vmHandler.ListBootArtifacts)
+			vms.POST("/:id/boot-artifacts", vmHandler.UploadBootArtifact)
+			vms.DELETE("/:id/boot-artifacts/:name", vmHandler.DeleteBootArtifact)
+			vms.GET("/:id/filesystems", vmHandler.ListFilesystems)
+			vms.POST("/:id/filesystems", vmHandler.AddFilesystem)
+			vms.DELETE("/:id/filesystems/:fsid", vmHandler.RemoveFilesystem)
+			vms.POST("/:id/encryption/rotate", vmHandler.RotateDiskKey)
+			vms.GET("/:id/nvram", vmHandler.GetVMNVRAM)
+			vms.POST("/:id/nvram/reset", vmHandler.ResetVMNVRAM)
+			vms.GET("/:id/nics", vmHandler.ListNICs)
+			vms.POST("/:id/nics", vmHandler.AddNIC)
+			vms.PUT("/:id/nics/:mac", vmHandler.UpdateNIC)
+			vms.DELETE("/:id/nics/:mac", vmHandler.RemoveNIC)
 			vms.GET("/:id/console", vmHandler.GetConsole)
 			vms.GET("/:id/stats", statsHandler.GetVMStats)
 			vms.GET("/:id/history", statsHandler.GetVMHistory)
@@ -79,6 +139,9 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 			vms.POST("/:id/hotplug/cpu", vmHandler.HotplugCPU)
 			vms.POST("/:id/hotplug/memory", vmHandler.HotplugMemory)
 			vms.POST("/:id/sync", vmHandler.SyncVMStatus)
+			vms.GET("/:id/guest-info", vmHandler.GetGuestInfo)
+			vms.POST("/:id/guest-exec", vmHandler.GuestExec)
+			vms.POST("/:id/ssh-keys", vmHandler.InjectSSHKeys)
 
 			vms.GET("/statuses", vmHandler.GetAllVMStatuses)
 
@@ -120,6 +183,12 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 			}
 		}
 
+		host := api.Group("/host")
+		{
+			host.Use(jwtMiddleware)
+			host.GET("/capabilities", hostHandler.GetCapabilities)
+		}
+
 		templates := api.Group("/templates")
 		{
 			templates.Use(jwtMiddleware)
@@ -140,6 +209,26 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 			}
 		}
 
+		flavors := api.Group("/flavors")
+		{
+			flavors.Use(jwtMiddleware)
+			flavors.GET("", flavorHandler.ListFlavors)
+			flavors.GET("/:id", flavorHandler.GetFlavor)
+			flavors.POST("", middleware.AdminRequired(), flavorHandler.CreateFlavor)
+			flavors.PUT("/:id", middleware.AdminRequired(), flavorHandler.UpdateFlavor)
+			flavors.DELETE("/:id", middleware.AdminRequired(), flavorHandler.DeleteFlavor)
+		}
+
+		sharedFolders := api.Group("/shared-folders")
+		{
+			sharedFolders.Use(jwtMiddleware)
+			sharedFolders.GET("", sharedFolderHandler.ListSharedFolders)
+			sharedFolders.GET("/:id", sharedFolderHandler.GetSharedFolder)
+			sharedFolders.POST("", middleware.AdminRequired(), sharedFolderHandler.CreateSharedFolder)
+			sharedFolders.PUT("/:id", middleware.AdminRequired(), sharedFolderHandler.UpdateSharedFolder)
+			sharedFolders.DELETE("/:id", middleware.AdminRequired(), sharedFolderHandler.DeleteSharedFolder)
+		}
+
 		isos := api.Group("/isos")
 		{
 			isos.Use(jwtMiddleware)
@@ -169,6 +258,7 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 				users.PUT("/:id", adminHandler.UpdateUser)
 				users.DELETE("/:id", adminHandler.DeleteUser)
 				users.PUT("/:id/quota", adminHandler.UpdateUserQuota)
+				users.PUT("/:id/qos-max", adminHandler.UpdateUserQoSMax)
 				users.PUT("/:id/role", adminHandler.UpdateUserRole)
 			}
 
@@ -192,6 +282,13 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 				alertHistories.GET("/stats", alertHistoryHandler.GetAlertStats)
 			}
 
+			sshKeys := admin.Group("/ssh-keys")
+			{
+				sshKeys.GET("", sshKeyHandler.ListGlobalKeys)
+				sshKeys.POST("", sshKeyHandler.CreateGlobalKey)
+				sshKeys.DELETE("/:id", sshKeyHandler.DeleteGlobalKey)
+			}
+
 			admin.GET("/audit-logs", auditHandler.ListAuditLogs)
 			admin.GET("/audit-logs/:id", auditHandler.GetAuditLog)
 			admin.GET("/audit-logs/user/:id", auditHandler.ListByUser)
@@ -222,6 +319,26 @@ func Register(router *gin.Engine, cfg *config.Config, repos *repository.Reposito
 				networks.POST("/:id/stop", networkHandler.Stop)
 			}
 
+			domains := admin.Group("/domains")
+			{
+				domains.GET("/unmanaged", vmHandler.ListUnmanagedDomains)
+				domains.POST("/:uuid/adopt", vmHandler.AdoptDomain)
+			}
+
+			drifts := admin.Group("/drifts")
+			{
+				drifts.GET("", vmHandler.ListDrifts)
+				drifts.POST("/scan", vmHandler.ScanDrifts)
+				drifts.POST("/:id/accept-libvirt", vmHandler.AcceptLibvirtDrift)
+				drifts.POST("/:id/enforce-db", vmHandler.EnforceDBDrift)
+			}
+
+			orphans := admin.Group("/orphans")
+			{
+				orphans.GET("", orphanHandler.ListOrphans)
+				orphans.POST("/delete", orphanHandler.DeleteOrphans)
+			}
+
 			storage := admin.Group("/storage")
 			{
 				storage.GET("/pools", storageHandler.ListPools)
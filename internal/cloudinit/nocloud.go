@@ -0,0 +1,172 @@
+// Package cloudinit renders cloud-init NoCloud seed images.
+package cloudinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"vmmanager/internal/iso9660"
+)
+
+// VolumeLabel is the filesystem label cloud-init's NoCloud datasource looks for.
+const VolumeLabel = "cidata"
+
+const mimeBoundary = "==VMMANAGER-CLOUDINIT=="
+
+type Config struct {
+	InstanceID        string
+	Hostname          string
+	SSHAuthorizedKeys []string
+	// Username is the account PasswordHash is set for. When it is empty the
+	// hash goes to the default user of the image.
+	Username string
+	// PasswordHash is a crypt(3) hash; the seed image never carries the
+	// password in plain text.
+	PasswordHash string
+	Packages     []string
+	// UserData is raw user-data (cloud-config or script). It is merged before
+	// the generated cloud-config, so the structured fields above win on
+	// conflicts and list values such as SSH keys are appended.
+	UserData      string
+	NetworkConfig string
+}
+
+// IsEmpty reports whether the config carries nothing worth seeding.
+func (c *Config) IsEmpty() bool {
+	return c.Hostname == "" && len(c.SSHAuthorizedKeys) == 0 && c.PasswordHash == "" &&
+		len(c.Packages) == 0 && strings.TrimSpace(c.UserData) == "" && strings.TrimSpace(c.NetworkConfig) == ""
+}
+
+func (c *Config) MetaData() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "instance-id: %s\n", quote(c.InstanceID))
+	if c.Hostname != "" {
+		fmt.Fprintf(&sb, "local-hostname: %s\n", quote(c.Hostname))
+	}
+	return sb.String()
+}
+
+func (c *Config) generatedCloudConfig() string {
+	var sb strings.Builder
+	sb.WriteString("#cloud-config\n")
+	if c.Hostname != "" {
+		fmt.Fprintf(&sb, "hostname: %s\n", quote(c.Hostname))
+		sb.WriteString("preserve_hostname: false\n")
+	}
+	if c.PasswordHash != "" {
+		if c.Username == "" {
+			// Settings under "user" are merged into the default user of
+			// the distribution, whatever its name.
+			sb.WriteString("user:\n")
+			fmt.Fprintf(&sb, "  hashed_passwd: %s\n", quote(c.PasswordHash))
+			sb.WriteString("  lock_passwd: false\n")
+			sb.WriteString("chpasswd:\n  expire: false\n")
+		} else {
+			sb.WriteString("chpasswd:\n  expire: false\n  users:\n")
+			fmt.Fprintf(&sb, "    - name: %s\n", quote(c.Username))
+			fmt.Fprintf(&sb, "      password: %s\n", quote(c.PasswordHash))
+			sb.WriteString("      type: hash\n")
+		}
+		sb.WriteString("ssh_pwauth: true\n")
+	}
+	if len(c.SSHAuthorizedKeys) > 0 {
+		sb.WriteString("ssh_authorized_keys:\n")
+		for _, key := range c.SSHAuthorizedKeys {
+			fmt.Fprintf(&sb, "  - %s\n", quote(strings.TrimSpace(key)))
+		}
+	}
+	if len(c.Packages) > 0 {
+		sb.WriteString("package_update: true\n")
+		sb.WriteString("packages:\n")
+		for _, pkg := range c.Packages {
+			fmt.Fprintf(&sb, "  - %s\n", quote(pkg))
+		}
+	}
+	return sb.String()
+}
+
+// UserDataContent returns the user-data file. When raw user-data is supplied
+// alongside structured fields, both are sent as a MIME multipart message and
+// cloud-init merges them in order.
+func (c *Config) UserDataContent() string {
+	generated := c.generatedCloudConfig()
+	raw := strings.TrimSpace(c.UserData)
+	if raw == "" {
+		return generated
+	}
+	if generated == "#cloud-config\n" {
+		return raw + "\n"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Content-Type: multipart/mixed; boundary=\"" + mimeBoundary + "\"\n")
+	sb.WriteString("MIME-Version: 1.0\n\n")
+	writePart := func(contentType, body string) {
+		sb.WriteString("--" + mimeBoundary + "\n")
+		sb.WriteString("Content-Type: " + contentType + "; charset=\"utf-8\"\n")
+		sb.WriteString("MIME-Version: 1.0\n")
+		if contentType == "text/cloud-config" {
+			sb.WriteString("Merge-Type: list(append)+dict(recurse_array)+str()\n")
+		}
+		sb.WriteString("\n")
+		sb.WriteString(body)
+		if !strings.HasSuffix(body, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	writePart(userDataContentType(raw), raw)
+	writePart("text/cloud-config", generated)
+	sb.WriteString("--" + mimeBoundary + "--\n")
+	return sb.String()
+}
+
+// Files returns the NoCloud seed files.
+func (c *Config) Files() []iso9660.File {
+	files := []iso9660.File{
+		{Name: "meta-data", Data: []byte(c.MetaData())},
+		{Name: "user-data", Data: []byte(c.UserDataContent())},
+	}
+	if strings.TrimSpace(c.NetworkConfig) != "" {
+		files = append(files, iso9660.File{Name: "network-config", Data: []byte(strings.TrimSpace(c.NetworkConfig) + "\n")})
+	}
+	return files
+}
+
+// WriteSeedISO writes a NoCloud seed image labelled "cidata" to path.
+func (c *Config) WriteSeedISO(path string) error {
+	if c.InstanceID == "" {
+		return fmt.Errorf("instance id is required")
+	}
+	return iso9660.WriteFile(path, VolumeLabel, c.Files())
+}
+
+func userDataContentType(raw string) string {
+	switch {
+	case strings.HasPrefix(raw, "#cloud-config"):
+		return "text/cloud-config"
+	case strings.HasPrefix(raw, "#!"):
+		return "text/x-shellscript"
+	case strings.HasPrefix(raw, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	case strings.HasPrefix(raw, "#include"):
+		return "text/x-include-url"
+	default:
+		return "text/plain"
+	}
+}
+
+// quote renders s as a YAML double-quoted scalar; JSON string syntax is a
+// subset of it.
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// ValidHostname reports whether name is a valid RFC 1123 host name.
+func ValidHostname(name string) bool {
+	return len(name) <= 253 && hostnamePattern.MatchString(name)
+}
@@ -0,0 +1,150 @@
+package cloudinit_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vmmanager/internal/cloudinit"
+	"vmmanager/internal/iso9660"
+)
+
+const testHash = "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+
+func TestMetaData(t *testing.T) {
+	c := &cloudinit.Config{InstanceID: "vm-1", Hostname: "web1"}
+	want := "instance-id: \"vm-1\"\nlocal-hostname: \"web1\"\n"
+	if got := c.MetaData(); got != want {
+		t.Errorf("MetaData = %q, want %q", got, want)
+	}
+
+	c = &cloudinit.Config{InstanceID: "vm-1"}
+	if got := c.MetaData(); got != "instance-id: \"vm-1\"\n" {
+		t.Errorf("MetaData without hostname = %q", got)
+	}
+}
+
+func TestUserDataContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  cloudinit.Config
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "default user password",
+			config: cloudinit.Config{
+				Hostname:     "web1",
+				PasswordHash: testHash,
+			},
+			want: []string{
+				"#cloud-config\n",
+				"hostname: \"web1\"\n",
+				"user:\n  hashed_passwd: \"" + testHash + "\"\n  lock_passwd: false\n",
+				"ssh_pwauth: true\n",
+			},
+			notWant: []string{"\npassword:", "users:"},
+		},
+		{
+			name: "named user password",
+			config: cloudinit.Config{
+				Username:     "admin",
+				PasswordHash: testHash,
+			},
+			want: []string{
+				"chpasswd:\n  expire: false\n  users:\n    - name: \"admin\"\n      password: \"" + testHash + "\"\n      type: hash\n",
+			},
+			notWant: []string{"hashed_passwd"},
+		},
+		{
+			name: "keys and packages",
+			config: cloudinit.Config{
+				SSHAuthorizedKeys: []string{" ssh-ed25519 AAAA user@host\n"},
+				Packages:          []string{"htop"},
+			},
+			want: []string{
+				"ssh_authorized_keys:\n  - \"ssh-ed25519 AAAA user@host\"\n",
+				"package_update: true\npackages:\n  - \"htop\"\n",
+			},
+			notWant: []string{"chpasswd", "ssh_pwauth"},
+		},
+		{
+			name:   "raw user data only",
+			config: cloudinit.Config{UserData: "#!/bin/sh\necho hi\n"},
+			want:   []string{"#!/bin/sh\necho hi\n"},
+			notWant: []string{
+				"#cloud-config",
+				"multipart",
+			},
+		},
+		{
+			name: "raw user data with generated config",
+			config: cloudinit.Config{
+				Hostname: "web1",
+				UserData: "#!/bin/sh\necho hi",
+			},
+			want: []string{
+				"Content-Type: multipart/mixed",
+				"Content-Type: text/x-shellscript",
+				"Content-Type: text/cloud-config",
+				"Merge-Type: list(append)+dict(recurse_array)+str()\n",
+				"hostname: \"web1\"\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.config.UserDataContent()
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("user-data is missing %q:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("user-data contains %q:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSeedISO(t *testing.T) {
+	c := &cloudinit.Config{
+		InstanceID:    "vm-1",
+		PasswordHash:  testHash,
+		NetworkConfig: "version: 2\n",
+	}
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	if err := c.WriteSeedISO(path); err != nil {
+		t.Fatalf("WriteSeedISO failed: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("seed image mode = %o, want 600", perm)
+	}
+
+	img, err := iso9660.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if img.Label() != cloudinit.VolumeLabel {
+		t.Errorf("label = %q, want %q", img.Label(), cloudinit.VolumeLabel)
+	}
+	for _, name := range []string{"meta-data", "user-data", "network-config"} {
+		if _, err := img.ReadFile(name); err != nil {
+			t.Errorf("%s missing from seed image: %v", name, err)
+		}
+	}
+
+	if err := (&cloudinit.Config{}).WriteSeedISO(path); err == nil {
+		t.Error("WriteSeedISO without an instance id succeeded")
+	}
+}
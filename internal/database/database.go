@@ -523,6 +523,234 @@ func Migrate(db *gorm.DB) error {
 	CREATE INDEX IF NOT EXISTS idx_vm_operation_histories_triggered_by ON vm_operation_histories(triggered_by);
 	CREATE INDEX IF NOT EXISTS idx_vm_operation_histories_status ON vm_operation_histories(status);
 	CREATE INDEX IF NOT EXISTS idx_vm_operation_histories_started_at ON vm_operation_histories(started_at);
+
+	-- Migration: Add guest agent columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS agent_connected BOOLEAN DEFAULT FALSE;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_hostname VARCHAR(255);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_os VARCHAR(255);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_info JSONB;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_info_at TIMESTAMPTZ;
+
+	-- Migration: Add cloud-init columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cloud_init_iso_path VARCHAR(500);
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS cloud_init_user_data TEXT;
+
+	-- Migration: Add SSH key store
+	CREATE TABLE IF NOT EXISTS ssh_keys (
+		id UUID PRIMARY KEY,
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		public_key TEXT NOT NULL,
+		key_type VARCHAR(50) NOT NULL,
+		fingerprint VARCHAR(100) NOT NULL,
+		is_global BOOLEAN DEFAULT FALSE,
+		created_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ssh_keys_user ON ssh_keys(user_id);
+	CREATE INDEX IF NOT EXISTS idx_ssh_keys_global ON ssh_keys(is_global);
+
+	-- Migration: Make SSH key fingerprints unique per owner
+	DELETE FROM ssh_keys WHERE EXISTS (
+		SELECT 1 FROM ssh_keys older
+		WHERE older.fingerprint = ssh_keys.fingerprint
+		AND older.is_global = ssh_keys.is_global
+		AND (older.is_global OR older.user_id = ssh_keys.user_id)
+		AND (older.created_at < ssh_keys.created_at OR (older.created_at = ssh_keys.created_at AND older.id < ssh_keys.id))
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_ssh_keys_user_fingerprint ON ssh_keys(user_id, fingerprint) WHERE is_global = FALSE;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_ssh_keys_global_fingerprint ON ssh_keys(fingerprint) WHERE is_global = TRUE;
+
+	-- Migration: Add unattended install columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS unattend_profile VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_media_path VARCHAR(500);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_kernel_path VARCHAR(500);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_initrd_path VARCHAR(500);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_cmdline TEXT;
+
+	-- Migration: Add VM data disk columns
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS owner_id UUID REFERENCES users(id);
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS target_dev VARCHAR(20);
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS bus VARCHAR(20);
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS cache_mode VARCHAR(20);
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS read_only BOOLEAN DEFAULT false;
+	CREATE INDEX IF NOT EXISTS idx_storage_volumes_owner ON storage_volumes(owner_id);
+
+	-- Migration: Add VM network interfaces
+	CREATE TABLE IF NOT EXISTS vm_interfaces (
+		id UUID PRIMARY KEY,
+		vm_id UUID NOT NULL REFERENCES virtual_machines(id) ON DELETE CASCADE,
+		mac_address VARCHAR(17) NOT NULL UNIQUE,
+		source_type VARCHAR(20) NOT NULL DEFAULT 'network',
+		source VARCHAR(100) NOT NULL,
+		network_id UUID REFERENCES virtual_networks(id),
+		model VARCHAR(20) DEFAULT 'virtio',
+		link_state VARCHAR(10) DEFAULT 'up',
+		is_primary BOOLEAN DEFAULT false,
+		created_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_vm_interfaces_vm ON vm_interfaces(vm_id);
+
+	-- Migration: Record the primary interface of existing VMs
+	INSERT INTO vm_interfaces (id, vm_id, mac_address, source_type, source, model, link_state, is_primary, created_at, updated_at)
+	SELECT gen_random_uuid(), vm.id, LOWER(vm.mac_address), 'network', 'default', 'virtio', 'up', true, NOW(), NOW()
+	FROM virtual_machines vm
+	WHERE vm.mac_address IS NOT NULL AND vm.mac_address <> ''
+		AND NOT EXISTS (SELECT 1 FROM vm_interfaces i WHERE i.vm_id = vm.id AND i.is_primary)
+		AND NOT EXISTS (SELECT 1 FROM vm_interfaces i WHERE i.mac_address = LOWER(vm.mac_address));
+
+	-- Migration: Add VM hardware configuration columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS machine_type VARCHAR(50);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS firmware VARCHAR(20) DEFAULT 'uefi';
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS video_model VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS pending_changes TEXT;
+
+	-- Migration: Add VM firmware loader columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS loader_path VARCHAR(255);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS nvram_template VARCHAR(255);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS domain_type VARCHAR(10);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cpu_mode VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cpu_model VARCHAR(64);
+
+	-- Migration: Add VM tuning column
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS tuning TEXT;
+
+	-- Migration: Add VM QoS limit columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_read_iops BIGINT DEFAULT 0;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_write_iops BIGINT DEFAULT 0;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_read_bytes_sec BIGINT DEFAULT 0;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_write_bytes_sec BIGINT DEFAULT 0;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_net_inbound_kbps BIGINT DEFAULT 0;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_net_outbound_kbps BIGINT DEFAULT 0;
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_read_iops BIGINT DEFAULT 0;
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_write_iops BIGINT DEFAULT 0;
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_read_bytes_sec BIGINT DEFAULT 0;
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_write_bytes_sec BIGINT DEFAULT 0;
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_net_inbound_kbps BIGINT DEFAULT 0;
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_net_outbound_kbps BIGINT DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_read_iops BIGINT DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_write_iops BIGINT DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_read_bytes_sec BIGINT DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_write_bytes_sec BIGINT DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_net_inbound_kbps BIGINT DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_net_outbound_kbps BIGINT DEFAULT 0;
+
+	-- Migration: Add flavors table
+	CREATE TABLE IF NOT EXISTS flavors (
+		id UUID PRIMARY KEY,
+		name VARCHAR(100) NOT NULL UNIQUE,
+		description TEXT,
+		cpu INTEGER NOT NULL,
+		memory INTEGER NOT NULL,
+		disk INTEGER NOT NULL,
+		qos_disk_read_iops BIGINT DEFAULT 0,
+		qos_disk_write_iops BIGINT DEFAULT 0,
+		qos_disk_read_bytes_sec BIGINT DEFAULT 0,
+		qos_disk_write_bytes_sec BIGINT DEFAULT 0,
+		qos_net_inbound_kbps BIGINT DEFAULT 0,
+		qos_net_outbound_kbps BIGINT DEFAULT 0,
+		cpu_policy VARCHAR(20) DEFAULT 'shared',
+		allowed_roles TEXT[],
+		allowed_users TEXT[],
+		is_active BOOLEAN DEFAULT true,
+		created_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ
+	);
+
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS flavor_id UUID;
+
+	-- Migration: Add VM TPM column
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS tpm BOOLEAN DEFAULT false;
+
+	-- Migration: Add OS profile columns
+	ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS os_profile VARCHAR(20);
+	ALTER TABLE isos ADD COLUMN IF NOT EXISTS os_profile VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS os_profile VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_bus VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS driver_iso_path VARCHAR(500);
+
+	-- Migration: Add VM lifecycle policy columns
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_on_poweroff VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_on_reboot VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_on_crash VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_watchdog_action VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_restart_policy VARCHAR(20);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_restart_max_retries INTEGER DEFAULT 0;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_restart_backoff INTEGER DEFAULT 0;
+
+	-- Migration: Add shared folders and VM filesystems
+	CREATE TABLE IF NOT EXISTS shared_folders (
+		id UUID PRIMARY KEY,
+		name VARCHAR(100) NOT NULL UNIQUE,
+		description TEXT,
+		host_path VARCHAR(500) NOT NULL,
+		allow_write BOOLEAN DEFAULT false,
+		allowed_roles TEXT[],
+		allowed_users TEXT[],
+		created_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS vm_filesystems (
+		id UUID PRIMARY KEY,
+		vm_id UUID NOT NULL REFERENCES virtual_machines(id) ON DELETE CASCADE,
+		shared_folder_id UUID NOT NULL REFERENCES shared_folders(id),
+		source_path VARCHAR(500) NOT NULL,
+		mount_tag VARCHAR(36) NOT NULL,
+		read_only BOOLEAN DEFAULT false,
+		created_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_vm_filesystems_vm ON vm_filesystems(vm_id);
+	CREATE INDEX IF NOT EXISTS idx_vm_filesystems_folder ON vm_filesystems(shared_folder_id);
+
+	-- Migration: Add encrypted VM disks and data volumes
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_enabled BOOLEAN DEFAULT false;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_secret_uuid VARCHAR(36);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_wrapped_key TEXT;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_rotated_at TIMESTAMPTZ;
+	ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS encrypted BOOLEAN DEFAULT false;
+	ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS encryption_key TEXT;
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_enabled BOOLEAN DEFAULT false;
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_secret_uuid VARCHAR(36);
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_wrapped_key TEXT;
+	ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_rotated_at TIMESTAMPTZ;
+
+	-- Migration: Add memory balloon statistics and policy
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS balloon_auto BOOLEAN DEFAULT false;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS balloon_min_memory INTEGER DEFAULT 0;
+	ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS memory_balloon BIGINT DEFAULT 0;
+	ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS memory_unused BIGINT DEFAULT 0;
+	ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS memory_available BIGINT DEFAULT 0;
+	ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS major_faults BIGINT DEFAULT 0;
+
+	-- Migration: Add direct kernel boot
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_enabled BOOLEAN DEFAULT false;
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_kernel VARCHAR(500);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_initrd VARCHAR(500);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_dtb VARCHAR(500);
+	ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_cmdline TEXT;
+
+	-- Migration: Add VM drift records
+	CREATE TABLE IF NOT EXISTS vm_drifts (
+		id UUID PRIMARY KEY,
+		vm_id UUID NOT NULL REFERENCES virtual_machines(id) ON DELETE CASCADE,
+		field VARCHAR(30) NOT NULL,
+		db_value VARCHAR(500),
+		libvirt_value VARCHAR(500),
+		status VARCHAR(20) DEFAULT 'open',
+		resolution VARCHAR(20),
+		resolved_by UUID,
+		detected_at TIMESTAMPTZ NOT NULL,
+		resolved_at TIMESTAMPTZ
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_vm_drifts_vm ON vm_drifts(vm_id);
+	CREATE INDEX IF NOT EXISTS idx_vm_drifts_status ON vm_drifts(status);
 	`
 	return db.Exec(sql).Error
 }
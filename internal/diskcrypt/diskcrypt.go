@@ -0,0 +1,97 @@
+// Package diskcrypt creates and maintains LUKS encrypted qcow2 disk images.
+// Every disk has its own random passphrase, which libvirt keeps as a secret
+// and the database keeps wrapped with the master key of the manager.
+package diskcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// passphraseBytes is the entropy of a disk passphrase. Passphrases are hex
+// encoded so they stay printable for qemu-img and libvirt alike.
+const passphraseBytes = 32
+
+// Keyring wraps disk passphrases with the master key.
+type Keyring struct {
+	aead cipher.AEAD
+}
+
+// NewKeyring returns a keyring for masterKey, 32 base64 encoded bytes.
+func NewKeyring(masterKey string) (*Keyring, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(masterKey))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{aead: aead}, nil
+}
+
+// LoadKeyring returns the keyring for masterKey, or for the key stored in
+// masterKeyFile when masterKey is empty. Without either it returns nil and
+// disk encryption stays unavailable.
+func LoadKeyring(masterKey, masterKeyFile string) (*Keyring, error) {
+	if masterKey == "" && masterKeyFile != "" {
+		data, err := os.ReadFile(masterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		masterKey = string(data)
+	}
+	if masterKey == "" {
+		return nil, nil
+	}
+	return NewKeyring(masterKey)
+}
+
+// NewPassphrase returns a random disk passphrase.
+func NewPassphrase() ([]byte, error) {
+	raw := make([]byte, passphraseBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(raw)), nil
+}
+
+// Wrap encrypts passphrase with the master key.
+func (k *Keyring) Wrap(passphrase []byte) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, passphrase, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap decrypts a passphrase returned by Wrap.
+func (k *Keyring) Unwrap(wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped key is not valid base64: %w", err)
+	}
+	size := k.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	passphrase, err := k.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key, was the master key changed?: %w", err)
+	}
+	return passphrase, nil
+}
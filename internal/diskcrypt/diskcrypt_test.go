@@ -0,0 +1,57 @@
+package diskcrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func testKeyring(t *testing.T, seed byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{seed}, 32)))
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	return k
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	k := testKeyring(t, 1)
+	passphrase, err := NewPassphrase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passphrase) != 2*passphraseBytes {
+		t.Errorf("passphrase has %d characters", len(passphrase))
+	}
+
+	wrapped, err := k.Wrap(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := k.Unwrap(wrapped)
+	if err != nil || !bytes.Equal(got, passphrase) {
+		t.Errorf("Unwrap = %q, %v, want %q", got, err, passphrase)
+	}
+
+	if _, err := testKeyring(t, 2).Unwrap(wrapped); err == nil {
+		t.Error("Unwrap succeeded with another master key")
+	}
+}
+
+func TestNewKeyringRejectsShortKey(t *testing.T) {
+	if _, err := NewKeyring(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Error("NewKeyring accepted a 5 byte key")
+	}
+	if k, err := LoadKeyring("", ""); k != nil || err != nil {
+		t.Errorf("LoadKeyring without key = %v, %v", k, err)
+	}
+}
+
+func TestImageOpts(t *testing.T) {
+	got := imageOpts("/var/lib/vm,1/disk.qcow2", "sec0")
+	want := "driver=qcow2,file.filename=/var/lib/vm,,1/disk.qcow2,encrypt.key-secret=sec0"
+	if got != want {
+		t.Errorf("imageOpts = %q, want %q", got, want)
+	}
+}
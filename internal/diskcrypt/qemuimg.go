@@ -0,0 +1,99 @@
+package diskcrypt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// escapeOpt escapes value for a qemu option string, where a comma has to
+// be doubled.
+func escapeOpt(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// imageOpts opens the encrypted qcow2 image at path with secret.
+func imageOpts(path, secret string) string {
+	return fmt.Sprintf("driver=qcow2,file.filename=%s,encrypt.key-secret=%s", escapeOpt(path), secret)
+}
+
+// qemuImg runs qemu-img with a secret object for each passphrase in
+// secrets. The passphrases are handed over in private temporary files so
+// they never show up in the process list.
+func qemuImg(ctx context.Context, secrets map[string][]byte, args ...string) error {
+	var objects []string
+	for id, passphrase := range secrets {
+		f, err := os.CreateTemp("", "vmmanager-secret-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(passphrase)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		objects = append(objects, "--object", fmt.Sprintf("secret,id=%s,file=%s", id, escapeOpt(f.Name())))
+	}
+
+	// Global options such as --object go after the subcommand.
+	full := append([]string{args[0]}, objects...)
+	full = append(full, args[1:]...)
+	output, err := exec.CommandContext(ctx, "qemu-img", full...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img %s: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CreateImage creates an empty encrypted qcow2 image of sizeGB at path.
+func CreateImage(ctx context.Context, path string, sizeGB int, passphrase []byte) error {
+	return qemuImg(ctx, map[string][]byte{"sec0": passphrase},
+		"create", "-f", "qcow2", "-o", "encrypt.format=luks,encrypt.key-secret=sec0,preallocation=off", path, fmt.Sprintf("%dG", sizeGB))
+}
+
+// ConvertImage copies the image at src to a qcow2 image at dst. srcPass
+// opens an encrypted source and dstPass encrypts the copy; either may be
+// nil for a plain image.
+func ConvertImage(ctx context.Context, src string, srcPass []byte, dst string, dstPass []byte) error {
+	secrets := map[string][]byte{}
+	args := []string{"convert"}
+	if srcPass != nil {
+		secrets["src"] = srcPass
+		args = append(args, "--image-opts", imageOpts(src, "src"))
+	} else {
+		args = append(args, src)
+	}
+	args = append(args, "-O", "qcow2")
+	if dstPass != nil {
+		secrets["dst"] = dstPass
+		args = append(args, "-o", "encrypt.format=luks,encrypt.key-secret=dst")
+	}
+	args = append(args, dst)
+	return qemuImg(ctx, secrets, args...)
+}
+
+// ResizeImage grows the encrypted image at path to sizeGB.
+func ResizeImage(ctx context.Context, path string, passphrase []byte, sizeGB int64) error {
+	return qemuImg(ctx, map[string][]byte{"sec0": passphrase},
+		"resize", "--image-opts", imageOpts(path, "sec0"), fmt.Sprintf("%dG", sizeGB))
+}
+
+// AddPassphrase adds newPass to a free key slot of the image at path,
+// which opens with current.
+func AddPassphrase(ctx context.Context, path string, current, newPass []byte) error {
+	return qemuImg(ctx, map[string][]byte{"cur": current, "new": newPass},
+		"amend", "--image-opts", imageOpts(path, "cur"), "-o", "encrypt.state=active,encrypt.new-secret=new")
+}
+
+// RemovePassphrase erases the key slots holding oldPass from the image at
+// path, which opens with current. Data stays readable with current, as the
+// volume key itself does not change.
+func RemovePassphrase(ctx context.Context, path string, current, oldPass []byte) error {
+	return qemuImg(ctx, map[string][]byte{"cur": current, "old": oldPass},
+		"amend", "--image-opts", imageOpts(path, "cur"), "-o", "encrypt.state=inactive,encrypt.old-secret=old")
+}
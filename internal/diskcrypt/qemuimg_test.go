@@ -0,0 +1,177 @@
+package diskcrypt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeQemuImg puts a qemu-img on PATH that records its arguments, one per
+// line, and the content of each secret file it is handed. It fails when
+// QEMU_IMG_FAIL is set.
+func fakeQemuImg(t *testing.T) (argsFile, secretsFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile = filepath.Join(dir, "args")
+	secretsFile = filepath.Join(dir, "secrets")
+	script := `#!/bin/sh
+for arg in "$@"; do
+	echo "$arg" >> "` + argsFile + `"
+	case "$arg" in
+	secret,id=*)
+		id=${arg#secret,id=}
+		id=${id%%,*}
+		echo "$id=$(cat "${arg#*,file=}")" >> "` + secretsFile + `"
+		;;
+	esac
+done
+if [ -n "$QEMU_IMG_FAIL" ]; then
+	echo "broken image" >&2
+	exit 1
+fi
+`
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile, secretsFile
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// withoutObjects drops the --object arguments, whose temporary file names
+// differ between runs, and returns the ids of the secrets they define.
+func withoutObjects(args []string) (rest, ids []string) {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--object" && i+1 < len(args) {
+			id := strings.TrimPrefix(args[i+1], "secret,id=")
+			ids = append(ids, id[:strings.Index(id, ",")])
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	sort.Strings(ids)
+	return rest, ids
+}
+
+func TestCreateImage(t *testing.T) {
+	argsFile, secretsFile := fakeQemuImg(t)
+
+	if err := CreateImage(context.Background(), "/pool/disk.qcow2", 20, []byte("pass")); err != nil {
+		t.Fatalf("CreateImage failed: %v", err)
+	}
+
+	args, ids := withoutObjects(readLines(t, argsFile))
+	want := []string{"create", "-f", "qcow2", "-o", "encrypt.format=luks,encrypt.key-secret=sec0,preallocation=off", "/pool/disk.qcow2", "20G"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %q, want %q", args, want)
+	}
+	if !reflect.DeepEqual(ids, []string{"sec0"}) {
+		t.Errorf("secrets = %q", ids)
+	}
+	if got := readLines(t, secretsFile); !reflect.DeepEqual(got, []string{"sec0=pass"}) {
+		t.Errorf("secret files = %q", got)
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	tests := []struct {
+		name             string
+		srcPass, dstPass []byte
+		want             []string
+		secrets          []string
+	}{
+		{
+			name:    "encrypt a plain image",
+			dstPass: []byte("new"),
+			want:    []string{"convert", "/pool/plain.img", "-O", "qcow2", "-o", "encrypt.format=luks,encrypt.key-secret=dst", "/pool/out.qcow2"},
+			secrets: []string{"dst=new"},
+		},
+		{
+			name:    "decrypt an encrypted image",
+			srcPass: []byte("old"),
+			want:    []string{"convert", "--image-opts", "driver=qcow2,file.filename=/pool/plain.img,encrypt.key-secret=src", "-O", "qcow2", "/pool/out.qcow2"},
+			secrets: []string{"src=old"},
+		},
+		{
+			name:    "re-encrypt",
+			srcPass: []byte("old"),
+			dstPass: []byte("new"),
+			want:    []string{"convert", "--image-opts", "driver=qcow2,file.filename=/pool/plain.img,encrypt.key-secret=src", "-O", "qcow2", "-o", "encrypt.format=luks,encrypt.key-secret=dst", "/pool/out.qcow2"},
+			secrets: []string{"dst=new", "src=old"},
+		},
+		{
+			name: "plain copy",
+			want: []string{"convert", "/pool/plain.img", "-O", "qcow2", "/pool/out.qcow2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsFile, secretsFile := fakeQemuImg(t)
+
+			if err := ConvertImage(context.Background(), "/pool/plain.img", tt.srcPass, "/pool/out.qcow2", tt.dstPass); err != nil {
+				t.Fatalf("ConvertImage failed: %v", err)
+			}
+
+			args, _ := withoutObjects(readLines(t, argsFile))
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("args = %q, want %q", args, tt.want)
+			}
+			var secrets []string
+			if _, err := os.Stat(secretsFile); err == nil {
+				secrets = readLines(t, secretsFile)
+				sort.Strings(secrets)
+			}
+			if !reflect.DeepEqual(secrets, tt.secrets) {
+				t.Errorf("secret files = %q, want %q", secrets, tt.secrets)
+			}
+		})
+	}
+}
+
+func TestQemuImgRemovesSecretFiles(t *testing.T) {
+	argsFile, _ := fakeQemuImg(t)
+	t.Setenv("QEMU_IMG_FAIL", "1")
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	err := ConvertImage(context.Background(), "/pool/a,b.qcow2", []byte("old"), "/pool/out.qcow2", []byte("new"))
+	if err == nil || !strings.Contains(err.Error(), "broken image") {
+		t.Fatalf("ConvertImage error = %v, want qemu-img output", err)
+	}
+
+	args := readLines(t, argsFile)
+	if !reflect.DeepEqual(args[:1], []string{"convert"}) {
+		t.Errorf("subcommand = %q, want convert first", args[0])
+	}
+	found := false
+	for _, arg := range args {
+		if strings.Contains(arg, "file.filename=/pool/a,,b.qcow2,") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("comma in source path not escaped: %q", args)
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("secret files left behind: %v", entries)
+	}
+}
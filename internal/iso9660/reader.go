@@ -0,0 +1,173 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// Image is a read-only view of an existing ISO9660 image, used to pull boot
+// files out of installer media. Joliet names are preferred when present;
+// otherwise primary names are matched case-insensitively without the ";1"
+// version suffix.
+type Image struct {
+	f      *os.File
+	label  string
+	root   []byte
+	joliet bool
+}
+
+// Open reads the volume descriptors of the image at path.
+func Open(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{f: f}
+	vd := make([]byte, sectorSize)
+	for sector := int64(16); ; sector++ {
+		if _, err := f.ReadAt(vd, sector*sectorSize); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read volume descriptor: %w", err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			f.Close()
+			return nil, fmt.Errorf("not an ISO9660 image")
+		}
+
+		switch vd[0] {
+		case 1:
+			img.label = strings.TrimRight(string(vd[40:72]), " \x00")
+			if img.root == nil {
+				img.root = append([]byte(nil), vd[156:190]...)
+			}
+		case 2:
+			if esc := string(vd[88:91]); esc == "%/@" || esc == "%/C" || esc == "%/E" {
+				img.root = append([]byte(nil), vd[156:190]...)
+				img.joliet = true
+			}
+		}
+		if vd[0] == 255 {
+			break
+		}
+	}
+
+	if img.root == nil {
+		f.Close()
+		return nil, fmt.Errorf("no primary volume descriptor found")
+	}
+	return img, nil
+}
+
+func (img *Image) Close() error {
+	return img.f.Close()
+}
+
+// Label returns the primary volume identifier.
+func (img *Image) Label() string {
+	return img.label
+}
+
+// ReadFile returns the contents of the file at name, a slash separated path
+// relative to the image root.
+func (img *Image) ReadFile(name string) ([]byte, error) {
+	r, err := img.open(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Extract copies the file at name to dest.
+func (img *Image) Extract(name, dest string) error {
+	r, err := img.open(name)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (img *Image) open(name string) (*io.SectionReader, error) {
+	record := img.root
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for i, part := range parts {
+		if record[25]&2 == 0 {
+			return nil, fmt.Errorf("%s: not a directory", strings.Join(parts[:i], "/"))
+		}
+		next, err := img.lookup(record, part)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		record = next
+	}
+	if record[25]&2 != 0 {
+		return nil, fmt.Errorf("%s: is a directory", name)
+	}
+
+	extent := int64(binary.LittleEndian.Uint32(record[2:]))
+	size := int64(binary.LittleEndian.Uint32(record[10:]))
+	return io.NewSectionReader(img.f, extent*sectorSize, size), nil
+}
+
+func (img *Image) lookup(dirRecord []byte, name string) ([]byte, error) {
+	extent := int64(binary.LittleEndian.Uint32(dirRecord[2:]))
+	size := int(binary.LittleEndian.Uint32(dirRecord[10:]))
+
+	dir := make([]byte, size)
+	if _, err := img.f.ReadAt(dir, extent*sectorSize); err != nil {
+		return nil, err
+	}
+
+	for offset := 0; offset < len(dir); {
+		recLen := int(dir[offset])
+		if recLen == 0 {
+			offset += sectorSize - offset%sectorSize
+			continue
+		}
+		if offset+recLen > len(dir) || recLen < 34 {
+			break
+		}
+		rec := dir[offset : offset+recLen]
+		offset += recLen
+
+		idLen := int(rec[32])
+		id := rec[33 : 33+idLen]
+		if idLen == 1 && (id[0] == 0 || id[0] == 1) {
+			continue
+		}
+		if strings.EqualFold(img.decodeName(id), name) {
+			return rec, nil
+		}
+	}
+	return nil, fmt.Errorf("file not found")
+}
+
+func (img *Image) decodeName(id []byte) string {
+	var name string
+	if img.joliet {
+		codes := make([]uint16, len(id)/2)
+		for i := range codes {
+			codes[i] = binary.BigEndian.Uint16(id[i*2:])
+		}
+		name = string(utf16.Decode(codes))
+	} else {
+		name = string(id)
+	}
+	if i := strings.LastIndex(name, ";"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, ".")
+}
@@ -0,0 +1,50 @@
+package iso9660_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"vmmanager/internal/iso9660"
+)
+
+func TestOpenReadsBackBuiltImage(t *testing.T) {
+	kernel := bytes.Repeat([]byte{0x4d, 0x5a}, 3000)
+	path := filepath.Join(t.TempDir(), "media.iso")
+	if err := iso9660.WriteFile(path, "OEMDRV", []iso9660.File{
+		{Name: "ks.cfg", Data: []byte("text\n")},
+		{Name: "vmlinuz", Data: kernel},
+	}); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	img, err := iso9660.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	if img.Label() != "OEMDRV" {
+		t.Errorf("label = %q, want OEMDRV", img.Label())
+	}
+
+	data, err := img.ReadFile("/VMLINUZ")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(data, kernel) {
+		t.Errorf("vmlinuz content mismatch (%d bytes)", len(data))
+	}
+
+	dest := filepath.Join(t.TempDir(), "ks.cfg")
+	if err := img.Extract("ks.cfg", dest); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if _, err := img.ReadFile("missing"); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if _, err := img.ReadFile("ks.cfg/x"); err == nil {
+		t.Error("expected error when traversing a file")
+	}
+}
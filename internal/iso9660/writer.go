@@ -0,0 +1,288 @@
+// Package iso9660 builds small, flat ISO9660 images with Joliet extensions
+// and reads files out of existing images. The writer is used for cloud-init
+// NoCloud seeds and unattended-install media, so it only supports files in
+// the root directory.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+type File struct {
+	Name string
+	Data []byte
+}
+
+type dirEntry struct {
+	primaryName string
+	jolietName  string
+	data        []byte
+	extent      uint32
+}
+
+// Build returns an ISO image containing files in its root directory. The
+// volume identifier is written to both the primary and the Joliet volume
+// descriptors, so tools such as blkid report it as the filesystem label.
+func Build(volumeID string, files []File) ([]byte, error) {
+	if volumeID == "" || len(volumeID) > 16 {
+		return nil, fmt.Errorf("volume identifier must be 1-16 characters")
+	}
+
+	entries := make([]*dirEntry, 0, len(files))
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if f.Name == "" || strings.ContainsAny(f.Name, "/\\") {
+			return nil, fmt.Errorf("invalid file name: %q", f.Name)
+		}
+		primary := primaryIdentifier(f.Name)
+		if seen[primary] {
+			return nil, fmt.Errorf("duplicate file name: %q", f.Name)
+		}
+		seen[primary] = true
+		entries = append(entries, &dirEntry{
+			primaryName: primary,
+			jolietName:  f.Name + ";1",
+			data:        f.Data,
+		})
+	}
+
+	now := time.Now().UTC()
+
+	primaryRecords := func(e *dirEntry) []byte { return []byte(e.primaryName) }
+	jolietRecords := func(e *dirEntry) []byte { return ucs2(e.jolietName) }
+
+	primaryDirSize := directorySize(entries, primaryRecords)
+	jolietDirSize := directorySize(entries, jolietRecords)
+
+	// Layout: system area (0-15), PVD (16), Joliet SVD (17), terminator (18),
+	// four path tables (19-22), the two root directories, then file data.
+	const (
+		pathTableLSector  = 19
+		pathTableMSector  = 20
+		jPathTableLSector = 21
+		jPathTableMSector = 22
+		primaryRootSector = 23
+	)
+	jolietRootSector := uint32(primaryRootSector) + primaryDirSize/sectorSize
+	next := jolietRootSector + jolietDirSize/sectorSize
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].primaryName < entries[j].primaryName })
+	for _, e := range entries {
+		e.extent = next
+		next += sectorsFor(uint32(len(e.data)))
+	}
+	totalSectors := next
+
+	img := make([]byte, int(totalSectors)*sectorSize)
+
+	copy(img[16*sectorSize:], volumeDescriptor(1, volumeID, totalSectors, primaryRootSector, primaryDirSize, pathTableLSector, pathTableMSector, now))
+	copy(img[17*sectorSize:], volumeDescriptor(2, volumeID, totalSectors, jolietRootSector, jolietDirSize, jPathTableLSector, jPathTableMSector, now))
+	terminator := img[18*sectorSize:]
+	terminator[0] = 255
+	copy(terminator[1:6], "CD001")
+	terminator[6] = 1
+
+	copy(img[pathTableLSector*sectorSize:], pathTable(primaryRootSector, binary.LittleEndian))
+	copy(img[pathTableMSector*sectorSize:], pathTable(primaryRootSector, binary.BigEndian))
+	copy(img[jPathTableLSector*sectorSize:], pathTable(jolietRootSector, binary.LittleEndian))
+	copy(img[jPathTableMSector*sectorSize:], pathTable(jolietRootSector, binary.BigEndian))
+
+	copy(img[primaryRootSector*sectorSize:], directory(entries, primaryRootSector, primaryDirSize, primaryRecords, now))
+	sortedJoliet := append([]*dirEntry(nil), entries...)
+	sort.Slice(sortedJoliet, func(i, j int) bool { return sortedJoliet[i].jolietName < sortedJoliet[j].jolietName })
+	copy(img[jolietRootSector*sectorSize:], directory(sortedJoliet, jolietRootSector, jolietDirSize, jolietRecords, now))
+
+	for _, e := range entries {
+		copy(img[int(e.extent)*sectorSize:], e.data)
+	}
+
+	return img, nil
+}
+
+// WriteFile builds an image and writes it to path. Seed images carry
+// credentials, so only the owner may read the file; libvirt hands it to QEMU
+// when the domain starts.
+func WriteFile(path, volumeID string, files []File) error {
+	img, err := Build(volumeID, files)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, img, 0600)
+}
+
+// primaryIdentifier maps a name onto ISO9660 d-characters ("NAME.EXT;1").
+func primaryIdentifier(name string) string {
+	upper := strings.ToUpper(name)
+	var sb strings.Builder
+	for _, r := range upper {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '.' {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	id := sb.String()
+	base, ext := id, ""
+	if i := strings.LastIndex(id, "."); i >= 0 {
+		base, ext = id[:i], id[i+1:]
+	}
+	base = strings.ReplaceAll(base, ".", "_")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	if len(ext) > 6 {
+		ext = ext[:6]
+	}
+	return base + "." + ext + ";1"
+}
+
+func ucs2(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	out := make([]byte, len(codes)*2)
+	for i, c := range codes {
+		binary.BigEndian.PutUint16(out[i*2:], c)
+	}
+	return out
+}
+
+func sectorsFor(size uint32) uint32 {
+	if size == 0 {
+		return 0
+	}
+	return (size + sectorSize - 1) / sectorSize
+}
+
+func recordLen(idLen int) int {
+	l := 33 + idLen
+	if l%2 == 1 {
+		l++
+	}
+	return l
+}
+
+// directorySize lays out records the same way directory does (records may
+// not straddle a sector) and returns the size rounded up to whole sectors.
+func directorySize(entries []*dirEntry, name func(*dirEntry) []byte) uint32 {
+	offset := 2 * recordLen(1)
+	for _, e := range entries {
+		l := recordLen(len(name(e)))
+		if offset%sectorSize+l > sectorSize {
+			offset += sectorSize - offset%sectorSize
+		}
+		offset += l
+	}
+	return sectorsFor(uint32(offset)) * sectorSize
+}
+
+func directory(entries []*dirEntry, self uint32, size uint32, name func(*dirEntry) []byte, now time.Time) []byte {
+	buf := make([]byte, size)
+	offset := 0
+	offset += copy(buf[offset:], dirRecord([]byte{0}, self, size, true, now))
+	offset += copy(buf[offset:], dirRecord([]byte{1}, self, size, true, now))
+	for _, e := range entries {
+		rec := dirRecord(name(e), e.extent, uint32(len(e.data)), false, now)
+		if offset%sectorSize+len(rec) > sectorSize {
+			offset += sectorSize - offset%sectorSize
+		}
+		offset += copy(buf[offset:], rec)
+	}
+	return buf
+}
+
+func dirRecord(id []byte, extent, size uint32, isDir bool, now time.Time) []byte {
+	rec := make([]byte, recordLen(len(id)))
+	rec[0] = byte(len(rec))
+	putBoth32(rec[2:], extent)
+	putBoth32(rec[10:], size)
+	rec[18] = byte(now.Year() - 1900)
+	rec[19] = byte(now.Month())
+	rec[20] = byte(now.Day())
+	rec[21] = byte(now.Hour())
+	rec[22] = byte(now.Minute())
+	rec[23] = byte(now.Second())
+	if isDir {
+		rec[25] = 2
+	}
+	putBoth16(rec[28:], 1)
+	rec[32] = byte(len(id))
+	copy(rec[33:], id)
+	return rec
+}
+
+func pathTable(rootExtent uint32, order binary.ByteOrder) []byte {
+	pt := make([]byte, 10)
+	pt[0] = 1
+	order.PutUint32(pt[2:], rootExtent)
+	order.PutUint16(pt[6:], 1)
+	return pt
+}
+
+func volumeDescriptor(vdType byte, volumeID string, totalSectors, rootExtent, rootSize, pathL, pathM uint32, now time.Time) []byte {
+	vd := make([]byte, sectorSize)
+	vd[0] = vdType
+	copy(vd[1:6], "CD001")
+	vd[6] = 1
+
+	joliet := vdType == 2
+	text := func(dst []byte, s string) {
+		if joliet {
+			for i := 0; i+1 < len(dst); i += 2 {
+				dst[i], dst[i+1] = 0, ' '
+			}
+			copy(dst, ucs2(s))
+			return
+		}
+		for i := range dst {
+			dst[i] = ' '
+		}
+		copy(dst, s)
+	}
+
+	text(vd[8:40], "LINUX")
+	text(vd[40:72], volumeID)
+	putBoth32(vd[80:], totalSectors)
+	if joliet {
+		copy(vd[88:91], "%/E")
+	}
+	putBoth16(vd[120:], 1)
+	putBoth16(vd[124:], 1)
+	putBoth16(vd[128:], sectorSize)
+	putBoth32(vd[132:], 10)
+	binary.LittleEndian.PutUint32(vd[140:], pathL)
+	binary.BigEndian.PutUint32(vd[148:], pathM)
+	copy(vd[156:190], dirRecord([]byte{0}, rootExtent, rootSize, true, now))
+	text(vd[190:318], "")
+	text(vd[318:446], "")
+	text(vd[446:574], "")
+	text(vd[574:702], "VMMANAGER")
+	text(vd[702:739], "")
+	text(vd[739:776], "")
+	text(vd[776:813], "")
+
+	stamp := []byte(now.Format("20060102150405") + "00")
+	copy(vd[813:], stamp)
+	copy(vd[830:], stamp)
+	copy(vd[847:], bytes.Repeat([]byte{'0'}, 16))
+	copy(vd[864:], bytes.Repeat([]byte{'0'}, 16))
+	vd[881] = 1
+	return vd
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
@@ -0,0 +1,107 @@
+package iso9660_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"vmmanager/internal/iso9660"
+)
+
+const sectorSize = 2048
+
+func readJolietRoot(t *testing.T, img []byte) map[string][]byte {
+	t.Helper()
+
+	svd := img[17*sectorSize : 18*sectorSize]
+	if svd[0] != 2 || string(svd[1:6]) != "CD001" || string(svd[88:91]) != "%/E" {
+		t.Fatalf("missing Joliet supplementary volume descriptor")
+	}
+
+	root := svd[156:190]
+	extent := binary.LittleEndian.Uint32(root[2:])
+	size := binary.LittleEndian.Uint32(root[10:])
+	dir := img[int(extent)*sectorSize : int(extent)*sectorSize+int(size)]
+
+	files := make(map[string][]byte)
+	for offset := 0; offset < len(dir); {
+		recLen := int(dir[offset])
+		if recLen == 0 {
+			offset += sectorSize - offset%sectorSize
+			continue
+		}
+		rec := dir[offset : offset+recLen]
+		idLen := int(rec[32])
+		if rec[25]&2 == 0 {
+			id := rec[33 : 33+idLen]
+			codes := make([]uint16, idLen/2)
+			for i := range codes {
+				codes[i] = binary.BigEndian.Uint16(id[i*2:])
+			}
+			name := strings.TrimSuffix(string(utf16.Decode(codes)), ";1")
+			fileExtent := binary.LittleEndian.Uint32(rec[2:])
+			fileSize := binary.LittleEndian.Uint32(rec[10:])
+			files[name] = img[int(fileExtent)*sectorSize : int(fileExtent)*sectorSize+int(fileSize)]
+		}
+		offset += recLen
+	}
+	return files
+}
+
+func TestBuildContainsFilesAndLabel(t *testing.T) {
+	userData := []byte("#cloud-config\nhostname: \"vm1\"\n")
+	metaData := []byte("instance-id: \"abc\"\n")
+	large := bytes.Repeat([]byte("x"), 3*sectorSize+17)
+
+	img, err := iso9660.Build("cidata", []iso9660.File{
+		{Name: "user-data", Data: userData},
+		{Name: "meta-data", Data: metaData},
+		{Name: "network-config", Data: large},
+	})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	if len(img)%sectorSize != 0 {
+		t.Fatalf("image size %d is not sector aligned", len(img))
+	}
+
+	pvd := img[16*sectorSize : 17*sectorSize]
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		t.Fatalf("missing primary volume descriptor")
+	}
+	if label := strings.TrimRight(string(pvd[40:72]), " "); label != "cidata" {
+		t.Errorf("volume label = %q, want cidata", label)
+	}
+	if total := binary.LittleEndian.Uint32(pvd[80:]); int(total)*sectorSize != len(img) {
+		t.Errorf("volume space size %d does not match image size %d", total, len(img))
+	}
+	if img[18*sectorSize] != 255 {
+		t.Errorf("missing volume descriptor set terminator")
+	}
+
+	files := readJolietRoot(t, img)
+	if !bytes.Equal(files["user-data"], userData) {
+		t.Errorf("user-data = %q", files["user-data"])
+	}
+	if !bytes.Equal(files["meta-data"], metaData) {
+		t.Errorf("meta-data = %q", files["meta-data"])
+	}
+	if !bytes.Equal(files["network-config"], large) {
+		t.Errorf("network-config content mismatch (%d bytes)", len(files["network-config"]))
+	}
+}
+
+func TestBuildRejectsInvalidInput(t *testing.T) {
+	if _, err := iso9660.Build("", nil); err == nil {
+		t.Error("expected error for empty volume identifier")
+	}
+	if _, err := iso9660.Build("cidata", []iso9660.File{{Name: "a/b"}}); err == nil {
+		t.Error("expected error for file name with path separator")
+	}
+	if _, err := iso9660.Build("cidata", []iso9660.File{{Name: "user-data"}, {Name: "user_data"}}); err == nil {
+		t.Error("expected error for names colliding in the primary directory")
+	}
+}
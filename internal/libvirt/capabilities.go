@@ -0,0 +1,539 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FirmwareDescriptorDirs are searched for QEMU firmware descriptors, which
+// tell which loaders support secure boot and which NVRAM template belongs to
+// them. Earlier directories take precedence.
+var FirmwareDescriptorDirs = []string{
+	"/etc/qemu/firmware",
+	"/usr/share/qemu/firmware",
+}
+
+// HugePagesDir is where the kernel reports the hugepage pools of every page
+// size.
+var HugePagesDir = "/sys/kernel/mm/hugepages"
+
+// HostCapabilities describes what guests the host can run.
+type HostCapabilities struct {
+	HostArch     string              `json:"host_arch"`
+	HostCPUModel string              `json:"host_cpu_model"`
+	NUMACells    []HostNUMACell      `json:"numa_cells"`
+	Guests       []GuestCapabilities `json:"guests"`
+}
+
+// HostNUMACell is a NUMA node of the host with its CPUs and the number of
+// pages of every size in its pool.
+type HostNUMACell struct {
+	ID        int            `json:"id"`
+	MemoryKiB uint64         `json:"memory_kib"`
+	CPUs      []int          `json:"cpus"`
+	Pages     map[uint64]int `json:"pages"`
+}
+
+// GuestCapabilities describes one guest architecture, merged from the
+// connect and domain capabilities of its emulator.
+type GuestCapabilities struct {
+	Arch              string               `json:"arch"`
+	Emulator          string               `json:"emulator"`
+	DomainType        string               `json:"domain_type"`
+	DomainTypes       []string             `json:"domain_types"`
+	Machines          []string             `json:"machines"`
+	MaxVCPUs          int                  `json:"max_vcpus"`
+	CPUModes          []string             `json:"cpu_modes"`
+	CPUModels         []string             `json:"cpu_models"`
+	Firmware          []FirmwareCapability `json:"firmware"`
+	DiskBuses         []string             `json:"disk_buses"`
+	VideoModels       []string             `json:"video_models"`
+	GraphicsTypes     []string             `json:"graphics_types"`
+	RNGModels         []string             `json:"rng_models"`
+	TPMModels         []string             `json:"tpm_models"`
+	TPMBackends       []string             `json:"tpm_backends"`
+	FilesystemDrivers []string             `json:"filesystem_drivers"`
+}
+
+// FirmwareCapability is a UEFI loader the guest can boot from.
+type FirmwareCapability struct {
+	Path          string `json:"path"`
+	Type          string `json:"type"`
+	NVRAMTemplate string `json:"nvram_template,omitempty"`
+	SecureBoot    bool   `json:"secure_boot"`
+	EnrolledKeys  bool   `json:"enrolled_keys"`
+	RequiresSMM   bool   `json:"requires_smm"`
+}
+
+type capabilitiesXML struct {
+	Host struct {
+		CPU struct {
+			Arch  string `xml:"arch"`
+			Model string `xml:"model"`
+		} `xml:"cpu"`
+		Cells []struct {
+			ID     int `xml:"id,attr"`
+			Memory struct {
+				Unit  string `xml:"unit,attr"`
+				Value uint64 `xml:",chardata"`
+			} `xml:"memory"`
+			Pages []struct {
+				Size  uint64 `xml:"size,attr"`
+				Count int    `xml:",chardata"`
+			} `xml:"pages"`
+			CPUs []struct {
+				ID int `xml:"id,attr"`
+			} `xml:"cpus>cpu"`
+		} `xml:"topology>cells>cell"`
+	} `xml:"host"`
+	Guests []struct {
+		OSType string `xml:"os_type"`
+		Arch   struct {
+			Name     string `xml:"name,attr"`
+			Emulator string `xml:"emulator"`
+			Machines []struct {
+				Canonical string `xml:"canonical,attr"`
+				Name      string `xml:",chardata"`
+			} `xml:"machine"`
+			Domains []struct {
+				Type string `xml:"type,attr"`
+			} `xml:"domain"`
+		} `xml:"arch"`
+	} `xml:"guest"`
+}
+
+type capsEnum struct {
+	Name   string   `xml:"name,attr"`
+	Values []string `xml:"value"`
+}
+
+type capsDevice struct {
+	Supported string     `xml:"supported,attr"`
+	Enums     []capsEnum `xml:"enum"`
+}
+
+func (d capsDevice) values(name string) []string {
+	if d.Supported != "yes" {
+		return nil
+	}
+	for _, enum := range d.Enums {
+		if enum.Name == name {
+			return enum.Values
+		}
+	}
+	return nil
+}
+
+type domainCapabilitiesXML struct {
+	VCPU struct {
+		Max int `xml:"max,attr"`
+	} `xml:"vcpu"`
+	OS struct {
+		Loader struct {
+			Supported string     `xml:"supported,attr"`
+			Values    []string   `xml:"value"`
+			Enums     []capsEnum `xml:"enum"`
+		} `xml:"loader"`
+	} `xml:"os"`
+	CPU struct {
+		Modes []struct {
+			Name      string `xml:"name,attr"`
+			Supported string `xml:"supported,attr"`
+			Models    []struct {
+				Usable string `xml:"usable,attr"`
+				Name   string `xml:",chardata"`
+			} `xml:"model"`
+		} `xml:"mode"`
+	} `xml:"cpu"`
+	Devices struct {
+		Disk       capsDevice `xml:"disk"`
+		Graphics   capsDevice `xml:"graphics"`
+		Video      capsDevice `xml:"video"`
+		RNG        capsDevice `xml:"rng"`
+		TPM        capsDevice `xml:"tpm"`
+		Filesystem capsDevice `xml:"filesystem"`
+	} `xml:"devices"`
+}
+
+// firmwareDescriptor is the subset of the QEMU firmware interop JSON format
+// (docs/interop/firmware.json) needed to describe a UEFI loader.
+type firmwareDescriptor struct {
+	InterfaceTypes []string `json:"interface-types"`
+	Mapping        struct {
+		Device     string `json:"device"`
+		Executable struct {
+			Filename string `json:"filename"`
+		} `json:"executable"`
+		NVRAMTemplate struct {
+			Filename string `json:"filename"`
+		} `json:"nvram-template"`
+	} `json:"mapping"`
+	Targets []struct {
+		Architecture string `json:"architecture"`
+	} `json:"targets"`
+	Features []string `json:"features"`
+}
+
+// GetHostCapabilities returns the capabilities of the host. They are read
+// once and cached, as they only change when QEMU or the firmware packages
+// are updated; refresh forces a new read.
+func (c *Client) GetHostCapabilities(refresh bool) (*HostCapabilities, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("libvirt connection is nil")
+	}
+
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	if c.caps != nil && !refresh {
+		return c.caps, nil
+	}
+
+	capsXML, err := c.conn.GetCapabilities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	caps, err := parseCapabilities(capsXML)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := loadFirmwareDescriptors(FirmwareDescriptorDirs)
+	for i := range caps.Guests {
+		guest := &caps.Guests[i]
+		domCapsXML, err := c.conn.GetDomainCapabilities(guest.Emulator, guest.Arch, "", guest.DomainType, 0)
+		if err != nil {
+			log.Printf("[LIBVIRT] Failed to get domain capabilities for %s: %v", guest.Arch, err)
+			continue
+		}
+		if err := parseDomainCapabilities(domCapsXML, guest, descriptors); err != nil {
+			log.Printf("[LIBVIRT] Failed to parse domain capabilities for %s: %v", guest.Arch, err)
+		}
+	}
+
+	c.caps = caps
+	log.Printf("[LIBVIRT] Host capabilities loaded: %d guest architectures", len(caps.Guests))
+	return caps, nil
+}
+
+func parseCapabilities(capsXML string) (*HostCapabilities, error) {
+	var raw capabilitiesXML
+	if err := xml.Unmarshal([]byte(capsXML), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse capabilities: %w", err)
+	}
+
+	caps := &HostCapabilities{
+		HostArch:     raw.Host.CPU.Arch,
+		HostCPUModel: raw.Host.CPU.Model,
+	}
+	for _, c := range raw.Host.Cells {
+		memory := DomainMemory{Unit: c.Memory.Unit, Value: c.Memory.Value}
+		cell := HostNUMACell{ID: c.ID, MemoryKiB: memory.KiB(), Pages: map[uint64]int{}}
+		for _, cpu := range c.CPUs {
+			cell.CPUs = append(cell.CPUs, cpu.ID)
+		}
+		for _, pages := range c.Pages {
+			cell.Pages[pages.Size] = pages.Count
+		}
+		caps.NUMACells = append(caps.NUMACells, cell)
+	}
+	for _, g := range raw.Guests {
+		if g.OSType != "hvm" {
+			continue
+		}
+		guest := GuestCapabilities{
+			Arch:     g.Arch.Name,
+			Emulator: g.Arch.Emulator,
+		}
+		for _, d := range g.Arch.Domains {
+			guest.DomainTypes = appendUnique(guest.DomainTypes, d.Type)
+		}
+		// Prefer hardware acceleration for the domain capabilities query.
+		guest.DomainType = "qemu"
+		if slices.Contains(guest.DomainTypes, "kvm") {
+			guest.DomainType = "kvm"
+		}
+		for _, m := range g.Arch.Machines {
+			guest.Machines = appendUnique(guest.Machines, strings.TrimSpace(m.Name))
+			if m.Canonical != "" {
+				guest.Machines = appendUnique(guest.Machines, m.Canonical)
+			}
+		}
+		sort.Strings(guest.Machines)
+		caps.Guests = append(caps.Guests, guest)
+	}
+	return caps, nil
+}
+
+func parseDomainCapabilities(domCapsXML string, guest *GuestCapabilities, descriptors map[string]firmwareDescriptor) error {
+	var raw domainCapabilitiesXML
+	if err := xml.Unmarshal([]byte(domCapsXML), &raw); err != nil {
+		return fmt.Errorf("failed to parse domain capabilities: %w", err)
+	}
+
+	guest.MaxVCPUs = raw.VCPU.Max
+	for _, mode := range raw.CPU.Modes {
+		if mode.Supported != "yes" {
+			continue
+		}
+		guest.CPUModes = append(guest.CPUModes, mode.Name)
+		if mode.Name != "custom" {
+			continue
+		}
+		for _, model := range mode.Models {
+			if model.Usable != "no" {
+				guest.CPUModels = append(guest.CPUModels, model.Name)
+			}
+		}
+	}
+
+	guest.DiskBuses = raw.Devices.Disk.values("bus")
+	guest.VideoModels = raw.Devices.Video.values("modelType")
+	guest.GraphicsTypes = raw.Devices.Graphics.values("type")
+	guest.RNGModels = raw.Devices.RNG.values("model")
+	guest.TPMModels = raw.Devices.TPM.values("model")
+	guest.TPMBackends = raw.Devices.TPM.values("backendModel")
+	guest.FilesystemDrivers = raw.Devices.Filesystem.values("driverType")
+
+	if raw.OS.Loader.Supported != "yes" {
+		return nil
+	}
+	loaderType := "pflash"
+	for _, enum := range raw.OS.Loader.Enums {
+		if enum.Name == "type" && len(enum.Values) > 0 && !slices.Contains(enum.Values, "pflash") {
+			loaderType = enum.Values[0]
+		}
+	}
+	paths := raw.OS.Loader.Values
+	if len(paths) == 0 {
+		// Newer libvirt leaves the list empty when firmware is picked from
+		// descriptors; offer the descriptors for this architecture instead.
+		for path, desc := range descriptors {
+			if desc.hasTarget(guest.Arch) {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+	}
+	for _, path := range paths {
+		guest.Firmware = append(guest.Firmware, describeFirmware(path, loaderType, descriptors))
+	}
+	return nil
+}
+
+// describeFirmware fills in the secure boot support and NVRAM template of a
+// loader from its descriptor, falling back to the file name conventions of
+// the edk2 packages when there is none.
+func describeFirmware(path, loaderType string, descriptors map[string]firmwareDescriptor) FirmwareCapability {
+	fw := FirmwareCapability{Path: path, Type: loaderType}
+	if desc, ok := descriptors[path]; ok {
+		fw.NVRAMTemplate = desc.Mapping.NVRAMTemplate.Filename
+		fw.SecureBoot = slices.Contains(desc.Features, "secure-boot")
+		fw.EnrolledKeys = slices.Contains(desc.Features, "enrolled-keys")
+		fw.RequiresSMM = slices.Contains(desc.Features, "requires-smm")
+		return fw
+	}
+
+	name := strings.ToLower(filepath.Base(path))
+	fw.SecureBoot = strings.Contains(name, "secboot") || strings.Contains(name, ".ms.")
+	fw.RequiresSMM = fw.SecureBoot && !strings.Contains(name, "aavmf")
+	for _, candidate := range []string{
+		strings.Replace(path, "_CODE", "_VARS", 1),
+		strings.Replace(strings.Replace(path, "_CODE", "_VARS", 1), ".secboot", "", 1),
+	} {
+		if candidate != path && fileExists(candidate) {
+			fw.NVRAMTemplate = candidate
+			break
+		}
+	}
+	return fw
+}
+
+// loadFirmwareDescriptors reads the UEFI flash descriptors in dirs keyed by
+// loader path. A file name found in an earlier directory overrides later
+// ones, as QEMU does.
+func loadFirmwareDescriptors(dirs []string) map[string]firmwareDescriptor {
+	descriptors := map[string]firmwareDescriptor{}
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if seen[filepath.Base(file)] {
+				continue
+			}
+			seen[filepath.Base(file)] = true
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			var desc firmwareDescriptor
+			if err := json.Unmarshal(data, &desc); err != nil {
+				log.Printf("[LIBVIRT] Ignoring unreadable firmware descriptor %s: %v", file, err)
+				continue
+			}
+			path := desc.Mapping.Executable.Filename
+			if desc.Mapping.Device != "flash" || path == "" || !slices.Contains(desc.InterfaceTypes, "uefi") {
+				continue
+			}
+			if _, ok := descriptors[path]; !ok {
+				descriptors[path] = desc
+			}
+		}
+	}
+	return descriptors
+}
+
+func (d firmwareDescriptor) hasTarget(arch string) bool {
+	for _, target := range d.Targets {
+		if target.Architecture == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// Guest returns the capabilities of the given architecture. "arm64" is
+// accepted as an alias of "aarch64".
+func (h *HostCapabilities) Guest(arch string) *GuestCapabilities {
+	if arch == "arm64" {
+		arch = "aarch64"
+	}
+	for i := range h.Guests {
+		if h.Guests[i].Arch == arch {
+			return &h.Guests[i]
+		}
+	}
+	return nil
+}
+
+// NUMACell returns the host NUMA node with the given id.
+func (h *HostCapabilities) NUMACell(id int) *HostNUMACell {
+	for i := range h.NUMACells {
+		if h.NUMACells[i].ID == id {
+			return &h.NUMACells[i]
+		}
+	}
+	return nil
+}
+
+// HugePagePool is the state of the hugepage pool of one page size. Free
+// holds the free pages of every host NUMA cell. Reserved counts the pages the
+// kernel has promised to mappings that have not faulted them in yet. Free
+// still includes them, and the kernel only reports them host-wide.
+type HugePagePool struct {
+	Free     map[int]int `json:"free"`
+	Reserved int         `json:"reserved"`
+}
+
+// GetHugePagePool returns the hugepage pool of sizeKiB pages. Unlike the
+// cached capabilities it is read on every call.
+func (c *Client) GetHugePagePool(sizeKiB uint64) (*HugePagePool, error) {
+	caps, err := c.GetHostCapabilities(false)
+	if err != nil {
+		return nil, err
+	}
+	pool := &HugePagePool{Free: map[int]int{}, Reserved: reservedHugePages(HugePagesDir, sizeKiB)}
+	for _, cell := range caps.NUMACells {
+		counts, err := c.conn.GetFreePages([]uint64{sizeKiB}, cell.ID, 1, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get free pages of NUMA cell %d: %w", cell.ID, err)
+		}
+		if len(counts) > 0 {
+			pool.Free[cell.ID] = int(counts[0])
+		}
+	}
+	return pool, nil
+}
+
+// reservedHugePages reads the reserved pages of sizeKiB from dir. A missing
+// pool, as on a remote hypervisor, counts as nothing reserved.
+func reservedHugePages(dir string, sizeKiB uint64) int {
+	data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("hugepages-%dkB", sizeKiB), "resv_hugepages"))
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Available returns the pages left for a new guest on the given cells, or on
+// all cells when none are given.
+func (p *HugePagePool) Available(cells map[int]bool) int {
+	available := 0
+	for id, free := range p.Free {
+		if len(cells) == 0 || cells[id] {
+			available += free
+		}
+	}
+	return max(available-p.Reserved, 0)
+}
+
+// HasCPU reports whether the host has a CPU with the given id.
+func (h *HostCapabilities) HasCPU(cpu int) bool {
+	for _, cell := range h.NUMACells {
+		if slices.Contains(cell.CPUs, cpu) {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsMachine reports whether machine is a machine type or alias the
+// emulator knows.
+func (g *GuestCapabilities) SupportsMachine(machine string) bool {
+	return slices.Contains(g.Machines, machine)
+}
+
+// PickFirmware returns the preferred UEFI loader with the requested secure
+// boot support. Loaders with an NVRAM template come first, since without one
+// the variable store cannot be created. For secure boot, templates with
+// enrolled keys come next, as secure boot stays off until keys are enrolled.
+func (g *GuestCapabilities) PickFirmware(secureBoot bool) *FirmwareCapability {
+	rank := func(fw *FirmwareCapability) int {
+		r := 0
+		if fw.NVRAMTemplate != "" {
+			r += 2
+		}
+		if secureBoot && fw.EnrolledKeys {
+			r++
+		}
+		return r
+	}
+	var picked *FirmwareCapability
+	for i := range g.Firmware {
+		fw := &g.Firmware[i]
+		if fw.SecureBoot != secureBoot || fw.Type != "pflash" {
+			continue
+		}
+		if picked == nil || rank(fw) > rank(picked) {
+			picked = fw
+		}
+	}
+	return picked
+}
+
+func appendUnique(values []string, value string) []string {
+	if value == "" || slices.Contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,128 @@
+package libvirt
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func readTestFile(t *testing.T, name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestParseHostCapabilities(t *testing.T) {
+	caps, err := parseCapabilities(readTestFile(t, "testdata/capabilities.xml"))
+	if err != nil {
+		t.Fatalf("parseCapabilities failed: %v", err)
+	}
+	if caps.HostArch != "x86_64" || len(caps.Guests) != 2 {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+	}
+
+	guest := caps.Guest("x86_64")
+	if guest == nil || guest.DomainType != "kvm" {
+		t.Fatalf("x86_64 guest should use kvm: %+v", guest)
+	}
+	for _, machine := range []string{"q35", "pc-q35-8.2", "pc"} {
+		if !guest.SupportsMachine(machine) {
+			t.Errorf("machine %s not supported", machine)
+		}
+	}
+	if guest.SupportsMachine("virt") {
+		t.Errorf("x86_64 guest claims the virt machine")
+	}
+	if arm := caps.Guest("arm64"); arm == nil || arm.DomainType != "qemu" || !arm.SupportsMachine("virt") {
+		t.Errorf("unexpected aarch64 guest: %+v", arm)
+	}
+
+	if len(caps.NUMACells) != 2 {
+		t.Fatalf("expected 2 NUMA cells, got %d", len(caps.NUMACells))
+	}
+	node0 := caps.NUMACell(0)
+	if node0 == nil || node0.MemoryKiB != 16318480 || node0.Pages[2048] != 1024 || !slices.Equal(node0.CPUs, []int{0, 1, 2, 3}) {
+		t.Errorf("unexpected NUMA cell 0: %+v", node0)
+	}
+	if !caps.HasCPU(7) || caps.HasCPU(8) || caps.NUMACell(2) != nil {
+		t.Errorf("host CPU lookup does not match the topology")
+	}
+
+	descriptors := loadFirmwareDescriptors([]string{"testdata/firmware"})
+	if err := parseDomainCapabilities(readTestFile(t, "testdata/domcaps_x86_64.xml"), guest, descriptors); err != nil {
+		t.Fatalf("parseDomainCapabilities failed: %v", err)
+	}
+	if guest.MaxVCPUs != 288 || !slices.Contains(guest.CPUModes, "host-passthrough") {
+		t.Errorf("unexpected CPU capabilities: %d %v", guest.MaxVCPUs, guest.CPUModes)
+	}
+	if !slices.Equal(guest.CPUModels, []string{"Skylake-Client", "qemu64"}) {
+		t.Errorf("CPU models = %v, unusable models must be left out", guest.CPUModels)
+	}
+	if !slices.Contains(guest.VideoModels, "qxl") || !slices.Contains(guest.FilesystemDrivers, "virtiofs") || !slices.Contains(guest.TPMModels, "tpm-crb") {
+		t.Errorf("unexpected device models: %+v", guest)
+	}
+
+	plain := guest.PickFirmware(false)
+	if plain == nil || plain.Path != "/usr/share/OVMF/OVMF_CODE_4M.fd" || plain.NVRAMTemplate != "/usr/share/OVMF/OVMF_VARS_4M.fd" {
+		t.Errorf("unexpected firmware without secure boot: %+v", plain)
+	}
+	secure := guest.PickFirmware(true)
+	if secure == nil || !secure.EnrolledKeys || !secure.RequiresSMM || secure.NVRAMTemplate != "/usr/share/OVMF/OVMF_VARS_4M.ms.fd" {
+		t.Errorf("unexpected secure boot firmware: %+v", secure)
+	}
+}
+
+func TestPickFirmwarePrefersEnrolledKeys(t *testing.T) {
+	guest := &GuestCapabilities{Firmware: []FirmwareCapability{
+		{Path: "/usr/share/OVMF/OVMF_CODE.secboot.fd", Type: "pflash", NVRAMTemplate: "/usr/share/OVMF/OVMF_VARS.secboot.fd", SecureBoot: true},
+		{Path: "/usr/share/OVMF/OVMF_CODE.ms.fd", Type: "pflash", NVRAMTemplate: "/usr/share/OVMF/OVMF_VARS.ms.fd", SecureBoot: true, EnrolledKeys: true},
+		{Path: "/usr/share/OVMF/OVMF_CODE.sb-nokeys.fd", Type: "pflash", SecureBoot: true, EnrolledKeys: true},
+	}}
+	if fw := guest.PickFirmware(true); fw == nil || fw.Path != "/usr/share/OVMF/OVMF_CODE.ms.fd" {
+		t.Errorf("expected the loader with an enrolled-keys template, got %+v", fw)
+	}
+	if fw := guest.PickFirmware(false); fw != nil {
+		t.Errorf("picked a secure boot loader for plain UEFI: %+v", fw)
+	}
+}
+
+func TestDescribeFirmwareWithoutDescriptor(t *testing.T) {
+	fw := describeFirmware("/usr/share/OVMF/OVMF_CODE.secboot.fd", "pflash", nil)
+	if !fw.SecureBoot || !fw.RequiresSMM {
+		t.Errorf("secboot loader not recognised: %+v", fw)
+	}
+	if fw := describeFirmware("/usr/share/AAVMF/AAVMF_CODE.fd", "pflash", nil); fw.SecureBoot {
+		t.Errorf("plain loader reported as secure boot: %+v", fw)
+	}
+}
+
+func TestHugePagePool(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "hugepages-2048kB"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hugepages-2048kB", "resv_hugepages"), []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := reservedHugePages(dir, 2048); got != 100 {
+		t.Errorf("reservedHugePages = %d, want 100", got)
+	}
+	if got := reservedHugePages(dir, 1048576); got != 0 {
+		t.Errorf("reservedHugePages without a pool = %d, want 0", got)
+	}
+
+	pool := &HugePagePool{Free: map[int]int{0: 300, 1: 500}, Reserved: 100}
+	if got := pool.Available(nil); got != 700 {
+		t.Errorf("Available on all cells = %d, want 700", got)
+	}
+	if got := pool.Available(map[int]bool{0: true}); got != 200 {
+		t.Errorf("Available on cell 0 = %d, want 200", got)
+	}
+	pool.Reserved = 400
+	if got := pool.Available(map[int]bool{0: true}); got != 0 {
+		t.Errorf("Available beyond the reserved pages = %d, want 0", got)
+	}
+}
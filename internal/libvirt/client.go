@@ -6,6 +6,7 @@ import (
 	"log"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/libvirt/libvirt-go"
 )
@@ -13,6 +14,9 @@ import (
 type Client struct {
 	conn *libvirt.Connect
 	uri  string
+
+	capsMu sync.Mutex
+	caps   *HostCapabilities
 }
 
 type Domain struct {
@@ -86,6 +90,25 @@ func (c *Client) UndefineDomainByName(name string) error {
 	return domain.Undefine()
 }
 
+// PurgeDomain undefines a shut off domain along with its managed save
+// image, snapshot metadata and NVRAM file.
+func (c *Client) PurgeDomain(uuid string) error {
+	domain, err := c.conn.LookupDomainByUUIDString(uuid)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	state, _, err := domain.GetState()
+	if err != nil {
+		return fmt.Errorf("failed to get domain state: %w", err)
+	}
+	if state != libvirt.DOMAIN_SHUTOFF {
+		return fmt.Errorf("domain is not shut off")
+	}
+	return domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA | libvirt.DOMAIN_UNDEFINE_NVRAM)
+}
+
 func (c *Client) DomainCreateXML(xmlData string) (*Domain, error) {
 	domain, err := c.conn.DomainCreateXML(xmlData, 0)
 	if err != nil {
@@ -222,6 +245,39 @@ func (c *Client) ListSecrets() ([]string, error) {
 	return c.conn.ListSecrets()
 }
 
+// DefineVolumeSecret defines the private, persistent secret uuid for the
+// volume at path and sets its value. Defining an existing UUID again only
+// replaces its value.
+func (c *Client) DefineVolumeSecret(uuid, path string, value []byte) error {
+	secretXML, err := marshalXML(SecretDef{
+		Ephemeral:   "no",
+		Private:     "yes",
+		UUID:        uuid,
+		Description: "vmmanager disk " + path,
+		Usage:       &SecretUsage{Type: "volume", Volume: path},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal secret XML: %w", err)
+	}
+
+	secret, err := c.conn.SecretDefineXML(secretXML, 0)
+	if err != nil {
+		return fmt.Errorf("failed to define secret: %w", err)
+	}
+	defer secret.Free()
+
+	return secret.SetValue(value, 0)
+}
+
+func (c *Client) UndefineSecret(uuid string) error {
+	secret, err := c.conn.LookupSecretByUUIDString(uuid)
+	if err != nil {
+		return err
+	}
+	defer secret.Free()
+	return secret.Undefine()
+}
+
 func (c *Client) ListDomains() ([]uint32, error) {
 	return c.conn.ListDomains()
 }
@@ -230,6 +286,23 @@ func (c *Client) ListDefinedDomains() ([]string, error) {
 	return c.conn.ListDefinedDomains()
 }
 
+// ListAllDomains returns every domain of the host, running or not. The
+// caller frees them.
+func (c *Client) ListAllDomains() ([]*Domain, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("libvirt connection is nil")
+	}
+	domains, err := c.conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]*Domain, 0, len(domains))
+	for i := range domains {
+		wrapped = append(wrapped, c.wrapDomain(&domains[i]))
+	}
+	return wrapped, nil
+}
+
 func (c *Client) GetHostname() (string, error) {
 	return c.conn.GetHostname()
 }
@@ -313,75 +386,55 @@ func (c *Client) GetMountedISO(domainUUID string) (string, error) {
 	return extractISOPath(xmlDesc), nil
 }
 
+// updateCDROMXML points the first CD-ROM of the definition at isoPath, or
+// empties it when isoPath is "". A CD-ROM is added when there is none.
 func updateCDROMXML(xmlDesc string, isoPath string) (string, error) {
-	cdromRegex := regexp.MustCompile(`(?s)<disk type='file' device='cdrom'>.*?</disk>`)
+	def, err := ParseDomainXML(xmlDesc)
+	if err != nil {
+		return "", err
+	}
 
-	if !cdromRegex.MatchString(xmlDesc) {
+	cdroms := def.DisksByDevice("cdrom")
+	if len(cdroms) == 0 {
 		if isoPath == "" {
 			return xmlDesc, nil
 		}
-
-		targetRegex := regexp.MustCompile(`</devices>`)
-		cdromXML := fmt.Sprintf(`<disk type='file' device='cdrom'>
-      <driver name='qemu' type='raw'/>
-      <source file='%s'/>
-      <target dev='sda' bus='sata'/>
-      <readonly/>
-    </disk>`, isoPath)
-		return targetRegex.ReplaceAllString(xmlDesc, cdromXML+"</devices>"), nil
-	}
-
-	if isoPath == "" {
-		newDiskXML := `<disk type='file' device='cdrom'>
-      <driver name='qemu' type='raw'/>
-      <target dev='sda' bus='sata'/>
-      <readonly/>
-    </disk>`
-		return cdromRegex.ReplaceAllString(xmlDesc, newDiskXML), nil
-	}
-
-	sourceRegex := regexp.MustCompile(`(?s)(<disk type='file' device='cdrom'>.*?<driver[^/]*/>)(.*?)(</disk>)`)
-	if sourceRegex.MatchString(xmlDesc) {
-		newSource := fmt.Sprintf(`$1
-      <source file='%s'/>
-      $3`, isoPath)
-		return sourceRegex.ReplaceAllString(xmlDesc, newSource), nil
+		def.devices().Disks = append(def.devices().Disks, DomainDisk{
+			Type:     "file",
+			Device:   "cdrom",
+			Driver:   &DiskDriver{Name: "qemu", Type: "raw"},
+			Target:   &DiskTarget{Dev: "sda", Bus: "sata"},
+			ReadOnly: &struct{}{},
+		})
+		cdroms = def.DisksByDevice("cdrom")
 	}
 
-	driverRegex := regexp.MustCompile(`(?s)(<disk type='file' device='cdrom'>.*?<driver[^/]*/>)(</disk>)`)
-	if driverRegex.MatchString(xmlDesc) {
-		newXML := fmt.Sprintf(`$1
-      <source file='%s'/>
-      $2`, isoPath)
-		return driverRegex.ReplaceAllString(xmlDesc, newXML), nil
+	cdrom := cdroms[0]
+	cdrom.Source = nil
+	if isoPath != "" {
+		cdrom.Type = "file"
+		cdrom.Source = &DiskSource{File: isoPath}
 	}
-
-	return xmlDesc, nil
+	return def.Marshal()
 }
 
+// extractISOPath returns the image in the first CD-ROM that has one.
 func extractISOPath(xmlDesc string) string {
-	sourceRegex := regexp.MustCompile(`<source file='([^']+)'[^/]*/?\s*>`)
-	matches := sourceRegex.FindAllStringSubmatch(xmlDesc, -1)
-
-	for _, match := range matches {
-		if len(match) > 1 && strings.HasSuffix(strings.ToLower(match[1]), ".iso") {
-			return match[1]
-		}
+	def, err := ParseDomainXML(xmlDesc)
+	if err != nil {
+		return ""
 	}
-
-	cdromRegex := regexp.MustCompile(`(?s)<disk type='file' device='cdrom'>.*?<source file='([^']+)'.*?</disk>`)
-	matches = cdromRegex.FindAllStringSubmatch(xmlDesc, -1)
-
-	for _, match := range matches {
-		if len(match) > 1 {
-			return match[1]
+	for _, cdrom := range def.DisksByDevice("cdrom") {
+		if path := cdrom.SourcePath(); path != "" {
+			return path
 		}
 	}
-
 	return ""
 }
 
-func (c *Client) CloneVM(sourceUUID string, newName string, newDiskPath string) (string, error) {
+// CloneVM defines a copy of the source domain. Each interface of the clone
+// gets the address macs maps the source interface's MAC address to.
+func (c *Client) CloneVM(sourceUUID string, newName string, newDiskPath string, macs map[string]string, diskSecretUUID string) (string, error) {
 	sourceDomain, err := c.conn.LookupDomainByUUIDString(sourceUUID)
 	if err != nil {
 		return "", fmt.Errorf("source domain not found: %w", err)
@@ -394,12 +447,7 @@ func (c *Client) CloneVM(sourceUUID string, newName string, newDiskPath string)
 	}
 
 	newUUID := generateUUID()
-	newMAC, err := generateMACAddress()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate MAC address: %w", err)
-	}
-
-	newXML, err := modifyCloneXML(xmlDesc, newName, newUUID, newMAC, newDiskPath)
+	newXML, err := modifyCloneXML(xmlDesc, newName, newUUID, macs, newDiskPath, diskSecretUUID)
 	if err != nil {
 		return "", fmt.Errorf("failed to modify XML: %w", err)
 	}
@@ -415,6 +463,39 @@ func (c *Client) CloneVM(sourceUUID string, newName string, newDiskPath string)
 	return newUUID, nil
 }
 
+// GetLiveDomainXML returns the XML of a domain as it runs, with the ports
+// libvirt picked for autoport graphics.
+func (c *Client) GetLiveDomainXML(uuid string) (string, error) {
+	domain, err := c.conn.LookupDomainByUUIDString(uuid)
+	if err != nil {
+		return "", fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get domain XML: %w", err)
+	}
+
+	return xmlDesc, nil
+}
+
+// GetDiskCapacity returns the virtual size in bytes of the disk of a domain
+// at target.
+func (c *Client) GetDiskCapacity(uuid, target string) (uint64, error) {
+	domain, err := c.conn.LookupDomainByUUIDString(uuid)
+	if err != nil {
+		return 0, fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	info, err := domain.GetBlockInfo(target, 0)
+	if err != nil {
+		return 0, err
+	}
+	return info.Capacity, nil
+}
+
 func (c *Client) GetDomainXML(uuid string) (string, error) {
 	domain, err := c.conn.LookupDomainByUUIDString(uuid)
 	if err != nil {
@@ -430,22 +511,72 @@ func (c *Client) GetDomainXML(uuid string) (string, error) {
 	return xmlDesc, nil
 }
 
-func modifyCloneXML(xmlDesc string, newName string, newUUID string, newMAC string, newDiskPath string) (string, error) {
-	uuidRegex := regexp.MustCompile(`<uuid>[^<]+</uuid>`)
-	xmlDesc = uuidRegex.ReplaceAllString(xmlDesc, fmt.Sprintf("<uuid>%s</uuid>", newUUID))
+// modifyCloneXML gives the definition a new identity. Interfaces take their
+// new MAC address from macs, keyed by the lowercase address of the source,
+// and the clone is refused when one is missing. The system disk is
+// pointed at newDiskPath and data disks are dropped, since they belong to
+// the source VM. The system disk opens with the secret diskSecretUUID, or
+// is plain without one, as the secret of the source belongs to its disk.
+// The NVRAM path is cleared so libvirt creates a fresh variable store for
+// the clone.
+func modifyCloneXML(xmlDesc string, newName string, newUUID string, macs map[string]string, newDiskPath string, diskSecretUUID string) (string, error) {
+	def, err := ParseDomainXML(xmlDesc)
+	if err != nil {
+		return "", err
+	}
+
+	def.Name = newName
+	def.UUID = newUUID
+	if def.OS != nil && def.OS.NVRAM != nil {
+		def.OS.NVRAM.Path = ""
+	}
 
-	nameRegex := regexp.MustCompile(`<name>[^<]+</name>`)
-	xmlDesc = nameRegex.ReplaceAllString(xmlDesc, fmt.Sprintf("<name>%s</name>", newName))
+	if def.Devices != nil {
+		for i, iface := range def.Devices.Interfaces {
+			source := ""
+			if iface.MAC != nil {
+				source = strings.ToLower(iface.MAC.Address)
+			}
+			mac, ok := macs[source]
+			if !ok {
+				return "", fmt.Errorf("no MAC address for the clone of interface %q", source)
+			}
+			def.Devices.Interfaces[i].MAC = &InterfaceMAC{Address: mac}
+		}
 
-	macRegex := regexp.MustCompile(`<mac address='[^']+'`)
-	xmlDesc = macRegex.ReplaceAllString(xmlDesc, fmt.Sprintf("<mac address='%s'", newMAC))
+		if newDiskPath != "" {
+			// Data disks would end up shared with the source, and
+			// leaving them out would silently lose them, so the clone
+			// is refused until they are detached.
+			var dataDisks []string
+			for i, disk := range def.DisksByDevice("disk") {
+				if i > 0 && disk.Target != nil {
+					dataDisks = append(dataDisks, disk.Target.Dev)
+				}
+			}
+			if len(dataDisks) > 0 {
+				return "", fmt.Errorf("source domain has data disks %s, detach them before cloning", strings.Join(dataDisks, ", "))
+			}
 
-	if newDiskPath != "" {
-		diskSourceRegex := regexp.MustCompile(`(<disk type='file' device='disk'>.*?<source file=')[^']+(')`)
-		xmlDesc = diskSourceRegex.ReplaceAllString(xmlDesc, fmt.Sprintf("${1}%s${2}", newDiskPath))
+			disks := def.Devices.Disks[:0]
+			rootSet := false
+			for _, disk := range def.Devices.Disks {
+				if disk.Device == "disk" {
+					if rootSet {
+						continue
+					}
+					disk.Type = "file"
+					disk.Source = &DiskSource{File: newDiskPath}
+					disk.Encryption = DiskEncryptionFor(diskSecretUUID)
+					rootSet = true
+				}
+				disks = append(disks, disk)
+			}
+			def.Devices.Disks = disks
+		}
 	}
 
-	return xmlDesc, nil
+	return def.Marshal()
 }
 
 func generateUUID() string {
@@ -460,15 +591,6 @@ func generateUUID() string {
 	)
 }
 
-func generateMACAddress() (string, error) {
-	b := make([]byte, 3)
-	_, err := rand.Read(b)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", b[0], b[1], b[2]), nil
-}
-
 func (c *Client) NetworkCreate(name string) error {
 	net, err := c.conn.LookupNetworkByName(name)
 	if err != nil {
@@ -789,10 +911,10 @@ func (c *Client) CreateSnapshot(domainUUID string, snapshotName string, descript
 	}
 	defer domain.Free()
 
-	snapshotXML := fmt.Sprintf(`<domainsnapshot>
-  <name>%s</name>
-  <description>%s</description>
-</domainsnapshot>`, snapshotName, description)
+	snapshotXML, err := marshalXML(DomainSnapshotDef{Name: snapshotName, Description: description})
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot XML: %w", err)
+	}
 
 	_, err = domain.CreateSnapshotXML(snapshotXML, 0)
 	return err
@@ -852,16 +974,22 @@ func (c *Client) GetSnapshotInfo(domainUUID string, snapshotName string) (*Snaps
 	defer snap.Free()
 
 	name, _ := snap.GetName()
-	xml, _ := snap.GetXMLDesc(0)
+	xmlDesc, _ := snap.GetXMLDesc(0)
 	isCurrent, _ := snap.IsCurrent(0)
 
-	return &SnapshotInfo{
-		Name:        name,
-		Description: parseSnapshotDescription(xml),
-		State:       parseSnapshotState(xml),
-		IsCurrent:   isCurrent,
-		CreatedAt:   parseSnapshotCreationTime(xml),
-	}, nil
+	info := &SnapshotInfo{
+		Name:      name,
+		State:     "unknown",
+		IsCurrent: isCurrent,
+	}
+	if def, err := ParseSnapshotXML(xmlDesc); err == nil {
+		info.Description = def.Description
+		info.CreatedAt = def.CreationTime
+		if def.State != "" {
+			info.State = def.State
+		}
+	}
+	return info, nil
 }
 
 func (c *Client) RevertToSnapshot(domainUUID string, snapshotName string) error {
@@ -904,36 +1032,6 @@ func (c *Client) DeleteSnapshot(domainUUID string, snapshotName string) error {
 	return snap.Delete(0)
 }
 
-func parseSnapshotDescription(xml string) string {
-	return findSubstring(xml, "<description>", "</description>")
-}
-
-func parseSnapshotState(xml string) string {
-	state := findSubstring(xml, "<state>", "</state>")
-	if state != "" {
-		return state
-	}
-	return "unknown"
-}
-
-func parseSnapshotCreationTime(xml string) string {
-	return findSubstring(xml, "<creationTime>", "</creationTime>")
-}
-
-func findSubstring(xml, startTag, endTag string) string {
-	for i := 0; i < len(xml); i++ {
-		if i+len(startTag) <= len(xml) && xml[i:i+len(startTag)] == startTag {
-			end := i + len(startTag)
-			for j := end; j < len(xml); j++ {
-				if j+len(endTag) <= len(xml) && xml[j:j+len(endTag)] == endTag {
-					return xml[end:j]
-				}
-			}
-		}
-	}
-	return ""
-}
-
 func (c *Client) SetVCPUs(domainUUID string, vcpus uint) error {
 	if c.conn == nil {
 		return fmt.Errorf("libvirt connection is nil")
@@ -1000,6 +1098,91 @@ func (c *Client) SetMemory(domainUUID string, memoryKB uint64) error {
 	return nil
 }
 
+// MemoryStats is what the balloon driver reports about a running guest, in
+// KiB. The guest figures are zero when the guest has no balloon driver or
+// the stats period is off.
+type MemoryStats struct {
+	Actual      uint64
+	Unused      uint64
+	Available   uint64
+	Usable      uint64
+	RSS         uint64
+	MajorFaults uint64
+}
+
+// HasGuestStats reports whether the guest driver reported its memory use.
+func (s *MemoryStats) HasGuestStats() bool {
+	return s.Available > 0
+}
+
+func (c *Client) GetMemoryStats(domainUUID string) (*MemoryStats, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return nil, fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	raw, err := domain.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &MemoryStats{}
+	for _, stat := range raw {
+		switch libvirt.DomainMemoryStatTags(stat.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			stats.Actual = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			stats.Unused = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_AVAILABLE:
+			stats.Available = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_USABLE:
+			stats.Usable = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_RSS:
+			stats.RSS = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT:
+			stats.MajorFaults = stat.Val
+		}
+	}
+	return stats, nil
+}
+
+// SetMemoryStatsPeriod makes the balloon driver of a running guest report
+// its memory use every period seconds.
+func (c *Client) SetMemoryStatsPeriod(domainUUID string, period int) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	return domain.SetMemoryStatsPeriod(period, libvirt.DOMAIN_MEM_LIVE)
+}
+
+// SetBalloon inflates or deflates the balloon of a running guest so it has
+// memoryKB. Unlike SetMemory it leaves the persistent definition alone.
+func (c *Client) SetBalloon(domainUUID string, memoryKB uint64) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	return domain.SetMemoryFlags(memoryKB, libvirt.DOMAIN_MEM_LIVE)
+}
+
 func (c *Client) SetMaxMemory(domainUUID string, maxMemoryKB uint64) error {
 	if c.conn == nil {
 		return fmt.Errorf("libvirt connection is nil")
@@ -1041,14 +1224,12 @@ func (c *Client) GetVCPUInfo(domainUUID string) (current uint, max uint, err err
 		return info.NrVirtCpu, 0, nil
 	}
 
-	maxVCPUsStr := findSubstring(xmlDesc, "<vcpu current='yes'>", "</vcpu>")
-	if maxVCPUsStr == "" {
-		maxVCPUsStr = findSubstring(xmlDesc, "<vcpu>", "</vcpu>")
+	def, err := ParseDomainXML(xmlDesc)
+	if err != nil || def.VCPU == nil {
+		return info.NrVirtCpu, 0, nil
 	}
-	var maxVCPUs uint
-	fmt.Sscanf(maxVCPUsStr, "%d", &maxVCPUs)
 
-	return info.NrVirtCpu, maxVCPUs, nil
+	return info.NrVirtCpu, uint(def.VCPU.Value), nil
 }
 
 func (c *Client) GetMemoryInfo(domainUUID string) (currentKB uint64, maxKB uint64, err error) {
@@ -1067,25 +1248,52 @@ func (c *Client) GetMemoryInfo(domainUUID string) (currentKB uint64, maxKB uint6
 		return 0, 0, fmt.Errorf("failed to get domain XML: %w", err)
 	}
 
-	currentKB = parseMemoryValue(xmlDesc, "<currentMemory unit='KiB'>", "</currentMemory>")
-	maxKB = parseMemoryValue(xmlDesc, "<memory unit='KiB'>", "</memory>")
+	def, err := ParseDomainXML(xmlDesc)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return def.CurrentMemory.KiB(), def.Memory.KiB(), nil
+}
+
+func (c *Client) SendKey(domainUUID string, codeset uint, holdTimeMs uint, keycodes []uint) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	if len(keycodes) == 0 || len(keycodes) > MaxSendKeys {
+		return fmt.Errorf("keycode count must be between 1 and %d", MaxSendKeys)
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if err := domain.SendKey(codeset, holdTimeMs, keycodes, 0); err != nil {
+		return fmt.Errorf("failed to send keys: %w", err)
+	}
 
-	return currentKB, maxKB, nil
+	log.Printf("[LIBVIRT] Sent %d keycodes to domain %s", len(keycodes), domainUUID)
+	return nil
 }
 
-func parseMemoryValue(xml, startTag, endTag string) uint64 {
-	valueStr := findSubstring(xml, startTag, endTag)
-	if valueStr == "" {
-		valueStr = findSubstring(xml, strings.Replace(startTag, "'KiB'", "'k'", 1), strings.Replace(endTag, "'KiB'", "'k'", 1))
+func (c *Client) PressPowerButton(domainUUID string) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
 	}
-	if valueStr == "" {
-		valueStr = findSubstring(xml, "<currentMemory>", "</currentMemory>")
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
 	}
-	if valueStr == "" {
-		valueStr = findSubstring(xml, "<memory>", "</memory>")
+	defer domain.Free()
+
+	if err := domain.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN); err != nil {
+		return fmt.Errorf("failed to press power button: %w", err)
 	}
 
-	var value uint64
-	fmt.Sscanf(valueStr, "%d", &value)
-	return value
+	log.Printf("[LIBVIRT] Pressed ACPI power button for domain %s", domainUUID)
+	return nil
 }
@@ -0,0 +1,147 @@
+package libvirt
+
+import (
+	"strings"
+	"testing"
+)
+
+func readTestDomain(t *testing.T) string {
+	return readTestFile(t, "testdata/domain_dumpxml.xml")
+}
+
+func TestUpdateCDROMXML(t *testing.T) {
+	xmlDesc := readTestDomain(t)
+
+	mounted, err := updateCDROMXML(xmlDesc, "/isos/debian.iso")
+	if err != nil {
+		t.Fatalf("updateCDROMXML failed: %v", err)
+	}
+	if got := extractISOPath(mounted); got != "/isos/debian.iso" {
+		t.Errorf("mounted ISO = %q", got)
+	}
+
+	ejected, err := updateCDROMXML(mounted, "")
+	if err != nil {
+		t.Fatalf("updateCDROMXML failed: %v", err)
+	}
+	if got := extractISOPath(ejected); got != "" {
+		t.Errorf("ISO still mounted after eject: %q", got)
+	}
+	def, _ := ParseDomainXML(ejected)
+	if cdroms := def.DisksByDevice("cdrom"); len(cdroms) != 1 || cdroms[0].Target.Dev != "sda" {
+		t.Errorf("CD-ROM drive was not kept empty: %+v", cdroms)
+	}
+}
+
+// readTestDomainWithoutDataDisks returns the test domain with only its
+// system disk and CD-ROM, as clones of domains with data disks are refused.
+func readTestDomainWithoutDataDisks(t *testing.T) string {
+	def, err := ParseDomainXML(readTestDomain(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var disks []DomainDisk
+	for _, disk := range def.Devices.Disks {
+		if disk.Target == nil || disk.Target.Dev != "vdb" {
+			disks = append(disks, disk)
+		}
+	}
+	def.Devices.Disks = disks
+	out, err := def.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// cloneMACs maps the MAC address of the test domain to the one of its clone.
+var cloneMACs = map[string]string{"52:54:00:12:34:56": "52:54:00:00:00:01"}
+
+func TestModifyCloneXMLRefusesDataDisks(t *testing.T) {
+	_, err := modifyCloneXML(readTestDomain(t), "web2", "11111111-2222-4333-8444-555555555555", cloneMACs, "/var/lib/vmmanager/web2.qcow2", "")
+	if err == nil || !strings.Contains(err.Error(), "vdb") {
+		t.Errorf("clone of a domain with a data disk was not refused: %v", err)
+	}
+}
+
+func TestModifyCloneXML(t *testing.T) {
+	out, err := modifyCloneXML(readTestDomainWithoutDataDisks(t), "web2", "11111111-2222-4333-8444-555555555555", cloneMACs, "/var/lib/vmmanager/web2.qcow2", "")
+	if err != nil {
+		t.Fatalf("modifyCloneXML failed: %v", err)
+	}
+	def, err := ParseDomainXML(out)
+	if err != nil {
+		t.Fatalf("clone XML does not parse: %v", err)
+	}
+
+	if def.Name != "web2" || def.UUID != "11111111-2222-4333-8444-555555555555" {
+		t.Errorf("clone identity not updated: %s %s", def.Name, def.UUID)
+	}
+	if mac := def.Devices.Interfaces[0].MAC.Address; mac != "52:54:00:00:00:01" {
+		t.Errorf("clone MAC = %s", mac)
+	}
+	if disk := def.FindDisk("vda"); disk == nil || disk.SourcePath() != "/var/lib/vmmanager/web2.qcow2" {
+		t.Errorf("system disk not repointed: %+v", disk)
+	}
+	if def.FindDisk("sda") == nil {
+		t.Errorf("clone lost its CD-ROM drive")
+	}
+	if def.OS.NVRAM.Path != "" {
+		t.Errorf("clone shares the NVRAM store %s", def.OS.NVRAM.Path)
+	}
+}
+
+func TestModifyCloneXMLInterfaces(t *testing.T) {
+	def, err := ParseDomainXML(readTestDomainWithoutDataDisks(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := def.Devices.Interfaces[0]
+	second.MAC = &InterfaceMAC{Address: "52:54:00:AB:CD:EF"}
+	def.Devices.Interfaces = append(def.Devices.Interfaces, second)
+	source, err := def.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	macs := map[string]string{
+		"52:54:00:12:34:56": "52:54:00:00:00:01",
+		"52:54:00:ab:cd:ef": "52:54:00:00:00:02",
+	}
+	out, err := modifyCloneXML(source, "web2", "11111111-2222-4333-8444-555555555555", macs, "/var/lib/vmmanager/web2.qcow2", "")
+	if err != nil {
+		t.Fatalf("modifyCloneXML failed: %v", err)
+	}
+	clone, err := ParseDomainXML(out)
+	if err != nil {
+		t.Fatalf("clone XML does not parse: %v", err)
+	}
+	var got []string
+	for _, iface := range clone.Devices.Interfaces {
+		got = append(got, iface.MAC.Address)
+	}
+	if len(got) != 2 || got[0] != "52:54:00:00:00:01" || got[1] != "52:54:00:00:00:02" {
+		t.Errorf("clone MACs = %v", got)
+	}
+
+	// An interface without an allocated address must not get a random one.
+	if _, err := modifyCloneXML(source, "web2", "11111111-2222-4333-8444-555555555555", cloneMACs, "/var/lib/vmmanager/web2.qcow2", ""); err == nil || !strings.Contains(err.Error(), "52:54:00:ab:cd:ef") {
+		t.Errorf("clone with an unmapped interface was not refused: %v", err)
+	}
+}
+
+func TestModifyCloneXMLEncrypted(t *testing.T) {
+	out, err := modifyCloneXML(readTestDomainWithoutDataDisks(t), "web2", "11111111-2222-4333-8444-555555555555", cloneMACs, "/var/lib/vmmanager/web2.qcow2", "66666666-7777-4888-9999-aaaaaaaaaaaa")
+	if err != nil {
+		t.Fatalf("modifyCloneXML failed: %v", err)
+	}
+	def, err := ParseDomainXML(out)
+	if err != nil {
+		t.Fatalf("clone XML does not parse: %v", err)
+	}
+
+	disk := def.FindDisk("vda")
+	if disk == nil || disk.Encryption == nil || disk.Encryption.Format != "luks" || disk.Encryption.Secret.UUID != "66666666-7777-4888-9999-aaaaaaaaaaaa" {
+		t.Errorf("system disk of the clone does not use its own secret: %+v", disk)
+	}
+}
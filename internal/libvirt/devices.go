@@ -0,0 +1,333 @@
+package libvirt
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+func deviceModifyFlags(live bool) libvirt.DomainDeviceModifyFlags {
+	flags := libvirt.DomainDeviceModifyFlags(libvirt.DOMAIN_DEVICE_MODIFY_CONFIG)
+	if live {
+		flags |= libvirt.DomainDeviceModifyFlags(libvirt.DOMAIN_DEVICE_MODIFY_LIVE)
+	}
+	return flags
+}
+
+func modificationImpact(live bool) libvirt.DomainModificationImpact {
+	flags := libvirt.DomainModificationImpact(libvirt.DOMAIN_AFFECT_CONFIG)
+	if live {
+		flags |= libvirt.DomainModificationImpact(libvirt.DOMAIN_AFFECT_LIVE)
+	}
+	return flags
+}
+
+// RootDiskTarget names the target of the system disk on bus. A SATA system
+// disk comes after the install, cloud-init, answer file and driver CD-ROMs.
+func RootDiskTarget(bus string) string {
+	if bus == "sata" {
+		return "sde"
+	}
+	return "vda"
+}
+
+// AttachDevice adds the device described by deviceXML to the persistent
+// definition of the domain and, when live is set, to the running guest.
+func (c *Client) AttachDevice(domainUUID, deviceXML string, live bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if err := domain.AttachDeviceFlags(deviceXML, deviceModifyFlags(live)); err != nil {
+		return fmt.Errorf("failed to attach device: %w", err)
+	}
+
+	log.Printf("[LIBVIRT] Device attached to domain %s (live: %v)", domainUUID, live)
+	return nil
+}
+
+// DetachDevice removes the device described by deviceXML from the persistent
+// definition of the domain and, when live is set, from the running guest.
+func (c *Client) DetachDevice(domainUUID, deviceXML string, live bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if err := domain.DetachDeviceFlags(deviceXML, deviceModifyFlags(live)); err != nil {
+		return fmt.Errorf("failed to detach device: %w", err)
+	}
+
+	log.Printf("[LIBVIRT] Device detached from domain %s (live: %v)", domainUUID, live)
+	return nil
+}
+
+// UpdateDevice replaces the matching device of the domain with deviceXML in
+// the persistent definition and, when live is set, in the running guest.
+func (c *Client) UpdateDevice(domainUUID, deviceXML string, live bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if err := domain.UpdateDeviceFlags(deviceXML, deviceModifyFlags(live)); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+
+	log.Printf("[LIBVIRT] Device updated on domain %s (live: %v)", domainUUID, live)
+	return nil
+}
+
+// ListTargetDevs returns the target names of every disk in the persistent
+// and live definition of the domain.
+func (c *Client) ListTargetDevs(domainUUID string) ([]string, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return nil, fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	var targets []string
+	for _, flags := range []libvirt.DomainXMLFlags{0, libvirt.DomainXMLFlags(libvirt.DOMAIN_XML_INACTIVE)} {
+		xmlDesc, err := domain.GetXMLDesc(flags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get domain XML: %w", err)
+		}
+		def, err := ParseDomainXML(xmlDesc)
+		if err != nil {
+			return nil, err
+		}
+		for _, disk := range def.devices().Disks {
+			if disk.Target != nil {
+				targets = append(targets, disk.Target.Dev)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// virtioSCSIController is added to domains that get a SCSI disk but have no
+// SCSI controller yet. Left to itself, libvirt would add an emulated LSI
+// controller that many guests cannot drive.
+const virtioSCSIController = "<controller type='scsi' model='virtio-scsi'/>"
+
+// EnsureSCSIController adds a virtio-scsi controller to the persistent
+// definition of the domain and, when live is set, to the running guest,
+// unless it already has a SCSI controller.
+func (c *Client) EnsureSCSIController(domainUUID string, live bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	flags := []libvirt.DomainXMLFlags{libvirt.DomainXMLFlags(libvirt.DOMAIN_XML_INACTIVE)}
+	if live {
+		flags = append(flags, 0)
+	}
+	for _, flag := range flags {
+		xmlDesc, err := domain.GetXMLDesc(flag)
+		if err != nil {
+			return fmt.Errorf("failed to get domain XML: %w", err)
+		}
+		def, err := ParseDomainXML(xmlDesc)
+		if err != nil {
+			return err
+		}
+		if hasController(def, "scsi") {
+			continue
+		}
+
+		modify := libvirt.DomainDeviceModifyFlags(libvirt.DOMAIN_DEVICE_MODIFY_CONFIG)
+		if flag == 0 {
+			modify = libvirt.DomainDeviceModifyFlags(libvirt.DOMAIN_DEVICE_MODIFY_LIVE)
+		}
+		if err := domain.AttachDeviceFlags(virtioSCSIController, modify); err != nil {
+			return fmt.Errorf("failed to add SCSI controller: %w", err)
+		}
+		log.Printf("[LIBVIRT] virtio-scsi controller added to domain %s (live: %v)", domainUUID, flag == 0)
+	}
+	return nil
+}
+
+func hasController(def *DomainDef, controllerType string) bool {
+	for _, controller := range def.devices().Controllers {
+		if controller.Type == controllerType {
+			return true
+		}
+	}
+	return false
+}
+
+// StorageVolumeGet returns the size and path of a volume in a pool.
+func (c *Client) StorageVolumeGet(poolName, volumeName string) (*StorageVolumeInfo, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("libvirt connection is nil")
+	}
+	pool, err := c.conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("storage pool not found: %w", err)
+	}
+	defer pool.Free()
+
+	vol, err := pool.LookupStorageVolByName(volumeName)
+	if err != nil {
+		return nil, fmt.Errorf("volume not found: %w", err)
+	}
+	defer vol.Free()
+
+	info, err := vol.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	path, err := vol.GetPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return &StorageVolumeInfo{
+		Name:       volumeName,
+		Capacity:   info.Capacity,
+		Allocation: info.Allocation,
+		Path:       path,
+	}, nil
+}
+
+// BlockResize grows the disk with the given target of a running domain to
+// sizeBytes.
+func (c *Client) BlockResize(domainUUID, target string, sizeBytes uint64) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if err := domain.BlockResize(target, sizeBytes, libvirt.DomainBlockResizeFlags(libvirt.DOMAIN_BLOCK_RESIZE_BYTES)); err != nil {
+		return fmt.Errorf("failed to resize %s: %w", target, err)
+	}
+
+	log.Printf("[LIBVIRT] Disk %s of domain %s resized to %d bytes", target, domainUUID, sizeBytes)
+	return nil
+}
+
+// StorageVolumeResize grows a volume that is not in use by a running domain
+// to capacity bytes.
+func (c *Client) StorageVolumeResize(poolName, volumeName string, capacity uint64) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+	pool, err := c.conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return fmt.Errorf("storage pool not found: %w", err)
+	}
+	defer pool.Free()
+
+	vol, err := pool.LookupStorageVolByName(volumeName)
+	if err != nil {
+		return fmt.Errorf("volume not found: %w", err)
+	}
+	defer vol.Free()
+
+	if err := vol.Resize(capacity, 0); err != nil {
+		return fmt.Errorf("failed to resize volume: %w", err)
+	}
+
+	log.Printf("[LIBVIRT] Volume %s/%s resized to %d bytes", poolName, volumeName, capacity)
+	return nil
+}
+
+// SetDiskIOTune replaces the I/O limits of the disk with the given target in
+// the persistent definition and, when live is set, on the running guest. A
+// nil tune removes every limit.
+func (c *Client) SetDiskIOTune(domainUUID, target string, tune *DiskIOTune, live bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if tune == nil {
+		tune = &DiskIOTune{}
+	}
+	params := &libvirt.DomainBlockIoTuneParameters{
+		ReadBytesSecSet:  true,
+		ReadBytesSec:     tune.ReadBytesSec,
+		WriteBytesSecSet: true,
+		WriteBytesSec:    tune.WriteBytesSec,
+		ReadIopsSecSet:   true,
+		ReadIopsSec:      tune.ReadIOPSSec,
+		WriteIopsSecSet:  true,
+		WriteIopsSec:     tune.WriteIOPSSec,
+	}
+	if err := domain.SetBlockIoTune(target, params, modificationImpact(live)); err != nil {
+		return fmt.Errorf("failed to set I/O limits of %s: %w", target, err)
+	}
+
+	log.Printf("[LIBVIRT] I/O limits of disk %s of domain %s updated (live: %v)", target, domainUUID, live)
+	return nil
+}
+
+// SetInterfaceBandwidth replaces the bandwidth limits of the NIC with the
+// given MAC address in the persistent definition and, when live is set, on
+// the running guest. A nil bandwidth removes every limit.
+func (c *Client) SetInterfaceBandwidth(domainUUID, mac string, bandwidth *InterfaceBandwidth, live bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	params := &libvirt.DomainInterfaceParameters{
+		BandwidthInAverageSet:  true,
+		BandwidthOutAverageSet: true,
+	}
+	if bandwidth != nil && bandwidth.Inbound != nil {
+		params.BandwidthInAverage = uint(bandwidth.Inbound.Average)
+	}
+	if bandwidth != nil && bandwidth.Outbound != nil {
+		params.BandwidthOutAverage = uint(bandwidth.Outbound.Average)
+	}
+	if err := domain.SetInterfaceParameters(mac, params, modificationImpact(live)); err != nil {
+		return fmt.Errorf("failed to set bandwidth of %s: %w", mac, err)
+	}
+
+	log.Printf("[LIBVIRT] Bandwidth of NIC %s of domain %s updated (live: %v)", mac, domainUUID, live)
+	return nil
+}
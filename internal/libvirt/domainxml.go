@@ -0,0 +1,727 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var emptyElementRegex = regexp.MustCompile(`<([A-Za-z][\w:.-]*)((?:\s+[^<>]*?)?)></([A-Za-z][\w:.-]*)>`)
+
+// RawElement keeps an element the typed model does not describe, so parsing
+// a definition and marshalling it again does not lose anything.
+type RawElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// DomainDef is the libvirt domain XML. Elements and attributes without a
+// field are kept in Attrs and Extra.
+type DomainDef struct {
+	XMLName       xml.Name        `xml:"domain"`
+	Type          string          `xml:"type,attr,omitempty"`
+	Attrs         []xml.Attr      `xml:",any,attr"`
+	Name          string          `xml:"name"`
+	UUID          string          `xml:"uuid,omitempty"`
+	Description   string          `xml:"description,omitempty"`
+	Memory        *DomainMemory   `xml:"memory"`
+	CurrentMemory *DomainMemory   `xml:"currentMemory"`
+	MemoryBacking *MemoryBacking  `xml:"memoryBacking"`
+	VCPU          *DomainVCPU     `xml:"vcpu"`
+	CPUTune       *DomainCPUTune  `xml:"cputune"`
+	NUMATune      *DomainNUMATune `xml:"numatune"`
+	OS            *DomainOS       `xml:"os"`
+	Features      *DomainFeatures `xml:"features"`
+	CPU           *DomainCPU      `xml:"cpu"`
+	Clock         *DomainClock    `xml:"clock"`
+	OnPoweroff    string          `xml:"on_poweroff,omitempty"`
+	OnReboot      string          `xml:"on_reboot,omitempty"`
+	OnCrash       string          `xml:"on_crash,omitempty"`
+	Devices       *DomainDevices  `xml:"devices"`
+	Extra         []RawElement    `xml:",any"`
+}
+
+type DomainMemory struct {
+	Unit  string     `xml:"unit,attr,omitempty"`
+	Attrs []xml.Attr `xml:",any,attr"`
+	Value uint64     `xml:",chardata"`
+}
+
+type MemoryBacking struct {
+	HugePages *HugePages    `xml:"hugepages"`
+	Source    *MemorySource `xml:"source"`
+	Access    *MemoryAccess `xml:"access"`
+	Extra     []RawElement  `xml:",any"`
+}
+
+type MemorySource struct {
+	Type string `xml:"type,attr"`
+}
+
+type MemoryAccess struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type HugePages struct {
+	Pages []HugePage `xml:"page"`
+}
+
+type HugePage struct {
+	Size    uint64 `xml:"size,attr"`
+	Unit    string `xml:"unit,attr,omitempty"`
+	Nodeset string `xml:"nodeset,attr,omitempty"`
+}
+
+type DomainCPUTune struct {
+	VCPUPins    []VCPUPin    `xml:"vcpupin"`
+	EmulatorPin *EmulatorPin `xml:"emulatorpin"`
+	Extra       []RawElement `xml:",any"`
+}
+
+type VCPUPin struct {
+	VCPU   int    `xml:"vcpu,attr"`
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type EmulatorPin struct {
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type DomainNUMATune struct {
+	Memory   *NUMAMemory   `xml:"memory"`
+	MemNodes []NUMAMemNode `xml:"memnode"`
+	Extra    []RawElement  `xml:",any"`
+}
+
+type NUMAMemory struct {
+	Mode    string `xml:"mode,attr,omitempty"`
+	Nodeset string `xml:"nodeset,attr,omitempty"`
+}
+
+type NUMAMemNode struct {
+	CellID  int    `xml:"cellid,attr"`
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type DomainVCPU struct {
+	Placement string     `xml:"placement,attr,omitempty"`
+	Current   int        `xml:"current,attr,omitempty"`
+	Attrs     []xml.Attr `xml:",any,attr"`
+	Value     int        `xml:",chardata"`
+}
+
+type DomainOS struct {
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Type    OSType       `xml:"type"`
+	Loader  *OSLoader    `xml:"loader"`
+	NVRAM   *OSNVRAM     `xml:"nvram"`
+	Kernel  string       `xml:"kernel,omitempty"`
+	Initrd  string       `xml:"initrd,omitempty"`
+	Cmdline string       `xml:"cmdline,omitempty"`
+	DTB     string       `xml:"dtb,omitempty"`
+	Boots   []OSBoot     `xml:"boot"`
+	Extra   []RawElement `xml:",any"`
+}
+
+type OSType struct {
+	Arch    string     `xml:"arch,attr,omitempty"`
+	Machine string     `xml:"machine,attr,omitempty"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Value   string     `xml:",chardata"`
+}
+
+type OSLoader struct {
+	Readonly string     `xml:"readonly,attr,omitempty"`
+	Secure   string     `xml:"secure,attr,omitempty"`
+	Type     string     `xml:"type,attr,omitempty"`
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Path     string     `xml:",chardata"`
+}
+
+type OSNVRAM struct {
+	Template string     `xml:"template,attr,omitempty"`
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Path     string     `xml:",chardata"`
+}
+
+type OSBoot struct {
+	Dev   string     `xml:"dev,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type DomainFeatures struct {
+	ACPI   *struct{}      `xml:"acpi"`
+	APIC   *FeatureAPIC   `xml:"apic"`
+	HyperV *FeatureHyperV `xml:"hyperv"`
+	GIC    *FeatureGIC    `xml:"gic"`
+	SMM    *FeatureSMM    `xml:"smm"`
+	Extra  []RawElement   `xml:",any"`
+}
+
+type FeatureAPIC struct {
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type FeatureGIC struct {
+	Version string     `xml:"version,attr,omitempty"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type FeatureSMM struct {
+	State string       `xml:"state,attr,omitempty"`
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Extra []RawElement `xml:",any"`
+}
+
+// FeatureHyperV holds the Hyper-V enlightenments that make Windows guests
+// use paravirtual timers, interrupts and spinlocks.
+type FeatureHyperV struct {
+	Mode        string           `xml:"mode,attr,omitempty"`
+	Relaxed     *FeatureState    `xml:"relaxed"`
+	VAPIC       *FeatureState    `xml:"vapic"`
+	Spinlocks   *HyperVSpinlocks `xml:"spinlocks"`
+	VPIndex     *FeatureState    `xml:"vpindex"`
+	Runtime     *FeatureState    `xml:"runtime"`
+	SynIC       *FeatureState    `xml:"synic"`
+	STimer      *FeatureState    `xml:"stimer"`
+	Reset       *FeatureState    `xml:"reset"`
+	Frequencies *FeatureState    `xml:"frequencies"`
+	TLBFlush    *FeatureState    `xml:"tlbflush"`
+	IPI         *FeatureState    `xml:"ipi"`
+	Extra       []RawElement     `xml:",any"`
+}
+
+type FeatureState struct {
+	State string `xml:"state,attr"`
+}
+
+type HyperVSpinlocks struct {
+	State   string `xml:"state,attr"`
+	Retries int    `xml:"retries,attr,omitempty"`
+}
+
+type DomainCPU struct {
+	Mode     string       `xml:"mode,attr,omitempty"`
+	Match    string       `xml:"match,attr,omitempty"`
+	Check    string       `xml:"check,attr,omitempty"`
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Model    *CPUModel    `xml:"model"`
+	Topology *CPUTopology `xml:"topology"`
+	NUMA     *CPUNUMA     `xml:"numa"`
+	Extra    []RawElement `xml:",any"`
+}
+
+type CPUTopology struct {
+	Sockets int        `xml:"sockets,attr"`
+	Dies    int        `xml:"dies,attr,omitempty"`
+	Cores   int        `xml:"cores,attr"`
+	Threads int        `xml:"threads,attr"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type CPUNUMA struct {
+	Cells []NUMACell `xml:"cell"`
+}
+
+type NUMACell struct {
+	ID     int          `xml:"id,attr"`
+	CPUs   string       `xml:"cpus,attr"`
+	Memory uint64       `xml:"memory,attr"`
+	Unit   string       `xml:"unit,attr,omitempty"`
+	Attrs  []xml.Attr   `xml:",any,attr"`
+	Extra  []RawElement `xml:",any"`
+}
+
+type CPUModel struct {
+	Fallback string     `xml:"fallback,attr,omitempty"`
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Value    string     `xml:",chardata"`
+}
+
+type DomainClock struct {
+	Offset string       `xml:"offset,attr,omitempty"`
+	Attrs  []xml.Attr   `xml:",any,attr"`
+	Timers []ClockTimer `xml:"timer"`
+	Extra  []RawElement `xml:",any"`
+}
+
+type ClockTimer struct {
+	Name       string     `xml:"name,attr"`
+	TickPolicy string     `xml:"tickpolicy,attr,omitempty"`
+	Present    string     `xml:"present,attr,omitempty"`
+	Attrs      []xml.Attr `xml:",any,attr"`
+}
+
+type DomainDevices struct {
+	Emulator    string             `xml:"emulator,omitempty"`
+	Disks       []DomainDisk       `xml:"disk"`
+	Filesystems []DomainFilesystem `xml:"filesystem"`
+	Controllers []DomainController `xml:"controller"`
+	Interfaces  []DomainInterface  `xml:"interface"`
+	Serials     []DomainChardev    `xml:"serial"`
+	Consoles    []DomainChardev    `xml:"console"`
+	Channels    []DomainChardev    `xml:"channel"`
+	Inputs      []DomainInput      `xml:"input"`
+	Graphics    []DomainGraphics   `xml:"graphics"`
+	Videos      []DomainVideo      `xml:"video"`
+	TPMs        []DomainTPM        `xml:"tpm"`
+	Watchdogs   []DomainWatchdog   `xml:"watchdog"`
+	MemBalloon  *DomainMemBalloon  `xml:"memballoon"`
+	Extra       []RawElement       `xml:",any"`
+}
+
+type DomainDisk struct {
+	XMLName    xml.Name        `xml:"disk"`
+	Type       string          `xml:"type,attr"`
+	Device     string          `xml:"device,attr,omitempty"`
+	Attrs      []xml.Attr      `xml:",any,attr"`
+	Driver     *DiskDriver     `xml:"driver"`
+	Source     *DiskSource     `xml:"source"`
+	Target     *DiskTarget     `xml:"target"`
+	IOTune     *DiskIOTune     `xml:"iotune"`
+	Encryption *DiskEncryption `xml:"encryption"`
+	ReadOnly   *struct{}       `xml:"readonly"`
+	Serial     string          `xml:"serial,omitempty"`
+	Boot       *DeviceBoot     `xml:"boot"`
+	Extra      []RawElement    `xml:",any"`
+}
+
+// DiskIOTune throttles a disk. Zero values are left out and mean no limit.
+type DiskIOTune struct {
+	ReadBytesSec  uint64       `xml:"read_bytes_sec,omitempty"`
+	WriteBytesSec uint64       `xml:"write_bytes_sec,omitempty"`
+	ReadIOPSSec   uint64       `xml:"read_iops_sec,omitempty"`
+	WriteIOPSSec  uint64       `xml:"write_iops_sec,omitempty"`
+	Extra         []RawElement `xml:",any"`
+}
+
+// DiskEncryption opens an encrypted image with the passphrase held by a
+// libvirt secret.
+type DiskEncryption struct {
+	Format string       `xml:"format,attr"`
+	Secret *DiskSecret  `xml:"secret"`
+	Extra  []RawElement `xml:",any"`
+}
+
+type DiskSecret struct {
+	Type string `xml:"type,attr"`
+	UUID string `xml:"uuid,attr"`
+}
+
+// DiskEncryptionFor opens a LUKS encrypted qcow2 image with the passphrase
+// secret secretUUID. It returns nil for plain images without a secret.
+func DiskEncryptionFor(secretUUID string) *DiskEncryption {
+	if secretUUID == "" {
+		return nil
+	}
+	return &DiskEncryption{Format: "luks", Secret: &DiskSecret{Type: "passphrase", UUID: secretUUID}}
+}
+
+type DiskDriver struct {
+	Name    string     `xml:"name,attr,omitempty"`
+	Type    string     `xml:"type,attr,omitempty"`
+	Cache   string     `xml:"cache,attr,omitempty"`
+	Discard string     `xml:"discard,attr,omitempty"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type DiskSource struct {
+	File  string       `xml:"file,attr,omitempty"`
+	Dev   string       `xml:"dev,attr,omitempty"`
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Extra []RawElement `xml:",any"`
+}
+
+type DiskTarget struct {
+	Dev   string     `xml:"dev,attr"`
+	Bus   string     `xml:"bus,attr,omitempty"`
+	Tray  string     `xml:"tray,attr,omitempty"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type DeviceBoot struct {
+	Order int        `xml:"order,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type DomainController struct {
+	Type  string       `xml:"type,attr"`
+	Index string       `xml:"index,attr,omitempty"`
+	Model string       `xml:"model,attr,omitempty"`
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Extra []RawElement `xml:",any"`
+}
+
+type DomainInterface struct {
+	XMLName   xml.Name            `xml:"interface"`
+	Type      string              `xml:"type,attr"`
+	Attrs     []xml.Attr          `xml:",any,attr"`
+	MAC       *InterfaceMAC       `xml:"mac"`
+	Source    *InterfaceSource    `xml:"source"`
+	Target    *InterfaceTarget    `xml:"target"`
+	Model     *InterfaceModel     `xml:"model"`
+	Bandwidth *InterfaceBandwidth `xml:"bandwidth"`
+	Link      *InterfaceLink      `xml:"link"`
+	Extra     []RawElement        `xml:",any"`
+}
+
+// InterfaceBandwidth shapes the traffic of a NIC as seen from the guest.
+// Rates are in kilobytes per second.
+type InterfaceBandwidth struct {
+	Inbound  *BandwidthLimit `xml:"inbound"`
+	Outbound *BandwidthLimit `xml:"outbound"`
+}
+
+type BandwidthLimit struct {
+	Average uint64     `xml:"average,attr"`
+	Peak    uint64     `xml:"peak,attr,omitempty"`
+	Burst   uint64     `xml:"burst,attr,omitempty"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type InterfaceMAC struct {
+	Address string     `xml:"address,attr"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type InterfaceSource struct {
+	Network string     `xml:"network,attr,omitempty"`
+	Bridge  string     `xml:"bridge,attr,omitempty"`
+	Dev     string     `xml:"dev,attr,omitempty"`
+	Mode    string     `xml:"mode,attr,omitempty"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type InterfaceTarget struct {
+	Dev   string     `xml:"dev,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type InterfaceModel struct {
+	Type  string     `xml:"type,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type InterfaceLink struct {
+	State string     `xml:"state,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+// DomainChardev is a serial port, console or channel.
+type DomainChardev struct {
+	Type   string         `xml:"type,attr"`
+	Attrs  []xml.Attr     `xml:",any,attr"`
+	Log    *ChardevLog    `xml:"log"`
+	Target *ChardevTarget `xml:"target"`
+	Extra  []RawElement   `xml:",any"`
+}
+
+type ChardevLog struct {
+	File   string `xml:"file,attr"`
+	Append string `xml:"append,attr,omitempty"`
+}
+
+type ChardevTarget struct {
+	Type  string       `xml:"type,attr,omitempty"`
+	Name  string       `xml:"name,attr,omitempty"`
+	Port  string       `xml:"port,attr,omitempty"`
+	State string       `xml:"state,attr,omitempty"`
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Extra []RawElement `xml:",any"`
+}
+
+type DomainInput struct {
+	Type  string       `xml:"type,attr"`
+	Bus   string       `xml:"bus,attr,omitempty"`
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Extra []RawElement `xml:",any"`
+}
+
+type DomainGraphics struct {
+	Type     string           `xml:"type,attr"`
+	Port     int              `xml:"port,attr,omitempty"`
+	AutoPort string           `xml:"autoport,attr,omitempty"`
+	Listen   string           `xml:"listen,attr,omitempty"`
+	Passwd   string           `xml:"passwd,attr,omitempty"`
+	Attrs    []xml.Attr       `xml:",any,attr"`
+	Listens  []GraphicsListen `xml:"listen"`
+	Extra    []RawElement     `xml:",any"`
+}
+
+type GraphicsListen struct {
+	Type    string     `xml:"type,attr"`
+	Address string     `xml:"address,attr,omitempty"`
+	Network string     `xml:"network,attr,omitempty"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+type DomainVideo struct {
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Model *VideoModel  `xml:"model"`
+	Extra []RawElement `xml:",any"`
+}
+
+// DomainTPM is a TPM device, emulated by swtpm for the emulator backend.
+type DomainTPM struct {
+	Model   string       `xml:"model,attr,omitempty"`
+	Backend *TPMBackend  `xml:"backend"`
+	Extra   []RawElement `xml:",any"`
+}
+
+type TPMBackend struct {
+	Type    string       `xml:"type,attr"`
+	Version string       `xml:"version,attr,omitempty"`
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Extra   []RawElement `xml:",any"`
+}
+
+type DomainFilesystem struct {
+	Type       string            `xml:"type,attr,omitempty"`
+	AccessMode string            `xml:"accessmode,attr,omitempty"`
+	Attrs      []xml.Attr        `xml:",any,attr"`
+	Driver     *FilesystemDriver `xml:"driver"`
+	Source     *FilesystemSource `xml:"source"`
+	Target     *FilesystemTarget `xml:"target"`
+	ReadOnly   *struct{}         `xml:"readonly"`
+	Extra      []RawElement      `xml:",any"`
+}
+
+type FilesystemDriver struct {
+	Type  string     `xml:"type,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type FilesystemSource struct {
+	Dir   string     `xml:"dir,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+type FilesystemTarget struct {
+	Dir string `xml:"dir,attr"`
+}
+
+type DomainWatchdog struct {
+	Model  string       `xml:"model,attr"`
+	Action string       `xml:"action,attr,omitempty"`
+	Attrs  []xml.Attr   `xml:",any,attr"`
+	Extra  []RawElement `xml:",any"`
+}
+
+// DomainMemBalloon is the balloon device. With a stats period the guest
+// driver reports its memory use that often, in seconds.
+type DomainMemBalloon struct {
+	Model       string           `xml:"model,attr"`
+	AutoDeflate string           `xml:"autodeflate,attr,omitempty"`
+	Attrs       []xml.Attr       `xml:",any,attr"`
+	Stats       *MemBalloonStats `xml:"stats"`
+	Extra       []RawElement     `xml:",any"`
+}
+
+// MemBalloonStatsPeriod is how often the guest balloon driver reports its
+// memory use, in seconds. Stats are collected every 30 seconds.
+const MemBalloonStatsPeriod = 10
+
+type MemBalloonStats struct {
+	Period int `xml:"period,attr"`
+}
+
+type VideoModel struct {
+	Type  string       `xml:"type,attr"`
+	RAM   int          `xml:"ram,attr,omitempty"`
+	VRAM  int          `xml:"vram,attr,omitempty"`
+	Heads int          `xml:"heads,attr,omitempty"`
+	Attrs []xml.Attr   `xml:",any,attr"`
+	Extra []RawElement `xml:",any"`
+}
+
+// ParseDomainXML decodes a domain definition as returned by libvirt.
+func ParseDomainXML(xmlDesc string) (*DomainDef, error) {
+	var def DomainDef
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	def.keepNamespacePrefixes()
+	return &def, nil
+}
+
+// keepNamespacePrefixes turns namespace declarations on the root element,
+// such as xmlns:qemu, and the elements using them back into their prefixed
+// names. encoding/xml resolves prefixes to URLs on decode and cannot
+// re-emit them.
+func (d *DomainDef) keepNamespacePrefixes() {
+	prefixes := map[string]string{}
+	for i, attr := range d.Attrs {
+		if attr.Name.Space == "xmlns" {
+			prefixes[attr.Value] = attr.Name.Local
+			d.Attrs[i].Name = xml.Name{Local: "xmlns:" + attr.Name.Local}
+		}
+	}
+	for i, el := range d.Extra {
+		if prefix, ok := prefixes[el.XMLName.Space]; ok {
+			d.Extra[i].XMLName = xml.Name{Local: prefix + ":" + el.XMLName.Local}
+		}
+		for j, attr := range el.Attrs {
+			if prefix, ok := prefixes[attr.Name.Space]; ok {
+				d.Extra[i].Attrs[j].Name = xml.Name{Local: prefix + ":" + attr.Name.Local}
+			}
+		}
+	}
+}
+
+func marshalXML(v interface{}) (string, error) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// encoding/xml never writes self-closing tags; use them for elements
+	// without content to keep the output close to what libvirt produces.
+	return emptyElementRegex.ReplaceAllStringFunc(string(out), func(el string) string {
+		m := emptyElementRegex.FindStringSubmatch(el)
+		if m[1] != m[3] {
+			return el
+		}
+		return "<" + m[1] + m[2] + "/>"
+	}), nil
+}
+
+// Marshal encodes the definition for DefineXML.
+func (d *DomainDef) Marshal() (string, error) {
+	out, err := marshalXML(d)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal domain XML: %w", err)
+	}
+	return out, nil
+}
+
+// MarshalDevice encodes a single device, such as a DomainDisk or
+// DomainInterface, for the attach, detach and update device calls.
+func MarshalDevice(device interface{}) (string, error) {
+	out, err := marshalXML(device)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal device XML: %w", err)
+	}
+	return out, nil
+}
+
+// KiB converts a memory element to KiB.
+func (m *DomainMemory) KiB() uint64 {
+	if m == nil {
+		return 0
+	}
+	switch strings.ToLower(m.Unit) {
+	case "b", "bytes":
+		return m.Value / 1024
+	case "", "k", "kib":
+		return m.Value
+	case "kb":
+		return m.Value * 1000 / 1024
+	case "m", "mib":
+		return m.Value * 1024
+	case "mb":
+		return m.Value * 1000 * 1000 / 1024
+	case "g", "gib":
+		return m.Value * 1024 * 1024
+	case "gb":
+		return m.Value * 1000 * 1000 * 1000 / 1024
+	case "t", "tib":
+		return m.Value * 1024 * 1024 * 1024
+	}
+	return m.Value
+}
+
+func (d *DomainDef) devices() *DomainDevices {
+	if d.Devices == nil {
+		d.Devices = &DomainDevices{}
+	}
+	return d.Devices
+}
+
+// DisksByDevice returns pointers to the disks of the given device kind
+// ("disk", "cdrom" or "floppy").
+func (d *DomainDef) DisksByDevice(device string) []*DomainDisk {
+	var disks []*DomainDisk
+	if d.Devices == nil {
+		return disks
+	}
+	for i := range d.Devices.Disks {
+		if d.Devices.Disks[i].Device == device {
+			disks = append(disks, &d.Devices.Disks[i])
+		}
+	}
+	return disks
+}
+
+// FindDisk returns the disk with the given target name.
+func (d *DomainDef) FindDisk(target string) *DomainDisk {
+	if d.Devices == nil {
+		return nil
+	}
+	for i := range d.Devices.Disks {
+		if t := d.Devices.Disks[i].Target; t != nil && t.Dev == target {
+			return &d.Devices.Disks[i]
+		}
+	}
+	return nil
+}
+
+// FindGraphics returns the first graphics device of the given type ("vnc" or
+// "spice").
+func (d *DomainDef) FindGraphics(graphicsType string) *DomainGraphics {
+	if d.Devices == nil {
+		return nil
+	}
+	for i := range d.Devices.Graphics {
+		if d.Devices.Graphics[i].Type == graphicsType {
+			return &d.Devices.Graphics[i]
+		}
+	}
+	return nil
+}
+
+// SourcePath returns the file or block device path of the disk.
+func (d *DomainDisk) SourcePath() string {
+	if d.Source == nil {
+		return ""
+	}
+	if d.Source.File != "" {
+		return d.Source.File
+	}
+	return d.Source.Dev
+}
+
+// DomainSnapshotDef is the libvirt domain snapshot XML.
+type DomainSnapshotDef struct {
+	XMLName      xml.Name     `xml:"domainsnapshot"`
+	Name         string       `xml:"name,omitempty"`
+	Description  string       `xml:"description,omitempty"`
+	State        string       `xml:"state,omitempty"`
+	CreationTime string       `xml:"creationTime,omitempty"`
+	Extra        []RawElement `xml:",any"`
+}
+
+// SecretDef is the libvirt secret XML.
+type SecretDef struct {
+	XMLName     xml.Name     `xml:"secret"`
+	Ephemeral   string       `xml:"ephemeral,attr,omitempty"`
+	Private     string       `xml:"private,attr,omitempty"`
+	UUID        string       `xml:"uuid,omitempty"`
+	Description string       `xml:"description,omitempty"`
+	Usage       *SecretUsage `xml:"usage"`
+}
+
+type SecretUsage struct {
+	Type   string `xml:"type,attr"`
+	Volume string `xml:"volume,omitempty"`
+}
+
+// ParseSnapshotXML decodes a domain snapshot definition.
+func ParseSnapshotXML(xmlDesc string) (*DomainSnapshotDef, error) {
+	var def DomainSnapshotDef
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot XML: %w", err)
+	}
+	return &def, nil
+}
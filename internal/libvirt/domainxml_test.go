@@ -0,0 +1,114 @@
+package libvirt_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"vmmanager/internal/libvirt"
+)
+
+func loadDomain(t *testing.T) (*libvirt.DomainDef, string) {
+	data, err := os.ReadFile("testdata/domain_dumpxml.xml")
+	if err != nil {
+		t.Fatalf("failed to read test domain: %v", err)
+	}
+	def, err := libvirt.ParseDomainXML(string(data))
+	if err != nil {
+		t.Fatalf("ParseDomainXML failed: %v", err)
+	}
+	return def, string(data)
+}
+
+func TestParseDomainXMLTypedFields(t *testing.T) {
+	def, _ := loadDomain(t)
+
+	if def.Name != "web1" || def.VCPU.Value != 4 || def.VCPU.Current != 2 {
+		t.Errorf("unexpected identity or vcpus: %s %+v", def.Name, def.VCPU)
+	}
+	if def.Memory.KiB() != 4194304 || def.CurrentMemory.KiB() != 2097152 {
+		t.Errorf("unexpected memory: %d / %d", def.CurrentMemory.KiB(), def.Memory.KiB())
+	}
+	if disk := def.FindDisk("vdb"); disk == nil || disk.SourcePath() != "/dev/vg0/web1-data" {
+		t.Errorf("block data disk not found: %+v", disk)
+	}
+	if cdroms := def.DisksByDevice("cdrom"); len(cdroms) != 1 || cdroms[0].SourcePath() != "/var/lib/vmmanager/isos/alma-9.iso" {
+		t.Errorf("unexpected CD-ROMs: %+v", cdroms)
+	}
+	if g := def.FindGraphics("spice"); g == nil || g.Port != 5901 || g.Passwd != "s3cret" {
+		t.Errorf("unexpected SPICE graphics: %+v", g)
+	}
+	if def.FindGraphics("vnc") != nil {
+		t.Errorf("found VNC graphics in a SPICE-only domain")
+	}
+	if !libvirt.CDROMEjected(mustMarshal(t, def)) {
+		t.Errorf("CDROMEjected = false for an open tray")
+	}
+}
+
+func TestDomainXMLRoundTripKeepsUnknownElements(t *testing.T) {
+	def, _ := loadDomain(t)
+	out := mustMarshal(t, def)
+
+	for _, want := range []string{
+		`xmlns:qemu="http://libvirt.org/schemas/domain/qemu/1.0"`,
+		`<qemu:commandline>`,
+		`<qemu:arg value='-no-hpet'/>`,
+		`<vmm:owner>alice</vmm:owner>`,
+		`<bootmenu enable="no"/>`,
+		`<vmport state="off"/>`,
+		`<topology sockets="1" dies="1" cores="4" threads="1"/>`,
+		`<source file="/var/lib/vmmanager/web1.qcow2" index="2"/>`,
+		`<backingStore/>`,
+		`<alias name="virtio-disk0"/>`,
+		`portid="0e9a5b1c-7d2f-4a3e-8b6c-1f0e9d8c7b6a"`,
+		`<console type="pty" tty="/dev/pts/4">`,
+		`<model type="qxl" ram="65536" vram="65536" heads="1" vgamem="16384" primary="yes"/>`,
+		`<backend model='random'>/dev/urandom</backend>`,
+		`<label>+107:+107</label>`,
+		`<apic eoi="on"/>`,
+		`<tseg unit="MiB">48</tseg>`,
+		`<mac address="52:54:00:12:34:56" type="static"/>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("marshalled domain lost %s", want)
+		}
+	}
+
+	again, err := libvirt.ParseDomainXML(out)
+	if err != nil {
+		t.Fatalf("re-parsing marshalled domain failed: %v", err)
+	}
+	if second := mustMarshal(t, again); second != out {
+		t.Errorf("second round trip is not stable:\n%s", second)
+	}
+}
+
+func TestMarshalDevice(t *testing.T) {
+	out, err := libvirt.MarshalDevice(libvirt.DomainInterface{
+		Type:   "bridge",
+		MAC:    &libvirt.InterfaceMAC{Address: "52:54:00:ab:cd:ef"},
+		Source: &libvirt.InterfaceSource{Bridge: "br0"},
+		Model:  &libvirt.InterfaceModel{Type: "virtio"},
+	})
+	if err != nil {
+		t.Fatalf("MarshalDevice failed: %v", err)
+	}
+	want := `<interface type="bridge">
+  <mac address="52:54:00:ab:cd:ef"/>
+  <source bridge="br0"/>
+  <model type="virtio"/>
+</interface>`
+	if out != want {
+		t.Errorf("MarshalDevice =\n%s\nwant\n%s", out, want)
+	}
+}
+
+func mustMarshal(t *testing.T, def *libvirt.DomainDef) string {
+	t.Helper()
+	out, err := def.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	return out
+}
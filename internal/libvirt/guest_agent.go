@@ -0,0 +1,252 @@
+package libvirt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// GuestAgentChannelName is the virtio-serial port qemu-guest-agent listens on.
+const GuestAgentChannelName = "org.qemu.guest_agent.0"
+
+const defaultGuestAgentTimeout = 5
+
+type GuestOSInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+}
+
+type GuestIPAddress struct {
+	Type    string `json:"ip-address-type"`
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+type GuestInterface struct {
+	Name            string           `json:"name"`
+	HardwareAddress string           `json:"hardware-address"`
+	IPAddresses     []GuestIPAddress `json:"ip-addresses"`
+}
+
+type GuestFilesystem struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	UsedBytes  uint64 `json:"used-bytes"`
+	TotalBytes uint64 `json:"total-bytes"`
+}
+
+type GuestUser struct {
+	User      string  `json:"user"`
+	Domain    string  `json:"domain,omitempty"`
+	LoginTime float64 `json:"login-time"`
+}
+
+type GuestExecResult struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal,omitempty"`
+	Stdout       string `json:"stdout"`
+	Stderr       string `json:"stderr"`
+	OutTruncated bool   `json:"out_truncated"`
+	ErrTruncated bool   `json:"err_truncated"`
+}
+
+type guestAgentRequest struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// GuestAgentCommand runs a raw qemu-guest-agent command and decodes its
+// "return" member into result (which may be nil).
+func (c *Client) GuestAgentCommand(domainUUID string, command string, args interface{}, timeoutSec int, result interface{}) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	payload, err := json.Marshal(guestAgentRequest{Execute: command, Arguments: args})
+	if err != nil {
+		return fmt.Errorf("failed to encode guest agent command: %w", err)
+	}
+
+	if timeoutSec <= 0 {
+		timeoutSec = defaultGuestAgentTimeout
+	}
+
+	output, err := domain.QemuAgentCommand(string(payload), libvirt.DomainQemuAgentCommandTimeout(timeoutSec), 0)
+	if err != nil {
+		return fmt.Errorf("guest agent command %s failed: %w", command, err)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return decodeGuestAgentReply(command, output, result)
+}
+
+// decodeGuestAgentReply decodes the "return" member of the reply of the
+// guest agent to command into result.
+func decodeGuestAgentReply(command, output string, result interface{}) error {
+	var resp struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(output), &resp); err != nil {
+		return fmt.Errorf("failed to parse guest agent response: %w", err)
+	}
+	if err := json.Unmarshal(resp.Return, result); err != nil {
+		return fmt.Errorf("failed to parse guest agent %s result: %w", command, err)
+	}
+	return nil
+}
+
+// guestExecStatus is the reply to guest-exec-status, with the output
+// base64 encoded.
+type guestExecStatus struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal"`
+	OutData      string `json:"out-data"`
+	ErrData      string `json:"err-data"`
+	OutTruncated bool   `json:"out-truncated"`
+	ErrTruncated bool   `json:"err-truncated"`
+}
+
+func (s *guestExecStatus) result() (*GuestExecResult, error) {
+	stdout, err := base64.StdEncoding.DecodeString(s.OutData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode guest command output: %w", err)
+	}
+	stderr, err := base64.StdEncoding.DecodeString(s.ErrData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode guest command error output: %w", err)
+	}
+	return &GuestExecResult{
+		Exited:       s.Exited,
+		ExitCode:     s.ExitCode,
+		Signal:       s.Signal,
+		Stdout:       string(stdout),
+		Stderr:       string(stderr),
+		OutTruncated: s.OutTruncated,
+		ErrTruncated: s.ErrTruncated,
+	}, nil
+}
+
+func (c *Client) GuestPing(domainUUID string) error {
+	return c.GuestAgentCommand(domainUUID, "guest-ping", nil, 2, nil)
+}
+
+func (c *Client) GuestGetOSInfo(domainUUID string) (*GuestOSInfo, error) {
+	var info GuestOSInfo
+	if err := c.GuestAgentCommand(domainUUID, "guest-get-osinfo", nil, 0, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) GuestGetHostname(domainUUID string) (string, error) {
+	var result struct {
+		HostName string `json:"host-name"`
+	}
+	if err := c.GuestAgentCommand(domainUUID, "guest-get-host-name", nil, 0, &result); err != nil {
+		return "", err
+	}
+	return result.HostName, nil
+}
+
+func (c *Client) GuestGetInterfaces(domainUUID string) ([]GuestInterface, error) {
+	var ifaces []GuestInterface
+	if err := c.GuestAgentCommand(domainUUID, "guest-network-get-interfaces", nil, 0, &ifaces); err != nil {
+		return nil, err
+	}
+	return ifaces, nil
+}
+
+func (c *Client) GuestGetFilesystems(domainUUID string) ([]GuestFilesystem, error) {
+	var fs []GuestFilesystem
+	if err := c.GuestAgentCommand(domainUUID, "guest-get-fsinfo", nil, 0, &fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (c *Client) GuestGetUsers(domainUUID string) ([]GuestUser, error) {
+	var users []GuestUser
+	if err := c.GuestAgentCommand(domainUUID, "guest-get-users", nil, 0, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GuestExec starts a process in the guest and polls guest-exec-status until it
+// exits or the timeout elapses.
+func (c *Client) GuestExec(domainUUID string, path string, args []string, input []byte, timeout time.Duration) (*GuestExecResult, error) {
+	execArgs := map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}
+	if len(input) > 0 {
+		execArgs["input-data"] = base64.StdEncoding.EncodeToString(input)
+	}
+
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := c.GuestAgentCommand(domainUUID, "guest-exec", execArgs, 0, &started); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status guestExecStatus
+		if err := c.GuestAgentCommand(domainUUID, "guest-exec-status", map[string]int{"pid": started.PID}, 0, &status); err != nil {
+			return nil, err
+		}
+
+		if status.Exited {
+			return status.result()
+		}
+
+		if time.Now().After(deadline) {
+			return &GuestExecResult{Exited: false}, fmt.Errorf("guest command (pid %d) did not finish within %s", started.PID, timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// GuestAddAuthorizedKeys appends keys to user's authorized_keys through the
+// guest agent. Keys already present in the guest are left untouched.
+func (c *Client) GuestAddAuthorizedKeys(domainUUID, user string, keys []string) error {
+	if c.conn == nil {
+		return fmt.Errorf("libvirt connection is nil")
+	}
+
+	domain, err := c.conn.LookupDomainByUUIDString(domainUUID)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+	defer domain.Free()
+
+	if err := domain.AuthorizedSSHKeysSet(user, keys, libvirt.DomainAuthorizedSSHKeysFlags(libvirt.DOMAIN_AUTHORIZED_SSH_KEYS_SET_APPEND)); err != nil {
+		return fmt.Errorf("failed to set authorized keys for %s: %w", user, err)
+	}
+
+	log.Printf("[LIBVIRT] Added %d authorized key(s) for %s on domain %s", len(keys), user, domainUUID)
+	return nil
+}
@@ -0,0 +1,128 @@
+package libvirt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeGuestAgentReply(t *testing.T) {
+	t.Run("osinfo", func(t *testing.T) {
+		output := `{"return":{"name":"Ubuntu","kernel-release":"6.8.0-45-generic","version":"24.04.1 LTS (Noble Numbat)","pretty-name":"Ubuntu 24.04.1 LTS","version-id":"24.04","kernel-version":"#45-Ubuntu SMP PREEMPT_DYNAMIC","machine":"x86_64","id":"ubuntu"}}`
+		var info GuestOSInfo
+		if err := decodeGuestAgentReply("guest-get-osinfo", output, &info); err != nil {
+			t.Fatal(err)
+		}
+		want := GuestOSInfo{
+			ID:            "ubuntu",
+			Name:          "Ubuntu",
+			PrettyName:    "Ubuntu 24.04.1 LTS",
+			Version:       "24.04.1 LTS (Noble Numbat)",
+			VersionID:     "24.04",
+			KernelRelease: "6.8.0-45-generic",
+			KernelVersion: "#45-Ubuntu SMP PREEMPT_DYNAMIC",
+			Machine:       "x86_64",
+		}
+		if info != want {
+			t.Errorf("osinfo = %+v, want %+v", info, want)
+		}
+	})
+
+	t.Run("host name", func(t *testing.T) {
+		var result struct {
+			HostName string `json:"host-name"`
+		}
+		if err := decodeGuestAgentReply("guest-get-host-name", `{"return":{"host-name":"web-01"}}`, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.HostName != "web-01" {
+			t.Errorf("host name = %q", result.HostName)
+		}
+	})
+
+	t.Run("interfaces", func(t *testing.T) {
+		output := `{"return":[` +
+			`{"name":"lo","ip-addresses":[{"ip-address-type":"ipv4","ip-address":"127.0.0.1","prefix":8}],"hardware-address":"00:00:00:00:00:00","statistics":{"rx-bytes":1024}},` +
+			`{"name":"enp1s0","ip-addresses":[{"ip-address-type":"ipv4","ip-address":"192.168.122.10","prefix":24},{"ip-address-type":"ipv6","ip-address":"fe80::5054:ff:fe12:3456","prefix":64}],"hardware-address":"52:54:00:12:34:56"},` +
+			`{"name":"enp2s0","hardware-address":"52:54:00:ab:cd:ef"}]}`
+		var ifaces []GuestInterface
+		if err := decodeGuestAgentReply("guest-network-get-interfaces", output, &ifaces); err != nil {
+			t.Fatal(err)
+		}
+		want := []GuestInterface{
+			{Name: "lo", HardwareAddress: "00:00:00:00:00:00", IPAddresses: []GuestIPAddress{{Type: "ipv4", Address: "127.0.0.1", Prefix: 8}}},
+			{Name: "enp1s0", HardwareAddress: "52:54:00:12:34:56", IPAddresses: []GuestIPAddress{
+				{Type: "ipv4", Address: "192.168.122.10", Prefix: 24},
+				{Type: "ipv6", Address: "fe80::5054:ff:fe12:3456", Prefix: 64},
+			}},
+			{Name: "enp2s0", HardwareAddress: "52:54:00:ab:cd:ef"},
+		}
+		if !reflect.DeepEqual(ifaces, want) {
+			t.Errorf("interfaces = %+v, want %+v", ifaces, want)
+		}
+	})
+
+	t.Run("filesystems", func(t *testing.T) {
+		output := `{"return":[{"name":"vda1","total-bytes":20957446144,"mountpoint":"/","disk":[{"bus-type":"virtio","bus":0,"unit":0,"target":0}],"used-bytes":4211335168,"type":"ext4"},{"name":"vda15","mountpoint":"/boot/efi","disk":[],"type":"vfat"}]}`
+		var fs []GuestFilesystem
+		if err := decodeGuestAgentReply("guest-get-fsinfo", output, &fs); err != nil {
+			t.Fatal(err)
+		}
+		want := []GuestFilesystem{
+			{Name: "vda1", Mountpoint: "/", Type: "ext4", UsedBytes: 4211335168, TotalBytes: 20957446144},
+			{Name: "vda15", Mountpoint: "/boot/efi", Type: "vfat"},
+		}
+		if !reflect.DeepEqual(fs, want) {
+			t.Errorf("filesystems = %+v, want %+v", fs, want)
+		}
+	})
+
+	t.Run("users", func(t *testing.T) {
+		output := `{"return":[{"user":"ubuntu","login-time":1760784000.123456},{"user":"Administrator","domain":"WORKGROUP","login-time":1760787600.5}]}`
+		var users []GuestUser
+		if err := decodeGuestAgentReply("guest-get-users", output, &users); err != nil {
+			t.Fatal(err)
+		}
+		want := []GuestUser{
+			{User: "ubuntu", LoginTime: 1760784000.123456},
+			{User: "Administrator", Domain: "WORKGROUP", LoginTime: 1760787600.5},
+		}
+		if !reflect.DeepEqual(users, want) {
+			t.Errorf("users = %+v, want %+v", users, want)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		var info GuestOSInfo
+		if err := decodeGuestAgentReply("guest-get-osinfo", `{"return":`, &info); err == nil {
+			t.Error("truncated reply decoded")
+		}
+		var ifaces []GuestInterface
+		if err := decodeGuestAgentReply("guest-network-get-interfaces", `{"return":{"name":"lo"}}`, &ifaces); err == nil {
+			t.Error("object decoded into a list of interfaces")
+		}
+		if err := decodeGuestAgentReply("guest-get-osinfo", `{}`, &info); err == nil {
+			t.Error("reply without a return member decoded")
+		}
+	})
+}
+
+func TestGuestExecStatusResult(t *testing.T) {
+	var status guestExecStatus
+	output := `{"return":{"exitcode":1,"out-data":"aW5zdGFsbGVkCg==","err-data":"d2FybmluZwo=","exited":true,"err-truncated":true}}`
+	if err := decodeGuestAgentReply("guest-exec-status", output, &status); err != nil {
+		t.Fatal(err)
+	}
+	got, err := status.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &GuestExecResult{Exited: true, ExitCode: 1, Stdout: "installed\n", Stderr: "warning\n", ErrTruncated: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result = %+v, want %+v", got, want)
+	}
+
+	status.OutData = "not base64!"
+	if _, err := status.result(); err == nil {
+		t.Error("invalid output decoded")
+	}
+}
@@ -0,0 +1,41 @@
+package libvirt
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// SerialLogDir is where the first serial port of every managed domain is
+// mirrored, so installer output can be searched after the fact.
+const SerialLogDir = "/var/log/libvirt/qemu"
+
+// SerialLogPath returns the serial console log file of the VM with vmID.
+func SerialLogPath(vmID string) string {
+	return filepath.Join(SerialLogDir, vmID+"-serial.log")
+}
+
+// BlockStats returns the I/O counters of disk, given as its target name
+// (for example "vda").
+func (d *Domain) BlockStats(disk string) (int64, int64, error) {
+	stats, err := d.domain.BlockStats(disk)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get block stats for %s: %w", disk, err)
+	}
+	return stats.RdBytes, stats.WrBytes, nil
+}
+
+// CDROMEjected reports whether the guest has opened the tray of any CD-ROM
+// in the live domain XML, which installers do when they are finished with
+// the install media.
+func CDROMEjected(xmlDesc string) bool {
+	def, err := ParseDomainXML(xmlDesc)
+	if err != nil {
+		return false
+	}
+	for _, cdrom := range def.DisksByDevice("cdrom") {
+		if cdrom.Target != nil && cdrom.Target.Tray == "open" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package libvirt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// MaxSendKeys is the number of keycodes libvirt accepts in a single send-key call.
+const MaxSendKeys = 16
+
+// linuxKeyCodes maps key names to Linux input event codes (KEY_* in
+// linux/input-event-codes.h), which is the codeset used for named keys.
+var linuxKeyCodes = map[string]uint{
+	"esc": 1, "escape": 1,
+	"1": 2, "2": 3, "3": 4, "4": 5, "5": 6, "6": 7, "7": 8, "8": 9, "9": 10, "0": 11,
+	"minus": 12, "equal": 13, "backspace": 14, "tab": 15,
+	"q": 16, "w": 17, "e": 18, "r": 19, "t": 20, "y": 21, "u": 22, "i": 23, "o": 24, "p": 25,
+	"leftbrace": 26, "rightbrace": 27, "enter": 28, "return": 28,
+	"ctrl": 29, "leftctrl": 29,
+	"a": 30, "s": 31, "d": 32, "f": 33, "g": 34, "h": 35, "j": 36, "k": 37, "l": 38,
+	"semicolon": 39, "apostrophe": 40, "grave": 41,
+	"shift": 42, "leftshift": 42, "backslash": 43,
+	"z": 44, "x": 45, "c": 46, "v": 47, "b": 48, "n": 49, "m": 50,
+	"comma": 51, "dot": 52, "slash": 53, "rightshift": 54, "kpasterisk": 55,
+	"alt": 56, "leftalt": 56, "space": 57, "capslock": 58,
+	"f1": 59, "f2": 60, "f3": 61, "f4": 62, "f5": 63, "f6": 64, "f7": 65, "f8": 66, "f9": 67, "f10": 68,
+	"numlock": 69, "scrolllock": 70, "f11": 87, "f12": 88,
+	"rightctrl": 97, "sysrq": 99, "printscreen": 99, "rightalt": 100, "altgr": 100,
+	"home": 102, "up": 103, "pageup": 104, "left": 105, "right": 106,
+	"end": 107, "down": 108, "pagedown": 109, "insert": 110, "delete": 111, "del": 111,
+	"power": 116, "pause": 119,
+	"meta": 125, "leftmeta": 125, "super": 125, "win": 125, "rightmeta": 126, "menu": 127,
+}
+
+var keycodeSets = map[string]uint{
+	"linux":  uint(libvirt.KEYCODE_SET_LINUX),
+	"xt":     uint(libvirt.KEYCODE_SET_XT),
+	"atset1": uint(libvirt.KEYCODE_SET_ATSET1),
+	"atset2": uint(libvirt.KEYCODE_SET_ATSET2),
+	"atset3": uint(libvirt.KEYCODE_SET_ATSET3),
+	"os_x":   uint(libvirt.KEYCODE_SET_OSX),
+	"xt_kbd": uint(libvirt.KEYCODE_SET_XT_KBD),
+	"usb":    uint(libvirt.KEYCODE_SET_USB),
+	"win32":  uint(libvirt.KEYCODE_SET_WIN32),
+	"qnum":   uint(libvirt.KEYCODE_SET_QNUM),
+}
+
+// ParseKeyCombo converts a combination such as "ctrl+alt+del" into Linux keycodes.
+func ParseKeyCombo(combo string) ([]uint, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(combo)), "+")
+	keycodes := make([]uint, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			return nil, fmt.Errorf("invalid key combination: %q", combo)
+		}
+		code, ok := linuxKeyCodes[p]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q in combination %q", p, combo)
+		}
+		keycodes = append(keycodes, code)
+	}
+	if len(keycodes) > MaxSendKeys {
+		return nil, fmt.Errorf("too many keys in combination %q (max %d)", combo, MaxSendKeys)
+	}
+	return keycodes, nil
+}
+
+// ParseKeycodeSet resolves a codeset name; an empty name means linux.
+func ParseKeycodeSet(name string) (uint, error) {
+	if name == "" {
+		return uint(libvirt.KEYCODE_SET_LINUX), nil
+	}
+	codeset, ok := keycodeSets[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown keycode set: %s", name)
+	}
+	return codeset, nil
+}
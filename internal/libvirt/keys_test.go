@@ -0,0 +1,63 @@
+package libvirt
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+func TestParseKeyCombo(t *testing.T) {
+	tests := []struct {
+		combo   string
+		want    []uint
+		wantErr bool
+	}{
+		{combo: "ctrl+alt+del", want: []uint{29, 56, 111}},
+		{combo: " Ctrl + Alt + Delete ", want: []uint{29, 56, 111}},
+		{combo: "enter", want: []uint{28}},
+		{combo: "shift+f10", want: []uint{42, 68}},
+		{combo: "altgr+sysrq", want: []uint{100, 99}},
+		{combo: "", wantErr: true},
+		{combo: "ctrl++c", wantErr: true},
+		{combo: "ctrl+", wantErr: true},
+		{combo: "hyper+x", wantErr: true},
+		{combo: "f13", wantErr: true},
+		{combo: strings.Repeat("a+", MaxSendKeys-1) + "a", want: slices.Repeat([]uint{30}, MaxSendKeys)},
+		{combo: strings.Repeat("a+", MaxSendKeys) + "a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.combo, func(t *testing.T) {
+			got, err := ParseKeyCombo(tt.combo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeyCombo(%q) error = %v, wantErr %v", tt.combo, err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("ParseKeyCombo(%q) = %v, want %v", tt.combo, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeycodeSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    uint
+		wantErr bool
+	}{
+		{name: "", want: uint(libvirt.KEYCODE_SET_LINUX)},
+		{name: "linux", want: uint(libvirt.KEYCODE_SET_LINUX)},
+		{name: "QNUM", want: uint(libvirt.KEYCODE_SET_QNUM)},
+		{name: "win32", want: uint(libvirt.KEYCODE_SET_WIN32)},
+		{name: "ebcdic", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseKeycodeSet(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseKeycodeSet(%q) = %d, %v, want %d, wantErr %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -24,6 +24,7 @@ type User struct {
 	QuotaMemory  int              `gorm:"default:8192" json:"quotaMemory"`
 	QuotaDisk    int              `gorm:"default:100" json:"quotaDisk"`
 	QuotaVMCount int              `gorm:"default:5" json:"quotaVmCount"`
+	QoSMax       QoSLimits        `gorm:"embedded;embeddedPrefix:qos_max_" json:"qosMax"`
 	LastLoginAt  *time.Time       `json:"lastLoginAt"`
 	CreatedAt    time.Time        `json:"createdAt"`
 	UpdatedAt    time.Time        `json:"updatedAt"`
@@ -44,6 +45,7 @@ type VMTemplate struct {
 	Description       string     `gorm:"type:text" json:"description"`
 	OSType            string     `gorm:"size:50;not null" json:"osType"`
 	OSVersion         string     `gorm:"size:50" json:"osVersion"`
+	OSProfile         string     `gorm:"size:20" json:"osProfile"`
 	Architecture      string     `gorm:"size:20;default:'arm64'" json:"architecture"`
 	Format            string     `gorm:"size:20;default:'qcow2'" json:"format"`
 	CPUMin            int        `gorm:"default:1" json:"cpuMin"`
@@ -67,47 +69,138 @@ type VMTemplate struct {
 	ISOPath           string     `gorm:"size:500" json:"isoPath"`
 	InstallScript     string     `gorm:"type:text" json:"installScript"`
 	PostInstallScript string     `gorm:"type:text" json:"postInstallScript"`
+	CloudInitUserData string     `gorm:"type:text" json:"cloudInitUserData"`
+	QoS               QoSLimits  `gorm:"embedded;embeddedPrefix:qos_" json:"qos"`
 }
 
 type VirtualMachine struct {
-	ID                uuid.UUID   `gorm:"type:uuid;primaryKey" json:"id"`
-	Name              string      `gorm:"size:100;not null" json:"name"`
-	Description       string      `gorm:"type:text" json:"description"`
-	TemplateID        *uuid.UUID  `gorm:"type:uuid" json:"templateId"`
-	ISOID             *uuid.UUID  `gorm:"type:uuid" json:"isoId"`
-	InstallationMode  string      `gorm:"size:20;default:'template'" json:"installationMode"`
-	OwnerID           uuid.UUID   `gorm:"type:uuid;not null" json:"ownerId"`
-	Status            string      `gorm:"size:20;default:'stopped'" json:"status"`
-	Architecture      string      `gorm:"size:20;default:'x86_64'" json:"architecture"`
-	VNCPort           int         `json:"vncPort"`
-	VNCPassword       string      `gorm:"size:20" json:"-"`
-	SPICEPort         int         `json:"spicePort"`
-	MACAddress        string      `gorm:"size:17;uniqueIndex" json:"macAddress"`
-	IPAddress         string      `json:"ipAddress"`
-	Gateway           string      `json:"gateway"`
-	DNSServers        []string    `gorm:"type:text[]" json:"dnsServers"`
-	CPUAllocated      int         `gorm:"not null" json:"cpuAllocated"`
-	MemoryAllocated   int         `gorm:"not null" json:"memoryAllocated"`
-	DiskAllocated     int         `gorm:"not null" json:"diskAllocated"`
-	DiskPath          string      `gorm:"size:500" json:"diskPath"`
-	LibvirtDomainID   int         `json:"libvirtDomainId"`
-	LibvirtDomainUUID string      `gorm:"size:50" json:"libvirtDomainUuid"`
-	BootOrder         string      `gorm:"size:50;default:'hd,cdrom,network'" json:"bootOrder"`
-	VCPUHotplug       bool        `gorm:"default:false" json:"vcpuHotplug"`
-	MemoryHotplug     bool        `gorm:"default:false" json:"memoryHotplug"`
-	Autostart         bool        `gorm:"default:false" json:"autostart"`
-	Notes             string      `gorm:"type:text" json:"notes"`
-	Tags              []string    `gorm:"type:text[]" json:"tags"`
-	IsInstalled       bool        `gorm:"default:false" json:"isInstalled"`
-	InstallStatus     string      `gorm:"size:50;default:''" json:"installStatus"`
-	InstallProgress   int         `gorm:"default:0" json:"installProgress"`
-	AgentInstalled    bool        `gorm:"default:false" json:"agentInstalled"`
-	Owner             *User       `gorm:"foreignKey:OwnerID" json:"owner"`
-	Template          *VMTemplate `gorm:"foreignKey:TemplateID" json:"template"`
-	ISO               *ISO        `gorm:"foreignKey:ISOID" json:"iso"`
-	CreatedAt         time.Time   `json:"createdAt"`
-	UpdatedAt         time.Time   `json:"updatedAt"`
-	DeletedAt         *time.Time  `gorm:"index" json:"deletedAt"`
+	ID                uuid.UUID       `gorm:"type:uuid;primaryKey" json:"id"`
+	Name              string          `gorm:"size:100;not null" json:"name"`
+	Description       string          `gorm:"type:text" json:"description"`
+	TemplateID        *uuid.UUID      `gorm:"type:uuid" json:"templateId"`
+	FlavorID          *uuid.UUID      `gorm:"type:uuid" json:"flavorId"`
+	ISOID             *uuid.UUID      `gorm:"type:uuid" json:"isoId"`
+	InstallationMode  string          `gorm:"size:20;default:'template'" json:"installationMode"`
+	OwnerID           uuid.UUID       `gorm:"type:uuid;not null" json:"ownerId"`
+	Status            string          `gorm:"size:20;default:'stopped'" json:"status"`
+	Architecture      string          `gorm:"size:20;default:'x86_64'" json:"architecture"`
+	VNCPort           int             `json:"vncPort"`
+	VNCPassword       string          `gorm:"size:20" json:"-"`
+	SPICEPort         int             `json:"spicePort"`
+	MACAddress        string          `gorm:"size:17;uniqueIndex" json:"macAddress"`
+	IPAddress         string          `json:"ipAddress"`
+	Gateway           string          `json:"gateway"`
+	DNSServers        []string        `gorm:"type:text[]" json:"dnsServers"`
+	CPUAllocated      int             `gorm:"not null" json:"cpuAllocated"`
+	MemoryAllocated   int             `gorm:"not null" json:"memoryAllocated"`
+	DiskAllocated     int             `gorm:"not null" json:"diskAllocated"`
+	DiskPath          string          `gorm:"size:500" json:"diskPath"`
+	LibvirtDomainID   int             `json:"libvirtDomainId"`
+	LibvirtDomainUUID string          `gorm:"size:50" json:"libvirtDomainUuid"`
+	BootOrder         string          `gorm:"size:50;default:'hd,cdrom,network'" json:"bootOrder"`
+	VCPUHotplug       bool            `gorm:"default:false" json:"vcpuHotplug"`
+	MemoryHotplug     bool            `gorm:"default:false" json:"memoryHotplug"`
+	Autostart         bool            `gorm:"default:false" json:"autostart"`
+	Notes             string          `gorm:"type:text" json:"notes"`
+	Tags              []string        `gorm:"type:text[]" json:"tags"`
+	IsInstalled       bool            `gorm:"default:false" json:"isInstalled"`
+	InstallStatus     string          `gorm:"size:50;default:''" json:"installStatus"`
+	InstallProgress   int             `gorm:"default:0" json:"installProgress"`
+	AgentInstalled    bool            `gorm:"default:false" json:"agentInstalled"`
+	AgentConnected    bool            `gorm:"default:false" json:"agentConnected"`
+	GuestHostname     string          `gorm:"size:255" json:"guestHostname"`
+	GuestOS           string          `gorm:"size:255" json:"guestOs"`
+	GuestInfo         *string         `gorm:"type:jsonb" json:"guestInfo"`
+	GuestInfoAt       *time.Time      `json:"guestInfoAt"`
+	CloudInitISOPath  string          `gorm:"size:500" json:"cloudInitIsoPath"`
+	UnattendProfile   string          `gorm:"size:20" json:"unattendProfile"`
+	InstallMediaPath  string          `gorm:"size:500" json:"installMediaPath"`
+	InstallKernelPath string          `gorm:"size:500" json:"installKernelPath"`
+	InstallInitrdPath string          `gorm:"size:500" json:"installInitrdPath"`
+	InstallCmdline    string          `gorm:"type:text" json:"installCmdline"`
+	MachineType       string          `gorm:"size:50" json:"machineType"`
+	Firmware          string          `gorm:"size:20;default:'uefi'" json:"firmware"`
+	LoaderPath        string          `gorm:"size:255" json:"loaderPath"`
+	NVRAMTemplate     string          `gorm:"size:255" json:"nvramTemplate"`
+	DomainType        string          `gorm:"size:10" json:"domainType"`
+	CPUMode           string          `gorm:"size:20" json:"cpuMode"`
+	CPUModel          string          `gorm:"size:64" json:"cpuModel"`
+	TPM               bool            `gorm:"default:false" json:"tpm"`
+	OSProfile         string          `gorm:"size:20" json:"osProfile"`
+	DiskBus           string          `gorm:"size:20" json:"diskBus"`
+	DriverISOPath     string          `gorm:"size:500" json:"driverIsoPath"`
+	VideoModel        string          `gorm:"size:20" json:"videoModel"`
+	Tuning            string          `gorm:"type:text" json:"-"`
+	QoS               QoSLimits       `gorm:"embedded;embeddedPrefix:qos_" json:"qos"`
+	Lifecycle         LifecyclePolicy `gorm:"embedded;embeddedPrefix:lifecycle_" json:"lifecycle"`
+	Encryption        DiskEncryption  `gorm:"embedded;embeddedPrefix:disk_encryption_" json:"encryption"`
+	Balloon           BalloonPolicy   `gorm:"embedded;embeddedPrefix:balloon_" json:"balloon"`
+	DirectBoot        DirectBoot      `gorm:"embedded;embeddedPrefix:direct_boot_" json:"directBoot"`
+	PendingChanges    string          `gorm:"type:text" json:"-"`
+	DataDisks         []StorageVolume `gorm:"-" json:"dataDisks,omitempty"`
+	Interfaces        []VMInterface   `gorm:"-" json:"interfaces,omitempty"`
+	Filesystems       []VMFilesystem  `gorm:"-" json:"filesystems,omitempty"`
+	Owner             *User           `gorm:"foreignKey:OwnerID" json:"owner"`
+	Template          *VMTemplate     `gorm:"foreignKey:TemplateID" json:"template"`
+	ISO               *ISO            `gorm:"foreignKey:ISOID" json:"iso"`
+	CreatedAt         time.Time       `json:"createdAt"`
+	UpdatedAt         time.Time       `json:"updatedAt"`
+	DeletedAt         *time.Time      `gorm:"index" json:"deletedAt"`
+}
+
+// QoSLimits caps the disk I/O and network bandwidth of a VM. Disk limits
+// apply to every disk and network limits to every NIC; zero means unlimited.
+// Network rates are in kilobytes per second.
+type QoSLimits struct {
+	DiskReadIOPS      int64 `gorm:"column:disk_read_iops;default:0" json:"diskReadIops"`
+	DiskWriteIOPS     int64 `gorm:"column:disk_write_iops;default:0" json:"diskWriteIops"`
+	DiskReadBytesSec  int64 `gorm:"column:disk_read_bytes_sec;default:0" json:"diskReadBytesSec"`
+	DiskWriteBytesSec int64 `gorm:"column:disk_write_bytes_sec;default:0" json:"diskWriteBytesSec"`
+	NetInboundKBps    int64 `gorm:"column:net_inbound_kbps;default:0" json:"netInboundKBps"`
+	NetOutboundKBps   int64 `gorm:"column:net_outbound_kbps;default:0" json:"netOutboundKBps"`
+}
+
+// LifecyclePolicy says what happens when the guest powers off, reboots,
+// crashes or hangs. libvirt carries out the actions and the watchdog, the
+// sync service the restart policy. Empty values keep the defaults; the
+// restart backoff is in seconds.
+type LifecyclePolicy struct {
+	OnPoweroff        string `gorm:"column:on_poweroff;size:20" json:"onPoweroff"`
+	OnReboot          string `gorm:"column:on_reboot;size:20" json:"onReboot"`
+	OnCrash           string `gorm:"column:on_crash;size:20" json:"onCrash"`
+	WatchdogAction    string `gorm:"column:watchdog_action;size:20" json:"watchdogAction"`
+	RestartPolicy     string `gorm:"column:restart_policy;size:20" json:"restartPolicy"`
+	RestartMaxRetries int    `gorm:"column:restart_max_retries;default:0" json:"restartMaxRetries"`
+	RestartBackoff    int    `gorm:"column:restart_backoff;default:0" json:"restartBackoff"`
+}
+
+// DiskEncryption describes the LUKS encryption of the system disk. The
+// passphrase is kept in the libvirt secret SecretUUID and, wrapped with the
+// master key, in WrappedKey so the secret can be defined again.
+type DiskEncryption struct {
+	Enabled    bool       `gorm:"column:enabled;default:false" json:"enabled"`
+	SecretUUID string     `gorm:"column:secret_uuid;size:36" json:"secretUuid,omitempty"`
+	WrappedKey string     `gorm:"column:wrapped_key;type:text" json:"-"`
+	RotatedAt  *time.Time `gorm:"column:rotated_at" json:"rotatedAt,omitempty"`
+}
+
+// BalloonPolicy lets the manager move the memory of a running guest
+// between MinMemory and the allocated memory, in MB. Idle guests give
+// memory back to the host and get it again under pressure.
+type BalloonPolicy struct {
+	Auto      bool `gorm:"column:auto;default:false" json:"auto"`
+	MinMemory int  `gorm:"column:min_memory;default:0" json:"minMemory"`
+}
+
+// DirectBoot boots a VM straight from a kernel and initrd on the host with
+// its own command line instead of through the bootloader on its disk. The
+// paths stay set while the VM boots from disk, so it can switch back.
+type DirectBoot struct {
+	Enabled bool   `gorm:"column:enabled;default:false" json:"enabled"`
+	Kernel  string `gorm:"column:kernel;size:500" json:"kernel"`
+	Initrd  string `gorm:"column:initrd;size:500" json:"initrd"`
+	DTB     string `gorm:"column:dtb;size:500" json:"dtb"`
+	Cmdline string `gorm:"column:cmdline;type:text" json:"cmdline"`
 }
 
 type VMStats struct {
@@ -120,7 +213,13 @@ type VMStats struct {
 	DiskWrite   int64     `gorm:"default:0" json:"diskWrite"`
 	NetworkRX   int64     `gorm:"default:0" json:"networkRx"`
 	NetworkTX   int64     `gorm:"default:0" json:"networkTx"`
-	CollectedAt time.Time `gorm:"index:idx_vm_stats_collected" json:"collectedAt"`
+	// Guest memory reported by the balloon driver, in MB, and the major
+	// page faults since the guest booted.
+	MemoryBalloon   int64     `gorm:"default:0" json:"memoryBalloon"`
+	MemoryUnused    int64     `gorm:"default:0" json:"memoryUnused"`
+	MemoryAvailable int64     `gorm:"default:0" json:"memoryAvailable"`
+	MajorFaults     int64     `gorm:"default:0" json:"majorFaults"`
+	CollectedAt     time.Time `gorm:"index:idx_vm_stats_collected" json:"collectedAt"`
 }
 
 type AuditLog struct {
@@ -246,6 +345,7 @@ type ISO struct {
 	SHA256       string     `gorm:"size:64" json:"sha256"`
 	OSType       string     `gorm:"size:50" json:"osType"`
 	OSVersion    string     `gorm:"size:50" json:"osVersion"`
+	OSProfile    string     `gorm:"size:20" json:"osProfile"`
 	Architecture string     `gorm:"size:20;default:'x86_64'" json:"architecture"`
 	Status       string     `gorm:"size:20;default:'active'" json:"status"`
 	UploadedBy   *uuid.UUID `gorm:"type:uuid" json:"uploadedBy"`
@@ -341,16 +441,22 @@ func (s *StoragePool) BeforeCreate(tx *gorm.DB) (err error) {
 }
 
 type StorageVolume struct {
-	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
-	PoolID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"poolId"`
-	Name       string     `gorm:"size:255;not null" json:"name"`
-	VolumeType string     `gorm:"size:20" json:"volumeType"`
-	Capacity   int64      `gorm:"default:0" json:"capacity"`
-	Allocation int64      `gorm:"default:0" json:"allocation"`
-	Format     string     `gorm:"size:20" json:"format"`
-	Path       string     `gorm:"size:500" json:"path"`
-	VMID       *uuid.UUID `gorm:"type:uuid;index" json:"vmId"`
-	CreatedAt  time.Time  `json:"createdAt"`
+	ID         uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	PoolID     uuid.UUID      `gorm:"type:uuid;not null;index" json:"poolId"`
+	Name       string         `gorm:"size:255;not null" json:"name"`
+	VolumeType string         `gorm:"size:20" json:"volumeType"`
+	Capacity   int64          `gorm:"default:0" json:"capacity"`
+	Allocation int64          `gorm:"default:0" json:"allocation"`
+	Format     string         `gorm:"size:20" json:"format"`
+	Path       string         `gorm:"size:500" json:"path"`
+	VMID       *uuid.UUID     `gorm:"type:uuid;index" json:"vmId"`
+	OwnerID    *uuid.UUID     `gorm:"type:uuid;index" json:"ownerId"`
+	TargetDev  string         `gorm:"size:20" json:"targetDev"`
+	Bus        string         `gorm:"size:20" json:"bus"`
+	CacheMode  string         `gorm:"size:20" json:"cacheMode"`
+	ReadOnly   bool           `gorm:"default:false" json:"readOnly"`
+	Encryption DiskEncryption `gorm:"embedded;embeddedPrefix:encryption_" json:"encryption"`
+	CreatedAt  time.Time      `json:"createdAt"`
 }
 
 func (v *StorageVolume) BeforeCreate(tx *gorm.DB) (err error) {
@@ -375,9 +481,14 @@ type VMBackup struct {
 	CompletedAt *time.Time `json:"completedAt"`
 	ExpiresAt   *time.Time `json:"expiresAt"`
 	ErrorMsg    string     `gorm:"type:text" json:"errorMsg"`
-	CreatedBy   *uuid.UUID `gorm:"type:uuid" json:"createdBy"`
-	CreatedAt   time.Time  `json:"createdAt"`
-	UpdatedAt   time.Time  `json:"updatedAt"`
+	// Encrypted backups are copies of an encrypted disk. EncryptionKey is
+	// the wrapped passphrase they open with, which key rotation on the VM
+	// does not change.
+	Encrypted     bool       `gorm:"default:false" json:"encrypted"`
+	EncryptionKey string     `gorm:"type:text" json:"-"`
+	CreatedBy     *uuid.UUID `gorm:"type:uuid" json:"createdBy"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
 }
 
 func (b *VMBackup) BeforeCreate(tx *gorm.DB) (err error) {
@@ -494,3 +605,140 @@ func (v *VMOperationHistory) BeforeCreate(tx *gorm.DB) (err error) {
 	}
 	return
 }
+
+// SSHKey is a public key owned by a user, or an organisation-wide key
+// (IsGlobal, no owner) that is injected into every VM.
+type SSHKey struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID      *uuid.UUID `gorm:"type:uuid;index:idx_ssh_keys_user" json:"userId"`
+	Name        string     `gorm:"size:100;not null" json:"name"`
+	PublicKey   string     `gorm:"type:text;not null" json:"publicKey"`
+	KeyType     string     `gorm:"size:50;not null" json:"keyType"`
+	Fingerprint string     `gorm:"size:100;not null" json:"fingerprint"`
+	IsGlobal    bool       `gorm:"default:false" json:"isGlobal"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+func (k *SSHKey) BeforeCreate(tx *gorm.DB) (err error) {
+	if k.ID == uuid.Nil {
+		k.ID = uuid.New()
+	}
+	return
+}
+
+// VMInterface is a network interface of a VM, attached either to a libvirt
+// network (SourceType "network") or to a host bridge (SourceType "bridge").
+// The primary interface mirrors VirtualMachine.MACAddress.
+type VMInterface struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	VMID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"vmId"`
+	MACAddress string     `gorm:"size:17;not null;uniqueIndex" json:"macAddress"`
+	SourceType string     `gorm:"size:20;not null;default:'network'" json:"sourceType"`
+	Source     string     `gorm:"size:100;not null" json:"source"`
+	NetworkID  *uuid.UUID `gorm:"type:uuid" json:"networkId"`
+	Model      string     `gorm:"size:20;default:'virtio'" json:"model"`
+	LinkState  string     `gorm:"size:10;default:'up'" json:"linkState"`
+	IsPrimary  bool       `gorm:"default:false" json:"isPrimary"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+func (i *VMInterface) BeforeCreate(tx *gorm.DB) (err error) {
+	if i.ID == uuid.Nil {
+		i.ID = uuid.New()
+	}
+	return
+}
+
+// Flavor is an admin-defined VM size with its QoS limits. With a dedicated
+// CPU policy every vCPU is pinned to a host CPU no other VM is pinned to.
+// Empty AllowedRoles and AllowedUsers make the flavor available to everyone.
+type Flavor struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	Name         string    `gorm:"size:100;not null;uniqueIndex" json:"name"`
+	Description  string    `gorm:"type:text" json:"description"`
+	CPU          int       `gorm:"not null" json:"cpu"`
+	Memory       int       `gorm:"not null" json:"memory"`
+	Disk         int       `gorm:"not null" json:"disk"`
+	QoS          QoSLimits `gorm:"embedded;embeddedPrefix:qos_" json:"qos"`
+	CPUPolicy    string    `gorm:"size:20;default:'shared'" json:"cpuPolicy"`
+	AllowedRoles []string  `gorm:"type:text[]" json:"allowedRoles"`
+	AllowedUsers []string  `gorm:"type:text[]" json:"allowedUsers"`
+	IsActive     bool      `gorm:"default:true" json:"isActive"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func (f *Flavor) BeforeCreate(tx *gorm.DB) (err error) {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	return
+}
+
+// SharedFolder is a host directory an admin allows VM owners to share into
+// their guests through virtio-fs. Guests only get write access when
+// AllowWrite is set. Empty AllowedRoles and AllowedUsers make the folder
+// available to everyone.
+type SharedFolder struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	Name         string    `gorm:"size:100;not null;uniqueIndex" json:"name"`
+	Description  string    `gorm:"type:text" json:"description"`
+	HostPath     string    `gorm:"size:500;not null" json:"hostPath"`
+	AllowWrite   bool      `gorm:"default:false" json:"allowWrite"`
+	AllowedRoles []string  `gorm:"type:text[]" json:"allowedRoles"`
+	AllowedUsers []string  `gorm:"type:text[]" json:"allowedUsers"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func (f *SharedFolder) BeforeCreate(tx *gorm.DB) (err error) {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	return
+}
+
+// VMFilesystem maps a shared folder, or a directory below it, into a VM.
+// The guest mounts it by its tag.
+type VMFilesystem struct {
+	ID             uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	VMID           uuid.UUID `gorm:"type:uuid;not null;index" json:"vmId"`
+	SharedFolderID uuid.UUID `gorm:"type:uuid;not null;index" json:"sharedFolderId"`
+	SourcePath     string    `gorm:"size:500;not null" json:"sourcePath"`
+	MountTag       string    `gorm:"size:36;not null" json:"mountTag"`
+	ReadOnly       bool      `gorm:"default:false" json:"readOnly"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+func (f *VMFilesystem) BeforeCreate(tx *gorm.DB) (err error) {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	return
+}
+
+// VMDrift is a difference between a field of a VM record and the persistent
+// definition of its libvirt domain. It stays open until the two agree again,
+// either because an admin resolved it or because they were changed to match.
+type VMDrift struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	VMID         uuid.UUID  `gorm:"type:uuid;not null;index" json:"vmId"`
+	Field        string     `gorm:"size:30;not null" json:"field"`
+	DBValue      string     `gorm:"size:500" json:"dbValue"`
+	LibvirtValue string     `gorm:"size:500" json:"libvirtValue"`
+	Status       string     `gorm:"size:20;default:'open'" json:"status"`
+	Resolution   string     `gorm:"size:20" json:"resolution,omitempty"`
+	ResolvedBy   *uuid.UUID `gorm:"type:uuid" json:"resolvedBy,omitempty"`
+	DetectedAt   time.Time  `json:"detectedAt"`
+	ResolvedAt   *time.Time `json:"resolvedAt,omitempty"`
+}
+
+func (d *VMDrift) BeforeCreate(tx *gorm.DB) (err error) {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"vmmanager/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrFlavorNotFound = errors.New("flavor not found")
+
+type FlavorRepository struct {
+	db *gorm.DB
+}
+
+func NewFlavorRepository(db *gorm.DB) *FlavorRepository {
+	return &FlavorRepository{db: db}
+}
+
+// Create inserts every field so that an inactive flavor is not turned
+// active by the column default.
+func (r *FlavorRepository) Create(ctx context.Context, flavor *models.Flavor) error {
+	return r.db.WithContext(ctx).Select("*").Create(flavor).Error
+}
+
+func (r *FlavorRepository) FindByID(ctx context.Context, id string) (*models.Flavor, error) {
+	var flavor models.Flavor
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&flavor).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrFlavorNotFound
+		}
+		return nil, err
+	}
+	return &flavor, nil
+}
+
+func (r *FlavorRepository) FindByName(ctx context.Context, name string) (*models.Flavor, error) {
+	var flavor models.Flavor
+	err := r.db.WithContext(ctx).Where("name = ?", name).First(&flavor).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrFlavorNotFound
+		}
+		return nil, err
+	}
+	return &flavor, nil
+}
+
+func (r *FlavorRepository) List(ctx context.Context) ([]models.Flavor, error) {
+	var flavors []models.Flavor
+	err := r.db.WithContext(ctx).
+		Order("cpu ASC, memory ASC, name ASC").
+		Find(&flavors).Error
+	return flavors, err
+}
+
+func (r *FlavorRepository) Update(ctx context.Context, flavor *models.Flavor) error {
+	return r.db.WithContext(ctx).Save(flavor).Error
+}
+
+func (r *FlavorRepository) Delete(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.Flavor{}).Error
+}
+
+// CountVMs returns how many VMs use the flavor.
+func (r *FlavorRepository) CountVMs(ctx context.Context, id string) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).
+		Model(&models.VirtualMachine{}).
+		Where("flavor_id = ?", id).
+		Count(&count).Error
+	return count, err
+}
@@ -25,6 +25,12 @@ type Repositories struct {
 	LoginHistory          *LoginHistoryRepository
 	ResourceChangeHistory *ResourceChangeHistoryRepository
 	VMOperationHistory    *VMOperationHistoryRepository
+	SSHKey                *SSHKeyRepository
+	VMInterface           *VMInterfaceRepository
+	Flavor                *FlavorRepository
+	SharedFolder          *SharedFolderRepository
+	VMFilesystem          *VMFilesystemRepository
+	VMDrift               *VMDriftRepository
 }
 
 func NewRepositories(db *gorm.DB) *Repositories {
@@ -49,6 +55,12 @@ func NewRepositories(db *gorm.DB) *Repositories {
 		LoginHistory:          NewLoginHistoryRepository(db),
 		ResourceChangeHistory: NewResourceChangeHistoryRepository(db),
 		VMOperationHistory:    NewVMOperationHistoryRepository(db),
+		SSHKey:                NewSSHKeyRepository(db),
+		VMInterface:           NewVMInterfaceRepository(db),
+		Flavor:                NewFlavorRepository(db),
+		SharedFolder:          NewSharedFolderRepository(db),
+		VMFilesystem:          NewVMFilesystemRepository(db),
+		VMDrift:               NewVMDriftRepository(db),
 	}
 }
 
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"vmmanager/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrSharedFolderNotFound = errors.New("shared folder not found")
+
+type SharedFolderRepository struct {
+	db *gorm.DB
+}
+
+func NewSharedFolderRepository(db *gorm.DB) *SharedFolderRepository {
+	return &SharedFolderRepository{db: db}
+}
+
+func (r *SharedFolderRepository) Create(ctx context.Context, folder *models.SharedFolder) error {
+	return r.db.WithContext(ctx).Create(folder).Error
+}
+
+func (r *SharedFolderRepository) FindByID(ctx context.Context, id string) (*models.SharedFolder, error) {
+	var folder models.SharedFolder
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&folder).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSharedFolderNotFound
+		}
+		return nil, err
+	}
+	return &folder, nil
+}
+
+func (r *SharedFolderRepository) FindByName(ctx context.Context, name string) (*models.SharedFolder, error) {
+	var folder models.SharedFolder
+	err := r.db.WithContext(ctx).Where("name = ?", name).First(&folder).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSharedFolderNotFound
+		}
+		return nil, err
+	}
+	return &folder, nil
+}
+
+func (r *SharedFolderRepository) List(ctx context.Context) ([]models.SharedFolder, error) {
+	var folders []models.SharedFolder
+	err := r.db.WithContext(ctx).Order("name ASC").Find(&folders).Error
+	return folders, err
+}
+
+func (r *SharedFolderRepository) Update(ctx context.Context, folder *models.SharedFolder) error {
+	return r.db.WithContext(ctx).Save(folder).Error
+}
+
+func (r *SharedFolderRepository) Delete(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.SharedFolder{}).Error
+}
+
+// CountMappings returns how many VM filesystems share the folder.
+func (r *SharedFolderRepository) CountMappings(ctx context.Context, id string) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).
+		Model(&models.VMFilesystem{}).
+		Where("shared_folder_id = ?", id).
+		Count(&count).Error
+	return count, err
+}
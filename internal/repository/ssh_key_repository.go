@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"vmmanager/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSSHKeyNotFound = errors.New("ssh key not found")
+	ErrSSHKeyExists   = errors.New("ssh key already exists")
+)
+
+type SSHKeyRepository struct {
+	db *gorm.DB
+}
+
+func NewSSHKeyRepository(db *gorm.DB) *SSHKeyRepository {
+	return &SSHKeyRepository{db: db}
+}
+
+// Create stores key. It returns ErrSSHKeyExists when the owner already has
+// a key with the same fingerprint, which the unique indexes on ssh_keys
+// enforce even when two requests race past ExistsFingerprint.
+func (r *SSHKeyRepository) Create(ctx context.Context, key *models.SSHKey) error {
+	err := r.db.WithContext(ctx).Create(key).Error
+	if translator, ok := r.db.Dialector.(gorm.ErrorTranslator); ok && err != nil {
+		err = translator.Translate(err)
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrSSHKeyExists
+	}
+	return err
+}
+
+func (r *SSHKeyRepository) FindByID(ctx context.Context, id string) (*models.SSHKey, error) {
+	var key models.SSHKey
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&key).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSSHKeyNotFound
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *SSHKeyRepository) ListByUser(ctx context.Context, userID string) ([]models.SSHKey, error) {
+	var keys []models.SSHKey
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND is_global = ?", userID, false).
+		Order("created_at DESC").
+		Find(&keys).Error
+	return keys, err
+}
+
+func (r *SSHKeyRepository) ListGlobal(ctx context.Context) ([]models.SSHKey, error) {
+	var keys []models.SSHKey
+	err := r.db.WithContext(ctx).
+		Where("is_global = ?", true).
+		Order("created_at DESC").
+		Find(&keys).Error
+	return keys, err
+}
+
+// FindByUserAndIDs returns the user's own keys among ids.
+func (r *SSHKeyRepository) FindByUserAndIDs(ctx context.Context, userID string, ids []string) ([]models.SSHKey, error) {
+	var keys []models.SSHKey
+	if len(ids) == 0 {
+		return keys, nil
+	}
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND is_global = ? AND id IN ?", userID, false, ids).
+		Find(&keys).Error
+	return keys, err
+}
+
+func (r *SSHKeyRepository) ExistsFingerprint(ctx context.Context, userID *string, fingerprint string) (bool, error) {
+	var count int64
+	query := r.db.WithContext(ctx).Model(&models.SSHKey{}).Where("fingerprint = ?", fingerprint)
+	if userID == nil {
+		query = query.Where("is_global = ?", true)
+	} else {
+		query = query.Where("user_id = ? AND is_global = ?", *userID, false)
+	}
+	err := query.Count(&count).Error
+	return count > 0, err
+}
+
+func (r *SSHKeyRepository) Update(ctx context.Context, key *models.SSHKey) error {
+	return r.db.WithContext(ctx).Save(key).Error
+}
+
+func (r *SSHKeyRepository) Delete(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.SSHKey{}).Error
+}
@@ -0,0 +1,62 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+
+	"github.com/google/uuid"
+)
+
+func TestSSHKeyRepository_CreateDuplicate(t *testing.T) {
+	db := setupTestDB(t)
+	// The unique indexes of the ssh_keys migration, on the singular table
+	// name the test naming strategy uses.
+	for _, stmt := range []string{
+		`CREATE TABLE ssh_key (
+			id UUID PRIMARY KEY,
+			user_id UUID,
+			name VARCHAR(100) NOT NULL,
+			public_key TEXT NOT NULL,
+			key_type VARCHAR(50) NOT NULL,
+			fingerprint VARCHAR(100) NOT NULL,
+			is_global BOOLEAN DEFAULT FALSE,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		)`,
+		`CREATE UNIQUE INDEX idx_ssh_keys_user_fingerprint ON ssh_key(user_id, fingerprint) WHERE is_global = FALSE`,
+		`CREATE UNIQUE INDEX idx_ssh_keys_global_fingerprint ON ssh_key(fingerprint) WHERE is_global = TRUE`,
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("failed to create ssh_key table: %v", err)
+		}
+	}
+	repo := repository.NewSSHKeyRepository(db)
+	ctx := context.Background()
+
+	alice, bob := uuid.New(), uuid.New()
+	newKey := func(owner *uuid.UUID) *models.SSHKey {
+		return &models.SSHKey{
+			UserID:      owner,
+			Name:        "laptop",
+			PublicKey:   "ssh-ed25519 AAAA",
+			KeyType:     "ssh-ed25519",
+			Fingerprint: "SHA256:abc",
+			IsGlobal:    owner == nil,
+		}
+	}
+
+	for _, owner := range []*uuid.UUID{&alice, &bob, nil} {
+		if err := repo.Create(ctx, newKey(owner)); err != nil {
+			t.Fatalf("Create for %v failed: %v", owner, err)
+		}
+	}
+	for _, owner := range []*uuid.UUID{&alice, nil} {
+		if err := repo.Create(ctx, newKey(owner)); !errors.Is(err, repository.ErrSSHKeyExists) {
+			t.Errorf("duplicate Create for %v = %v, want ErrSSHKeyExists", owner, err)
+		}
+	}
+}
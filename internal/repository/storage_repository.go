@@ -6,10 +6,15 @@ import (
 
 	"vmmanager/internal/models"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
-var ErrStoragePoolNotFound = errors.New("storage pool not found")
+var (
+	ErrStoragePoolNotFound   = errors.New("storage pool not found")
+	ErrStorageVolumeNotFound = errors.New("storage volume not found")
+	ErrStorageVolumeInUse    = errors.New("storage volume is attached to another VM")
+)
 
 type StoragePoolRepository struct {
 	db *gorm.DB
@@ -156,3 +161,45 @@ func (r *StorageVolumeRepository) SetVMID(ctx context.Context, id string, vmID *
 		Where("id = ?", id).
 		Update("vm_id", vmID).Error
 }
+
+// Attach marks the volume as attached to vmID at target. It fails with
+// ErrStorageVolumeInUse when the volume is already attached elsewhere.
+func (r *StorageVolumeRepository) Attach(ctx context.Context, volume *models.StorageVolume, vmID uuid.UUID) error {
+	result := r.db.WithContext(ctx).Model(&models.StorageVolume{}).
+		Where("id = ? AND (vm_id IS NULL OR vm_id = ?)", volume.ID, vmID).
+		Updates(map[string]interface{}{
+			"vm_id":      vmID,
+			"target_dev": volume.TargetDev,
+			"bus":        volume.Bus,
+			"cache_mode": volume.CacheMode,
+			"read_only":  volume.ReadOnly,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStorageVolumeInUse
+	}
+	volume.VMID = &vmID
+	return nil
+}
+
+// Detach clears the attachment of the volume.
+func (r *StorageVolumeRepository) Detach(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Model(&models.StorageVolume{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"vm_id":      nil,
+			"target_dev": "",
+		}).Error
+}
+
+// DetachAllFromVM releases every volume attached to vmID.
+func (r *StorageVolumeRepository) DetachAllFromVM(ctx context.Context, vmID string) error {
+	return r.db.WithContext(ctx).Model(&models.StorageVolume{}).
+		Where("vm_id = ?", vmID).
+		Updates(map[string]interface{}{
+			"vm_id":      nil,
+			"target_dev": "",
+		}).Error
+}
@@ -104,6 +104,21 @@ func (r *UserRepository) UpdateQuota(ctx context.Context, id string, cpu, memory
 		Updates(updates).Error
 }
 
+// UpdateQoSMax replaces the QoS maximums that apply to the VMs of a user.
+func (r *UserRepository) UpdateQoSMax(ctx context.Context, id string, limits models.QoSLimits) error {
+	return r.db.WithContext(ctx).
+		Model(&models.User{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"qos_max_disk_read_iops":       limits.DiskReadIOPS,
+			"qos_max_disk_write_iops":      limits.DiskWriteIOPS,
+			"qos_max_disk_read_bytes_sec":  limits.DiskReadBytesSec,
+			"qos_max_disk_write_bytes_sec": limits.DiskWriteBytesSec,
+			"qos_max_net_inbound_kbps":     limits.NetInboundKBps,
+			"qos_max_net_outbound_kbps":    limits.NetOutboundKBps,
+		}).Error
+}
+
 type ResourceUsage struct {
 	VMCount     int   `json:"vmCount"`
 	CPUUsed     int   `json:"cpuUsed"`
@@ -134,5 +149,19 @@ func (r *UserRepository) GetResourceUsage(ctx context.Context, userID string) (*
 	}
 	usage.DiskUsed = diskUsed
 
+	// Data disks count toward the owner's disk quota whether they are
+	// attached or not, rounded up to whole gigabytes like disk_allocated.
+	var dataDiskBytes int64
+	err = r.db.WithContext(ctx).
+		Model(&models.StorageVolume{}).
+		Where("owner_id = ? OR vm_id IN (?)", userID,
+			r.db.WithContext(ctx).Model(&models.VirtualMachine{}).Select("id").Where("owner_id = ?", userID)).
+		Select("COALESCE(SUM(capacity), 0)").
+		Scan(&dataDiskBytes).Error
+	if err != nil {
+		return nil, err
+	}
+	usage.DiskUsed += (dataDiskBytes + (1 << 30) - 1) >> 30
+
 	return &usage, nil
 }
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"vmmanager/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrVMDriftNotFound = errors.New("vm drift not found")
+
+type VMDriftRepository struct {
+	db *gorm.DB
+}
+
+func NewVMDriftRepository(db *gorm.DB) *VMDriftRepository {
+	return &VMDriftRepository{db: db}
+}
+
+func (r *VMDriftRepository) Create(ctx context.Context, drift *models.VMDrift) error {
+	return r.db.WithContext(ctx).Create(drift).Error
+}
+
+func (r *VMDriftRepository) FindByID(ctx context.Context, id string) (*models.VMDrift, error) {
+	var drift models.VMDrift
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&drift).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVMDriftNotFound
+		}
+		return nil, err
+	}
+	return &drift, nil
+}
+
+// ListOpen returns the open drifts of every VM, or of the VM with vmID when
+// it is set, oldest first.
+func (r *VMDriftRepository) ListOpen(ctx context.Context, vmID string) ([]models.VMDrift, error) {
+	var drifts []models.VMDrift
+	query := r.db.WithContext(ctx).Where("status = ?", "open")
+	if vmID != "" {
+		query = query.Where("vm_id = ?", vmID)
+	}
+	err := query.Order("detected_at ASC").Find(&drifts).Error
+	return drifts, err
+}
+
+func (r *VMDriftRepository) Update(ctx context.Context, drift *models.VMDrift) error {
+	return r.db.WithContext(ctx).Save(drift).Error
+}
+
+// Resolve closes a drift with resolution. resolvedBy is nil when the two
+// sides came to agree without an admin.
+func (r *VMDriftRepository) Resolve(ctx context.Context, id uuid.UUID, resolution string, resolvedBy *uuid.UUID) error {
+	now := time.Now()
+	return r.db.WithContext(ctx).Model(&models.VMDrift{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"status":      "resolved",
+			"resolution":  resolution,
+			"resolved_by": resolvedBy,
+			"resolved_at": &now,
+		}).Error
+}
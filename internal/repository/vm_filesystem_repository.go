@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"vmmanager/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrVMFilesystemNotFound = errors.New("vm filesystem not found")
+
+type VMFilesystemRepository struct {
+	db *gorm.DB
+}
+
+func NewVMFilesystemRepository(db *gorm.DB) *VMFilesystemRepository {
+	return &VMFilesystemRepository{db: db}
+}
+
+func (r *VMFilesystemRepository) Create(ctx context.Context, fs *models.VMFilesystem) error {
+	return r.db.WithContext(ctx).Create(fs).Error
+}
+
+func (r *VMFilesystemRepository) FindByVMAndID(ctx context.Context, vmID, id string) (*models.VMFilesystem, error) {
+	var fs models.VMFilesystem
+	err := r.db.WithContext(ctx).
+		Where("vm_id = ? AND id = ?", vmID, id).
+		First(&fs).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVMFilesystemNotFound
+		}
+		return nil, err
+	}
+	return &fs, nil
+}
+
+// ListByVM returns the filesystems of a VM in the order they were added.
+func (r *VMFilesystemRepository) ListByVM(ctx context.Context, vmID string) ([]models.VMFilesystem, error) {
+	var filesystems []models.VMFilesystem
+	err := r.db.WithContext(ctx).
+		Where("vm_id = ?", vmID).
+		Order("created_at ASC").
+		Find(&filesystems).Error
+	return filesystems, err
+}
+
+func (r *VMFilesystemRepository) Delete(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.VMFilesystem{}).Error
+}
+
+func (r *VMFilesystemRepository) DeleteByVM(ctx context.Context, vmID string) error {
+	return r.db.WithContext(ctx).Where("vm_id = ?", vmID).Delete(&models.VMFilesystem{}).Error
+}
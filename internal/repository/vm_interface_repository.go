@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"vmmanager/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrVMInterfaceNotFound = errors.New("vm interface not found")
+
+type VMInterfaceRepository struct {
+	db *gorm.DB
+}
+
+func NewVMInterfaceRepository(db *gorm.DB) *VMInterfaceRepository {
+	return &VMInterfaceRepository{db: db}
+}
+
+func (r *VMInterfaceRepository) Create(ctx context.Context, iface *models.VMInterface) error {
+	iface.MACAddress = strings.ToLower(iface.MACAddress)
+	return r.db.WithContext(ctx).Create(iface).Error
+}
+
+func (r *VMInterfaceRepository) FindByVMAndMAC(ctx context.Context, vmID, mac string) (*models.VMInterface, error) {
+	var iface models.VMInterface
+	err := r.db.WithContext(ctx).
+		Where("vm_id = ? AND mac_address = ?", vmID, strings.ToLower(mac)).
+		First(&iface).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVMInterfaceNotFound
+		}
+		return nil, err
+	}
+	return &iface, nil
+}
+
+// ListByVM returns the interfaces of a VM, primary first.
+func (r *VMInterfaceRepository) ListByVM(ctx context.Context, vmID string) ([]models.VMInterface, error) {
+	var ifaces []models.VMInterface
+	err := r.db.WithContext(ctx).
+		Where("vm_id = ?", vmID).
+		Order("is_primary DESC, created_at ASC").
+		Find(&ifaces).Error
+	return ifaces, err
+}
+
+func (r *VMInterfaceRepository) Update(ctx context.Context, iface *models.VMInterface) error {
+	return r.db.WithContext(ctx).Save(iface).Error
+}
+
+func (r *VMInterfaceRepository) Delete(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.VMInterface{}).Error
+}
+
+func (r *VMInterfaceRepository) DeleteByVM(ctx context.Context, vmID string) error {
+	return r.db.WithContext(ctx).Where("vm_id = ?", vmID).Delete(&models.VMInterface{}).Error
+}
+
+// MACInUse reports whether mac is taken by any interface or by the primary
+// MAC address of any VM.
+func (r *VMInterfaceRepository) MACInUse(ctx context.Context, mac string) (bool, error) {
+	mac = strings.ToLower(mac)
+
+	var count int64
+	if err := r.db.WithContext(ctx).Model(&models.VMInterface{}).
+		Where("mac_address = ?", mac).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	if err := r.db.WithContext(ctx).Model(&models.VirtualMachine{}).
+		Where("LOWER(mac_address) = ?", mac).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 
 	"vmmanager/internal/models"
 
@@ -114,6 +115,15 @@ func (r *VMRepository) ListByStatus(ctx context.Context, status string) ([]model
 	return vms, err
 }
 
+// ListTuned returns the VMs with CPU pinning, NUMA or hugepage settings.
+func (r *VMRepository) ListTuned(ctx context.Context) ([]models.VirtualMachine, error) {
+	var vms []models.VirtualMachine
+	err := r.db.WithContext(ctx).
+		Where("tuning IS NOT NULL AND tuning <> ''").
+		Find(&vms).Error
+	return vms, err
+}
+
 func (r *VMRepository) CountByOwner(ctx context.Context, ownerID string) (int64, error) {
 	var count int64
 	err := r.db.WithContext(ctx).
@@ -195,3 +205,46 @@ func (r *VMRepository) UpdateInstallStatus(ctx context.Context, id, installStatu
 		Where("id = ?", id).
 		Update("install_status", installStatus).Error
 }
+
+func (r *VMRepository) UpdateInstallProgress(ctx context.Context, id, installStatus string, progress int) error {
+	return r.db.WithContext(ctx).
+		Model(&models.VirtualMachine{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"install_status":   installStatus,
+			"install_progress": progress,
+		}).Error
+}
+
+func (r *VMRepository) UpdateGuestInfo(ctx context.Context, id string, hostname, guestOS, guestInfo, ipAddress string) error {
+	updates := map[string]interface{}{
+		"agent_connected": true,
+		"guest_hostname":  hostname,
+		"guest_os":        guestOS,
+		"guest_info":      guestInfo,
+		"guest_info_at":   time.Now(),
+	}
+	if ipAddress != "" {
+		updates["ip_address"] = ipAddress
+	}
+	return r.db.WithContext(ctx).
+		Model(&models.VirtualMachine{}).
+		Where("id = ?", id).
+		Updates(updates).Error
+}
+
+func (r *VMRepository) UpdateAgentConnected(ctx context.Context, id string, connected bool) error {
+	return r.db.WithContext(ctx).
+		Model(&models.VirtualMachine{}).
+		Where("id = ?", id).
+		Update("agent_connected", connected).Error
+}
+
+// ClearPendingChanges forgets the configuration changes that were waiting
+// for the next power cycle of a VM.
+func (r *VMRepository) ClearPendingChanges(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).
+		Model(&models.VirtualMachine{}).
+		Where("id = ?", id).
+		Update("pending_changes", "").Error
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +15,11 @@ import (
 	"github.com/google/uuid"
 )
 
+// driftMetric is the metric of alerts about a VM record and the definition
+// of its domain drifting apart. The drift service reports it as it finds
+// drift instead of it being polled.
+const driftMetric = "config_drift"
+
 type AlertService struct {
 	ruleRepo     *repository.AlertRuleRepository
 	historyRepo  *repository.AlertHistoryRepository
@@ -250,6 +256,43 @@ func (s *AlertService) triggerAlert(ctx context.Context, rule models.AlertRule,
 	}
 }
 
+// ReportDrift raises an alert for the fields on which a VM record and the
+// definition of its domain started to disagree. Rules on the config_drift
+// metric decide the severity and the notification channels, with the number
+// of fields as the value; without such a rule a warning is recorded.
+func (s *AlertService) ReportDrift(ctx context.Context, vmID, vmName string, fields []string) {
+	value := float64(len(fields))
+
+	rules, err := s.ruleRepo.FindByVMAndMetric(ctx, vmID, driftMetric)
+	if err != nil {
+		log.Printf("[ALERT] Failed to get drift rules: %v", err)
+	}
+	if len(rules) > 0 {
+		for _, rule := range rules {
+			if s.shouldTriggerAlert(rule, value) {
+				s.triggerAlert(ctx, rule, vmID, vmName, value)
+			}
+		}
+		return
+	}
+
+	vmUUID, _ := uuid.Parse(vmID)
+	history := &models.AlertHistory{
+		VMID:         &vmUUID,
+		Severity:     "warning",
+		Metric:       driftMetric,
+		CurrentValue: value,
+		Condition:    ">",
+		Message:      fmt.Sprintf("VM %s: libvirt definition differs from the record in %s", vmName, strings.Join(fields, ", ")),
+		Status:       "triggered",
+	}
+	if err := s.historyRepo.Create(ctx, history); err != nil {
+		log.Printf("[ALERT] Failed to create alert history: %v", err)
+		return
+	}
+	log.Printf("[ALERT] Drift alert: %s", history.Message)
+}
+
 func (s *AlertService) sendNotification(notification models.AlertNotification) {
 	for _, channel := range notification.Channels {
 		switch channel {
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"vmmanager/internal/diskcrypt"
 	"vmmanager/internal/libvirt"
 	"vmmanager/internal/models"
 	"vmmanager/internal/repository"
@@ -21,6 +22,7 @@ type BackupService struct {
 	scheduleRepo *repository.BackupScheduleRepository
 	vmRepo       *repository.VMRepository
 	libvirt      *libvirt.Client
+	keyring      *diskcrypt.Keyring
 	backupDir    string
 	stopChan     chan struct{}
 	wg           sync.WaitGroup
@@ -46,6 +48,17 @@ func NewBackupService(
 	}
 }
 
+// SetKeyring lets the service restore encrypted backups whose key differs
+// from the current key of the VM.
+func (s *BackupService) SetKeyring(keyring *diskcrypt.Keyring) {
+	s.keyring = keyring
+}
+
+// BackupDir is where the service writes backups.
+func (s *BackupService) BackupDir() string {
+	return s.backupDir
+}
+
 func (s *BackupService) Start() {
 	log.Println("[BackupService] Starting backup service...")
 
@@ -226,6 +239,8 @@ func (s *BackupService) ExecuteBackup(backupID string) error {
 
 	backup.FilePath = backupPath
 	backup.FileSize = fileInfo.Size()
+	backup.Encrypted = vm.Encryption.Enabled
+	backup.EncryptionKey = vm.Encryption.WrappedKey
 	backup.Status = "completed"
 	backup.Progress = 100
 	now := time.Now()
@@ -311,7 +326,7 @@ func (s *BackupService) RestoreBackup(backupID string, vmID string) error {
 		return fmt.Errorf("backup file not found: %s", backup.FilePath)
 	}
 
-	if err := s.copyDiskFile(backup.FilePath, vm.DiskPath); err != nil {
+	if err := s.restoreDisk(ctx, backup, vm); err != nil {
 		return fmt.Errorf("failed to restore disk: %w", err)
 	}
 
@@ -319,6 +334,39 @@ func (s *BackupService) RestoreBackup(backupID string, vmID string) error {
 	return nil
 }
 
+// restoreDisk writes the disk of backup over the disk of vm. A backup that
+// opens with the current key of vm is copied as is. Any other one, after a
+// key rotation or when restoring to another VM, is converted to the
+// encryption of vm.
+func (s *BackupService) restoreDisk(ctx context.Context, backup *models.VMBackup, vm *models.VirtualMachine) error {
+	if backup.EncryptionKey == vm.Encryption.WrappedKey {
+		return s.copyDiskFile(backup.FilePath, vm.DiskPath)
+	}
+	if s.keyring == nil {
+		return fmt.Errorf("no master key is configured to re-encrypt the backup")
+	}
+
+	var srcPass, dstPass []byte
+	var err error
+	if backup.Encrypted {
+		if srcPass, err = s.keyring.Unwrap(backup.EncryptionKey); err != nil {
+			return err
+		}
+	}
+	if vm.Encryption.Enabled {
+		if dstPass, err = s.keyring.Unwrap(vm.Encryption.WrappedKey); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := vm.DiskPath + ".restore"
+	if err := diskcrypt.ConvertImage(ctx, backup.FilePath, srcPass, tmpPath, dstPass); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, vm.DiskPath)
+}
+
 func (s *BackupService) cleanupExpiredBackups() {
 	ctx := context.Background()
 
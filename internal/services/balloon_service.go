@@ -0,0 +1,133 @@
+package services
+
+import (
+	"log"
+	"sync"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+)
+
+const (
+	// A guest with less than balloonGrowBelow percent of its memory free,
+	// or with more than balloonFaultBurst major faults since the last run,
+	// gets memory back; one with more than balloonShrinkAbove percent free
+	// gives some up.
+	balloonGrowBelow   = 15
+	balloonShrinkAbove = 40
+	balloonFaultBurst  = 100
+	// balloonHeadroom is the percent of free memory a guest is left with
+	// after a change.
+	balloonHeadroom = 30
+	// The balloon shrinks a guest by at most balloonShrinkStep and grows it
+	// by at least balloonGrowStep percent of its allocated memory per run,
+	// and leaves it alone for changes below balloonHysteresis percent.
+	balloonShrinkStep = 10
+	balloonGrowStep   = 25
+	balloonHysteresis = 2
+)
+
+// BalloonService moves memory between idle and busy guests that have the
+// automatic balloon policy, from the stats the scheduler collects.
+type BalloonService struct {
+	libvirt *libvirt.Client
+	mu      sync.Mutex
+	faults  map[string]uint64
+}
+
+func NewBalloonService(libvirtClient *libvirt.Client) *BalloonService {
+	return &BalloonService{
+		libvirt: libvirtClient,
+		faults:  make(map[string]uint64),
+	}
+}
+
+// balloonLimits returns the floor and the ceiling of the memory of vm, in
+// KiB. The ceiling is the allocated memory and the floor defaults to half
+// of it.
+func balloonLimits(vm *models.VirtualMachine) (uint64, uint64) {
+	maxKB := uint64(vm.MemoryAllocated) * 1024
+	minKB := uint64(vm.Balloon.MinMemory) * 1024
+	if minKB == 0 {
+		minKB = maxKB / 2
+	}
+	if minKB > maxKB {
+		minKB = maxKB
+	}
+	return minKB, maxKB
+}
+
+// balloonTarget returns the memory a guest should have, in KiB, given its
+// stats, the major faults since the last run and its limits. It returns
+// the current size when nothing should change.
+func balloonTarget(stats *libvirt.MemoryStats, newFaults, minKB, maxKB uint64) uint64 {
+	actual := stats.Actual
+	if !stats.HasGuestStats() || actual == 0 {
+		return actual
+	}
+
+	unused := stats.Unused
+	if unused > stats.Available {
+		unused = stats.Available
+	}
+	used := stats.Available - unused
+	free := unused * 100 / stats.Available
+	want := used * 100 / (100 - balloonHeadroom)
+
+	target := actual
+	switch {
+	case free < balloonGrowBelow || newFaults > balloonFaultBurst:
+		target = max(want, actual+maxKB*balloonGrowStep/100)
+	case free > balloonShrinkAbove:
+		step := maxKB * balloonShrinkStep / 100
+		target = want
+		if actual > step && target < actual-step {
+			target = actual - step
+		}
+	}
+
+	target = min(max(target, minKB), maxKB)
+	diff := max(target, actual) - min(target, actual)
+	if diff < maxKB*balloonHysteresis/100 {
+		return actual
+	}
+	return target
+}
+
+// Balance resizes the balloon of the running vm from its latest stats.
+func (s *BalloonService) Balance(vm *models.VirtualMachine, stats *libvirt.MemoryStats) {
+	if s.libvirt == nil || vm.LibvirtDomainUUID == "" {
+		return
+	}
+
+	id := vm.ID.String()
+	s.mu.Lock()
+	last, seen := s.faults[id]
+	s.faults[id] = stats.MajorFaults
+	s.mu.Unlock()
+
+	// The counter starts over when the guest reboots.
+	var newFaults uint64
+	if seen && stats.MajorFaults > last {
+		newFaults = stats.MajorFaults - last
+	}
+
+	minKB, maxKB := balloonLimits(vm)
+	target := balloonTarget(stats, newFaults, minKB, maxKB)
+	if target == stats.Actual {
+		return
+	}
+
+	if err := s.libvirt.SetBalloon(vm.LibvirtDomainUUID, target); err != nil {
+		log.Printf("[BALLOON] Failed to resize balloon of VM %s: %v", vm.Name, err)
+		return
+	}
+	log.Printf("[BALLOON] VM %s memory %d MB -> %d MB", vm.Name, stats.Actual/1024, target/1024)
+}
+
+// Forget drops what the service remembers about the VM with id.
+func (s *BalloonService) Forget(id string) {
+	s.mu.Lock()
+	delete(s.faults, id)
+	s.mu.Unlock()
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"testing"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+)
+
+func TestBalloonLimits(t *testing.T) {
+	tests := []struct {
+		name             string
+		memory, min      int
+		wantMin, wantMax uint64
+	}{
+		{name: "half by default", memory: 4096, wantMin: 2048 * 1024, wantMax: 4096 * 1024},
+		{name: "configured floor", memory: 4096, min: 1024, wantMin: 1024 * 1024, wantMax: 4096 * 1024},
+		{name: "floor above allocation", memory: 1024, min: 2048, wantMin: 1024 * 1024, wantMax: 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &models.VirtualMachine{MemoryAllocated: tt.memory, Balloon: models.BalloonPolicy{Auto: true, MinMemory: tt.min}}
+			minKB, maxKB := balloonLimits(vm)
+			if minKB != tt.wantMin || maxKB != tt.wantMax {
+				t.Errorf("balloonLimits = %d, %d, want %d, %d", minKB, maxKB, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestBalloonTarget(t *testing.T) {
+	const (
+		gib   = 1024 * 1024
+		minKB = 1 * gib
+		maxKB = 4 * gib
+	)
+	// guest returns the stats of a guest with actual KiB, of which the
+	// given percent is free.
+	guest := func(actual uint64, freePercent uint64) *libvirt.MemoryStats {
+		return &libvirt.MemoryStats{Actual: actual, Available: actual, Unused: actual * freePercent / 100}
+	}
+
+	tests := []struct {
+		name      string
+		stats     *libvirt.MemoryStats
+		newFaults uint64
+		want      uint64
+	}{
+		{name: "no guest stats", stats: &libvirt.MemoryStats{Actual: 2 * gib}, want: 2 * gib},
+		{name: "steady", stats: guest(2*gib, 30), want: 2 * gib},
+		{name: "grows under pressure", stats: guest(2*gib, 5), want: 3 * gib},
+		{name: "grows on a fault burst", stats: guest(2*gib, 30), newFaults: balloonFaultBurst + 1, want: 3 * gib},
+		{name: "few faults ignored", stats: guest(2*gib, 30), newFaults: balloonFaultBurst, want: 2 * gib},
+		{name: "growth capped at the allocation", stats: guest(3*gib+gib/2, 5), want: maxKB},
+		{name: "full size under pressure", stats: guest(maxKB, 5), want: maxKB},
+		{name: "shrinks one step when idle", stats: guest(maxKB, 80), want: maxKB - maxKB*balloonShrinkStep/100},
+		{name: "shrink stops at the floor", stats: guest(minKB+gib/5, 90), want: minKB},
+		{name: "small change skipped", stats: guest(minKB+maxKB/100, 90), want: minKB + maxKB/100},
+		{
+			name:  "unused above available",
+			stats: &libvirt.MemoryStats{Actual: maxKB, Available: 2 * gib, Unused: 3 * gib},
+			want:  maxKB - maxKB*balloonShrinkStep/100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := balloonTarget(tt.stats, tt.newFaults, minKB, maxKB); got != tt.want {
+				t.Errorf("balloonTarget = %d KiB, want %d KiB", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+)
+
+// Fields of a VM record that are compared with the persistent definition of
+// its domain.
+const (
+	DriftFieldCPU        = "cpu"
+	DriftFieldMemory     = "memory"
+	DriftFieldDiskPath   = "disk_path"
+	DriftFieldMACAddress = "mac_address"
+	DriftFieldVNCPort    = "vnc_port"
+)
+
+// Resolutions of a drift. An admin either takes the value of libvirt into
+// the record or writes the value of the record into the definition; a drift
+// is cleared when the two agree again by other means.
+const (
+	DriftResolutionAcceptLibvirt = "accept_libvirt"
+	DriftResolutionEnforceDB     = "enforce_db"
+	DriftResolutionCleared       = "cleared"
+)
+
+// FieldDrift is a field on which a VM record and its domain disagree.
+type FieldDrift struct {
+	Field        string
+	DBValue      string
+	LibvirtValue string
+}
+
+type DriftEvent struct {
+	Type      string           `json:"type"`
+	VMID      string           `json:"vm_id"`
+	VMName    string           `json:"vm_name"`
+	Drifts    []models.VMDrift `json:"drifts"`
+	Timestamp time.Time        `json:"timestamp"`
+}
+
+// DriftService compares every VM record with the persistent definition of
+// its domain, keeps a drift record per differing field and raises an alert
+// when a VM starts to drift.
+type DriftService struct {
+	libvirt      *libvirt.Client
+	vmRepo       *repository.VMRepository
+	driftRepo    *repository.VMDriftRepository
+	alertService *AlertService
+	wsHub        *WebSocketHub
+	stopChan     chan struct{}
+	wg           sync.WaitGroup
+	interval     time.Duration
+}
+
+func NewDriftService(libvirtClient *libvirt.Client, vmRepo *repository.VMRepository, driftRepo *repository.VMDriftRepository, interval time.Duration) *DriftService {
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+
+	return &DriftService{
+		libvirt:   libvirtClient,
+		vmRepo:    vmRepo,
+		driftRepo: driftRepo,
+		stopChan:  make(chan struct{}),
+		interval:  interval,
+	}
+}
+
+// SetAlerting makes new drift raise an alert and go out to the websocket
+// clients of wsHub.
+func (s *DriftService) SetAlerting(alertService *AlertService, wsHub *WebSocketHub) {
+	s.alertService = alertService
+	s.wsHub = wsHub
+}
+
+func (s *DriftService) Start() {
+	s.wg.Add(1)
+	go s.reconcileLoop()
+	log.Printf("[DRIFT] Service started with reconcile interval: %v", s.interval)
+}
+
+func (s *DriftService) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+	log.Printf("[DRIFT] Service stopped")
+}
+
+func (s *DriftService) reconcileLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if _, err := s.ReconcileAll(ctx); err != nil {
+				log.Printf("[DRIFT] Reconcile failed: %v", err)
+			}
+			cancel()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// ReconcileAll reconciles every VM with a defined domain and returns how
+// many drifts are open afterwards.
+func (s *DriftService) ReconcileAll(ctx context.Context) (int, error) {
+	if s.libvirt == nil || s.vmRepo == nil || s.driftRepo == nil {
+		return 0, nil
+	}
+
+	vms, _, err := s.vmRepo.List(ctx, 0, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	open := 0
+	for i := range vms {
+		drifts, err := s.ReconcileVM(ctx, &vms[i])
+		if err != nil {
+			log.Printf("[DRIFT] Failed to reconcile VM %s: %v", vms[i].Name, err)
+			continue
+		}
+		open += len(drifts)
+	}
+	return open, nil
+}
+
+// ReconcileVM compares vm with the persistent definition of its domain and
+// brings its drift records up to date. Fields that drifted for the first
+// time are reported. It returns the open drifts of vm.
+func (s *DriftService) ReconcileVM(ctx context.Context, vm *models.VirtualMachine) ([]models.VMDrift, error) {
+	if s.libvirt == nil || vm.LibvirtDomainUUID == "" || isTransitionalStatus(vm.Status) {
+		return nil, nil
+	}
+
+	xmlDesc, err := s.libvirt.GetDomainXML(vm.LibvirtDomainUUID)
+	if err != nil {
+		// An undefined domain is not drift; StartVM defines it again.
+		return nil, nil
+	}
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.driftRepo.ListOpen(ctx, vm.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	byField := make(map[string]models.VMDrift, len(existing))
+	for _, drift := range existing {
+		byField[drift.Field] = drift
+	}
+
+	var open, added []models.VMDrift
+	for _, found := range DetectDrift(vm, def) {
+		drift, ok := byField[found.Field]
+		delete(byField, found.Field)
+		if ok {
+			if drift.DBValue != found.DBValue || drift.LibvirtValue != found.LibvirtValue {
+				drift.DBValue = found.DBValue
+				drift.LibvirtValue = found.LibvirtValue
+				if err := s.driftRepo.Update(ctx, &drift); err != nil {
+					return nil, err
+				}
+			}
+			open = append(open, drift)
+			continue
+		}
+
+		drift = models.VMDrift{
+			VMID:         vm.ID,
+			Field:        found.Field,
+			DBValue:      found.DBValue,
+			LibvirtValue: found.LibvirtValue,
+			Status:       "open",
+			DetectedAt:   time.Now(),
+		}
+		if err := s.driftRepo.Create(ctx, &drift); err != nil {
+			return nil, err
+		}
+		open = append(open, drift)
+		added = append(added, drift)
+	}
+
+	for _, drift := range byField {
+		if err := s.driftRepo.Resolve(ctx, drift.ID, DriftResolutionCleared, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(added) > 0 {
+		s.reportDrift(ctx, vm, added)
+	}
+	return open, nil
+}
+
+func (s *DriftService) reportDrift(ctx context.Context, vm *models.VirtualMachine, drifts []models.VMDrift) {
+	fields := make([]string, 0, len(drifts))
+	for _, drift := range drifts {
+		fields = append(fields, drift.Field)
+	}
+	log.Printf("[DRIFT] VM %s drifted from its domain in %s", vm.Name, strings.Join(fields, ", "))
+
+	if s.alertService != nil {
+		s.alertService.ReportDrift(ctx, vm.ID.String(), vm.Name, fields)
+	}
+
+	if s.wsHub != nil {
+		message, err := json.Marshal(map[string]interface{}{
+			"type": "vm_drift_detected",
+			"data": DriftEvent{
+				Type:      "drift_detected",
+				VMID:      vm.ID.String(),
+				VMName:    vm.Name,
+				Drifts:    drifts,
+				Timestamp: time.Now(),
+			},
+		})
+		if err != nil {
+			log.Printf("[DRIFT] Failed to marshal message: %v", err)
+			return
+		}
+		s.wsHub.Broadcast(message)
+	}
+}
+
+// rootDisk returns the first disk of def with a source, which is the system
+// disk of the VMs this manager defines.
+func rootDisk(def *libvirt.DomainDef) *libvirt.DomainDisk {
+	for _, disk := range def.DisksByDevice("disk") {
+		if disk.Source != nil && (disk.Source.File != "" || disk.Source.Dev != "") {
+			return disk
+		}
+	}
+	return nil
+}
+
+func primaryInterface(def *libvirt.DomainDef) *libvirt.DomainInterface {
+	if def.Devices == nil {
+		return nil
+	}
+	for i := range def.Devices.Interfaces {
+		if iface := &def.Devices.Interfaces[i]; iface.MAC != nil {
+			return iface
+		}
+	}
+	return nil
+}
+
+// fixedGraphicsPort returns the port of the first display of def, or 0 when
+// libvirt picks one when the domain starts.
+func fixedGraphicsPort(def *libvirt.DomainDef) int {
+	if def.Devices == nil || len(def.Devices.Graphics) == 0 {
+		return 0
+	}
+	graphics := def.Devices.Graphics[0]
+	if graphics.AutoPort == "yes" || graphics.Port <= 0 {
+		return 0
+	}
+	return graphics.Port
+}
+
+// DetectDrift lists the fields on which vm and def, the persistent
+// definition of its domain, disagree. Fields the record leaves empty are
+// not compared, and the display port only when def fixes one, as the
+// record keeps the port the domain last ran on.
+func DetectDrift(vm *models.VirtualMachine, def *libvirt.DomainDef) []FieldDrift {
+	var drifts []FieldDrift
+	add := func(field, dbValue, libvirtValue string) {
+		if dbValue != libvirtValue {
+			drifts = append(drifts, FieldDrift{Field: field, DBValue: dbValue, LibvirtValue: libvirtValue})
+		}
+	}
+
+	if def.VCPU != nil {
+		add(DriftFieldCPU, strconv.Itoa(vm.CPUAllocated), strconv.Itoa(def.VCPU.Value))
+	}
+	if def.Memory != nil {
+		add(DriftFieldMemory, strconv.Itoa(vm.MemoryAllocated), strconv.FormatUint(def.Memory.KiB()/1024, 10))
+	}
+	if vm.DiskPath != "" {
+		path := ""
+		if disk := rootDisk(def); disk != nil {
+			path = disk.Source.File
+			if path == "" {
+				path = disk.Source.Dev
+			}
+		}
+		add(DriftFieldDiskPath, vm.DiskPath, path)
+	}
+	if vm.MACAddress != "" {
+		mac := ""
+		if iface := primaryInterface(def); iface != nil {
+			mac = strings.ToLower(iface.MAC.Address)
+		}
+		add(DriftFieldMACAddress, strings.ToLower(vm.MACAddress), mac)
+	}
+	if port := fixedGraphicsPort(def); port != 0 {
+		add(DriftFieldVNCPort, strconv.Itoa(vm.VNCPort), strconv.Itoa(port))
+	}
+	return drifts
+}
+
+// AcceptLibvirtValue sets field of vm to value, as found in the definition
+// of its domain.
+func AcceptLibvirtValue(vm *models.VirtualMachine, field, value string) error {
+	switch field {
+	case DriftFieldCPU, DriftFieldMemory, DriftFieldVNCPort:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s value %q", field, value)
+		}
+		switch field {
+		case DriftFieldCPU:
+			vm.CPUAllocated = n
+		case DriftFieldMemory:
+			vm.MemoryAllocated = n
+		default:
+			vm.VNCPort = n
+		}
+	case DriftFieldDiskPath:
+		if value == "" {
+			return fmt.Errorf("domain has no system disk")
+		}
+		vm.DiskPath = value
+	case DriftFieldMACAddress:
+		if value == "" {
+			return fmt.Errorf("domain has no network interface")
+		}
+		vm.MACAddress = value
+	default:
+		return fmt.Errorf("unknown drift field %s", field)
+	}
+	return nil
+}
+
+// EnforceDBValue writes field of vm into def, leaving the rest of the
+// definition as it is.
+func EnforceDBValue(def *libvirt.DomainDef, vm *models.VirtualMachine, field string) error {
+	switch field {
+	case DriftFieldCPU:
+		if def.VCPU == nil {
+			def.VCPU = &libvirt.DomainVCPU{Placement: "static"}
+		}
+		def.VCPU.Value = vm.CPUAllocated
+		if def.VCPU.Current != 0 {
+			def.VCPU.Current = vm.CPUAllocated
+		}
+	case DriftFieldMemory:
+		def.Memory = &libvirt.DomainMemory{Unit: "MiB", Value: uint64(vm.MemoryAllocated)}
+		def.CurrentMemory = &libvirt.DomainMemory{Unit: "MiB", Value: uint64(vm.MemoryAllocated)}
+	case DriftFieldDiskPath:
+		disk := rootDisk(def)
+		if disk == nil {
+			return fmt.Errorf("domain has no system disk")
+		}
+		if disk.Source.Dev != "" {
+			return fmt.Errorf("system disk is a block device")
+		}
+		disk.Source.File = vm.DiskPath
+	case DriftFieldMACAddress:
+		iface := primaryInterface(def)
+		if iface == nil {
+			return fmt.Errorf("domain has no network interface")
+		}
+		iface.MAC.Address = vm.MACAddress
+	case DriftFieldVNCPort:
+		if def.Devices == nil || len(def.Devices.Graphics) == 0 {
+			return fmt.Errorf("domain has no display")
+		}
+		graphics := &def.Devices.Graphics[0]
+		if vm.VNCPort > 0 {
+			graphics.Port, graphics.AutoPort = vm.VNCPort, "no"
+		} else {
+			graphics.Port, graphics.AutoPort = -1, "yes"
+		}
+	default:
+		return fmt.Errorf("unknown drift field %s", field)
+	}
+	return nil
+}
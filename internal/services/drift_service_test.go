@@ -0,0 +1,303 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+)
+
+func driftVM() *models.VirtualMachine {
+	return &models.VirtualMachine{
+		Name:            "drift",
+		CPUAllocated:    2,
+		MemoryAllocated: 2048,
+		DiskPath:        "/var/lib/vmmanager/drift.qcow2",
+		MACAddress:      "52:54:00:12:34:56",
+		VNCPort:         5901,
+	}
+}
+
+// driftDef returns a definition that matches driftVM, with a display whose
+// port libvirt picks.
+func driftDef() *libvirt.DomainDef {
+	return &libvirt.DomainDef{
+		Name:   "drift",
+		VCPU:   &libvirt.DomainVCPU{Placement: "static", Value: 2},
+		Memory: &libvirt.DomainMemory{Unit: "KiB", Value: 2048 * 1024},
+		Devices: &libvirt.DomainDevices{
+			Disks: []libvirt.DomainDisk{
+				{Type: "file", Device: "cdrom", Source: &libvirt.DiskSource{File: "/isos/install.iso"}},
+				{Type: "file", Device: "disk", Source: &libvirt.DiskSource{File: "/var/lib/vmmanager/drift.qcow2"}},
+			},
+			Interfaces: []libvirt.DomainInterface{
+				{Type: "network", MAC: &libvirt.InterfaceMAC{Address: "52:54:00:12:34:56"}},
+			},
+			Graphics: []libvirt.DomainGraphics{{Type: "vnc", Port: -1, AutoPort: "yes"}},
+		},
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		vm     func(*models.VirtualMachine)
+		def    func(*libvirt.DomainDef)
+		drifts []FieldDrift
+	}{
+		{name: "in sync"},
+		{
+			name:   "vcpus",
+			def:    func(d *libvirt.DomainDef) { d.VCPU.Value = 4 },
+			drifts: []FieldDrift{{Field: DriftFieldCPU, DBValue: "2", LibvirtValue: "4"}},
+		},
+		{
+			name:   "memory in another unit",
+			def:    func(d *libvirt.DomainDef) { d.Memory = &libvirt.DomainMemory{Unit: "GiB", Value: 4} },
+			drifts: []FieldDrift{{Field: DriftFieldMemory, DBValue: "2048", LibvirtValue: "4096"}},
+		},
+		{
+			name: "same memory in another unit",
+			def:  func(d *libvirt.DomainDef) { d.Memory = &libvirt.DomainMemory{Unit: "MiB", Value: 2048} },
+		},
+		{
+			name:   "disk path",
+			def:    func(d *libvirt.DomainDef) { d.Devices.Disks[1].Source.File = "/srv/other.qcow2" },
+			drifts: []FieldDrift{{Field: DriftFieldDiskPath, DBValue: "/var/lib/vmmanager/drift.qcow2", LibvirtValue: "/srv/other.qcow2"}},
+		},
+		{
+			name:   "block device disk",
+			def:    func(d *libvirt.DomainDef) { d.Devices.Disks[1].Source = &libvirt.DiskSource{Dev: "/dev/vg0/drift"} },
+			drifts: []FieldDrift{{Field: DriftFieldDiskPath, DBValue: "/var/lib/vmmanager/drift.qcow2", LibvirtValue: "/dev/vg0/drift"}},
+		},
+		{
+			name:   "disk removed",
+			def:    func(d *libvirt.DomainDef) { d.Devices.Disks = d.Devices.Disks[:1] },
+			drifts: []FieldDrift{{Field: DriftFieldDiskPath, DBValue: "/var/lib/vmmanager/drift.qcow2"}},
+		},
+		{
+			name: "disk path not recorded",
+			vm:   func(vm *models.VirtualMachine) { vm.DiskPath = "" },
+			def:  func(d *libvirt.DomainDef) { d.Devices.Disks[1].Source.File = "/srv/other.qcow2" },
+		},
+		{
+			name: "MAC case ignored",
+			vm:   func(vm *models.VirtualMachine) { vm.MACAddress = "52:54:00:AB:CD:EF" },
+			def:  func(d *libvirt.DomainDef) { d.Devices.Interfaces[0].MAC.Address = "52:54:00:ab:cd:ef" },
+		},
+		{
+			name:   "MAC",
+			def:    func(d *libvirt.DomainDef) { d.Devices.Interfaces[0].MAC.Address = "52:54:00:AB:CD:EF" },
+			drifts: []FieldDrift{{Field: DriftFieldMACAddress, DBValue: "52:54:00:12:34:56", LibvirtValue: "52:54:00:ab:cd:ef"}},
+		},
+		{
+			name:   "interface removed",
+			def:    func(d *libvirt.DomainDef) { d.Devices.Interfaces = nil },
+			drifts: []FieldDrift{{Field: DriftFieldMACAddress, DBValue: "52:54:00:12:34:56"}},
+		},
+		{
+			name:   "fixed display port",
+			def:    func(d *libvirt.DomainDef) { d.Devices.Graphics[0].Port, d.Devices.Graphics[0].AutoPort = 5905, "no" },
+			drifts: []FieldDrift{{Field: DriftFieldVNCPort, DBValue: "5901", LibvirtValue: "5905"}},
+		},
+		{
+			name: "automatic display port",
+			vm:   func(vm *models.VirtualMachine) { vm.VNCPort = 5999 },
+		},
+		{
+			name: "several fields",
+			def: func(d *libvirt.DomainDef) {
+				d.VCPU.Value = 1
+				d.Devices.Interfaces[0].MAC.Address = "52:54:00:00:00:01"
+			},
+			drifts: []FieldDrift{
+				{Field: DriftFieldCPU, DBValue: "2", LibvirtValue: "1"},
+				{Field: DriftFieldMACAddress, DBValue: "52:54:00:12:34:56", LibvirtValue: "52:54:00:00:00:01"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, def := driftVM(), driftDef()
+			if tt.vm != nil {
+				tt.vm(vm)
+			}
+			if tt.def != nil {
+				tt.def(def)
+			}
+			if got := DetectDrift(vm, def); !reflect.DeepEqual(got, tt.drifts) {
+				t.Errorf("DetectDrift = %+v, want %+v", got, tt.drifts)
+			}
+		})
+	}
+}
+
+func TestAcceptLibvirtValue(t *testing.T) {
+	tests := []struct {
+		field, value string
+		want         func(*models.VirtualMachine)
+		wantErr      bool
+	}{
+		{field: DriftFieldCPU, value: "4", want: func(vm *models.VirtualMachine) { vm.CPUAllocated = 4 }},
+		{field: DriftFieldMemory, value: "4096", want: func(vm *models.VirtualMachine) { vm.MemoryAllocated = 4096 }},
+		{field: DriftFieldVNCPort, value: "5905", want: func(vm *models.VirtualMachine) { vm.VNCPort = 5905 }},
+		{field: DriftFieldDiskPath, value: "/srv/other.qcow2", want: func(vm *models.VirtualMachine) { vm.DiskPath = "/srv/other.qcow2" }},
+		{field: DriftFieldMACAddress, value: "52:54:00:ab:cd:ef", want: func(vm *models.VirtualMachine) { vm.MACAddress = "52:54:00:ab:cd:ef" }},
+		{field: DriftFieldCPU, value: "0", wantErr: true},
+		{field: DriftFieldMemory, value: "lots", wantErr: true},
+		{field: DriftFieldVNCPort, value: "-1", wantErr: true},
+		{field: DriftFieldDiskPath, value: "", wantErr: true},
+		{field: DriftFieldMACAddress, value: "", wantErr: true},
+		{field: "name", value: "other", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field+"="+tt.value, func(t *testing.T) {
+			vm := driftVM()
+			err := AcceptLibvirtValue(vm, tt.field, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AcceptLibvirtValue error = %v, wantErr %v", err, tt.wantErr)
+			}
+			want := driftVM()
+			if tt.want != nil {
+				tt.want(want)
+			}
+			if !reflect.DeepEqual(vm, want) {
+				t.Errorf("VM = %+v, want %+v", vm, want)
+			}
+		})
+	}
+}
+
+func TestEnforceDBValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   string
+		vm      func(*models.VirtualMachine)
+		def     func(*libvirt.DomainDef)
+		check   func(*testing.T, *libvirt.DomainDef)
+		wantErr bool
+	}{
+		{
+			name:  "vcpus with a current count",
+			field: DriftFieldCPU,
+			def:   func(d *libvirt.DomainDef) { d.VCPU = &libvirt.DomainVCPU{Placement: "static", Current: 1, Value: 4} },
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if d.VCPU.Value != 2 || d.VCPU.Current != 2 || d.VCPU.Placement != "static" {
+					t.Errorf("vcpu = %+v", d.VCPU)
+				}
+			},
+		},
+		{
+			name:  "vcpus missing",
+			field: DriftFieldCPU,
+			def:   func(d *libvirt.DomainDef) { d.VCPU = nil },
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if d.VCPU == nil || d.VCPU.Value != 2 || d.VCPU.Current != 0 {
+					t.Errorf("vcpu = %+v", d.VCPU)
+				}
+			},
+		},
+		{
+			name:  "memory",
+			field: DriftFieldMemory,
+			def:   func(d *libvirt.DomainDef) { d.Memory = &libvirt.DomainMemory{Unit: "GiB", Value: 4} },
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if d.Memory.KiB() != 2048*1024 || d.CurrentMemory.KiB() != 2048*1024 {
+					t.Errorf("memory = %+v, current %+v", d.Memory, d.CurrentMemory)
+				}
+			},
+		},
+		{
+			name:  "disk path",
+			field: DriftFieldDiskPath,
+			def:   func(d *libvirt.DomainDef) { d.Devices.Disks[1].Source.File = "/srv/other.qcow2" },
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if d.Devices.Disks[1].Source.File != "/var/lib/vmmanager/drift.qcow2" || d.Devices.Disks[0].Source.File != "/isos/install.iso" {
+					t.Errorf("disks = %+v, %+v", d.Devices.Disks[0].Source, d.Devices.Disks[1].Source)
+				}
+			},
+		},
+		{
+			name:    "block device disk",
+			field:   DriftFieldDiskPath,
+			def:     func(d *libvirt.DomainDef) { d.Devices.Disks[1].Source = &libvirt.DiskSource{Dev: "/dev/vg0/drift"} },
+			wantErr: true,
+		},
+		{
+			name:    "no disk",
+			field:   DriftFieldDiskPath,
+			def:     func(d *libvirt.DomainDef) { d.Devices.Disks = d.Devices.Disks[:1] },
+			wantErr: true,
+		},
+		{
+			name:  "MAC",
+			field: DriftFieldMACAddress,
+			def:   func(d *libvirt.DomainDef) { d.Devices.Interfaces[0].MAC.Address = "52:54:00:ab:cd:ef" },
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if got := d.Devices.Interfaces[0].MAC.Address; got != "52:54:00:12:34:56" {
+					t.Errorf("MAC = %s", got)
+				}
+			},
+		},
+		{
+			name:    "no interface",
+			field:   DriftFieldMACAddress,
+			def:     func(d *libvirt.DomainDef) { d.Devices.Interfaces = nil },
+			wantErr: true,
+		},
+		{
+			name:  "fixed display port",
+			field: DriftFieldVNCPort,
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if g := d.Devices.Graphics[0]; g.Port != 5901 || g.AutoPort != "no" {
+					t.Errorf("graphics = %+v", g)
+				}
+			},
+		},
+		{
+			name:  "automatic display port",
+			field: DriftFieldVNCPort,
+			vm:    func(vm *models.VirtualMachine) { vm.VNCPort = 0 },
+			def:   func(d *libvirt.DomainDef) { d.Devices.Graphics[0].Port, d.Devices.Graphics[0].AutoPort = 5905, "no" },
+			check: func(t *testing.T, d *libvirt.DomainDef) {
+				if g := d.Devices.Graphics[0]; g.Port != -1 || g.AutoPort != "yes" {
+					t.Errorf("graphics = %+v", g)
+				}
+			},
+		},
+		{
+			name:    "no display",
+			field:   DriftFieldVNCPort,
+			def:     func(d *libvirt.DomainDef) { d.Devices.Graphics = nil },
+			wantErr: true,
+		},
+		{name: "unknown field", field: "name", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, def := driftVM(), driftDef()
+			if tt.vm != nil {
+				tt.vm(vm)
+			}
+			if tt.def != nil {
+				tt.def(def)
+			}
+			err := EnforceDBValue(def, vm, tt.field)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnforceDBValue error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, def)
+			}
+			if err == nil {
+				if drifts := DetectDrift(vm, def); len(drifts) != 0 {
+					t.Errorf("drift left after enforcing %s: %+v", tt.field, drifts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+)
+
+type GuestInfo struct {
+	Hostname     string                    `json:"hostname"`
+	OS           *libvirt.GuestOSInfo      `json:"os,omitempty"`
+	Interfaces   []libvirt.GuestInterface  `json:"interfaces"`
+	Filesystems  []libvirt.GuestFilesystem `json:"filesystems"`
+	Users        []libvirt.GuestUser       `json:"users"`
+	PrimaryIP    string                    `json:"primaryIp"`
+	CollectedAt  time.Time                 `json:"collectedAt"`
+	PartialError string                    `json:"partialError,omitempty"`
+}
+
+type GuestAgentService struct {
+	libvirt  *libvirt.Client
+	vmRepo   *repository.VMRepository
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	interval time.Duration
+}
+
+func NewGuestAgentService(libvirtClient *libvirt.Client, vmRepo *repository.VMRepository, interval time.Duration) *GuestAgentService {
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	return &GuestAgentService{
+		libvirt:  libvirtClient,
+		vmRepo:   vmRepo,
+		stopChan: make(chan struct{}),
+		interval: interval,
+	}
+}
+
+func (s *GuestAgentService) Start() {
+	s.wg.Add(1)
+	go s.collectLoop()
+	log.Printf("[GUEST_AGENT] Service started with collect interval: %v", s.interval)
+}
+
+func (s *GuestAgentService) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+	log.Printf("[GUEST_AGENT] Service stopped")
+}
+
+func (s *GuestAgentService) collectLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.collectAll()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *GuestAgentService) collectAll() {
+	if s.libvirt == nil || s.vmRepo == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	vms, err := s.vmRepo.ListByStatus(ctx, "running")
+	if err != nil {
+		log.Printf("[GUEST_AGENT] Failed to list running VMs: %v", err)
+		return
+	}
+
+	for i := range vms {
+		vm := &vms[i]
+		if vm.LibvirtDomainUUID == "" {
+			continue
+		}
+		if _, err := s.Collect(ctx, vm); err != nil && vm.AgentConnected {
+			log.Printf("[GUEST_AGENT] Guest agent for VM %s became unreachable: %v", vm.Name, err)
+		}
+	}
+}
+
+// Collect queries the guest agent of a running VM and stores the result on the
+// VM record. Only the ping is mandatory; individual queries that the guest
+// does not support are reported in PartialError.
+func (s *GuestAgentService) Collect(ctx context.Context, vm *models.VirtualMachine) (*GuestInfo, error) {
+	if s.libvirt == nil {
+		return nil, fmt.Errorf("libvirt client is not initialized")
+	}
+
+	if err := s.libvirt.GuestPing(vm.LibvirtDomainUUID); err != nil {
+		if vm.AgentConnected {
+			s.vmRepo.UpdateAgentConnected(ctx, vm.ID.String(), false)
+		}
+		return nil, fmt.Errorf("guest agent not responding: %w", err)
+	}
+
+	info := &GuestInfo{CollectedAt: time.Now()}
+	var errs []string
+
+	if hostname, err := s.libvirt.GuestGetHostname(vm.LibvirtDomainUUID); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		info.Hostname = hostname
+	}
+
+	if osInfo, err := s.libvirt.GuestGetOSInfo(vm.LibvirtDomainUUID); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		info.OS = osInfo
+	}
+
+	if ifaces, err := s.libvirt.GuestGetInterfaces(vm.LibvirtDomainUUID); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		info.Interfaces = ifaces
+		info.PrimaryIP = primaryGuestIP(ifaces, vm.MACAddress)
+	}
+
+	if fs, err := s.libvirt.GuestGetFilesystems(vm.LibvirtDomainUUID); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		info.Filesystems = fs
+	}
+
+	if users, err := s.libvirt.GuestGetUsers(vm.LibvirtDomainUUID); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		info.Users = users
+	}
+
+	if len(errs) > 0 {
+		info.PartialError = strings.Join(errs, "; ")
+	}
+
+	guestOS := ""
+	if info.OS != nil {
+		guestOS = info.OS.PrettyName
+		if guestOS == "" {
+			guestOS = strings.TrimSpace(info.OS.Name + " " + info.OS.Version)
+		}
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode guest info: %w", err)
+	}
+
+	if err := s.vmRepo.UpdateGuestInfo(ctx, vm.ID.String(), info.Hostname, guestOS, string(data), info.PrimaryIP); err != nil {
+		return info, fmt.Errorf("failed to save guest info: %w", err)
+	}
+
+	return info, nil
+}
+
+// primaryGuestIP prefers an IPv4 address on the interface matching the VM's
+// MAC, falling back to the first global IPv4 address reported by the guest.
+func primaryGuestIP(ifaces []libvirt.GuestInterface, mac string) string {
+	fallback := ""
+	for _, iface := range ifaces {
+		for _, addr := range iface.IPAddresses {
+			if addr.Type != "ipv4" {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if mac != "" && strings.EqualFold(iface.HardwareAddress, mac) {
+				return addr.Address
+			}
+			if fallback == "" {
+				fallback = addr.Address
+			}
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"testing"
+
+	"vmmanager/internal/libvirt"
+)
+
+func TestPrimaryGuestIP(t *testing.T) {
+	loopback := libvirt.GuestInterface{Name: "lo", HardwareAddress: "00:00:00:00:00:00", IPAddresses: []libvirt.GuestIPAddress{
+		{Type: "ipv4", Address: "127.0.0.1", Prefix: 8},
+	}}
+	docker := libvirt.GuestInterface{Name: "docker0", HardwareAddress: "02:42:ac:11:00:01", IPAddresses: []libvirt.GuestIPAddress{
+		{Type: "ipv4", Address: "172.17.0.1", Prefix: 16},
+	}}
+	primary := libvirt.GuestInterface{Name: "enp1s0", HardwareAddress: "52:54:00:12:34:56", IPAddresses: []libvirt.GuestIPAddress{
+		{Type: "ipv6", Address: "2001:db8::10", Prefix: 64},
+		{Type: "ipv4", Address: "169.254.10.20", Prefix: 16},
+		{Type: "ipv4", Address: "192.168.122.10", Prefix: 24},
+	}}
+	linkLocalOnly := libvirt.GuestInterface{Name: "enp2s0", HardwareAddress: "52:54:00:ab:cd:ef", IPAddresses: []libvirt.GuestIPAddress{
+		{Type: "ipv6", Address: "fe80::5054:ff:feab:cdef", Prefix: 64},
+		{Type: "ipv4", Address: "169.254.1.1", Prefix: 16},
+	}}
+
+	tests := []struct {
+		name   string
+		ifaces []libvirt.GuestInterface
+		mac    string
+		want   string
+	}{
+		{"matching MAC wins over earlier interfaces", []libvirt.GuestInterface{loopback, docker, primary}, "52:54:00:12:34:56", "192.168.122.10"},
+		{"MAC compared case-insensitively", []libvirt.GuestInterface{primary, docker}, "02:42:AC:11:00:01", "172.17.0.1"},
+		{"falls back to the first global IPv4", []libvirt.GuestInterface{loopback, docker, primary}, "52:54:00:99:99:99", "172.17.0.1"},
+		{"no MAC known", []libvirt.GuestInterface{loopback, primary}, "", "192.168.122.10"},
+		{"matching interface without a usable address", []libvirt.GuestInterface{linkLocalOnly, docker}, "52:54:00:ab:cd:ef", "172.17.0.1"},
+		{"only loopback and link-local", []libvirt.GuestInterface{loopback, linkLocalOnly}, "", ""},
+		{"no interfaces", nil, "52:54:00:12:34:56", ""},
+	}
+	for _, tt := range tests {
+		if got := primaryGuestIP(tt.ifaces, tt.mac); got != tt.want {
+			t.Errorf("%s: primaryGuestIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"sync"
 	"time"
 
@@ -25,6 +28,39 @@ const (
 	InstallStatusPaused     InstallStatus = "paused"
 )
 
+// Install steps reported in InstallProgress.CurrentStep.
+const (
+	InstallStepBootingInstaller  = "booting_installer"
+	InstallStepInstalling        = "installing"
+	InstallStepRebooting         = "rebooting"
+	InstallStepFirstBootComplete = "first_boot_complete"
+)
+
+// Signals that tell the monitor the installer has finished.
+const (
+	InstallSignalSerialMarker = "serial_marker"
+	InstallSignalCDROMEject   = "cdrom_eject"
+	InstallSignalShutdown     = "shutdown"
+)
+
+const (
+	// DefaultCompletionMarker is searched for on the serial console when
+	// no marker is configured.
+	DefaultCompletionMarker = "VMMANAGER-INSTALL-COMPLETE"
+
+	defaultFirstBootTimeout = 10 * time.Minute
+	// installerWriteThreshold is how much an installer has to write to the
+	// system disk before it counts as installing rather than booting.
+	installerWriteThreshold = 64 << 20
+	expectedInstallBytes    = 4 << 30
+	installingProgressFloor = 10
+	maxSerialLogRead        = 4 << 20
+)
+
+// InstallCompleteFunc detaches the install media of vm once its installer
+// has finished and boots the installed system.
+type InstallCompleteFunc func(ctx context.Context, vm *models.VirtualMachine) error
+
 type InstallProgress struct {
 	VMID         string        `json:"vmId"`
 	VMName       string        `json:"vmName"`
@@ -36,18 +72,31 @@ type InstallProgress struct {
 	CompletedAt  *time.Time    `json:"completedAt,omitempty"`
 	StartedAt    *time.Time    `json:"startedAt,omitempty"`
 	ErrorMessage string        `json:"errorMessage,omitempty"`
+	Signal       string        `json:"signal,omitempty"`
+	RebootedAt   *time.Time    `json:"rebootedAt,omitempty"`
+
+	observed     bool
+	serialOffset int64
+	diskWritten  int64
+	// finishedRunning is set when the installer finished while the guest
+	// kept running, so a later power off is restarted into the installed
+	// system.
+	finishedRunning bool
 }
 
 type InstallMonitor struct {
-	vmRepo     *repository.VMRepository
-	libvirt    *libvirt.Client
-	clients    map[string]map[*websocket.Conn]bool
-	clientsMu  sync.RWMutex
-	progress   map[string]*InstallProgress
-	progressMu sync.RWMutex
-	stopChan   chan struct{}
-	running    bool
-	runningMu  sync.Mutex
+	vmRepo           *repository.VMRepository
+	libvirt          *libvirt.Client
+	clients          map[string]map[*websocket.Conn]bool
+	clientsMu        sync.RWMutex
+	progress         map[string]*InstallProgress
+	progressMu       sync.RWMutex
+	stopChan         chan struct{}
+	running          bool
+	runningMu        sync.Mutex
+	completionMarker string
+	firstBootTimeout time.Duration
+	onComplete       InstallCompleteFunc
 }
 
 func NewInstallMonitor(vmRepo *repository.VMRepository, libvirtClient *libvirt.Client) *InstallMonitor {
@@ -57,9 +106,34 @@ func NewInstallMonitor(vmRepo *repository.VMRepository, libvirtClient *libvirt.C
 		clients:  make(map[string]map[*websocket.Conn]bool),
 		progress: make(map[string]*InstallProgress),
 		stopChan: make(chan struct{}),
+
+		completionMarker: DefaultCompletionMarker,
+		firstBootTimeout: defaultFirstBootTimeout,
+	}
+}
+
+// SetCompletionMarker sets the string that marks a finished install on the
+// serial console. An empty marker keeps the default.
+func (m *InstallMonitor) SetCompletionMarker(marker string) {
+	if marker != "" {
+		m.completionMarker = marker
 	}
 }
 
+// SetFirstBootTimeout sets how long to wait for the guest agent of a freshly
+// installed system before the install is marked completed anyway.
+func (m *InstallMonitor) SetFirstBootTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		m.firstBootTimeout = timeout
+	}
+}
+
+// SetCompletionHandler sets the function that boots the installed system
+// once an installer has finished.
+func (m *InstallMonitor) SetCompletionHandler(fn InstallCompleteFunc) {
+	m.onComplete = fn
+}
+
 func (m *InstallMonitor) Start() {
 	m.runningMu.Lock()
 	defer m.runningMu.Unlock()
@@ -143,39 +217,101 @@ func (m *InstallMonitor) checkVMInstallStatus(ctx context.Context, vm *models.Vi
 		return
 	}
 
+	if vm.IsInstalled {
+		m.checkFirstBoot(vm, domain, state, progress)
+	} else {
+		m.checkInstaller(ctx, vm, domain, state, progress)
+	}
+
+	m.persistProgress(ctx, vm, progress)
+	m.broadcastProgress(vm.ID.String(), progress)
+}
+
+// installerFinished reports whether the installer of vm is done and its
+// media can be dropped. A guest that powers off on reboot is done once it is
+// shut off after a completion signal or after it wrote to its disk. A guest
+// whose reboot restarts it in place, like Windows setup, never shuts off, so
+// the completion signal seen on an earlier check is enough while it runs.
+func installerFinished(vm *models.VirtualMachine, state int, progress *InstallProgress, rebootRestarts bool) bool {
 	switch state {
 	case 1:
-		if progress.StartedAt == nil {
-			now := time.Now()
-			progress.StartedAt = &now
-			progress.Status = InstallStatusInstalling
-			progress.Message = "Installation in progress"
+		return rebootRestarts && progress.CurrentStep == InstallStepRebooting && progress.Signal != ""
+	case 5:
+		wroteDisk := progress.diskWritten >= installerWriteThreshold || vm.InstallProgress >= installingProgressFloor
+		return vm.InstallStatus == string(InstallStatusInstalling) && (progress.Signal != "" || wroteDisk)
+	}
+	return false
+}
+
+// rebootRestarts reports whether a guest reboot restarts the domain instead
+// of powering it off.
+func rebootRestarts(domain *libvirt.Domain) bool {
+	xmlDesc, err := domain.GetXMLDesc()
+	if err != nil {
+		return false
+	}
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		return false
+	}
+	return def.OnReboot == "" || def.OnReboot == "restart"
+}
+
+// checkInstaller follows a guest that is still booted from the install
+// media until one of the completion signals shows up or the installer shuts
+// the guest down.
+func (m *InstallMonitor) checkInstaller(ctx context.Context, vm *models.VirtualMachine, domain *libvirt.Domain, state int, progress *InstallProgress) {
+	switch state {
+	case 1:
+		if progress.CurrentStep == InstallStepRebooting && installerFinished(vm, state, progress, rebootRestarts(domain)) {
+			log.Printf("[InstallMonitor] Installer of VM %s finished and the guest restarts in place (%s)", vm.Name, progress.Signal)
+			progress.finishedRunning = true
+			m.finishInstaller(ctx, vm, progress)
+			return
+		}
+		if !progress.observed {
+			progress.observed = true
+			progress.serialOffset = serialLogSize(vm)
+			if progress.StartedAt == nil {
+				now := time.Now()
+				progress.StartedAt = &now
+			}
+		}
+		progress.Status = InstallStatusInstalling
+		if progress.CurrentStep == "init" {
+			progress.CurrentStep = InstallStepBootingInstaller
+			progress.Message = "Booting installer"
 		}
-		progress.Progress = m.estimateProgress(vm, progress)
 
-		if m.detectInstallationComplete(vm, domain) {
-			progress.Status = InstallStatusCompleted
-			progress.Progress = 100
-			now := time.Now()
-			progress.CompletedAt = &now
-			progress.Message = "Installation completed successfully"
+		if _, written, err := domain.BlockStats(libvirt.RootDiskTarget(vm.DiskBus)); err == nil && written > progress.diskWritten {
+			progress.diskWritten = written
+		}
+		if progress.CurrentStep == InstallStepBootingInstaller && progress.diskWritten >= installerWriteThreshold {
+			progress.CurrentStep = InstallStepInstalling
+			progress.Message = "Installing to disk"
+		}
 
-			m.vmRepo.UpdateInstallStatus(ctx, vm.ID.String(), "completed")
+		if progress.CurrentStep != InstallStepRebooting {
+			if signal := m.detectInstallationComplete(vm, domain, progress); signal != "" {
+				log.Printf("[InstallMonitor] Installer of VM %s finished (%s)", vm.Name, signal)
+				progress.Signal = signal
+				progress.CurrentStep = InstallStepRebooting
+				progress.Message = "Installer finished, waiting for the guest to restart"
+			}
 		}
+		progress.Progress = m.estimateProgress(vm, progress)
 
 	case 3:
 		progress.Status = InstallStatusPaused
 		progress.Message = "VM is paused"
 
 	case 5:
-		if progress.Status == InstallStatusInstalling {
-			progress.Status = InstallStatusCompleted
-			progress.Progress = 100
-			now := time.Now()
-			progress.CompletedAt = &now
-			progress.Message = "Installation completed, VM stopped"
-
-			m.vmRepo.UpdateInstallStatus(ctx, vm.ID.String(), "completed")
+		if installerFinished(vm, state, progress, false) {
+			if progress.Signal == "" {
+				progress.Signal = InstallSignalShutdown
+			}
+			log.Printf("[InstallMonitor] Installer of VM %s shut the guest down (%s)", vm.Name, progress.Signal)
+			m.finishInstaller(ctx, vm, progress)
 		} else {
 			progress.Status = InstallStatusPending
 			progress.Message = "VM is stopped, waiting to start"
@@ -184,8 +320,104 @@ func (m *InstallMonitor) checkVMInstallStatus(ctx context.Context, vm *models.Vi
 	default:
 		progress.Message = fmt.Sprintf("VM state: %d", state)
 	}
+}
 
-	m.broadcastProgress(vm.ID.String(), progress)
+// finishInstaller hands the VM to the completion handler, which detaches
+// the install media and boots the installed system.
+func (m *InstallMonitor) finishInstaller(ctx context.Context, vm *models.VirtualMachine, progress *InstallProgress) {
+	progress.Status = InstallStatusInstalling
+	progress.CurrentStep = InstallStepRebooting
+	progress.Progress = 90
+
+	if m.onComplete == nil {
+		m.completeInstall(progress, "Installation completed, VM stopped")
+		return
+	}
+
+	if err := m.onComplete(ctx, vm); err != nil {
+		log.Printf("[InstallMonitor] Failed to boot installed system of VM %s: %v", vm.Name, err)
+		progress.Status = InstallStatusFailed
+		progress.ErrorMessage = err.Error()
+		progress.Message = "Failed to boot installed system: " + err.Error()
+		return
+	}
+
+	now := time.Now()
+	progress.RebootedAt = &now
+	progress.Message = "Booting installed system"
+}
+
+// checkFirstBoot waits for the installed system to answer a guest agent
+// ping. Guests without an agent are considered booted after the first boot
+// timeout. A guest whose installer finished while it kept running is started
+// again when it powers off, as its definition no longer has the media.
+func (m *InstallMonitor) checkFirstBoot(vm *models.VirtualMachine, domain *libvirt.Domain, state int, progress *InstallProgress) {
+	progress.Status = InstallStatusInstalling
+	progress.CurrentStep = InstallStepRebooting
+	if progress.Progress < 90 {
+		progress.Progress = 90
+	}
+	if progress.RebootedAt == nil {
+		now := time.Now()
+		progress.RebootedAt = &now
+	}
+
+	if state == 5 && progress.finishedRunning {
+		progress.finishedRunning = false
+		if err := domain.Create(); err != nil {
+			log.Printf("[InstallMonitor] Failed to start installed system of VM %s: %v", vm.Name, err)
+		} else {
+			now := time.Now()
+			progress.RebootedAt = &now
+		}
+	}
+
+	if state != 1 {
+		progress.Message = "Waiting for the installed system to start"
+		return
+	}
+
+	if err := m.libvirt.GuestPing(vm.LibvirtDomainUUID); err == nil {
+		m.completeInstall(progress, "First boot complete, guest agent is responding")
+		return
+	}
+
+	if time.Since(*progress.RebootedAt) >= m.firstBootTimeout {
+		m.completeInstall(progress, "First boot complete, no guest agent response")
+		return
+	}
+
+	progress.Progress = 95
+	progress.Message = "Waiting for the guest agent"
+}
+
+func (m *InstallMonitor) completeInstall(progress *InstallProgress, message string) {
+	now := time.Now()
+	progress.Status = InstallStatusCompleted
+	progress.CurrentStep = InstallStepFirstBootComplete
+	progress.Progress = 100
+	progress.CompletedAt = &now
+	progress.Message = message
+}
+
+// persistProgress mirrors the install status and progress into the VM
+// record when they change.
+func (m *InstallMonitor) persistProgress(ctx context.Context, vm *models.VirtualMachine, progress *InstallProgress) {
+	status := vm.InstallStatus
+	switch progress.Status {
+	case InstallStatusInstalling, InstallStatusCompleted, InstallStatusFailed:
+		status = string(progress.Status)
+	}
+	if status == vm.InstallStatus && progress.Progress == vm.InstallProgress {
+		return
+	}
+
+	if err := m.vmRepo.UpdateInstallProgress(ctx, vm.ID.String(), status, progress.Progress); err != nil {
+		log.Printf("[InstallMonitor] Failed to update install progress of VM %s: %v", vm.Name, err)
+		return
+	}
+	vm.InstallStatus = status
+	vm.InstallProgress = progress.Progress
 }
 
 func (m *InstallMonitor) getOrCreateProgress(vm *models.VirtualMachine) *InstallProgress {
@@ -200,7 +432,7 @@ func (m *InstallMonitor) getOrCreateProgress(vm *models.VirtualMachine) *Install
 		VMID:        vm.ID.String(),
 		VMName:      vm.Name,
 		Status:      InstallStatusPending,
-		Progress:    0,
+		Progress:    vm.InstallProgress,
 		Message:     "Initializing",
 		CurrentStep: "init",
 		TotalSteps:  4,
@@ -209,47 +441,94 @@ func (m *InstallMonitor) getOrCreateProgress(vm *models.VirtualMachine) *Install
 	return p
 }
 
+// estimateProgress maps the install stage and the amount written to the
+// system disk onto a percentage. It never goes backwards.
 func (m *InstallMonitor) estimateProgress(vm *models.VirtualMachine, progress *InstallProgress) int {
-	if progress.StartedAt == nil {
-		return 0
+	estimated := 0
+	switch progress.CurrentStep {
+	case InstallStepBootingInstaller:
+		estimated = 5
+	case InstallStepInstalling:
+		expected := int64(expectedInstallBytes)
+		if disk := int64(vm.DiskAllocated) << 30; disk > 0 && disk/2 < expected {
+			expected = disk / 2
+		}
+		estimated = installingProgressFloor + int(float64(progress.diskWritten)/float64(expected)*75)
+		if estimated > 85 {
+			estimated = 85
+		}
+	case InstallStepRebooting:
+		estimated = 90
+	case InstallStepFirstBootComplete:
+		estimated = 100
 	}
 
-	elapsed := time.Since(*progress.StartedAt)
-
-	estimatedDuration := 10 * time.Minute
+	if estimated < progress.Progress {
+		return progress.Progress
+	}
+	return estimated
+}
 
-	estimatedProgress := int(float64(elapsed) / float64(estimatedDuration) * 100)
-	if estimatedProgress > 95 {
-		estimatedProgress = 95
+// detectInstallationComplete looks for the signals an installer gives when
+// it is done while the guest is still running: the completion marker on the
+// serial console or an ejected CD-ROM. It returns the signal that was seen,
+// or an empty string. The guest agent is only trusted after the reboot, as
+// some installer images run one themselves.
+func (m *InstallMonitor) detectInstallationComplete(vm *models.VirtualMachine, domain *libvirt.Domain, progress *InstallProgress) string {
+	if m.serialMarkerSeen(vm, progress) {
+		return InstallSignalSerialMarker
 	}
-	if estimatedProgress < 0 {
-		estimatedProgress = 0
+
+	if xmlDesc, err := domain.GetXMLDesc(); err == nil && libvirt.CDROMEjected(xmlDesc) {
+		return InstallSignalCDROMEject
 	}
 
-	return estimatedProgress
+	return ""
 }
 
-func (m *InstallMonitor) detectInstallationComplete(vm *models.VirtualMachine, domain *libvirt.Domain) bool {
-	xmlDesc, err := domain.GetXMLDesc()
+// serialMarkerSeen searches the serial console log written since the
+// installer started for the completion marker. Only new output is read on
+// each call; the tail is kept so a marker split across two reads still
+// matches.
+func (m *InstallMonitor) serialMarkerSeen(vm *models.VirtualMachine, progress *InstallProgress) bool {
+	if m.completionMarker == "" {
+		return false
+	}
+
+	f, err := os.Open(libvirt.SerialLogPath(vm.ID.String()))
 	if err != nil {
 		return false
 	}
+	defer f.Close()
 
-	if vm.InstallationMode == "iso" {
-		elapsed := 0 * time.Second
-		if progress, exists := m.progress[vm.ID.String()]; exists && progress.StartedAt != nil {
-			elapsed = time.Since(*progress.StartedAt)
-		}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	if info.Size() < progress.serialOffset {
+		progress.serialOffset = 0
+	}
+	if _, err := f.Seek(progress.serialOffset, io.SeekStart); err != nil {
+		return false
+	}
 
-		minInstallTime := 2 * time.Minute
-		if elapsed < minInstallTime {
-			return false
-		}
+	data, err := io.ReadAll(io.LimitReader(f, maxSerialLogRead))
+	if err != nil {
+		return false
 	}
 
-	_ = xmlDesc
+	if next := progress.serialOffset + int64(len(data)) - int64(len(m.completionMarker)-1); next > progress.serialOffset {
+		progress.serialOffset = next
+	}
+	return bytes.Contains(data, []byte(m.completionMarker))
+}
 
-	return false
+func serialLogSize(vm *models.VirtualMachine) int64 {
+	info, err := os.Stat(libvirt.SerialLogPath(vm.ID.String()))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 func (m *InstallMonitor) broadcastProgress(vmID string, progress *InstallProgress) {
@@ -332,8 +611,8 @@ func (m *InstallMonitor) MarkInstallStarted(vmID string, vmName string) {
 		VMName:      vmName,
 		Status:      InstallStatusInstalling,
 		Progress:    0,
-		Message:     "Installation started",
-		CurrentStep: "boot",
+		Message:     "Booting installer",
+		CurrentStep: InstallStepBootingInstaller,
 		TotalSteps:  4,
 		StartedAt:   &now,
 	}
@@ -348,6 +627,7 @@ func (m *InstallMonitor) MarkInstallCompleted(vmID string) {
 		progress.Progress = 100
 		now := time.Now()
 		progress.CompletedAt = &now
+		progress.CurrentStep = InstallStepFirstBootComplete
 		progress.Message = "Installation completed"
 	}
 }
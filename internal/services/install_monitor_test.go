@@ -0,0 +1,89 @@
+package services
+
+import (
+	"testing"
+
+	"vmmanager/internal/models"
+)
+
+func TestInstallerFinished(t *testing.T) {
+	installing := &models.VirtualMachine{InstallStatus: string(InstallStatusInstalling)}
+	signalled := &InstallProgress{CurrentStep: InstallStepRebooting, Signal: InstallSignalSerialMarker}
+
+	tests := []struct {
+		name           string
+		vm             *models.VirtualMachine
+		state          int
+		progress       *InstallProgress
+		rebootRestarts bool
+		want           bool
+	}{
+		{
+			name:     "shut off after a signal",
+			vm:       installing,
+			state:    5,
+			progress: signalled,
+			want:     true,
+		},
+		{
+			name:     "shut off after writing the disk",
+			vm:       installing,
+			state:    5,
+			progress: &InstallProgress{CurrentStep: InstallStepInstalling, diskWritten: installerWriteThreshold},
+			want:     true,
+		},
+		{
+			name:     "shut off before installing",
+			vm:       installing,
+			state:    5,
+			progress: &InstallProgress{CurrentStep: InstallStepBootingInstaller},
+			want:     false,
+		},
+		{
+			name:     "shut off before the install started",
+			vm:       &models.VirtualMachine{InstallStatus: string(InstallStatusPending)},
+			state:    5,
+			progress: signalled,
+			want:     false,
+		},
+		{
+			name:           "running after a signal with restart on reboot",
+			vm:             installing,
+			state:          1,
+			progress:       signalled,
+			rebootRestarts: true,
+			want:           true,
+		},
+		{
+			name:     "running after a signal with destroy on reboot",
+			vm:       installing,
+			state:    1,
+			progress: signalled,
+			want:     false,
+		},
+		{
+			name:           "running without a signal",
+			vm:             installing,
+			state:          1,
+			progress:       &InstallProgress{CurrentStep: InstallStepInstalling, diskWritten: installerWriteThreshold},
+			rebootRestarts: true,
+			want:           false,
+		},
+		{
+			name:           "paused after a signal",
+			vm:             installing,
+			state:          3,
+			progress:       signalled,
+			rebootRestarts: true,
+			want:           false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := installerFinished(tt.vm, tt.state, tt.progress, tt.rebootRestarts); got != tt.want {
+				t.Errorf("installerFinished = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
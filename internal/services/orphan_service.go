@@ -0,0 +1,640 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+	"vmmanager/internal/repository"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of resources the orphan scan looks for.
+const (
+	OrphanKindDisk     = "disk"
+	OrphanKindBoot     = "boot"
+	OrphanKindVolume   = "volume"
+	OrphanKindNVRAM    = "nvram"
+	OrphanKindBackup   = "backup"
+	OrphanKindUpload   = "upload"
+	OrphanKindDomain   = "domain"
+	OrphanKindSnapshot = "snapshot"
+)
+
+// nvramDir is where libvirt keeps the UEFI variable stores of domains.
+const nvramDir = "/var/lib/libvirt/qemu/nvram"
+
+// workFileSuffixes name the copies written next to a disk while a restore
+// or an encryption replaces it. They belong to the disk.
+var workFileSuffixes = []string{".restore", ".encrypting"}
+
+// maxBackingChain bounds how many backing files of an owned disk are
+// followed.
+const maxBackingChain = 16
+
+// Orphan is a resource on the host that no record owns. ID is the path of
+// files and directories, the UUID of domains and "<vm id>/<name>" for
+// snapshots.
+type Orphan struct {
+	Kind       string    `json:"kind"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	FirstSeen  time.Time `json:"first_seen"`
+	// DeletableAt is when the scheduled collection may delete the orphan.
+	DeletableAt time.Time `json:"deletable_at"`
+}
+
+// key identifies the orphan across scans.
+func (o Orphan) key() string {
+	return o.Kind + ":" + o.ID
+}
+
+// OrphanScanConfig tells the orphan service where VMManager keeps its files
+// and how the scheduled collection runs.
+type OrphanScanConfig struct {
+	StoragePath string
+	BackupDir   string
+	UploadPath  string
+	Interval    time.Duration
+	GracePeriod time.Duration
+	// AutoDelete lets the scheduled collection delete orphans past the
+	// grace period; otherwise it only logs them.
+	AutoDelete bool
+}
+
+// OrphanService finds the disks, NVRAM files, volumes, backups, uploads,
+// snapshots and libvirt domains that failed creates and deletes leave
+// behind, and deletes them on request or after a grace period.
+type OrphanService struct {
+	repos     *repository.Repositories
+	libvirt   *libvirt.Client
+	cfg       OrphanScanConfig
+	mu        sync.Mutex
+	firstSeen map[string]time.Time
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewOrphanService(repos *repository.Repositories, libvirtClient *libvirt.Client, cfg OrphanScanConfig) *OrphanService {
+	if cfg.Interval == 0 {
+		cfg.Interval = 6 * time.Hour
+	}
+	if cfg.GracePeriod == 0 {
+		cfg.GracePeriod = 7 * 24 * time.Hour
+	}
+	if cfg.UploadPath == "" {
+		cfg.UploadPath = "./uploads"
+	}
+
+	return &OrphanService{
+		repos:     repos,
+		libvirt:   libvirtClient,
+		cfg:       cfg,
+		firstSeen: make(map[string]time.Time),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+func (s *OrphanService) Start() {
+	s.wg.Add(1)
+	go s.collectLoop()
+	log.Printf("[ORPHAN] Service started with scan interval: %v, grace period: %v, auto delete: %v", s.cfg.Interval, s.cfg.GracePeriod, s.cfg.AutoDelete)
+}
+
+func (s *OrphanService) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+	log.Printf("[ORPHAN] Service stopped")
+}
+
+func (s *OrphanService) collectLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Collect()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// Collect scans for orphans and, with auto delete on, deletes those past
+// the grace period.
+func (s *OrphanService) Collect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	orphans, err := s.Scan(ctx)
+	if err != nil {
+		log.Printf("[ORPHAN] Scan failed: %v", err)
+		return
+	}
+	if len(orphans) == 0 {
+		return
+	}
+
+	var size int64
+	for _, orphan := range orphans {
+		size += orphan.Size
+	}
+	log.Printf("[ORPHAN] Found %d orphaned resources, %d bytes", len(orphans), size)
+
+	if !s.cfg.AutoDelete {
+		return
+	}
+	now := time.Now()
+	for _, orphan := range orphans {
+		if now.Before(orphan.DeletableAt) {
+			continue
+		}
+		if err := s.Remove(ctx, orphan); err != nil {
+			log.Printf("[ORPHAN] Failed to delete %s %s: %v", orphan.Kind, orphan.ID, err)
+			continue
+		}
+		log.Printf("[ORPHAN] Deleted %s %s after the grace period", orphan.Kind, orphan.ID)
+	}
+}
+
+// owners is what the records of VMManager own, as the scan checks it.
+type owners struct {
+	vmIDs     map[string]bool
+	vmNames   map[string]bool
+	domains   map[string]bool
+	paths     map[string]bool
+	snapshots map[string]map[string]bool
+	vms       []models.VirtualMachine
+}
+
+// ownsFile reports whether a record owns the file at path. Files named after
+// a VM, like its install media, belong to it as well, and so do the work
+// copies of an owned disk.
+func (o *owners) ownsFile(path string) bool {
+	if o.paths[path] {
+		return true
+	}
+	for _, suffix := range workFileSuffixes {
+		if disk, ok := strings.CutSuffix(path, suffix); ok && o.paths[disk] {
+			return true
+		}
+	}
+	base := filepath.Base(path)
+	if len(base) >= 36 && o.vmIDs[base[:36]] {
+		return true
+	}
+	return false
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// within reports whether path lies in dir.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *OrphanService) loadOwners(ctx context.Context) (*owners, error) {
+	vms, _, err := s.repos.VM.List(ctx, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	o := &owners{
+		vmIDs:     make(map[string]bool),
+		vmNames:   make(map[string]bool),
+		domains:   make(map[string]bool),
+		paths:     make(map[string]bool),
+		snapshots: make(map[string]map[string]bool),
+		vms:       vms,
+	}
+	addPath := func(path string) {
+		if path != "" {
+			o.paths[absPath(path)] = true
+		}
+	}
+	for _, vm := range vms {
+		o.vmIDs[vm.ID.String()] = true
+		o.vmNames[vm.Name] = true
+		if vm.LibvirtDomainUUID != "" {
+			o.domains[vm.LibvirtDomainUUID] = true
+		}
+		for _, path := range []string{vm.DiskPath, vm.CloudInitISOPath, vm.InstallMediaPath, vm.InstallKernelPath,
+			vm.InstallInitrdPath, vm.DriverISOPath, vm.DirectBoot.Kernel, vm.DirectBoot.Initrd, vm.DirectBoot.DTB} {
+			addPath(path)
+		}
+	}
+
+	for _, column := range []struct {
+		model  interface{}
+		column string
+	}{
+		{&models.StorageVolume{}, "path"},
+		{&models.VMBackup{}, "file_path"},
+		{&models.VMTemplate{}, "template_path"},
+		{&models.ISO{}, "iso_path"},
+		{&models.ISOUpload{}, "upload_path"},
+		{&models.TemplateUpload{}, "upload_path"},
+	} {
+		var paths []string
+		if err := s.repos.DB.WithContext(ctx).Model(column.model).Pluck(column.column, &paths).Error; err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", column.column, err)
+		}
+		for _, path := range paths {
+			addPath(path)
+		}
+	}
+
+	// Linked clones and overlays need the images they are based on.
+	var backing []string
+	for path := range o.paths {
+		for i := 0; i < maxBackingChain; i++ {
+			next, err := qcow2BackingFile(path)
+			if err != nil || next == "" || o.paths[next] {
+				break
+			}
+			backing = append(backing, next)
+			path = next
+		}
+	}
+	for _, path := range backing {
+		o.paths[path] = true
+	}
+
+	var snapshots []models.VMSnapshot
+	if err := s.repos.DB.WithContext(ctx).Select("vm_id", "name").Find(&snapshots).Error; err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, snapshot := range snapshots {
+		id := snapshot.VMID.String()
+		if o.snapshots[id] == nil {
+			o.snapshots[id] = make(map[string]bool)
+		}
+		o.snapshots[id][snapshot.Name] = true
+	}
+
+	return o, nil
+}
+
+// qcow2BackingFile returns the absolute path of the backing file of the
+// qcow2 image at path, or an empty path when it has none or is no qcow2
+// image. A relative backing file is relative to the image.
+func qcow2BackingFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// magic, version, backing file offset and backing file size
+	var header [20]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return "", nil
+	}
+	if string(header[:4]) != "QFI\xfb" {
+		return "", nil
+	}
+	offset := binary.BigEndian.Uint64(header[8:16])
+	size := binary.BigEndian.Uint32(header[16:20])
+	if offset == 0 || size == 0 {
+		return "", nil
+	}
+	// qemu limits the name to 1023 bytes.
+	if size > 1023 {
+		return "", fmt.Errorf("backing file name of %s is %d bytes long", path, size)
+	}
+	name := make([]byte, size)
+	if _, err := f.ReadAt(name, int64(offset)); err != nil {
+		return "", err
+	}
+	backing := string(name)
+	if strings.Contains(backing, ":") && !strings.HasPrefix(backing, "/") {
+		// A protocol such as nbd: or json: names no local file.
+		return "", nil
+	}
+	if !filepath.IsAbs(backing) {
+		backing = filepath.Join(filepath.Dir(path), backing)
+	}
+	return filepath.Clean(backing), nil
+}
+
+// Scan lists the resources on the host that no record owns.
+func (s *OrphanService) Scan(ctx context.Context) ([]Orphan, error) {
+	o, err := s.loadOwners(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	if s.cfg.StoragePath != "" {
+		orphans = append(orphans, s.scanStorage(o)...)
+	}
+	orphans = append(orphans, s.scanVolumes(ctx, o)...)
+	if s.cfg.BackupDir != "" {
+		orphans = append(orphans, scanFiles(absPath(s.cfg.BackupDir), OrphanKindBackup, o)...)
+	}
+	orphans = append(orphans, s.scanUploads(o)...)
+	if s.libvirt != nil {
+		orphans = append(orphans, s.scanLibvirt(o)...)
+	}
+
+	s.track(orphans, time.Now())
+	return orphans, nil
+}
+
+// track sets when each of orphans was first seen, which is now for one the
+// last scan did not find, and when it may be deleted: a grace period after
+// it was first seen or last modified, whichever is later. Orphans the scan
+// no longer finds are forgotten.
+func (s *OrphanService) track(orphans []Orphan, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]time.Time, len(orphans))
+	for i := range orphans {
+		orphan := &orphans[i]
+		first, ok := s.firstSeen[orphan.key()]
+		if !ok {
+			first = now
+		}
+		seen[orphan.key()] = first
+		orphan.FirstSeen = first
+		orphan.DeletableAt = first.Add(s.cfg.GracePeriod)
+		if modified := orphan.ModifiedAt.Add(s.cfg.GracePeriod); modified.After(orphan.DeletableAt) {
+			orphan.DeletableAt = modified
+		}
+	}
+	s.firstSeen = seen
+}
+
+// fileOrphan describes the file or directory at path, with the total size
+// of a directory.
+func fileOrphan(kind, path string, info fs.FileInfo) Orphan {
+	orphan := Orphan{
+		Kind:       kind,
+		ID:         path,
+		Name:       filepath.Base(path),
+		Size:       info.Size(),
+		ModifiedAt: info.ModTime(),
+	}
+	if info.IsDir() {
+		orphan.Size = 0
+		filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if fi, err := d.Info(); err == nil {
+					orphan.Size += fi.Size()
+					if fi.ModTime().After(orphan.ModifiedAt) {
+						orphan.ModifiedAt = fi.ModTime()
+					}
+				}
+			}
+			return nil
+		})
+	}
+	return orphan
+}
+
+// scanFiles lists the regular files right in dir that no record owns.
+func scanFiles(dir, kind string, o *owners) []Orphan {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var orphans []Orphan
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if o.ownsFile(path) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			orphans = append(orphans, fileOrphan(kind, path, info))
+		}
+	}
+	return orphans
+}
+
+// scanStorage lists the disk images in the storage path and the boot file
+// directories of VMs that are gone.
+func (s *OrphanService) scanStorage(o *owners) []Orphan {
+	root := absPath(s.cfg.StoragePath)
+	orphans := scanFiles(root, OrphanKindDisk, o)
+
+	bootDir := filepath.Join(root, "boot")
+	entries, _ := os.ReadDir(bootDir)
+	for _, entry := range entries {
+		if !entry.IsDir() || o.vmIDs[entry.Name()] {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			orphans = append(orphans, fileOrphan(OrphanKindBoot, filepath.Join(bootDir, entry.Name()), info))
+		}
+	}
+	return orphans
+}
+
+// scanVolumes lists the files in the directory pools that no volume
+// records. The storage path is left to scanStorage.
+func (s *OrphanService) scanVolumes(ctx context.Context, o *owners) []Orphan {
+	pools, _, err := s.repos.StoragePool.List(ctx, 0, 0)
+	if err != nil {
+		log.Printf("[ORPHAN] Failed to list storage pools: %v", err)
+		return nil
+	}
+	var orphans []Orphan
+	for _, pool := range pools {
+		if pool.PoolType != "dir" || pool.TargetPath == "" {
+			continue
+		}
+		dir := absPath(pool.TargetPath)
+		if s.cfg.StoragePath != "" && dir == absPath(s.cfg.StoragePath) {
+			continue
+		}
+		orphans = append(orphans, scanFiles(dir, OrphanKindVolume, o)...)
+	}
+	return orphans
+}
+
+// scanUploads lists the ISO and template upload directories that neither an
+// upload in progress nor a finished ISO or template uses.
+func (s *OrphanService) scanUploads(o *owners) []Orphan {
+	var orphans []Orphan
+	for _, sub := range []string{"isos", "templates"} {
+		dir := filepath.Join(absPath(s.cfg.UploadPath), sub)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			if _, err := uuid.Parse(entry.Name()); err != nil {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if o.ownsDir(path) {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				orphans = append(orphans, fileOrphan(OrphanKindUpload, path, info))
+			}
+		}
+	}
+	return orphans
+}
+
+// ownsDir reports whether a record owns dir or a file in it.
+func (o *owners) ownsDir(dir string) bool {
+	for path := range o.paths {
+		if path == dir || within(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanLibvirt lists the domains whose system disk lies in the storage path
+// but that no VM record describes, the snapshots of VMs without a record
+// and the NVRAM files no domain or VM uses. Domains defined outside of
+// VMManager are left to adoption.
+func (s *OrphanService) scanLibvirt(o *owners) []Orphan {
+	domains, err := s.libvirt.ListAllDomains()
+	if err != nil {
+		log.Printf("[ORPHAN] Failed to list domains: %v", err)
+		return nil
+	}
+
+	var orphans []Orphan
+	nvrams := make(map[string]bool)
+	for _, domain := range domains {
+		domainUUID, name := domain.UUID, domain.Name
+		domain.Free()
+
+		xmlDesc, err := s.libvirt.GetDomainXML(domainUUID)
+		if err != nil {
+			continue
+		}
+		def, err := libvirt.ParseDomainXML(xmlDesc)
+		if err != nil {
+			continue
+		}
+		if def.OS != nil && def.OS.NVRAM != nil && def.OS.NVRAM.Path != "" {
+			nvrams[absPath(def.OS.NVRAM.Path)] = true
+		}
+
+		if o.domains[domainUUID] || o.vmIDs[domainUUID] || o.vmNames[name] || s.cfg.StoragePath == "" {
+			continue
+		}
+		disk := rootDisk(def)
+		if disk == nil || disk.Source.File == "" || !within(absPath(s.cfg.StoragePath), absPath(disk.Source.File)) {
+			continue
+		}
+		orphan := Orphan{Kind: OrphanKindDomain, ID: domainUUID, Name: name}
+		if info, err := os.Stat(disk.Source.File); err == nil {
+			orphan.ModifiedAt = info.ModTime()
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	for _, vm := range o.vms {
+		if vm.LibvirtDomainUUID == "" {
+			continue
+		}
+		names, err := s.libvirt.ListSnapshots(vm.LibvirtDomainUUID)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if o.snapshots[vm.ID.String()][name] {
+				continue
+			}
+			orphan := Orphan{Kind: OrphanKindSnapshot, ID: vm.ID.String() + "/" + name, Name: name}
+			if info, err := s.libvirt.GetSnapshotInfo(vm.LibvirtDomainUUID, name); err == nil {
+				if created, err := strconv.ParseInt(info.CreatedAt, 10, 64); err == nil {
+					orphan.ModifiedAt = time.Unix(created, 0)
+				}
+			}
+			orphans = append(orphans, orphan)
+		}
+	}
+
+	entries, err := os.ReadDir(nvramDir)
+	if err != nil {
+		return orphans
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(nvramDir, entry.Name())
+		owner := strings.TrimSuffix(entry.Name(), "_VARS.fd")
+		if nvrams[path] || o.vmIDs[owner] || o.vmNames[owner] {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			orphans = append(orphans, fileOrphan(OrphanKindNVRAM, path, info))
+		}
+	}
+	return orphans
+}
+
+// Remove deletes orphan. Callers find it with Scan first, so the scan
+// decides what may be deleted.
+func (s *OrphanService) Remove(ctx context.Context, orphan Orphan) error {
+	var err error
+	switch orphan.Kind {
+	case OrphanKindDisk, OrphanKindVolume, OrphanKindNVRAM, OrphanKindBackup:
+		err = os.Remove(orphan.ID)
+	case OrphanKindBoot, OrphanKindUpload:
+		err = os.RemoveAll(orphan.ID)
+	case OrphanKindDomain:
+		if s.libvirt == nil {
+			return fmt.Errorf("libvirt client is not initialized")
+		}
+		err = s.libvirt.PurgeDomain(orphan.ID)
+	case OrphanKindSnapshot:
+		if s.libvirt == nil {
+			return fmt.Errorf("libvirt client is not initialized")
+		}
+		vmID, name, _ := strings.Cut(orphan.ID, "/")
+		var vm *models.VirtualMachine
+		vm, err = s.repos.VM.FindByID(ctx, vmID)
+		if err == nil {
+			err = s.libvirt.DeleteSnapshot(vm.LibvirtDomainUUID, name)
+		}
+	default:
+		return fmt.Errorf("unknown orphan kind %s", orphan.Kind)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.firstSeen, orphan.key())
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+const orphanVMID = "5b1e4c3a-8d2f-4e6b-9a71-0c3d5e7f9a12"
+
+func writeFile(t *testing.T, path string, data []byte, modified time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !modified.IsZero() {
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// qcow2Image returns the start of a qcow2 image with backing as its
+// backing file name.
+func qcow2Image(backing string) []byte {
+	header := make([]byte, 104)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3)
+	if backing != "" {
+		binary.BigEndian.PutUint64(header[8:], uint64(len(header)))
+		binary.BigEndian.PutUint32(header[16:], uint32(len(backing)))
+	}
+	return append(header, backing...)
+}
+
+func orphanIDs(orphans []Orphan) []string {
+	ids := []string{}
+	for _, orphan := range orphans {
+		ids = append(ids, orphan.Kind+":"+filepath.Base(orphan.ID))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestOwnsFile(t *testing.T) {
+	o := &owners{
+		vmIDs: map[string]bool{orphanVMID: true},
+		paths: map[string]bool{"/storage/disk.qcow2": true},
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/storage/disk.qcow2", true},
+		{"/storage/disk.qcow2.restore", true},
+		{"/storage/disk.qcow2.encrypting", true},
+		{"/storage/other.qcow2.restore", false},
+		{"/storage/disk.qcow2.bak", false},
+		{"/storage/" + orphanVMID + "-cidata.iso", true},
+		{"/storage/" + orphanVMID[:35] + ".qcow2", false},
+		{"/storage/0f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a.qcow2", false},
+	}
+	for _, tt := range tests {
+		if got := o.ownsFile(tt.path); got != tt.want {
+			t.Errorf("ownsFile(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		dir, path string
+		want      bool
+	}{
+		{"/storage", "/storage/disk.qcow2", true},
+		{"/storage", "/storage/boot/vm/Image", true},
+		{"/storage", "/storage", true},
+		{"/storage", "/storage2/disk.qcow2", false},
+		{"/storage", "/srv/disk.qcow2", false},
+		{"/storage", "/storage/../srv/disk.qcow2", false},
+		{"/storage", "/storage/..hidden", true},
+	}
+	for _, tt := range tests {
+		if got := within(tt.dir, tt.path); got != tt.want {
+			t.Errorf("within(%s, %s) = %v, want %v", tt.dir, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestScanFiles(t *testing.T) {
+	dir := t.TempDir()
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeFile(t, filepath.Join(dir, "owned.qcow2"), []byte("disk"), time.Time{})
+	writeFile(t, filepath.Join(dir, "owned.qcow2.restore"), []byte("copy"), time.Time{})
+	writeFile(t, filepath.Join(dir, orphanVMID+".qcow2"), []byte("vm"), time.Time{})
+	writeFile(t, filepath.Join(dir, "stray.qcow2"), []byte("stray disk"), modified)
+	writeFile(t, filepath.Join(dir, ".hidden"), nil, time.Time{})
+	writeFile(t, filepath.Join(dir, "sub", "nested.qcow2"), nil, time.Time{})
+
+	o := &owners{
+		vmIDs: map[string]bool{orphanVMID: true},
+		paths: map[string]bool{filepath.Join(dir, "owned.qcow2"): true},
+	}
+	orphans := scanFiles(dir, OrphanKindDisk, o)
+	if len(orphans) != 1 {
+		t.Fatalf("scanFiles = %+v, want only stray.qcow2", orphans)
+	}
+	got := orphans[0]
+	if got.Kind != OrphanKindDisk || got.ID != filepath.Join(dir, "stray.qcow2") || got.Name != "stray.qcow2" {
+		t.Errorf("orphan = %+v", got)
+	}
+	if got.Size != int64(len("stray disk")) || !got.ModifiedAt.Equal(modified) {
+		t.Errorf("orphan size %d, modified %v, want %d, %v", got.Size, got.ModifiedAt, len("stray disk"), modified)
+	}
+
+	if orphans := scanFiles(filepath.Join(dir, "missing"), OrphanKindDisk, o); orphans != nil {
+		t.Errorf("scanFiles of a missing directory = %+v", orphans)
+	}
+}
+
+func TestScanUploads(t *testing.T) {
+	root := t.TempDir()
+	inUse := "0f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a"
+	finished := "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+	stray := "1e0f9a8b-7c6d-4e5f-8a3b-9c2d5b6a7f80"
+	writeFile(t, filepath.Join(root, "isos", inUse, "chunk_0"), []byte("12345"), time.Time{})
+	writeFile(t, filepath.Join(root, "isos", finished, "debian.iso"), []byte("iso"), time.Time{})
+	writeFile(t, filepath.Join(root, "templates", stray, "chunk_0"), []byte("123"), time.Time{})
+	writeFile(t, filepath.Join(root, "templates", stray, "chunk_1"), []byte("4567"), time.Time{})
+	writeFile(t, filepath.Join(root, "templates", "not-a-uuid", "chunk_0"), nil, time.Time{})
+	writeFile(t, filepath.Join(root, "isos", stray+".iso"), nil, time.Time{})
+
+	o := &owners{paths: map[string]bool{
+		filepath.Join(root, "isos", inUse):                  true,
+		filepath.Join(root, "isos", finished, "debian.iso"): true,
+	}}
+	s := &OrphanService{cfg: OrphanScanConfig{UploadPath: root}}
+
+	orphans := s.scanUploads(o)
+	if len(orphans) != 1 {
+		t.Fatalf("scanUploads = %+v, want only the stray template upload", orphans)
+	}
+	if got := orphans[0]; got.Kind != OrphanKindUpload || got.ID != filepath.Join(root, "templates", stray) || got.Size != 7 {
+		t.Errorf("orphan = %+v", got)
+	}
+
+	if !o.ownsDir(filepath.Join(root, "isos", finished)) || o.ownsDir(filepath.Join(root, "isos", finished+"0")) {
+		t.Error("ownsDir matched the wrong directories")
+	}
+}
+
+func TestScanStorage(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "disk.qcow2"), nil, time.Time{})
+	writeFile(t, filepath.Join(root, "disk.qcow2.restore"), nil, time.Time{})
+	writeFile(t, filepath.Join(root, "lost.qcow2"), nil, time.Time{})
+	writeFile(t, filepath.Join(root, "boot", orphanVMID, "Image"), nil, time.Time{})
+	writeFile(t, filepath.Join(root, "boot", "0f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a", "Image"), nil, time.Time{})
+
+	o := &owners{
+		vmIDs: map[string]bool{orphanVMID: true},
+		paths: map[string]bool{filepath.Join(root, "disk.qcow2"): true},
+	}
+	s := &OrphanService{cfg: OrphanScanConfig{StoragePath: root}}
+
+	got := orphanIDs(s.scanStorage(o))
+	want := []string{"boot:0f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a", "disk:lost.qcow2"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("scanStorage = %v, want %v", got, want)
+	}
+}
+
+func TestQcow2BackingFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base.qcow2"), qcow2Image(""), time.Time{})
+	writeFile(t, filepath.Join(dir, "relative.qcow2"), qcow2Image("base.qcow2"), time.Time{})
+	writeFile(t, filepath.Join(dir, "absolute.qcow2"), qcow2Image("/srv/images/base.qcow2"), time.Time{})
+	writeFile(t, filepath.Join(dir, "network.qcow2"), qcow2Image("nbd://host/export"), time.Time{})
+	writeFile(t, filepath.Join(dir, "raw.img"), make([]byte, 512), time.Time{})
+	writeFile(t, filepath.Join(dir, "short.img"), []byte("QFI"), time.Time{})
+
+	tests := []struct {
+		name, want string
+	}{
+		{"base.qcow2", ""},
+		{"relative.qcow2", filepath.Join(dir, "base.qcow2")},
+		{"absolute.qcow2", "/srv/images/base.qcow2"},
+		{"network.qcow2", ""},
+		{"raw.img", ""},
+		{"short.img", ""},
+	}
+	for _, tt := range tests {
+		got, err := qcow2BackingFile(filepath.Join(dir, tt.name))
+		if err != nil || got != tt.want {
+			t.Errorf("qcow2BackingFile(%s) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := qcow2BackingFile(filepath.Join(dir, "missing.qcow2")); err == nil {
+		t.Error("qcow2BackingFile of a missing file succeeded")
+	}
+}
+
+func TestOrphanTrack(t *testing.T) {
+	grace := 24 * time.Hour
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	s := &OrphanService{cfg: OrphanScanConfig{GracePeriod: grace}, firstSeen: make(map[string]time.Time)}
+
+	old := Orphan{Kind: OrphanKindDisk, ID: "/storage/old.qcow2", ModifiedAt: start.Add(-30 * 24 * time.Hour)}
+	fresh := Orphan{Kind: OrphanKindDisk, ID: "/storage/fresh.qcow2", ModifiedAt: start.Add(time.Hour)}
+	orphans := []Orphan{old, fresh}
+	s.track(orphans, start)
+	if !orphans[0].FirstSeen.Equal(start) || !orphans[0].DeletableAt.Equal(start.Add(grace)) {
+		t.Errorf("old orphan first seen %v, deletable at %v", orphans[0].FirstSeen, orphans[0].DeletableAt)
+	}
+	// A file written after the scan found it waits for a grace period
+	// after the write.
+	if want := fresh.ModifiedAt.Add(grace); !orphans[1].DeletableAt.Equal(want) {
+		t.Errorf("fresh orphan deletable at %v, want %v", orphans[1].DeletableAt, want)
+	}
+
+	// The next scan keeps the time the orphan was first seen.
+	later := start.Add(6 * time.Hour)
+	orphans = []Orphan{old}
+	s.track(orphans, later)
+	if !orphans[0].FirstSeen.Equal(start) || !orphans[0].DeletableAt.Equal(start.Add(grace)) {
+		t.Errorf("rescanned orphan first seen %v, deletable at %v", orphans[0].FirstSeen, orphans[0].DeletableAt)
+	}
+
+	// An orphan that disappeared for a scan starts over.
+	orphans = []Orphan{fresh}
+	s.track(orphans, later)
+	if !orphans[0].FirstSeen.Equal(later) {
+		t.Errorf("reappeared orphan first seen %v, want %v", orphans[0].FirstSeen, later)
+	}
+	if _, ok := s.firstSeen[old.key()]; ok {
+		t.Error("orphan that is gone is still tracked")
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"vmmanager/internal/libvirt"
+	"vmmanager/internal/models"
+
+	libvirtgo "github.com/libvirt/libvirt-go"
+)
+
+const (
+	restartPolicyAlways    = "always"
+	restartPolicyOnFailure = "on-failure"
+
+	defaultRestartBackoff = 10 * time.Second
+	maxRestartBackoff     = 10 * time.Minute
+	// restartResetAfter is how long a restarted guest has to keep running
+	// before its restart count starts over.
+	restartResetAfter = 10 * time.Minute
+)
+
+// StartPrepareFunc does the work a start of vm needs before its domain
+// boots, such as defining the secrets of its encrypted disks.
+type StartPrepareFunc func(ctx context.Context, vm *models.VirtualMachine) error
+
+// SetStartPreparer sets what runs before the restart policy starts a VM.
+func (s *VMSyncService) SetStartPreparer(fn StartPrepareFunc) {
+	s.mu.Lock()
+	s.prepareStart = fn
+	s.mu.Unlock()
+}
+
+// restartState counts the automatic restarts of a VM.
+type restartState struct {
+	attempts    int
+	lastAttempt time.Time
+}
+
+// restartDelay is the wait after the last of attempts restarts. The first
+// restart happens at once and every further one doubles the backoff, up to
+// maxRestartBackoff unless the backoff itself is longer.
+func restartDelay(backoff time.Duration, attempts int) time.Duration {
+	if attempts == 0 {
+		return 0
+	}
+	delay := backoff
+	for i := 1; i < attempts && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartBackoff && backoff < maxRestartBackoff {
+		delay = maxRestartBackoff
+	}
+	return delay
+}
+
+// guestFailed reports whether state and reason describe a guest that
+// crashed or failed rather than one that was shut down or destroyed.
+func guestFailed(state, reason int) bool {
+	switch libvirtgo.DomainState(state) {
+	case libvirtgo.DOMAIN_CRASHED:
+		return true
+	case libvirtgo.DOMAIN_SHUTOFF:
+		r := libvirtgo.DomainShutoffReason(reason)
+		return r == libvirtgo.DOMAIN_SHUTOFF_CRASHED || r == libvirtgo.DOMAIN_SHUTOFF_FAILED
+	}
+	return false
+}
+
+// stoppedFromOutside reports whether state and reason describe a guest
+// that was destroyed, which only happens on request of the manager or of
+// someone on the host, never by the guest itself.
+func stoppedFromOutside(state, reason int) bool {
+	return libvirtgo.DomainState(state) == libvirtgo.DOMAIN_SHUTOFF &&
+		libvirtgo.DomainShutoffReason(reason) == libvirtgo.DOMAIN_SHUTOFF_DESTROYED
+}
+
+// enforceRestartPolicy starts vm again when its guest went down on its own
+// and the restart policy of vm asks for it. It reports whether it took care
+// of the VM, which then stays running or is restarting while the backoff
+// runs; otherwise the sync records the new state as usual.
+func (s *VMSyncService) enforceRestartPolicy(ctx context.Context, vm *models.VirtualMachine, domain *libvirt.Domain, state, reason int) bool {
+	policy := vm.Lifecycle.RestartPolicy
+	if policy != restartPolicyAlways && policy != restartPolicyOnFailure {
+		return false
+	}
+
+	id := vm.ID.String()
+	domainState := libvirtgo.DomainState(state)
+	if domainState != libvirtgo.DOMAIN_SHUTOFF && domainState != libvirtgo.DOMAIN_CRASHED {
+		if domainState == libvirtgo.DOMAIN_RUNNING {
+			s.mu.Lock()
+			if restart, ok := s.restarts[id]; ok && time.Since(restart.lastAttempt) > restartResetAfter {
+				delete(s.restarts, id)
+			}
+			s.mu.Unlock()
+		}
+		return false
+	}
+
+	// The manager marks a VM as stopping before it shuts it down or
+	// destroys it, so one still recorded as running went down on its own,
+	// unless it was destroyed on the host behind the manager's back.
+	// Installers power off on purpose.
+	if vm.Status != "running" && vm.Status != "restarting" {
+		return false
+	}
+	if stoppedFromOutside(state, reason) {
+		return false
+	}
+	if vm.InstallStatus == "pending" || vm.InstallStatus == "installing" {
+		return false
+	}
+	if policy == restartPolicyOnFailure && !guestFailed(state, reason) {
+		return false
+	}
+
+	s.mu.Lock()
+	restart := s.restarts[id]
+	if restart == nil {
+		restart = &restartState{}
+		s.restarts[id] = restart
+	}
+	attempts, lastAttempt := restart.attempts, restart.lastAttempt
+	s.mu.Unlock()
+
+	if maxRetries := vm.Lifecycle.RestartMaxRetries; maxRetries > 0 && attempts >= maxRetries {
+		log.Printf("[VM_SYNC] VM %s went down after %d automatic restarts, giving up", vm.Name, attempts)
+		return false
+	}
+
+	backoff := time.Duration(vm.Lifecycle.RestartBackoff) * time.Second
+	if backoff == 0 {
+		backoff = defaultRestartBackoff
+	}
+	if time.Since(lastAttempt) < restartDelay(backoff, attempts) {
+		if vm.Status != "restarting" {
+			s.handleStatusChange(ctx, vm, vm.Status, "restarting", nil)
+		}
+		return true
+	}
+
+	// The VM may have been stopped through the manager since the sync
+	// listed it.
+	current, err := s.vmRepo.FindByID(ctx, id)
+	if err != nil || (current.Status != "running" && current.Status != "restarting") {
+		return false
+	}
+
+	if domainState == libvirtgo.DOMAIN_CRASHED {
+		if err := domain.Destroy(); err != nil {
+			log.Printf("[VM_SYNC] Failed to destroy crashed VM %s: %v", vm.Name, err)
+		}
+	}
+	s.mu.Lock()
+	restart.attempts++
+	restart.lastAttempt = time.Now()
+	prepareStart := s.prepareStart
+	s.mu.Unlock()
+
+	if prepareStart != nil {
+		if err := prepareStart(ctx, current); err != nil {
+			log.Printf("[VM_SYNC] Failed to prepare restart of VM %s (attempt %d): %v", vm.Name, attempts+1, err)
+			if vm.Status != "restarting" {
+				s.handleStatusChange(ctx, vm, vm.Status, "restarting", nil)
+			}
+			return true
+		}
+	}
+
+	if err := domain.Create(); err != nil {
+		log.Printf("[VM_SYNC] Failed to restart VM %s (attempt %d): %v", vm.Name, attempts+1, err)
+		if vm.Status != "restarting" {
+			s.handleStatusChange(ctx, vm, vm.Status, "restarting", nil)
+		}
+		return true
+	}
+
+	log.Printf("[VM_SYNC] Restarted VM %s after it went down (attempt %d, policy %s)", vm.Name, attempts+1, policy)
+	if current.PendingChanges != "" {
+		if err := s.vmRepo.ClearPendingChanges(ctx, id); err != nil {
+			log.Printf("[VM_SYNC] Failed to clear pending changes of VM %s: %v", vm.Name, err)
+		}
+	}
+	if vm.Status != "running" {
+		s.handleStatusChange(ctx, vm, vm.Status, "running", nil)
+	}
+	return true
+}
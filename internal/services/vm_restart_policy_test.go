@@ -0,0 +1,58 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	libvirtgo "github.com/libvirt/libvirt-go"
+)
+
+func TestRestartDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{name: "first restart", backoff: 10 * time.Second, attempts: 0, want: 0},
+		{name: "after one restart", backoff: 10 * time.Second, attempts: 1, want: 10 * time.Second},
+		{name: "doubles", backoff: 10 * time.Second, attempts: 3, want: 40 * time.Second},
+		{name: "capped", backoff: 10 * time.Second, attempts: 20, want: maxRestartBackoff},
+		{name: "long backoff kept", backoff: 20 * time.Minute, attempts: 3, want: 20 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restartDelay(tt.backoff, tt.attempts); got != tt.want {
+				t.Errorf("restartDelay(%v, %d) = %v, want %v", tt.backoff, tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuestFailed(t *testing.T) {
+	shutoff := int(libvirtgo.DOMAIN_SHUTOFF)
+	tests := []struct {
+		name           string
+		state, reason  int
+		failed, killed bool
+	}{
+		{name: "crashed", state: int(libvirtgo.DOMAIN_CRASHED), failed: true},
+		{name: "shut off after a crash", state: shutoff, reason: int(libvirtgo.DOMAIN_SHUTOFF_CRASHED), failed: true},
+		{name: "failed to start", state: shutoff, reason: int(libvirtgo.DOMAIN_SHUTOFF_FAILED), failed: true},
+		{name: "shut down", state: shutoff, reason: int(libvirtgo.DOMAIN_SHUTOFF_SHUTDOWN)},
+		{name: "destroyed", state: shutoff, reason: int(libvirtgo.DOMAIN_SHUTOFF_DESTROYED), killed: true},
+		{name: "running", state: int(libvirtgo.DOMAIN_RUNNING)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := guestFailed(tt.state, tt.reason); got != tt.failed {
+				t.Errorf("guestFailed = %v, want %v", got, tt.failed)
+			}
+			if got := stoppedFromOutside(tt.state, tt.reason); got != tt.killed {
+				t.Errorf("stoppedFromOutside = %v, want %v", got, tt.killed)
+			}
+		})
+	}
+}
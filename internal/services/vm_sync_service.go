@@ -59,6 +59,8 @@ type VMSyncService struct {
 	wg           sync.WaitGroup
 	mu           sync.RWMutex
 	statusCache  map[string]*VMStatusInfo
+	restarts     map[string]*restartState
+	prepareStart StartPrepareFunc
 	eventChan    chan StatusChangeEvent
 	syncInterval time.Duration
 }
@@ -140,6 +142,7 @@ func NewVMSyncService(libvirtClient *libvirt.Client, vmRepo *repository.VMReposi
 		wsHub:        NewWebSocketHub(),
 		stopChan:     make(chan struct{}),
 		statusCache:  make(map[string]*VMStatusInfo),
+		restarts:     make(map[string]*restartState),
 		eventChan:    make(chan StatusChangeEvent, 100),
 		syncInterval: syncInterval,
 	}
@@ -247,11 +250,15 @@ func (s *VMSyncService) syncSingleVM(ctx context.Context, vm *models.VirtualMach
 		return
 	}
 
+	if s.enforceRestartPolicy(ctx, vm, domain, state, int(reason)) {
+		return
+	}
+
 	s.mu.RLock()
 	cachedInfo, exists := s.statusCache[vm.ID.String()]
 	s.mu.RUnlock()
 
-	newStatus := libvirtStateToStatus(state)
+	newStatus := LibvirtStateToStatus(state)
 	oldStatus := vm.Status
 
 	if exists && cachedInfo.Status != newStatus {
@@ -271,7 +278,7 @@ func (s *VMSyncService) getDomainInfo(domain *libvirt.Domain, vm *models.Virtual
 	info := &VMStatusInfo{
 		VMID:          vm.ID.String(),
 		VMName:        vm.Name,
-		Status:        libvirtStateToStatus(state),
+		Status:        LibvirtStateToStatus(state),
 		LibvirtState:  state,
 		LibvirtReason: reason,
 		CPUCount:      uint(vm.CPUAllocated),
@@ -375,7 +382,8 @@ func (s *VMSyncService) GetWebSocketHub() *WebSocketHub {
 	return s.wsHub
 }
 
-func libvirtStateToStatus(state int) string {
+// LibvirtStateToStatus maps a libvirt domain state to the status of a VM.
+func LibvirtStateToStatus(state int) string {
 	switch libvirtgo.DomainState(state) {
 	case libvirtgo.DOMAIN_NOSTATE:
 		return "no_state"
@@ -29,11 +29,18 @@ type Scheduler struct {
 	alertService       *services.AlertService
 	backupService      *services.BackupService
 	vmSyncService      *services.VMSyncService
+	guestAgentService  *services.GuestAgentService
+	balloonService     *services.BalloonService
+	driftService       *services.DriftService
+	orphanService      *services.OrphanService
 	stopChan           chan struct{}
 }
 
 func NewScheduler(db *gorm.DB, libvirtClient *libvirt.Client, alertService *services.AlertService, backupService *services.BackupService) *Scheduler {
 	vmRepo := repository.NewVMRepository(db)
+	vmSyncService := services.NewVMSyncService(libvirtClient, vmRepo, 10*time.Second)
+	driftService := services.NewDriftService(libvirtClient, vmRepo, repository.NewVMDriftRepository(db), 5*time.Minute)
+	driftService.SetAlerting(alertService, vmSyncService.GetWebSocketHub())
 
 	return &Scheduler{
 		db:                 db,
@@ -44,7 +51,10 @@ func NewScheduler(db *gorm.DB, libvirtClient *libvirt.Client, alertService *serv
 		libvirt:            libvirtClient,
 		alertService:       alertService,
 		backupService:      backupService,
-		vmSyncService:      services.NewVMSyncService(libvirtClient, vmRepo, 10*time.Second),
+		vmSyncService:      vmSyncService,
+		guestAgentService:  services.NewGuestAgentService(libvirtClient, vmRepo, time.Minute),
+		balloonService:     services.NewBalloonService(libvirtClient),
+		driftService:       driftService,
 		stopChan:           make(chan struct{}),
 	}
 }
@@ -65,6 +75,18 @@ func (s *Scheduler) Start() {
 		s.vmSyncService.Start()
 	}
 
+	if s.guestAgentService != nil {
+		s.guestAgentService.Start()
+	}
+
+	if s.driftService != nil {
+		s.driftService.Start()
+	}
+
+	if s.orphanService != nil {
+		s.orphanService.Start()
+	}
+
 	go func() {
 		for {
 			select {
@@ -84,6 +106,15 @@ func (s *Scheduler) Start() {
 				if s.vmSyncService != nil {
 					s.vmSyncService.Stop()
 				}
+				if s.guestAgentService != nil {
+					s.guestAgentService.Stop()
+				}
+				if s.driftService != nil {
+					s.driftService.Stop()
+				}
+				if s.orphanService != nil {
+					s.orphanService.Stop()
+				}
 				return
 			}
 		}
@@ -97,10 +128,27 @@ func (s *Scheduler) Stop() {
 	log.Println("Task scheduler stopped")
 }
 
+// SetOrphanService makes the scheduler run the scheduled orphan scan.
+func (s *Scheduler) SetOrphanService(orphanService *services.OrphanService) {
+	s.orphanService = orphanService
+}
+
 func (s *Scheduler) GetVMSyncService() *services.VMSyncService {
 	return s.vmSyncService
 }
 
+// GetDriftService returns the drift service of the scheduled scan, which
+// also serves the scans and resolutions of the API.
+func (s *Scheduler) GetDriftService() *services.DriftService {
+	return s.driftService
+}
+
+// GetGuestAgentService returns the guest agent service of the periodic
+// collection, which also serves the refreshes of the API.
+func (s *Scheduler) GetGuestAgentService() *services.GuestAgentService {
+	return s.guestAgentService
+}
+
 func (s *Scheduler) collectStats() {
 	if s.vmRepo == nil || s.statsRepo == nil {
 		log.Println("Warning: repositories not initialized, skipping stats collection")
@@ -118,6 +166,7 @@ func (s *Scheduler) collectStats() {
 
 	for _, vm := range vms {
 		if s.libvirt == nil || vm.Status != "running" {
+			s.balloonService.Forget(vm.ID.String())
 			continue
 		}
 
@@ -129,12 +178,46 @@ func (s *Scheduler) collectStats() {
 			CollectedAt: time.Now(),
 		}
 
+		if vm.LibvirtDomainUUID != "" {
+			s.collectMemoryStats(&vm, &stats)
+		}
+
 		if err := s.statsRepo.Create(ctx, &stats); err != nil {
 			log.Printf("Error creating VM stats: %v", err)
 		}
 	}
 }
 
+// collectMemoryStats fills stats with what the balloon driver of the guest
+// reports and lets the balloon service act on it.
+func (s *Scheduler) collectMemoryStats(vm *models.VirtualMachine, stats *models.VMStats) {
+	memStats, err := s.libvirt.GetMemoryStats(vm.LibvirtDomainUUID)
+	if err != nil {
+		return
+	}
+
+	stats.MemoryBalloon = int64(memStats.Actual / 1024)
+	if !memStats.HasGuestStats() {
+		// Guests defined before the balloon had a stats period report
+		// nothing until they get one.
+		if err := s.libvirt.SetMemoryStatsPeriod(vm.LibvirtDomainUUID, libvirt.MemBalloonStatsPeriod); err != nil {
+			log.Printf("Error enabling memory stats of VM %s: %v", vm.Name, err)
+		}
+		return
+	}
+
+	unused := min(memStats.Unused, memStats.Available)
+	stats.MemoryUnused = int64(unused / 1024)
+	stats.MemoryAvailable = int64(memStats.Available / 1024)
+	stats.MajorFaults = int64(memStats.MajorFaults)
+
+	if vm.Balloon.Auto {
+		s.balloonService.Balance(vm, memStats)
+	} else {
+		s.balloonService.Forget(vm.ID.String())
+	}
+}
+
 func (s *Scheduler) cleanupExpiredUploads() {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
@@ -0,0 +1,73 @@
+package unattend
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newcArchive returns an uncompressed "newc" cpio archive holding files in
+// its root. The kernel unpacks concatenated archives in order, so appending
+// this to an installer initrd adds the files to its root filesystem.
+func newcArchive(files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	mtime := time.Now().Unix()
+	ino := 1
+
+	writeEntry := func(name string, mode uint32, data []byte) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			ino, mode, 0, 0, 1, mtime, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		pad4(&buf)
+		buf.Write(data)
+		pad4(&buf)
+		ino++
+	}
+
+	for _, name := range sortedKeys(files) {
+		writeEntry(name, 0100644, files[name])
+	}
+	writeEntry("TRAILER!!!", 0, nil)
+	return buf.Bytes()
+}
+
+func pad4(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// AppendToInitrd appends files to the initrd image at path as an extra cpio
+// archive. The kernel only accepts an uncompressed archive that starts on a
+// four byte boundary, so the existing image is zero padded first.
+func AppendToInitrd(path string, files map[string][]byte) error {
+	for name := range files {
+		if name == "" || filepath.Base(name) != name {
+			return fmt.Errorf("invalid initrd file name: %q", name)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	var buf bytes.Buffer
+	for size := info.Size(); size%4 != 0; size++ {
+		buf.WriteByte(0)
+	}
+	buf.Write(newcArchive(files))
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
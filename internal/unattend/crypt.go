@@ -0,0 +1,135 @@
+package unattend
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"strings"
+)
+
+const (
+	cryptAlphabet    = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	cryptSaltLength  = 16
+	cryptRounds      = 5000
+	cryptSHA512Magic = "$6$"
+)
+
+// HashPassword returns a SHA-512 crypt(3) hash of password with a random
+// salt, the format installers accept for pre-hashed passwords.
+func HashPassword(password string) (string, error) {
+	raw := make([]byte, cryptSaltLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	salt := make([]byte, cryptSaltLength)
+	for i, b := range raw {
+		salt[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+	return SHA512Crypt(password, string(salt)), nil
+}
+
+// IsPasswordHash reports whether s already looks like a crypt(3) hash.
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$6$") || strings.HasPrefix(s, "$5$") || strings.HasPrefix(s, "$y$") || strings.HasPrefix(s, "$1$")
+}
+
+// SHA512Crypt returns the crypt(3) "$6$" hash of password with salt, using
+// the default round count. Salts longer than 16 characters are truncated.
+func SHA512Crypt(password, salt string) string {
+	p := []byte(password)
+	s := []byte(salt)
+	if len(s) > cryptSaltLength {
+		s = s[:cryptSaltLength]
+	}
+
+	alt := sha512.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	for i := len(p); i > 0; i -= sha512.Size {
+		if i > sha512.Size {
+			a.Write(altSum)
+		} else {
+			a.Write(altSum[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(p)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeatTo(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatTo(ds.Sum(nil), len(s))
+
+	for r := 0; r < cryptRounds; r++ {
+		c := sha512.New()
+		if r&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(sum)
+		}
+		if r%3 != 0 {
+			c.Write(sSeq)
+		}
+		if r%7 != 0 {
+			c.Write(pSeq)
+		}
+		if r&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pSeq)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(cryptSHA512Magic)
+	out.Write(s)
+	out.WriteByte('$')
+	for _, g := range [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	} {
+		encode24(&out, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+	}
+	encode24(&out, 0, 0, sum[63], 2)
+	return out.String()
+}
+
+func repeatTo(block []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		rest := n - len(out)
+		if rest > len(block) {
+			rest = len(block)
+		}
+		out = append(out, block[:rest]...)
+	}
+	return out
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,270 @@
+package unattend
+
+// windowsPostInstallScript is copied next to autounattend.xml and run at the
+// first logon.
+const windowsPostInstallScript = "post-install.ps1"
+
+// Every built-in profile powers the guest off when the install finishes so
+// the first shutdown marks completion and the installer media can be
+// detached before the next boot.
+var builtinTemplates = map[Profile]string{
+	ProfileKickstart:   kickstartTemplate,
+	ProfilePreseed:     preseedTemplate,
+	ProfileAutoinstall: autoinstallTemplate,
+	ProfileWindows:     autounattendTemplate,
+}
+
+const kickstartTemplate = `# Generated by vmmanager
+text
+lang {{.Locale}}
+keyboard {{.Keyboard}}
+timezone {{.Timezone}} --utc
+network --bootproto=dhcp --activate --hostname={{.Hostname}}
+rootpw --lock
+user --name={{.Username}} --groups=wheel --iscrypted --password={{.PasswordHash}}
+{{range .SSHAuthorizedKeys}}sshkey --username={{$.Username}} {{quote .}}
+{{end}}ignoredisk --only-use={{.RootDisk}}
+zerombr
+clearpart --all --initlabel --drives={{.RootDisk}}
+autopart --type={{if eq .DiskLayout "plain"}}plain{{else}}lvm{{end}}
+services --enabled=sshd,qemu-guest-agent
+firstboot --disable
+poweroff
+
+%packages
+@core
+qemu-guest-agent
+{{range .Packages}}{{.}}
+{{end}}%end
+{{if .PostInstallScript}}
+%post --log=/root/vmmanager-post-install.log
+{{.PostInstallScript}}
+%end
+{{end}}`
+
+const preseedTemplate = `# Generated by vmmanager
+d-i debian-installer/locale string {{.Locale}}
+d-i keyboard-configuration/xkb-keymap select {{.Keyboard}}
+d-i netcfg/choose_interface select auto
+d-i netcfg/get_hostname string {{.ShortHostname}}
+d-i netcfg/get_domain string {{.Domain}}
+d-i netcfg/hostname string {{.Hostname}}
+d-i mirror/country string manual
+d-i mirror/http/hostname string deb.debian.org
+d-i mirror/http/directory string /debian
+d-i mirror/http/proxy string
+d-i passwd/root-login boolean false
+d-i passwd/user-fullname string {{.Username}}
+d-i passwd/username string {{.Username}}
+d-i passwd/user-password-crypted password {{.PasswordHash}}
+d-i clock-setup/utc boolean true
+d-i time/zone string {{.Timezone}}
+d-i clock-setup/ntp boolean true
+d-i partman-auto/disk string /dev/{{.RootDisk}}
+d-i partman-auto/method string {{if eq .DiskLayout "plain"}}regular{{else}}lvm{{end}}
+d-i partman-auto-lvm/guided_size string max
+d-i partman-auto/choose_recipe select atomic
+d-i partman-lvm/device_remove_lvm boolean true
+d-i partman-lvm/confirm boolean true
+d-i partman-lvm/confirm_nooverwrite boolean true
+d-i partman-md/device_remove_md boolean true
+d-i partman-efi/non_efi_system boolean true
+d-i partman-partitioning/confirm_write_new_label boolean true
+d-i partman/choose_partition select finish
+d-i partman/confirm boolean true
+d-i partman/confirm_nooverwrite boolean true
+d-i apt-setup/cdrom/set-first boolean false
+tasksel tasksel/first multiselect standard, ssh-server
+d-i pkgsel/include string qemu-guest-agent{{range .Packages}} {{.}}{{end}}
+d-i pkgsel/upgrade select none
+popularity-contest popularity-contest/participate boolean false
+d-i grub-installer/only_debian boolean true
+d-i grub-installer/bootdev string default
+{{if .LateScript}}d-i preseed/late_command string in-target sh -c 'echo {{b64 .LateScript}} | base64 -d > /root/vmmanager-late.sh && sh /root/vmmanager-late.sh'
+{{end}}d-i finish-install/reboot_in_progress note
+d-i debian-installer/exit/poweroff boolean true
+`
+
+const autoinstallTemplate = `#cloud-config
+autoinstall:
+  version: 1
+  locale: {{quote .Locale}}
+  keyboard:
+    layout: {{quote .Keyboard}}
+  timezone: {{quote .Timezone}}
+  identity:
+    hostname: {{quote .ShortHostname}}
+    username: {{quote .Username}}
+    password: {{quote .PasswordHash}}
+  ssh:
+    install-server: true
+    allow-pw: true
+{{- if .SSHAuthorizedKeys}}
+    authorized-keys:
+{{- range .SSHAuthorizedKeys}}
+      - {{quote .}}
+{{- end}}
+{{- end}}
+  storage:
+    layout:
+      name: {{if eq .DiskLayout "plain"}}direct{{else}}lvm{{end}}
+  packages:
+    - qemu-guest-agent
+{{- range .Packages}}
+    - {{quote .}}
+{{- end}}
+{{- if .PostInstallScript}}
+  late-commands:
+    - {{quote (printf "curtin in-target -- sh -c 'echo %s | base64 -d | sh'" (b64 .PostInstallScript))}}
+{{- end}}
+  shutdown: poweroff
+`
+
+const autounattendTemplate = `<?xml version="1.0" encoding="utf-8"?>
+<!-- Generated by vmmanager -->
+<unattend xmlns="urn:schemas-microsoft-com:unattend" xmlns:wcm="http://schemas.microsoft.com/WMIConfig/2002/State">
+  <settings pass="windowsPE">
+    <component name="Microsoft-Windows-International-Core-WinPE" processorArchitecture="{{windowsArch .Architecture}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <SetupUILanguage>
+        <UILanguage>{{windowsLocale .Locale}}</UILanguage>
+      </SetupUILanguage>
+      <InputLocale>{{windowsLocale .Locale}}</InputLocale>
+      <SystemLocale>{{windowsLocale .Locale}}</SystemLocale>
+      <UILanguage>{{windowsLocale .Locale}}</UILanguage>
+      <UserLocale>{{windowsLocale .Locale}}</UserLocale>
+    </component>
+{{- if .DriverPaths}}
+    <component name="Microsoft-Windows-PnpCustomizationsWinPE" processorArchitecture="{{windowsArch .Architecture}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <DriverPaths>
+{{- range $i, $path := .DriverPaths}}
+        <PathAndCredentials wcm:action="add" wcm:keyValue="{{inc $i}}">
+          <Path>{{$path}}</Path>
+        </PathAndCredentials>
+{{- end}}
+      </DriverPaths>
+    </component>
+{{- end}}
+    <component name="Microsoft-Windows-Setup" processorArchitecture="{{windowsArch .Architecture}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <DiskConfiguration>
+        <Disk wcm:action="add">
+          <DiskID>0</DiskID>
+          <WillWipeDisk>true</WillWipeDisk>
+          <CreatePartitions>
+            <CreatePartition wcm:action="add">
+              <Order>1</Order>
+              <Type>EFI</Type>
+              <Size>100</Size>
+            </CreatePartition>
+            <CreatePartition wcm:action="add">
+              <Order>2</Order>
+              <Type>MSR</Type>
+              <Size>16</Size>
+            </CreatePartition>
+            <CreatePartition wcm:action="add">
+              <Order>3</Order>
+              <Type>Primary</Type>
+              <Extend>true</Extend>
+            </CreatePartition>
+          </CreatePartitions>
+          <ModifyPartitions>
+            <ModifyPartition wcm:action="add">
+              <Order>1</Order>
+              <PartitionID>1</PartitionID>
+              <Format>FAT32</Format>
+              <Label>System</Label>
+            </ModifyPartition>
+            <ModifyPartition wcm:action="add">
+              <Order>2</Order>
+              <PartitionID>3</PartitionID>
+              <Format>NTFS</Format>
+              <Label>Windows</Label>
+              <Letter>C</Letter>
+            </ModifyPartition>
+          </ModifyPartitions>
+        </Disk>
+      </DiskConfiguration>
+      <ImageInstall>
+        <OSImage>
+          <InstallFrom>
+            <MetaData wcm:action="add">
+              <Key>/IMAGE/INDEX</Key>
+              <Value>{{.ImageIndex}}</Value>
+            </MetaData>
+          </InstallFrom>
+          <InstallTo>
+            <DiskID>0</DiskID>
+            <PartitionID>3</PartitionID>
+          </InstallTo>
+        </OSImage>
+      </ImageInstall>
+      <UserData>
+        <AcceptEula>true</AcceptEula>
+{{- if .ProductKey}}
+        <ProductKey>
+          <Key>{{.ProductKey}}</Key>
+          <WillShowUI>OnError</WillShowUI>
+        </ProductKey>
+{{- end}}
+      </UserData>
+    </component>
+  </settings>
+  <settings pass="specialize">
+    <component name="Microsoft-Windows-Shell-Setup" processorArchitecture="{{windowsArch .Architecture}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <ComputerName>{{computerName .ShortHostname}}</ComputerName>
+      <TimeZone>{{xml (windowsTimezone .Timezone)}}</TimeZone>
+    </component>
+  </settings>
+  <settings pass="oobeSystem">
+    <component name="Microsoft-Windows-International-Core" processorArchitecture="{{windowsArch .Architecture}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <InputLocale>{{windowsLocale .Locale}}</InputLocale>
+      <SystemLocale>{{windowsLocale .Locale}}</SystemLocale>
+      <UILanguage>{{windowsLocale .Locale}}</UILanguage>
+      <UserLocale>{{windowsLocale .Locale}}</UserLocale>
+    </component>
+    <component name="Microsoft-Windows-Shell-Setup" processorArchitecture="{{windowsArch .Architecture}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <OOBE>
+        <HideEULAPage>true</HideEULAPage>
+        <HideOEMRegistrationScreen>true</HideOEMRegistrationScreen>
+        <HideOnlineAccountScreens>true</HideOnlineAccountScreens>
+        <HideWirelessSetupInOOBE>true</HideWirelessSetupInOOBE>
+        <ProtectYourPC>3</ProtectYourPC>
+      </OOBE>
+      <UserAccounts>
+        <LocalAccounts>
+          <LocalAccount wcm:action="add">
+            <Name>{{xml .Username}}</Name>
+            <Group>Administrators</Group>
+            <Password>
+              <Value>{{xml .Password}}</Value>
+              <PlainText>true</PlainText>
+            </Password>
+          </LocalAccount>
+        </LocalAccounts>
+      </UserAccounts>
+      <AutoLogon>
+        <Enabled>true</Enabled>
+        <LogonCount>1</LogonCount>
+        <Username>{{xml .Username}}</Username>
+        <Password>
+          <Value>{{xml .Password}}</Value>
+          <PlainText>true</PlainText>
+        </Password>
+      </AutoLogon>
+      <FirstLogonCommands>
+{{- if .PostInstallScript}}
+        <SynchronousCommand wcm:action="add">
+          <Order>1</Order>
+          <CommandLine>cmd /c for %d in (D E F G H I J K L M N O P Q R S T U V W X Y Z) do if exist %d:\post-install.ps1 powershell -NoProfile -ExecutionPolicy Bypass -File %d:\post-install.ps1</CommandLine>
+          <Description>Post-install script</Description>
+        </SynchronousCommand>
+{{- end}}
+        <SynchronousCommand wcm:action="add">
+          <Order>{{if .PostInstallScript}}2{{else}}1{{end}}</Order>
+          <CommandLine>shutdown /s /t 0</CommandLine>
+          <Description>Power off after install</Description>
+        </SynchronousCommand>
+      </FirstLogonCommands>
+    </component>
+  </settings>
+</unattend>
+`
@@ -0,0 +1,559 @@
+// Package unattend renders answer files for unattended OS installation from
+// ISO media and prepares the media that delivers them to the installer.
+package unattend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"vmmanager/internal/cloudinit"
+	"vmmanager/internal/iso9660"
+)
+
+type Profile string
+
+const (
+	ProfileKickstart   Profile = "kickstart"
+	ProfilePreseed     Profile = "preseed"
+	ProfileAutoinstall Profile = "autoinstall"
+	ProfileWindows     Profile = "autounattend"
+)
+
+// Delivery is how the answer file reaches the installer: on a secondary ISO
+// the installer scans for, or through a directly booted installer kernel
+// whose command line points at it.
+type Delivery string
+
+const (
+	DeliveryISO    Delivery = "iso"
+	DeliveryKernel Delivery = "kernel"
+)
+
+const (
+	DiskLayoutLVM   = "lvm"
+	DiskLayoutPlain = "plain"
+)
+
+const DefaultUsername = "vmadmin"
+
+// RootDiskDevice is the name the Linux installer gives the system disk on
+// bus. It is not the libvirt target: SATA CD-ROMs show up as srN, so a SATA
+// system disk on target sde is still the first disk, sda, in the guest.
+func RootDiskDevice(bus string) string {
+	if bus == "sata" {
+		return "sda"
+	}
+	return "vda"
+}
+
+// virtioDriverDirs are the folders of the virtio-win ISO with the storage,
+// network and guest device drivers Setup installs. Setup searches their
+// subfolders for the build matching the Windows version and architecture.
+var virtioDriverDirs = []string{"viostor", "vioscsi", "NetKVM", "Balloon", "vioserial"}
+
+// virtioDriveLetters are where the driver CD-ROM may be mounted during
+// Setup, after the installer and answer file CD-ROMs.
+var virtioDriveLetters = []string{"D", "E", "F", "G"}
+
+// ParseProfile accepts a profile name as stored on VMs and in requests.
+func ParseProfile(name string) (Profile, error) {
+	switch p := Profile(strings.ToLower(strings.TrimSpace(name))); p {
+	case ProfileKickstart, ProfilePreseed, ProfileAutoinstall, ProfileWindows:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown unattended install profile: %q", name)
+}
+
+// ProfileForOS guesses the profile from an ISO or template OS type. It
+// returns an empty profile when there is no obvious match.
+func ProfileForOS(osType string) Profile {
+	name := strings.ToLower(osType)
+	switch {
+	case strings.Contains(name, "windows"):
+		return ProfileWindows
+	case strings.Contains(name, "ubuntu"):
+		return ProfileAutoinstall
+	case strings.Contains(name, "debian"):
+		return ProfilePreseed
+	case strings.Contains(name, "fedora"), strings.Contains(name, "centos"), strings.Contains(name, "rhel"),
+		strings.Contains(name, "red hat"), strings.Contains(name, "rocky"), strings.Contains(name, "alma"):
+		return ProfileKickstart
+	}
+	return ""
+}
+
+func (p Profile) DefaultDelivery() Delivery {
+	switch p {
+	case ProfileKickstart, ProfileWindows:
+		return DeliveryISO
+	default:
+		return DeliveryKernel
+	}
+}
+
+// SupportsDelivery reports whether the installer can pick up the answer file
+// without console input when delivered as d. Debian and Ubuntu only start
+// fully automatic installs from kernel arguments, and Windows Setup has no
+// kernel to boot directly.
+func (p Profile) SupportsDelivery(d Delivery) bool {
+	switch p {
+	case ProfileKickstart:
+		return d == DeliveryISO || d == DeliveryKernel
+	case ProfileWindows:
+		return d == DeliveryISO
+	default:
+		return d == DeliveryKernel
+	}
+}
+
+// AnswerFileName is the name the installer looks for.
+func (p Profile) AnswerFileName() string {
+	switch p {
+	case ProfileKickstart:
+		return "ks.cfg"
+	case ProfilePreseed:
+		return "preseed.cfg"
+	case ProfileAutoinstall:
+		return "user-data"
+	default:
+		return "autounattend.xml"
+	}
+}
+
+// VolumeLabel is the label of the generated secondary ISO. Anaconda loads
+// ks.cfg from a volume labelled OEMDRV and subiquity reads a NoCloud seed;
+// preseed files travel inside the initrd instead.
+func (p Profile) VolumeLabel() string {
+	switch p {
+	case ProfileKickstart:
+		return "OEMDRV"
+	case ProfileAutoinstall:
+		return cloudinit.VolumeLabel
+	case ProfileWindows:
+		return "UNATTEND"
+	default:
+		return ""
+	}
+}
+
+// BootFiles returns the kernel and initrd paths inside the installer ISO.
+func (p Profile) BootFiles(arch string) (kernel, initrd string, err error) {
+	arm := arch == "arm64" || arch == "aarch64"
+	switch p {
+	case ProfileKickstart:
+		return "images/pxeboot/vmlinuz", "images/pxeboot/initrd.img", nil
+	case ProfilePreseed:
+		if arm {
+			return "install.a64/vmlinuz", "install.a64/initrd.gz", nil
+		}
+		return "install.amd/vmlinuz", "install.amd/initrd.gz", nil
+	case ProfileAutoinstall:
+		return "casper/vmlinuz", "casper/initrd", nil
+	}
+	return "", "", fmt.Errorf("profile %s does not support kernel delivery", p)
+}
+
+// KernelArgs returns the installer command line for kernel delivery.
+// installLabel is the volume label of the installer ISO.
+func (p Profile) KernelArgs(installLabel string) string {
+	switch p {
+	case ProfileKickstart:
+		return fmt.Sprintf("inst.stage2=hd:LABEL=%s inst.ks=hd:LABEL=%s:/%s", escapeLabel(installLabel), p.VolumeLabel(), p.AnswerFileName())
+	case ProfilePreseed:
+		return "auto=true priority=critical preseed/file=/" + p.AnswerFileName()
+	case ProfileAutoinstall:
+		return "autoinstall"
+	}
+	return ""
+}
+
+// escapeLabel encodes characters dracut cannot take literally in LABEL=.
+func escapeLabel(label string) string {
+	var sb strings.Builder
+	for _, r := range label {
+		if r == ' ' || r == '/' || r == '\\' {
+			fmt.Fprintf(&sb, `\x%02x`, r)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Vars are the per-VM values available to answer file templates.
+type Vars struct {
+	Hostname          string
+	Username          string
+	Password          string
+	PasswordHash      string
+	Timezone          string
+	Locale            string
+	Keyboard          string
+	DiskLayout        string
+	RootDisk          string
+	SSHAuthorizedKeys []string
+	Packages          []string
+	PostInstallScript string
+	ProductKey        string
+	ImageIndex        int
+	Architecture      string
+	// VirtioDrivers makes Windows Setup load the drivers of the attached
+	// virtio-win CD-ROM.
+	VirtioDrivers bool
+}
+
+var (
+	usernamePattern   = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	timezonePattern   = regexp.MustCompile(`^[A-Za-z0-9_+/ -]{1,64}$`)
+	localePattern     = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,32}$`)
+	keyboardPattern   = regexp.MustCompile(`^[A-Za-z0-9_:.-]{1,32}$`)
+	packagePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._:@-]*$`)
+	productKeyPattern = regexp.MustCompile(`^[A-Z0-9]{5}(-[A-Z0-9]{5}){4}$`)
+	rootDiskPattern   = regexp.MustCompile(`^(vd|sd|hd|xvd)[a-z]{1,2}$`)
+)
+
+// Normalize fills defaults, validates the values for profile p and derives
+// the password hash Linux installers expect.
+func (v *Vars) Normalize(p Profile) error {
+	if v.Username == "" {
+		v.Username = DefaultUsername
+	}
+	if v.Timezone == "" {
+		v.Timezone = "UTC"
+	}
+	if v.Locale == "" {
+		v.Locale = "en_US.UTF-8"
+	}
+	if v.Keyboard == "" {
+		v.Keyboard = "us"
+	}
+	if v.DiskLayout == "" {
+		v.DiskLayout = DiskLayoutLVM
+	}
+	if v.RootDisk == "" {
+		v.RootDisk = RootDiskDevice("")
+	}
+	if v.ImageIndex <= 0 {
+		v.ImageIndex = 1
+	}
+
+	if !cloudinit.ValidHostname(v.Hostname) {
+		return fmt.Errorf("invalid hostname: %q", v.Hostname)
+	}
+	if !usernamePattern.MatchString(v.Username) {
+		return fmt.Errorf("invalid username: %q", v.Username)
+	}
+	if !timezonePattern.MatchString(v.Timezone) {
+		return fmt.Errorf("invalid timezone: %q", v.Timezone)
+	}
+	if !localePattern.MatchString(v.Locale) {
+		return fmt.Errorf("invalid locale: %q", v.Locale)
+	}
+	if !keyboardPattern.MatchString(v.Keyboard) {
+		return fmt.Errorf("invalid keyboard layout: %q", v.Keyboard)
+	}
+	if v.DiskLayout != DiskLayoutLVM && v.DiskLayout != DiskLayoutPlain {
+		return fmt.Errorf("disk layout must be %q or %q", DiskLayoutLVM, DiskLayoutPlain)
+	}
+	if !rootDiskPattern.MatchString(v.RootDisk) {
+		return fmt.Errorf("invalid root disk: %q", v.RootDisk)
+	}
+	for _, pkg := range v.Packages {
+		if !packagePattern.MatchString(pkg) {
+			return fmt.Errorf("invalid package name: %q", pkg)
+		}
+	}
+	for _, key := range v.SSHAuthorizedKeys {
+		if strings.ContainsAny(key, "\r\n'\"") {
+			return fmt.Errorf("ssh keys must be single-line public keys")
+		}
+	}
+	if v.ProductKey != "" && !productKeyPattern.MatchString(v.ProductKey) {
+		return fmt.Errorf("invalid product key")
+	}
+
+	if p != ProfileWindows && strings.Contains(v.Timezone, " ") {
+		return fmt.Errorf("invalid timezone: %q", v.Timezone)
+	}
+
+	if p == ProfileWindows {
+		if v.Password == "" {
+			return fmt.Errorf("a plain text password is required for Windows installs")
+		}
+		return nil
+	}
+
+	if v.PasswordHash != "" {
+		if !IsPasswordHash(v.PasswordHash) || strings.ContainsAny(v.PasswordHash, " \r\n'\"") {
+			return fmt.Errorf("password hash must be in crypt(3) format")
+		}
+		return nil
+	}
+	if v.Password == "" {
+		return fmt.Errorf("password or password hash is required")
+	}
+	hash, err := HashPassword(v.Password)
+	if err != nil {
+		return err
+	}
+	v.PasswordHash = hash
+	return nil
+}
+
+// templateData is what answer file templates, including custom ones stored
+// in VMTemplate.InstallScript, are executed against.
+type templateData struct {
+	Vars
+	ShortHostname string
+	Domain        string
+	LateScript    string
+	// DriverPaths are the folders Windows Setup searches for drivers.
+	DriverPaths []string
+}
+
+func newTemplateData(v Vars) templateData {
+	data := templateData{Vars: v, ShortHostname: v.Hostname}
+	if i := strings.Index(v.Hostname, "."); i >= 0 {
+		data.ShortHostname = v.Hostname[:i]
+		data.Domain = v.Hostname[i+1:]
+	}
+
+	var late strings.Builder
+	if len(v.SSHAuthorizedKeys) > 0 {
+		home := "/home/" + v.Username
+		fmt.Fprintf(&late, "mkdir -p %s/.ssh\n", home)
+		for _, key := range v.SSHAuthorizedKeys {
+			fmt.Fprintf(&late, "echo '%s' >> %s/.ssh/authorized_keys\n", key, home)
+		}
+		fmt.Fprintf(&late, "chmod 700 %s/.ssh\nchmod 600 %s/.ssh/authorized_keys\n", home, home)
+		fmt.Fprintf(&late, "chown -R %s: %s/.ssh\n", v.Username, home)
+	}
+	if script := strings.TrimSpace(v.PostInstallScript); script != "" {
+		late.WriteString(script + "\n")
+	}
+	data.LateScript = late.String()
+
+	if v.VirtioDrivers {
+		for _, letter := range virtioDriveLetters {
+			for _, dir := range virtioDriverDirs {
+				data.DriverPaths = append(data.DriverPaths, letter+`:\`+dir)
+			}
+		}
+	}
+	return data
+}
+
+var templateFuncs = template.FuncMap{
+	"quote": func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	},
+	"b64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"xml": func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	},
+	"inc": func(i int) int {
+		return i + 1
+	},
+	"windowsArch": func(arch string) string {
+		if arch == "arm64" || arch == "aarch64" {
+			return "arm64"
+		}
+		return "amd64"
+	},
+	"windowsLocale": func(locale string) string {
+		if i := strings.IndexAny(locale, ".@"); i >= 0 {
+			locale = locale[:i]
+		}
+		return strings.ReplaceAll(locale, "_", "-")
+	},
+	"windowsTimezone": func(tz string) string {
+		if tz == "Etc/UTC" || tz == "UTC" {
+			return "UTC"
+		}
+		return tz
+	},
+	"computerName": func(name string) string {
+		if len(name) > 15 {
+			name = name[:15]
+		}
+		return strings.TrimRight(name, "-")
+	},
+}
+
+// ValidateTemplate checks that a custom answer file template parses. An empty
+// template is valid and selects the built-in one.
+func ValidateTemplate(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	_, err := template.New("install").Funcs(templateFuncs).Parse(text)
+	return err
+}
+
+// Render executes the built-in template for p, or customTemplate when it is
+// not empty, and returns the answer file.
+func Render(p Profile, customTemplate string, vars Vars) ([]byte, error) {
+	text := customTemplate
+	if strings.TrimSpace(text) == "" {
+		text = builtinTemplates[p]
+	}
+	if text == "" {
+		return nil, fmt.Errorf("no template for profile %s", p)
+	}
+
+	tmpl, err := template.New(string(p)).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid install template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, newTemplateData(vars)); err != nil {
+		return nil, fmt.Errorf("failed to render install template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Options describe one unattended install to prepare.
+type Options struct {
+	Profile  Profile
+	Delivery Delivery
+	// Template overrides the built-in answer file template when set.
+	Template string
+	Vars     Vars
+	// InstallISO is the installer image; boot files are read from it for
+	// kernel delivery.
+	InstallISO string
+	// OutputDir and Name decide where generated files are written:
+	// <OutputDir>/<Name>-install.iso, -install-vmlinuz and -install-initrd.
+	OutputDir string
+	Name      string
+}
+
+// Media is what has to be attached to the domain for the install.
+type Media struct {
+	ISOPath    string
+	KernelPath string
+	InitrdPath string
+	Cmdline    string
+}
+
+// Files lists every file Prepare wrote.
+func (m *Media) Files() []string {
+	var files []string
+	for _, f := range []string{m.ISOPath, m.KernelPath, m.InitrdPath} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Remove deletes the generated files.
+func (m *Media) Remove() {
+	for _, f := range m.Files() {
+		os.Remove(f)
+	}
+}
+
+// Prepare renders the answer file and writes the media that delivers it.
+func Prepare(opts Options) (*Media, error) {
+	if opts.Delivery == "" {
+		opts.Delivery = opts.Profile.DefaultDelivery()
+	}
+	if !opts.Profile.SupportsDelivery(opts.Delivery) {
+		return nil, fmt.Errorf("profile %s cannot be delivered via %s", opts.Profile, opts.Delivery)
+	}
+	if opts.Vars.Architecture == "" {
+		opts.Vars.Architecture = "x86_64"
+	}
+	if err := opts.Vars.Normalize(opts.Profile); err != nil {
+		return nil, err
+	}
+
+	answer, err := Render(opts.Profile, opts.Template, opts.Vars)
+	if err != nil {
+		return nil, err
+	}
+
+	media := &Media{}
+	base := filepath.Join(opts.OutputDir, opts.Name)
+
+	if label := opts.Profile.VolumeLabel(); label != "" {
+		files := []iso9660.File{{Name: opts.Profile.AnswerFileName(), Data: answer}}
+		switch opts.Profile {
+		case ProfileAutoinstall:
+			files = append(files, iso9660.File{Name: "meta-data", Data: []byte(fmt.Sprintf("instance-id: %s\n", opts.Name))})
+		case ProfileWindows:
+			if script := strings.TrimSpace(opts.Vars.PostInstallScript); script != "" {
+				files = append(files, iso9660.File{Name: windowsPostInstallScript, Data: []byte(script + "\r\n")})
+			}
+		}
+		media.ISOPath = base + "-install.iso"
+		if err := iso9660.WriteFile(media.ISOPath, label, files); err != nil {
+			return nil, fmt.Errorf("failed to write install media: %w", err)
+		}
+	}
+
+	if opts.Delivery == DeliveryKernel {
+		if err := media.extractBootFiles(opts, base, answer); err != nil {
+			media.Remove()
+			return nil, err
+		}
+	}
+
+	return media, nil
+}
+
+func (m *Media) extractBootFiles(opts Options, base string, answer []byte) error {
+	kernel, initrd, err := opts.Profile.BootFiles(opts.Vars.Architecture)
+	if err != nil {
+		return err
+	}
+
+	img, err := iso9660.Open(opts.InstallISO)
+	if err != nil {
+		return fmt.Errorf("failed to open installer ISO: %w", err)
+	}
+	defer img.Close()
+
+	m.KernelPath = base + "-install-vmlinuz"
+	if err := img.Extract(kernel, m.KernelPath); err != nil {
+		return fmt.Errorf("failed to extract installer kernel: %w", err)
+	}
+	m.InitrdPath = base + "-install-initrd"
+	if err := img.Extract(initrd, m.InitrdPath); err != nil {
+		return fmt.Errorf("failed to extract installer initrd: %w", err)
+	}
+
+	if opts.Profile == ProfilePreseed {
+		if err := AppendToInitrd(m.InitrdPath, map[string][]byte{opts.Profile.AnswerFileName(): answer}); err != nil {
+			return fmt.Errorf("failed to add preseed file to initrd: %w", err)
+		}
+	}
+
+	m.Cmdline = opts.Profile.KernelArgs(img.Label())
+	return nil
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+package unattend_test
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"vmmanager/internal/unattend"
+)
+
+func TestSHA512CryptMatchesReferenceVector(t *testing.T) {
+	got := unattend.SHA512Crypt("Hello world!", "saltstring")
+	want := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	if got != want {
+		t.Errorf("SHA512Crypt = %s, want %s", got, want)
+	}
+
+	hash, err := unattend.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("HashPassword failed: %v", err)
+	}
+	if !unattend.IsPasswordHash(hash) || hash == unattend.SHA512Crypt("secret", "") {
+		t.Errorf("unexpected hash %q", hash)
+	}
+}
+
+func TestRenderBuiltinProfiles(t *testing.T) {
+	for _, profile := range []unattend.Profile{
+		unattend.ProfileKickstart,
+		unattend.ProfilePreseed,
+		unattend.ProfileAutoinstall,
+		unattend.ProfileWindows,
+	} {
+		vars := unattend.Vars{
+			Hostname:          "web1.example.com",
+			Password:          "s3cret&<pw>",
+			SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFake user@host"},
+			Packages:          []string{"htop"},
+			PostInstallScript: "echo done",
+		}
+		if err := vars.Normalize(profile); err != nil {
+			t.Fatalf("%s: Normalize failed: %v", profile, err)
+		}
+
+		out, err := unattend.Render(profile, "", vars)
+		if err != nil {
+			t.Fatalf("%s: Render failed: %v", profile, err)
+		}
+		text := string(out)
+
+		if !strings.Contains(text, "web1") {
+			t.Errorf("%s: hostname missing from answer file", profile)
+		}
+		if profile == unattend.ProfileWindows {
+			if strings.Contains(text, "s3cret&<pw>") {
+				t.Errorf("%s: password was not XML escaped", profile)
+			}
+			dec := xml.NewDecoder(strings.NewReader(text))
+			for {
+				if _, err := dec.Token(); err != nil {
+					if err != io.EOF {
+						t.Errorf("%s: answer file is not well-formed XML: %v", profile, err)
+					}
+					break
+				}
+			}
+			continue
+		}
+		if strings.Contains(text, "s3cret") || !strings.Contains(text, vars.PasswordHash) {
+			t.Errorf("%s: expected only the password hash in the answer file", profile)
+		}
+	}
+}
+
+func TestNormalizeRejectsUnsafeValues(t *testing.T) {
+	cases := map[string]unattend.Vars{
+		"hostname": {Hostname: "bad host", Password: "x"},
+		"timezone": {Hostname: "vm1", Password: "x", Timezone: "UTC\nd-i foo"},
+		"package":  {Hostname: "vm1", Password: "x", Packages: []string{"htop; rm -rf /"}},
+		"password": {Hostname: "vm1"},
+		"rootdisk": {Hostname: "vm1", Password: "x", RootDisk: "sda;reboot"},
+	}
+	for name, vars := range cases {
+		if err := vars.Normalize(unattend.ProfilePreseed); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestRenderRootDisk(t *testing.T) {
+	for _, tt := range []struct {
+		bus  string
+		want map[unattend.Profile]string
+	}{
+		{"virtio", map[unattend.Profile]string{
+			unattend.ProfileKickstart: "ignoredisk --only-use=vda\nzerombr\nclearpart --all --initlabel --drives=vda\n",
+			unattend.ProfilePreseed:   "d-i partman-auto/disk string /dev/vda\n",
+		}},
+		{"sata", map[unattend.Profile]string{
+			unattend.ProfileKickstart: "ignoredisk --only-use=sda\nzerombr\nclearpart --all --initlabel --drives=sda\n",
+			unattend.ProfilePreseed:   "d-i partman-auto/disk string /dev/sda\n",
+		}},
+	} {
+		for profile, want := range tt.want {
+			vars := unattend.Vars{Hostname: "vm1", Password: "x", RootDisk: unattend.RootDiskDevice(tt.bus)}
+			if err := vars.Normalize(profile); err != nil {
+				t.Fatalf("%s: Normalize failed: %v", profile, err)
+			}
+			out, err := unattend.Render(profile, "", vars)
+			if err != nil {
+				t.Fatalf("%s: Render failed: %v", profile, err)
+			}
+			if !strings.Contains(string(out), want) {
+				t.Errorf("%s on %s: answer file lacks %q:\n%s", profile, tt.bus, want, out)
+			}
+		}
+	}
+}
+
+func TestRenderWindowsDriverPaths(t *testing.T) {
+	for _, drivers := range []bool{false, true} {
+		vars := unattend.Vars{Hostname: "win1", Password: "x", VirtioDrivers: drivers}
+		if err := vars.Normalize(unattend.ProfileWindows); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		out, err := unattend.Render(unattend.ProfileWindows, "", vars)
+		if err != nil {
+			t.Fatalf("Render failed: %v", err)
+		}
+
+		var answer struct {
+			Settings []struct {
+				Pass       string `xml:"pass,attr"`
+				Components []struct {
+					Name  string `xml:"name,attr"`
+					Paths []struct {
+						Key  string `xml:"keyValue,attr"`
+						Path string `xml:"Path"`
+					} `xml:"DriverPaths>PathAndCredentials"`
+				} `xml:"component"`
+			} `xml:"settings"`
+		}
+		if err := xml.Unmarshal(out, &answer); err != nil {
+			t.Fatalf("answer file is not well-formed XML: %v", err)
+		}
+		var paths []string
+		keys := map[string]bool{}
+		for _, settings := range answer.Settings {
+			for _, component := range settings.Components {
+				if component.Name != "Microsoft-Windows-PnpCustomizationsWinPE" {
+					continue
+				}
+				if settings.Pass != "windowsPE" {
+					t.Errorf("driver paths in the %s pass", settings.Pass)
+				}
+				for _, p := range component.Paths {
+					paths = append(paths, p.Path)
+					keys[p.Key] = true
+				}
+			}
+		}
+
+		if !drivers {
+			if len(paths) != 0 {
+				t.Errorf("driver paths without a driver ISO: %v", paths)
+			}
+			continue
+		}
+		if len(keys) != len(paths) {
+			t.Errorf("driver path keys are not unique: %v", keys)
+		}
+		for _, want := range []string{`D:\viostor`, `E:\NetKVM`, `G:\vioserial`} {
+			found := false
+			for _, p := range paths {
+				found = found || p == want
+			}
+			if !found {
+				t.Errorf("driver paths %v lack %s", paths, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const minRSAKeyBits = 2048
+
+var allowedSSHKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:        true,
+	ssh.KeyAlgoED25519:    true,
+	ssh.KeyAlgoECDSA256:   true,
+	ssh.KeyAlgoECDSA384:   true,
+	ssh.KeyAlgoECDSA521:   true,
+	ssh.KeyAlgoSKED25519:  true,
+	ssh.KeyAlgoSKECDSA256: true,
+}
+
+type SSHPublicKey struct {
+	Type        string
+	Fingerprint string
+	Comment     string
+	// Normalized is the key in authorized_keys form without options.
+	Normalized string
+}
+
+// ParseSSHPublicKey validates a single authorized_keys style public key and
+// returns its type and SHA256 fingerprint.
+func ParseSSHPublicKey(publicKey string) (*SSHPublicKey, error) {
+	publicKey = strings.TrimSpace(publicKey)
+	if publicKey == "" {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	if strings.Contains(publicKey, "\n") {
+		return nil, fmt.Errorf("only one public key may be given")
+	}
+
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(options) > 0 {
+		return nil, fmt.Errorf("authorized_keys options are not allowed")
+	}
+
+	keyType := key.Type()
+	if !allowedSSHKeyTypes[keyType] {
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+
+	if keyType == ssh.KeyAlgoRSA {
+		if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSAKeyBits {
+				return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+			}
+		}
+	}
+
+	normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		normalized += " " + comment
+	}
+
+	return &SSHPublicKey{
+		Type:        keyType,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Comment:     comment,
+		Normalized:  normalized,
+	}, nil
+}
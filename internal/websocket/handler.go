@@ -145,64 +145,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	go client.readPump()
 }
 
-func extractVNCPort(xmlDesc string) (int, error) {
-	for _, line := range strings.Split(xmlDesc, "\n") {
-		if strings.Contains(line, "<graphics") {
-			isVnc := strings.Contains(line, "type='vnc'") || strings.Contains(line, "type=\"vnc\"")
-			if isVnc {
-				for _, part := range strings.Fields(line) {
-					if strings.HasPrefix(part, "port='") {
-						portStr := strings.TrimPrefix(part, "port='")
-						portStr = strings.TrimSuffix(portStr, "'")
-						var port int
-						if _, err := fmt.Sscanf(portStr, "%d", &port); err == nil {
-							return port, nil
-						}
-					}
-					if strings.HasPrefix(part, "port=\"") {
-						portStr := strings.TrimPrefix(part, "port=\"")
-						portStr = strings.TrimSuffix(portStr, "\"")
-						var port int
-						if _, err := fmt.Sscanf(portStr, "%d", &port); err == nil {
-							return port, nil
-						}
-					}
-				}
-			}
-		}
+// extractGraphicsPort returns the port of the first graphics device of the
+// given type ("vnc" or "spice") in the live domain XML.
+func extractGraphicsPort(xmlDesc, graphicsType string) (int, error) {
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		return 0, err
 	}
-	return 0, fmt.Errorf("VNC port not found in domain XML")
-}
-
-func extractSPICEPort(xmlDesc string) (int, error) {
-	for _, line := range strings.Split(xmlDesc, "\n") {
-		if strings.Contains(line, "<graphics") {
-			isSpice := strings.Contains(line, "type='spice'") || strings.Contains(line, "type=\"spice\"")
-			log.Printf("[DEBUG] Found graphics line: %s, isSpice: %v", line, isSpice)
-			if isSpice {
-				for _, part := range strings.Fields(line) {
-					log.Printf("[DEBUG] Part: %s", part)
-					if strings.HasPrefix(part, "port='") {
-						portStr := strings.TrimPrefix(part, "port='")
-						portStr = strings.TrimSuffix(portStr, "'")
-						var port int
-						if _, err := fmt.Sscanf(portStr, "%d", &port); err == nil {
-							return port, nil
-						}
-					}
-					if strings.HasPrefix(part, "port=\"") {
-						portStr := strings.TrimPrefix(part, "port=\"")
-						portStr = strings.TrimSuffix(portStr, "\"")
-						var port int
-						if _, err := fmt.Sscanf(portStr, "%d", &port); err == nil {
-							return port, nil
-						}
-					}
-				}
-			}
-		}
+	graphics := def.FindGraphics(graphicsType)
+	if graphics == nil || graphics.Port <= 0 {
+		return 0, fmt.Errorf("%s port not found in domain XML", strings.ToUpper(graphicsType))
 	}
-	return 0, fmt.Errorf("SPICE port not found in domain XML")
+	return graphics.Port, nil
 }
 
 func (c *VNCClient) logPrefix() string {
@@ -249,7 +203,7 @@ func (c *VNCClient) proxyVNC(h *Handler) {
 
 	var targetPort int
 	if c.connType == "spice" {
-		targetPort, err = extractSPICEPort(xmlDesc)
+		targetPort, err = extractGraphicsPort(xmlDesc, "spice")
 		log.Printf("[DEBUG] XML contains spice: %v", strings.Contains(xmlDesc, "type='spice'"))
 		log.Printf("[DEBUG] XML contains vnc: %v", strings.Contains(xmlDesc, "type='vnc'"))
 		if err != nil {
@@ -259,7 +213,7 @@ func (c *VNCClient) proxyVNC(h *Handler) {
 		}
 		log.Printf("[SPICE][%s] SPICE port: %d", c.vmID, targetPort)
 	} else {
-		targetPort, err = extractVNCPort(xmlDesc)
+		targetPort, err = extractGraphicsPort(xmlDesc, "vnc")
 		if err != nil {
 			log.Printf("c.logPrefix()%s] Failed to extract VNC port: %v", c.vmID, err)
 			c.conn.Close()
@@ -418,17 +372,12 @@ func (c *VNCClient) getVNCPassword(h *Handler) string {
 		return ""
 	}
 
-	// Extract passwd attribute from graphics element
-	for _, line := range strings.Split(xmlDesc, "\n") {
-		if strings.Contains(line, "<graphics") && strings.Contains(line, "type='vnc'") {
-			for _, part := range strings.Fields(line) {
-				if strings.HasPrefix(part, "passwd='") {
-					passwd := strings.TrimPrefix(part, "passwd='")
-					passwd = strings.TrimSuffix(passwd, "'")
-					return passwd
-				}
-			}
-		}
+	def, err := libvirt.ParseDomainXML(xmlDesc)
+	if err != nil {
+		return ""
+	}
+	if graphics := def.FindGraphics("vnc"); graphics != nil {
+		return graphics.Passwd
 	}
 	return ""
 }
@@ -735,7 +684,7 @@ func (h *Handler) GetConsoleInfo(vmID string) (*ConsoleInfo, error) {
 		return nil, fmt.Errorf("failed to get domain XML: %w", err)
 	}
 
-	port, err := extractVNCPort(xmlDesc)
+	port, err := extractGraphicsPort(xmlDesc, "vnc")
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract VNC port: %w", err)
 	}
@@ -831,3 +780,11 @@ func (h *Handler) HandleVMStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+func (h *Handler) InstallMonitor() *services.InstallMonitor {
+	return h.installMonitor
+}
+
+func (h *Handler) VMSyncService() *services.VMSyncService {
+	return h.syncService
+}
@@ -0,0 +1,5 @@
+-- Add cloud-init NoCloud seed path to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cloud_init_iso_path VARCHAR(500);
+
+-- Add default cloud-init user-data to vm_templates table
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS cloud_init_user_data TEXT;
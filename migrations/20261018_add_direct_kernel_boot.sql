@@ -0,0 +1,6 @@
+-- Add direct kernel boot of VMs from a kernel, initrd and device tree on the host
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_enabled BOOLEAN DEFAULT false;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_kernel VARCHAR(500);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_initrd VARCHAR(500);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_dtb VARCHAR(500);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS direct_boot_cmdline TEXT;
@@ -0,0 +1,11 @@
+-- Add LUKS encryption of VM system disks and data volumes and the key of encrypted backups
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_enabled BOOLEAN DEFAULT false;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_secret_uuid VARCHAR(36);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_wrapped_key TEXT;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_encryption_rotated_at TIMESTAMPTZ;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS encrypted BOOLEAN DEFAULT false;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS encryption_key TEXT;
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_enabled BOOLEAN DEFAULT false;
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_secret_uuid VARCHAR(36);
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_wrapped_key TEXT;
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS encryption_rotated_at TIMESTAMPTZ;
@@ -0,0 +1,23 @@
+-- Create flavors table for admin-defined VM sizes and add the flavor of each VM
+CREATE TABLE IF NOT EXISTS flavors (
+    id UUID PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT,
+    cpu INTEGER NOT NULL,
+    memory INTEGER NOT NULL,
+    disk INTEGER NOT NULL,
+    qos_disk_read_iops BIGINT DEFAULT 0,
+    qos_disk_write_iops BIGINT DEFAULT 0,
+    qos_disk_read_bytes_sec BIGINT DEFAULT 0,
+    qos_disk_write_bytes_sec BIGINT DEFAULT 0,
+    qos_net_inbound_kbps BIGINT DEFAULT 0,
+    qos_net_outbound_kbps BIGINT DEFAULT 0,
+    cpu_policy VARCHAR(20) DEFAULT 'shared',
+    allowed_roles TEXT[],
+    allowed_users TEXT[],
+    is_active BOOLEAN DEFAULT true,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS flavor_id UUID;
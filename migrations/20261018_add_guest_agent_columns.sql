@@ -0,0 +1,6 @@
+-- Add QEMU guest agent columns to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS agent_connected BOOLEAN DEFAULT FALSE;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_hostname VARCHAR(255);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_os VARCHAR(255);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_info JSONB;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS guest_info_at TIMESTAMPTZ;
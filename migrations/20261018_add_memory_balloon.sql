@@ -0,0 +1,7 @@
+-- Add guest memory balloon statistics and the automatic balloon policy of VMs
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS balloon_auto BOOLEAN DEFAULT false;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS balloon_min_memory INTEGER DEFAULT 0;
+ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS memory_balloon BIGINT DEFAULT 0;
+ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS memory_unused BIGINT DEFAULT 0;
+ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS memory_available BIGINT DEFAULT 0;
+ALTER TABLE vm_stats ADD COLUMN IF NOT EXISTS major_faults BIGINT DEFAULT 0;
@@ -0,0 +1,6 @@
+-- Add OS profiles to templates, ISOs and virtual machines, plus the root disk bus and driver ISO of VMs
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS os_profile VARCHAR(20);
+ALTER TABLE isos ADD COLUMN IF NOT EXISTS os_profile VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS os_profile VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS disk_bus VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS driver_iso_path VARCHAR(500);
@@ -0,0 +1,26 @@
+-- Create shared folders admins allow for virtio-fs and the filesystems mapping them into VMs
+CREATE TABLE IF NOT EXISTS shared_folders (
+    id UUID PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT,
+    host_path VARCHAR(500) NOT NULL,
+    allow_write BOOLEAN DEFAULT false,
+    allowed_roles TEXT[],
+    allowed_users TEXT[],
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS vm_filesystems (
+    id UUID PRIMARY KEY,
+    vm_id UUID NOT NULL REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    shared_folder_id UUID NOT NULL REFERENCES shared_folders(id),
+    source_path VARCHAR(500) NOT NULL,
+    mount_tag VARCHAR(36) NOT NULL,
+    read_only BOOLEAN DEFAULT false,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_filesystems_vm ON vm_filesystems(vm_id);
+CREATE INDEX IF NOT EXISTS idx_vm_filesystems_folder ON vm_filesystems(shared_folder_id);
@@ -0,0 +1,12 @@
+-- Make SSH key fingerprints unique per user and among organisation-wide keys.
+-- Duplicates stored before the constraint existed keep their oldest copy.
+DELETE FROM ssh_keys WHERE EXISTS (
+    SELECT 1 FROM ssh_keys older
+    WHERE older.fingerprint = ssh_keys.fingerprint
+    AND older.is_global = ssh_keys.is_global
+    AND (older.is_global OR older.user_id = ssh_keys.user_id)
+    AND (older.created_at < ssh_keys.created_at OR (older.created_at = ssh_keys.created_at AND older.id < ssh_keys.id))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ssh_keys_user_fingerprint ON ssh_keys(user_id, fingerprint) WHERE is_global = FALSE;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ssh_keys_global_fingerprint ON ssh_keys(fingerprint) WHERE is_global = TRUE;
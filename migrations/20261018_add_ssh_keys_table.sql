@@ -0,0 +1,15 @@
+-- SSH Key Table (user keys and organisation-wide keys)
+CREATE TABLE IF NOT EXISTS ssh_keys (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    public_key TEXT NOT NULL,
+    key_type VARCHAR(50) NOT NULL,
+    fingerprint VARCHAR(100) NOT NULL,
+    is_global BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+CREATE INDEX idx_ssh_keys_user ON ssh_keys(user_id);
+CREATE INDEX idx_ssh_keys_global ON ssh_keys(is_global);
@@ -0,0 +1,6 @@
+-- Add unattended install profile and generated installer media to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS unattend_profile VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_media_path VARCHAR(500);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_kernel_path VARCHAR(500);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_initrd_path VARCHAR(500);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS install_cmdline TEXT;
@@ -0,0 +1,7 @@
+-- Track data disk ownership and attachment options on storage_volumes table
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS owner_id UUID REFERENCES users(id);
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS target_dev VARCHAR(20);
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS bus VARCHAR(20);
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS cache_mode VARCHAR(20);
+ALTER TABLE storage_volumes ADD COLUMN IF NOT EXISTS read_only BOOLEAN DEFAULT false;
+CREATE INDEX IF NOT EXISTS idx_storage_volumes_owner ON storage_volumes(owner_id);
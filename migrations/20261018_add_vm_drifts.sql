@@ -0,0 +1,16 @@
+-- Track differences between VM records and the persistent libvirt domain definitions
+CREATE TABLE IF NOT EXISTS vm_drifts (
+	id UUID PRIMARY KEY,
+	vm_id UUID NOT NULL REFERENCES virtual_machines(id) ON DELETE CASCADE,
+	field VARCHAR(30) NOT NULL,
+	db_value VARCHAR(500),
+	libvirt_value VARCHAR(500),
+	status VARCHAR(20) DEFAULT 'open',
+	resolution VARCHAR(20),
+	resolved_by UUID,
+	detected_at TIMESTAMPTZ NOT NULL,
+	resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_drifts_vm ON vm_drifts(vm_id);
+CREATE INDEX IF NOT EXISTS idx_vm_drifts_status ON vm_drifts(status);
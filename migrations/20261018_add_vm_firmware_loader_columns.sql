@@ -0,0 +1,7 @@
+-- Add the UEFI loader and NVRAM template picked from host capabilities to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS loader_path VARCHAR(255);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS nvram_template VARCHAR(255);
+-- Add the domain type and CPU mode and model checked against host capabilities
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS domain_type VARCHAR(10);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cpu_mode VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cpu_model VARCHAR(64);
@@ -0,0 +1,5 @@
+-- Add machine type, firmware, video model and pending changes to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS machine_type VARCHAR(50);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS firmware VARCHAR(20) DEFAULT 'uefi';
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS video_model VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS pending_changes TEXT;
@@ -0,0 +1,24 @@
+-- Create vm_interfaces table for VMs with more than one network interface
+CREATE TABLE IF NOT EXISTS vm_interfaces (
+    id UUID PRIMARY KEY,
+    vm_id UUID NOT NULL REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    mac_address VARCHAR(17) NOT NULL UNIQUE,
+    source_type VARCHAR(20) NOT NULL DEFAULT 'network',
+    source VARCHAR(100) NOT NULL,
+    network_id UUID REFERENCES virtual_networks(id),
+    model VARCHAR(20) DEFAULT 'virtio',
+    link_state VARCHAR(10) DEFAULT 'up',
+    is_primary BOOLEAN DEFAULT false,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_interfaces_vm ON vm_interfaces(vm_id);
+
+-- Record the primary interface of existing VMs
+INSERT INTO vm_interfaces (id, vm_id, mac_address, source_type, source, model, link_state, is_primary, created_at, updated_at)
+SELECT gen_random_uuid(), vm.id, LOWER(vm.mac_address), 'network', 'default', 'virtio', 'up', true, NOW(), NOW()
+FROM virtual_machines vm
+WHERE vm.mac_address IS NOT NULL AND vm.mac_address <> ''
+    AND NOT EXISTS (SELECT 1 FROM vm_interfaces i WHERE i.vm_id = vm.id AND i.is_primary)
+    AND NOT EXISTS (SELECT 1 FROM vm_interfaces i WHERE i.mac_address = LOWER(vm.mac_address));
@@ -0,0 +1,8 @@
+-- Add the per-VM lifecycle actions, watchdog and restart policy
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_on_poweroff VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_on_reboot VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_on_crash VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_watchdog_action VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_restart_policy VARCHAR(20);
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_restart_max_retries INTEGER DEFAULT 0;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS lifecycle_restart_backoff INTEGER DEFAULT 0;
@@ -0,0 +1,19 @@
+-- Add disk I/O and network bandwidth limits to virtual_machines and vm_templates, and per-user maximums to users
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_read_iops BIGINT DEFAULT 0;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_write_iops BIGINT DEFAULT 0;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_read_bytes_sec BIGINT DEFAULT 0;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_disk_write_bytes_sec BIGINT DEFAULT 0;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_net_inbound_kbps BIGINT DEFAULT 0;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS qos_net_outbound_kbps BIGINT DEFAULT 0;
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_read_iops BIGINT DEFAULT 0;
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_write_iops BIGINT DEFAULT 0;
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_read_bytes_sec BIGINT DEFAULT 0;
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_disk_write_bytes_sec BIGINT DEFAULT 0;
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_net_inbound_kbps BIGINT DEFAULT 0;
+ALTER TABLE vm_templates ADD COLUMN IF NOT EXISTS qos_net_outbound_kbps BIGINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_read_iops BIGINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_write_iops BIGINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_read_bytes_sec BIGINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_disk_write_bytes_sec BIGINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_net_inbound_kbps BIGINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS qos_max_net_outbound_kbps BIGINT DEFAULT 0;
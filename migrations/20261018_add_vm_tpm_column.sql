@@ -0,0 +1,2 @@
+-- Add emulated TPM 2.0 device flag to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS tpm BOOLEAN DEFAULT false;
@@ -0,0 +1,2 @@
+-- Add CPU pinning, NUMA topology and hugepage settings to virtual_machines table
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS tuning TEXT;